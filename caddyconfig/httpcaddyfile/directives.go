@@ -37,6 +37,8 @@ import (
 // The header directive goes second so that headers
 // can be manipulated before doing redirects.
 var directiveOrder = []string{
+	"opentelemetry",
+
 	"map",
 	"root",
 
@@ -0,0 +1,323 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package opentelemetry
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.opentelemetry.io/otel/metric"
+	controller "go.opentelemetry.io/otel/sdk/metric/controller/basic"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(App{})
+}
+
+// App is the otel app, which owns named tracer and meter providers. The
+// opentelemetry handlers refer to them by name, and other modules, e.g.
+// rate limiters or caches, use them through TracerProvider and
+// MeterProvider rather than building their own exporters.
+type App struct {
+	// Providers are the tracer and meter providers, keyed by their name.
+	Providers map[string]*ProviderConfig `json:"providers,omitempty"`
+
+	providers map[string]*appProvider
+	ctx       caddy.Context
+	logger    *zap.Logger
+}
+
+// ProviderConfig configures a tracer provider, and the meter provider
+// exporting with the same settings. The settings left empty fall back to
+// the standard OpenTelemetry environment variables, like the ones of the
+// opentelemetry handler.
+type ProviderConfig struct {
+	// ServiceName is the logical name of the service.
+	ServiceName string `json:"service_name,omitempty"`
+
+	// ServiceVersion is the version of the service, omitted by default.
+	ServiceVersion string `json:"service_version,omitempty"`
+
+	// ExporterTracesEndpoint is the target to which the spans and the
+	// metrics are sent, either a host:port or a URL.
+	ExporterTracesEndpoint string `json:"exporter_traces_endpoint,omitempty"`
+
+	// ExporterTracesProtocol is either "grpc" (default), "http/protobuf"
+	// or "stdout". The "stdout" protocol prints the spans and provides
+	// no meter provider.
+	ExporterTracesProtocol string `json:"exporter_traces_protocol,omitempty"`
+
+	// ExporterStdoutFile is the path of the file the spans are appended
+	// to by the "stdout" protocol. Default: standard error.
+	ExporterStdoutFile string `json:"exporter_stdout_file,omitempty"`
+
+	// ExporterHeaders are sent with each export, e.g. for authentication.
+	ExporterHeaders map[string]string `json:"exporter_headers,omitempty"`
+
+	// ExporterInsecure disables the TLS of the connection to the collector.
+	ExporterInsecure string `json:"exporter_insecure,omitempty"`
+
+	// ExporterTimeout bounds each export.
+	ExporterTimeout caddy.Duration `json:"exporter_timeout,omitempty"`
+
+	// ExporterCompression is either "gzip" or "none" (default).
+	ExporterCompression string `json:"exporter_compression,omitempty"`
+
+	// Sampler is the name of the sampler of the spans, see the one of
+	// the opentelemetry handler.
+	Sampler string `json:"sampler,omitempty"`
+
+	// SamplingRatio is the ratio of the traces sampled, between 0.0 and 1.0.
+	SamplingRatio *float64 `json:"sampling_ratio,omitempty"`
+
+	// ResourceAttributes are added to the resource of the spans and of
+	// the metrics.
+	ResourceAttributes map[string]string `json:"resource_attributes,omitempty"`
+
+	// MetricsCollectPeriod is the interval at which the metrics are
+	// exported. Default: the one of the SDK.
+	MetricsCollectPeriod caddy.Duration `json:"metrics_collect_period,omitempty"`
+
+	// DrainTimeout bounds the export of the queued spans when the app
+	// is cleaned up, like the one of the opentelemetry handler. By
+	// default, the queue is flushed once.
+	DrainTimeout caddy.Duration `json:"drain_timeout,omitempty"`
+
+	// ShutdownTimeout bounds the flush and the shutdown of the tracer
+	// provider. Default: 5s.
+	ShutdownTimeout caddy.Duration `json:"shutdown_timeout,omitempty"`
+}
+
+// appProvider holds the providers built from a ProviderConfig.
+type appProvider struct {
+	tracerProvider *sdktrace.TracerProvider
+	// queue tracks the spans of the tracer provider, to drain them on cleanup.
+	queue           *spanQueue
+	drainTimeout    time.Duration
+	shutdownTimeout time.Duration
+
+	// metricsExporter, res and collectPeriod configure the meter provider,
+	// which is only created once a module asks for it. Its protocol is
+	// stdout if the metrics cannot be exported, there is no meter provider.
+	metricsExporter tracerExporterConfig
+	res             *resource.Resource
+	collectPeriod   time.Duration
+
+	mu         sync.Mutex
+	controller *controller.Controller
+}
+
+// meterProvider returns the meter provider, created and started with ctx
+// on the first call.
+func (p *appProvider) meterProvider(ctx context.Context) (metric.MeterProvider, error) {
+	if p.metricsExporter.protocol == protocolStdout {
+		return nil, fmt.Errorf("the %s protocol exports no metrics", protocolStdout)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.controller == nil {
+		cont, err := newMetricController(ctx, p.metricsExporter, p.res, p.collectPeriod)
+		if err != nil {
+			return nil, fmt.Errorf("creating meter provider error: %w", err)
+		}
+		p.controller = cont
+	}
+	return p.controller, nil
+}
+
+// stopMeterProvider stops the meter provider, if created.
+func (p *appProvider) stopMeterProvider(ctx context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.controller == nil {
+		return nil
+	}
+	return p.controller.Stop(ctx)
+}
+
+// CaddyModule returns the Caddy module information.
+func (App) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "otel",
+		New: func() caddy.Module { return new(App) },
+	}
+}
+
+// Provision builds the providers of the app.
+func (app *App) Provision(ctx caddy.Context) error {
+	app.ctx = ctx
+	app.logger = ctx.Logger(app)
+	app.providers = make(map[string]*appProvider, len(app.Providers))
+
+	for name, providerConfig := range app.Providers {
+		provider, err := providerConfig.build(ctx)
+		if err != nil {
+			return fmt.Errorf("provisioning provider '%s': %v", name, err)
+		}
+		app.providers[name] = provider
+	}
+
+	return nil
+}
+
+// build creates the tracer provider of the config. The meter provider is
+// created on demand, see appProvider.meterProvider.
+func (pc *ProviderConfig) build(ctx context.Context) (*appProvider, error) {
+	if pc.SamplingRatio != nil && (*pc.SamplingRatio < 0 || *pc.SamplingRatio > 1) {
+		return nil, fmt.Errorf("sampling ratio must be between 0.0 and 1.0, got %v", *pc.SamplingRatio)
+	}
+
+	insecure, err := parseExporterInsecure(pc.ExporterInsecure)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := tracerConfig{
+		serviceName:        pc.ServiceName,
+		serviceVersion:     pc.ServiceVersion,
+		resourceAttributes: pc.ResourceAttributes,
+		exporter: tracerExporterConfig{
+			endpoint:    pc.ExporterTracesEndpoint,
+			protocol:    pc.ExporterTracesProtocol,
+			stdoutFile:  pc.ExporterStdoutFile,
+			headers:     pc.ExporterHeaders,
+			insecure:    insecure,
+			timeout:     time.Duration(pc.ExporterTimeout),
+			compression: pc.ExporterCompression,
+		},
+	}
+	if err := cfg.resolveExporter(ctx); err != nil {
+		return nil, err
+	}
+
+	samplerName := pc.Sampler
+	if samplerName == "" {
+		samplerName = os.Getenv(envTracesSampler)
+	}
+	sampler, err := newSampler(samplerName, pc.SamplingRatio, 0)
+	if err != nil {
+		return nil, fmt.Errorf("creating sampler error: %w", err)
+	}
+
+	setup, err := newTracerProviderSetup(ctx, cfg, sampler, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	shutdownTimeout := time.Duration(pc.ShutdownTimeout)
+	if shutdownTimeout <= 0 {
+		shutdownTimeout = defaultShutdownTimeout
+	}
+
+	provider := &appProvider{
+		tracerProvider:  sdktrace.NewTracerProvider(setup.opts...),
+		queue:           setup.queue,
+		drainTimeout:    time.Duration(pc.DrainTimeout),
+		shutdownTimeout: shutdownTimeout,
+		metricsExporter: cfg.exporter,
+		res:             setup.res,
+		collectPeriod:   time.Duration(pc.MetricsCollectPeriod),
+	}
+	// the metrics are exported with the first exporter of the spans
+	provider.metricsExporter.protocol = strings.TrimSpace(strings.Split(cfg.exporter.protocol, ",")[0])
+
+	return provider, nil
+}
+
+// Start starts the otel app.
+func (app *App) Start() error {
+	return nil
+}
+
+// Stop stops the otel app. The providers keep exporting until Cleanup,
+// for the spans of the requests still being served.
+func (app *App) Stop() error {
+	return nil
+}
+
+// Cleanup drains or flushes and shuts down the providers of the app,
+// within their shutdown timeout so that an unreachable collector does not
+// block the stop of Caddy.
+func (app *App) Cleanup() error {
+	var firstErr error
+	for name, provider := range app.providers {
+		ctx, cancel := context.WithTimeout(context.Background(), provider.shutdownTimeout)
+		err := provider.stopMeterProvider(ctx)
+		cancel()
+		if err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("stopping meter provider '%s': %w", name, err)
+		}
+
+		logger := app.logger.With(zap.String("provider", name))
+		err = shutdownTracerProvider(provider.tracerProvider, provider.queue, provider.drainTimeout, provider.shutdownTimeout, logger)
+		if err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("provider '%s': %w", name, err)
+		}
+	}
+	return firstErr
+}
+
+// provider returns the named provider of the app.
+func (app *App) provider(name string) (*appProvider, error) {
+	provider, ok := app.providers[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown otel provider '%s'", name)
+	}
+	return provider, nil
+}
+
+// TracerProvider returns the tracer provider of the named provider.
+func (app *App) TracerProvider(name string) (trace.TracerProvider, error) {
+	provider, err := app.provider(name)
+	if err != nil {
+		return nil, err
+	}
+	return provider.tracerProvider, nil
+}
+
+// MeterProvider returns the meter provider of the named provider, which
+// exports the metrics with the exporter settings of its spans. It is
+// created by the first call, so that the providers whose metrics are not
+// used do not export any.
+func (app *App) MeterProvider(name string) (metric.MeterProvider, error) {
+	provider, err := app.provider(name)
+	if err != nil {
+		return nil, err
+	}
+	meterProvider, err := provider.meterProvider(app.ctx)
+	if err != nil {
+		return nil, fmt.Errorf("otel provider '%s': %w", name, err)
+	}
+	return meterProvider, nil
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner  = (*App)(nil)
+	_ caddy.App          = (*App)(nil)
+	_ caddy.CleanerUpper = (*App)(nil)
+)
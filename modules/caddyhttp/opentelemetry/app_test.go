@@ -0,0 +1,124 @@
+package opentelemetry
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestApp_Provision(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	app := &App{
+		Providers: map[string]*ProviderConfig{
+			"debug": {ExporterTracesProtocol: "stdout", ExporterStdoutFile: os.DevNull},
+		},
+	}
+	if err := app.Provision(ctx); err != nil {
+		t.Fatalf("Provision() error = %v", err)
+	}
+
+	if tp, err := app.TracerProvider("debug"); err != nil || tp == nil {
+		t.Errorf("TracerProvider() = %v, %v, expected a tracer provider", tp, err)
+	}
+	// the stdout protocol exports no metrics
+	if _, err := app.MeterProvider("debug"); err == nil {
+		t.Errorf("MeterProvider() expected an error for the stdout protocol")
+	}
+	if _, err := app.TracerProvider("unknown"); err == nil {
+		t.Errorf("TracerProvider() expected an error for an unknown provider")
+	}
+
+	if err := app.Cleanup(); err != nil {
+		t.Errorf("Cleanup() error = %v", err)
+	}
+}
+
+func TestApp_MeterProvider_lazy(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	app := &App{
+		Providers: map[string]*ProviderConfig{
+			"shared": {ExporterTracesProtocol: "http/protobuf", ExporterTracesEndpoint: "localhost:4318"},
+		},
+	}
+	if err := app.Provision(ctx); err != nil {
+		t.Fatalf("Provision() error = %v", err)
+	}
+	defer app.Cleanup()
+
+	// no module asked for the metrics, none are exported
+	if app.providers["shared"].controller != nil {
+		t.Fatalf("Provision() created a meter provider")
+	}
+
+	mp, err := app.MeterProvider("shared")
+	if err != nil {
+		t.Fatalf("MeterProvider() error = %v", err)
+	}
+	if again, _ := app.MeterProvider("shared"); again != mp {
+		t.Errorf("MeterProvider() = %v, expected the meter provider created first %v", again, mp)
+	}
+}
+
+func TestApp_Provision_invalidSamplingRatio(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	ratio := 1.5
+	app := &App{
+		Providers: map[string]*ProviderConfig{
+			"debug": {ExporterTracesProtocol: "stdout", SamplingRatio: &ratio},
+		},
+	}
+	if err := app.Provision(ctx); err == nil {
+		t.Errorf("Provision() expected an error for a sampling ratio above 1.0")
+	}
+}
+
+func TestOpenTelemetryWrapper_appProvider(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	defer tp.Shutdown(context.Background())
+
+	providers := defaultTracerProviderCache.len()
+
+	otw, err := newOpenTelemetryWrapper(context.Background(), tracerConfig{tracerProvider: tp})
+	if err != nil {
+		t.Fatalf("newOpenTelemetryWrapper() error = %v", err)
+	}
+	if n := defaultTracerProviderCache.len(); n != providers {
+		t.Errorf("cached tracer providers = %d, expected %d", n, providers)
+	}
+
+	serve := func() {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		handler := caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error { return nil })
+		if err := otw.ServeHTTP(httptest.NewRecorder(), req, handler); err != nil {
+			t.Fatalf("ServeHTTP() error = %v", err)
+		}
+	}
+
+	serve()
+	if n := len(exporter.GetSpans()); n != 1 {
+		t.Fatalf("exported spans = %d, expected 1", n)
+	}
+
+	// the provider belongs to the app, the cleanup of the handler does not shut it down
+	if err := otw.cleanup(nil); err != nil {
+		t.Fatalf("cleanup() error = %v", err)
+	}
+	serve()
+	if n := len(exporter.GetSpans()); n != 2 {
+		t.Errorf("exported spans = %d, expected 2", n)
+	}
+}
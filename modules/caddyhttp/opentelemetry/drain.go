@@ -0,0 +1,238 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package opentelemetry
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.uber.org/zap"
+)
+
+// drainRetryInterval is the pause between two flushes while draining.
+const drainRetryInterval = 10 * time.Millisecond
+
+// spanQueue counts the spans handed to the span processors of a tracer
+// provider and not yet exported, which the batch span processor does not
+// expose. Each exporter of the provider must be wrapped by the exporter
+// method of the queue, and its processor by the processor method of the
+// returned queueExporter.
+type spanQueue struct {
+	// pending is the number of spans to export, once by exporter.
+	pending int64
+
+	// serviceName labels the spanCounts of the provider.
+	serviceName string
+
+	// draining is set once the provider is drained, the spans of the
+	// failed exports are then kept to be exported again.
+	draining int32
+
+	mu        sync.Mutex
+	exporters []*queueExporter
+}
+
+// exporter wraps exporter so that the spans it exports leave the queue.
+func (q *spanQueue) exporter(exporter sdktrace.SpanExporter) *queueExporter {
+	e := &queueExporter{
+		SpanExporter: exporter,
+		queue:        q,
+		maxQueued:    sdktrace.DefaultMaxQueueSize + sdktrace.DefaultMaxExportBatchSize,
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.exporters = append(q.exporters, e)
+	return e
+}
+
+// len returns the number of spans waiting to be exported.
+func (q *spanQueue) len() int64 {
+	return atomic.LoadInt64(&q.pending)
+}
+
+// drain keeps the spans of the exports failing from now on, to be
+// exported again by retry.
+func (q *spanQueue) drain() {
+	atomic.StoreInt32(&q.draining, 1)
+}
+
+// retry exports again the spans of the failed exports, which are no
+// longer in the span processors.
+func (q *spanQueue) retry(ctx context.Context) {
+	q.mu.Lock()
+	exporters := append([]*queueExporter(nil), q.exporters...)
+	q.mu.Unlock()
+
+	for _, exporter := range exporters {
+		exporter.retry(ctx)
+	}
+}
+
+// queueExporter removes the spans it exports from the queue. The spans of
+// a failed export are given up, the exporter having retried them already,
+// unless the queue is drained: they remain in the queue until exported
+// again or the drain times out.
+type queueExporter struct {
+	sdktrace.SpanExporter
+	queue *spanQueue
+
+	// queued is the number of spans in the processor of the exporter,
+	// which holds at most maxQueued, its queue and the batch it exports.
+	queued    int64
+	maxQueued int64
+
+	mu sync.Mutex
+	// failed are the spans of the exports failed while draining, the
+	// sdktrace.DefaultMaxQueueSize last ones.
+	failed []sdktrace.ReadOnlySpan
+}
+
+// processor wraps the span processor exporting with e, so that the spans
+// handed to it are counted in the queue.
+func (e *queueExporter) processor(processor sdktrace.SpanProcessor) sdktrace.SpanProcessor {
+	return queueProcessor{SpanProcessor: processor, exporter: e}
+}
+
+// enqueue counts a span handed to the processor. The processor does not
+// tell which spans it drops when its queue is full: the spans counted
+// beyond maxQueued are the ones it has dropped, which will never be
+// exported, and are removed from the queue.
+func (e *queueExporter) enqueue() {
+	atomic.AddInt64(&e.queue.pending, 1)
+	spanCounts.enqueued.WithLabelValues(e.queue.serviceName).Inc()
+
+	atomic.AddInt64(&e.queued, 1)
+	for {
+		queued := atomic.LoadInt64(&e.queued)
+		if queued <= e.maxQueued {
+			return
+		}
+		if atomic.CompareAndSwapInt64(&e.queued, queued, e.maxQueued) {
+			dropped := queued - e.maxQueued
+			atomic.AddInt64(&e.queue.pending, -dropped)
+			spanCounts.dropped.WithLabelValues(e.queue.serviceName).Add(float64(dropped))
+			return
+		}
+	}
+}
+
+// ExportSpans implements sdktrace.SpanExporter.
+func (e *queueExporter) ExportSpans(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+	// the spans have left the queue of the processor
+	atomic.AddInt64(&e.queued, -int64(len(spans)))
+	return e.export(ctx, spans)
+}
+
+// retry exports again the spans of the failed exports.
+func (e *queueExporter) retry(ctx context.Context) {
+	e.mu.Lock()
+	spans := e.failed
+	e.failed = nil
+	e.mu.Unlock()
+
+	_ = e.export(ctx, spans)
+}
+
+// export exports the spans, kept to be exported again if it fails while
+// the queue is drained, given up otherwise.
+func (e *queueExporter) export(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+	if len(spans) == 0 {
+		return nil
+	}
+
+	err := e.SpanExporter.ExportSpans(ctx, spans)
+	if err == nil {
+		atomic.AddInt64(&e.queue.pending, -int64(len(spans)))
+		spanCounts.exported.WithLabelValues(e.queue.serviceName).Add(float64(len(spans)))
+		return nil
+	}
+
+	if atomic.LoadInt32(&e.queue.draining) == 0 {
+		e.giveUp(int64(len(spans)))
+		return err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.failed = append(e.failed, spans...)
+	// like the processor, the oldest spans are given up beyond its queue size
+	if excess := int64(len(e.failed)) - sdktrace.DefaultMaxQueueSize; excess > 0 {
+		e.giveUp(excess)
+		e.failed = e.failed[excess:]
+	}
+	return err
+}
+
+// giveUp removes n spans which failed to export from the queue.
+func (e *queueExporter) giveUp(n int64) {
+	atomic.AddInt64(&e.queue.pending, -n)
+	spanCounts.exportFailed.WithLabelValues(e.queue.serviceName).Add(float64(n))
+}
+
+// Shutdown implements sdktrace.SpanExporter, giving up the spans of the
+// failed exports.
+func (e *queueExporter) Shutdown(ctx context.Context) error {
+	e.mu.Lock()
+	e.giveUp(int64(len(e.failed)))
+	e.failed = nil
+	e.mu.Unlock()
+
+	return e.SpanExporter.Shutdown(ctx)
+}
+
+// queueProcessor counts the spans handed to its processor in the queue of
+// its exporter.
+type queueProcessor struct {
+	sdktrace.SpanProcessor
+	exporter *queueExporter
+}
+
+// OnEnd implements sdktrace.SpanProcessor.
+func (p queueProcessor) OnEnd(s sdktrace.ReadOnlySpan) {
+	// like the processor, the spans not sampled are ignored
+	if s.SpanContext().IsSampled() {
+		p.exporter.enqueue()
+	}
+	p.SpanProcessor.OnEnd(s)
+}
+
+// drainTracerProvider flushes tp, and exports again the spans of the
+// failed exports, until its queue is empty or the timeout expires.
+func drainTracerProvider(tp *sdktrace.TracerProvider, queue *spanQueue, timeout time.Duration, logger *zap.Logger) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	queue.drain()
+	for {
+		if err := tp.ForceFlush(ctx); err != nil {
+			logger.Error("forcing flush", zap.Error(err))
+		}
+		queue.retry(ctx)
+		if queue.len() <= 0 {
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			logger.Warn("draining timed out, remaining spans are dropped", zap.Int64("spans", queue.len()))
+			return
+		case <-time.After(drainRetryInterval):
+		}
+	}
+}
@@ -0,0 +1,301 @@
+package opentelemetry
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.uber.org/zap"
+)
+
+// slowExporter takes delay to export each batch of spans.
+type slowExporter struct {
+	delay time.Duration
+
+	mu       sync.Mutex
+	exported int
+}
+
+func (e *slowExporter) ExportSpans(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+	time.Sleep(e.delay)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.exported += len(spans)
+	return nil
+}
+
+func (e *slowExporter) Shutdown(context.Context) error { return nil }
+
+func (e *slowExporter) count() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.exported
+}
+
+func TestTracerProviderCache_cleanupTracerProvider_drain(t *testing.T) {
+	cache := newTracerProviderCache()
+	key := tracerProviderKey{serviceName: "drain"}
+
+	exporter := &slowExporter{delay: 20 * time.Millisecond}
+	queue := new(spanQueue)
+	queued := queue.exporter(exporter)
+	tp, _ := cache.getTracerProvider(key, queue,
+		sdktrace.WithSpanProcessor(queued.processor(sdktrace.NewBatchSpanProcessor(queued, sdktrace.WithMaxExportBatchSize(1)))),
+	)
+
+	for i := 0; i < 5; i++ {
+		_, span := tp.Tracer("test").Start(context.Background(), "span")
+		span.End()
+	}
+
+	start := time.Now()
+	if err := cache.cleanupTracerProvider(key, 2*time.Second, 0, zap.NewNop()); err != nil {
+		t.Fatalf("cleanupTracerProvider() error = %v", err)
+	}
+	elapsed := time.Since(start)
+
+	if got := exporter.count(); got != 5 {
+		t.Errorf("exported %d spans, expected 5", got)
+	}
+	if queue.len() != 0 {
+		t.Errorf("queue length = %d, expected 0", queue.len())
+	}
+	if elapsed >= 2*time.Second {
+		t.Errorf("draining took %v, expected it to finish within the timeout", elapsed)
+	}
+}
+
+func TestDrainTracerProvider_timeout(t *testing.T) {
+	queue := new(spanQueue)
+	queued := queue.exporter(&flakyExporter{InMemoryExporter: tracetest.NewInMemoryExporter(), failing: true})
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(queued.processor(&stepProcessor{exporter: queued})))
+	defer tp.Shutdown(context.Background())
+
+	// the export keeps failing while draining, the span is never removed from the queue
+	_, span := tp.Tracer("test").Start(context.Background(), "span")
+	span.End()
+
+	start := time.Now()
+	drainTracerProvider(tp, queue, 50*time.Millisecond, zap.NewNop())
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("draining took %v, expected it to stop at the timeout", elapsed)
+	}
+}
+
+func TestDrainTracerProvider_multipleExporters(t *testing.T) {
+	first, second := tracetest.NewInMemoryExporter(), tracetest.NewInMemoryExporter()
+	queue := new(spanQueue)
+	queuedFirst, queuedSecond := queue.exporter(first), queue.exporter(second)
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithSpanProcessor(queuedFirst.processor(sdktrace.NewBatchSpanProcessor(queuedFirst))),
+		sdktrace.WithSpanProcessor(queuedSecond.processor(sdktrace.NewBatchSpanProcessor(queuedSecond))),
+	)
+
+	_, span := tp.Tracer("test").Start(context.Background(), "span")
+	span.End()
+
+	drainTracerProvider(tp, queue, time.Second, zap.NewNop())
+
+	if len(first.GetSpans()) != 1 || len(second.GetSpans()) != 1 {
+		t.Errorf("exported %d and %d spans, expected 1 by each exporter", len(first.GetSpans()), len(second.GetSpans()))
+	}
+	if queue.len() != 0 {
+		t.Errorf("queue length = %d, expected 0", queue.len())
+	}
+}
+
+// stepProcessor exports a single one of its ended spans on each flush.
+type stepProcessor struct {
+	exporter sdktrace.SpanExporter
+	// max is the number of spans held, the ones beyond are dropped, unlimited if zero.
+	max int
+
+	mu      sync.Mutex
+	pending []sdktrace.ReadOnlySpan
+}
+
+func (p *stepProcessor) OnStart(context.Context, sdktrace.ReadWriteSpan) {}
+
+func (p *stepProcessor) OnEnd(s sdktrace.ReadOnlySpan) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.max > 0 && len(p.pending) >= p.max {
+		return
+	}
+	p.pending = append(p.pending, s)
+}
+
+func (p *stepProcessor) Shutdown(context.Context) error { return nil }
+
+func (p *stepProcessor) ForceFlush(ctx context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.pending) == 0 {
+		return nil
+	}
+	span := p.pending[0]
+	p.pending = p.pending[1:]
+	return p.exporter.ExportSpans(ctx, []sdktrace.ReadOnlySpan{span})
+}
+
+func TestDrainTracerProvider_retry(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	queue := new(spanQueue)
+	queued := queue.exporter(exporter)
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(queued.processor(&stepProcessor{exporter: queued})))
+	defer tp.Shutdown(context.Background())
+
+	for i := 0; i < 5; i++ {
+		_, span := tp.Tracer("test").Start(context.Background(), "span")
+		span.End()
+	}
+
+	// a single flush exports a single span, draining flushes until all of them are
+	drainTracerProvider(tp, queue, time.Second, zap.NewNop())
+
+	if got := len(exporter.GetSpans()); got != 5 {
+		t.Errorf("exported %d spans, expected 5", got)
+	}
+	if queue.len() != 0 {
+		t.Errorf("queue length = %d, expected 0", queue.len())
+	}
+}
+
+func TestTracerProviderCache_cleanupTracerProvider_drainUnlocked(t *testing.T) {
+	cache := newTracerProviderCache()
+	key := tracerProviderKey{serviceName: "drain-unlocked"}
+
+	// the export keeps failing, the span is never removed from the queue and draining lasts until the timeout
+	queue := new(spanQueue)
+	queued := queue.exporter(&flakyExporter{InMemoryExporter: tracetest.NewInMemoryExporter(), failing: true})
+	tp, _ := cache.getTracerProvider(key, queue, sdktrace.WithSpanProcessor(queued.processor(&stepProcessor{exporter: queued})))
+	_, span := tp.Tracer("test").Start(context.Background(), "span")
+	span.End()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = cache.cleanupTracerProvider(key, 500*time.Millisecond, 0, zap.NewNop())
+	}()
+	// let the cleanup start draining
+	time.Sleep(50 * time.Millisecond)
+
+	start := time.Now()
+	if got := cache.len(); got != 0 {
+		t.Errorf("cache length = %d, expected the drained provider to be removed", got)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("reading the cache took %v while draining, expected it not to wait", elapsed)
+	}
+	<-done
+}
+
+// flakyExporter fails to export while failing is set.
+type flakyExporter struct {
+	*tracetest.InMemoryExporter
+	failing bool
+}
+
+func (e *flakyExporter) ExportSpans(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+	if e.failing {
+		return errors.New("collector unavailable")
+	}
+	return e.InMemoryExporter.ExportSpans(ctx, spans)
+}
+
+// failingExporter fails the first failures exports.
+type failingExporter struct {
+	*tracetest.InMemoryExporter
+	failures int
+}
+
+func (e *failingExporter) ExportSpans(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+	if e.failures > 0 {
+		e.failures--
+		return errors.New("collector unavailable")
+	}
+	return e.InMemoryExporter.ExportSpans(ctx, spans)
+}
+
+func TestDrainTracerProvider_retryFailed(t *testing.T) {
+	exporter := &failingExporter{InMemoryExporter: tracetest.NewInMemoryExporter(), failures: 2}
+	queue := new(spanQueue)
+	queued := queue.exporter(exporter)
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(queued.processor(&stepProcessor{exporter: queued})))
+	defer tp.Shutdown(context.Background())
+
+	_, span := tp.Tracer("test").Start(context.Background(), "span")
+	span.End()
+
+	// the span of the failed exports is no longer in the processor, it is exported again while draining
+	drainTracerProvider(tp, queue, time.Second, zap.NewNop())
+
+	if got := len(exporter.GetSpans()); got != 1 {
+		t.Errorf("exported %d spans, expected 1", got)
+	}
+	if queue.len() != 0 {
+		t.Errorf("queue length = %d, expected 0", queue.len())
+	}
+}
+
+func TestQueueExporter_failedNotDraining(t *testing.T) {
+	exporter := &flakyExporter{InMemoryExporter: tracetest.NewInMemoryExporter(), failing: true}
+	queue := new(spanQueue)
+	queued := queue.exporter(exporter)
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(queued.processor(sdktrace.NewSimpleSpanProcessor(queued))))
+	defer tp.Shutdown(context.Background())
+
+	_, span := tp.Tracer("test").Start(context.Background(), "span")
+	span.End()
+
+	// without a drain, the exporter has retried the span already, it is not kept
+	if queue.len() != 0 {
+		t.Errorf("queue length = %d, expected the failed span to be given up", queue.len())
+	}
+	if len(queued.failed) != 0 {
+		t.Errorf("kept %d failed spans, expected none", len(queued.failed))
+	}
+
+	// nor exported again with the next spans
+	exporter.failing = false
+	_, span = tp.Tracer("test").Start(context.Background(), "span")
+	span.End()
+	if got := len(exporter.GetSpans()); got != 1 {
+		t.Errorf("exported %d spans, expected 1", got)
+	}
+}
+
+func TestQueueExporter_queueFull(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	queue := new(spanQueue)
+	queued := queue.exporter(exporter)
+	queued.maxQueued = 2
+	processor := &stepProcessor{exporter: queued, max: 2}
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(queued.processor(processor)))
+	defer tp.Shutdown(context.Background())
+
+	for i := 0; i < 3; i++ {
+		_, span := tp.Tracer("test").Start(context.Background(), "span")
+		span.End()
+	}
+
+	// the span beyond the queue size is dropped by the processor, it is not waited for
+	if got := len(processor.pending); got != 2 {
+		t.Errorf("processor holds %d spans, expected 2", got)
+	}
+	if queue.len() != 2 {
+		t.Errorf("queue length = %d, expected 2", queue.len())
+	}
+
+	drainTracerProvider(tp, queue, time.Second, zap.NewNop())
+	if got := len(exporter.GetSpans()); got != 2 {
+		t.Errorf("exported %d spans, expected 2", got)
+	}
+	if queue.len() != 0 {
+		t.Errorf("queue length = %d, expected 0", queue.len())
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package opentelemetry
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// ipEnrichmentTTL is how long the attributes of a client IP address are
+// reused before the IPEnricher is asked for them again.
+const ipEnrichmentTTL = time.Minute
+
+// ipEnrichmentCacheSize bounds the number of client IP addresses whose
+// attributes are cached.
+const ipEnrichmentCacheSize = 10000
+
+// IPEnricher looks up attributes describing a client IP address, e.g. its
+// country or autonomous system from a GeoIP database, to be recorded on
+// the spans of its requests. The enrichers are guest modules of the
+// handler, in the http.handlers.opentelemetry.ip_enrichers namespace.
+type IPEnricher interface {
+	// EnrichIP returns the attributes of the IP address, none if unknown.
+	EnrichIP(ctx context.Context, ip string) []attribute.KeyValue
+}
+
+// ipEnrichments caches the attributes of the client IP addresses looked up
+// by the IPEnricher of a handler, so that it need not cache them itself.
+type ipEnrichments struct {
+	enricher IPEnricher
+
+	mu    sync.Mutex
+	cache map[string]ipEnrichment
+}
+
+// ipEnrichment holds the attributes of a client IP address until expiry.
+type ipEnrichment struct {
+	attrs  []attribute.KeyValue
+	expiry time.Time
+}
+
+// newIPEnrichments returns the cache of the attributes looked up by enricher.
+func newIPEnrichments(enricher IPEnricher) *ipEnrichments {
+	return &ipEnrichments{enricher: enricher, cache: make(map[string]ipEnrichment)}
+}
+
+// enrich returns the attributes of the client IP address from the cache or
+// from the enricher.
+func (e *ipEnrichments) enrich(ctx context.Context, ip string) []attribute.KeyValue {
+	now := time.Now()
+
+	e.mu.Lock()
+	enrichment, ok := e.cache[ip]
+	e.mu.Unlock()
+	if ok && now.Before(enrichment.expiry) {
+		return enrichment.attrs
+	}
+
+	// the lookup may be slow, the cache is not locked meanwhile
+	attrs := e.enricher.EnrichIP(ctx, ip)
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.cache) >= ipEnrichmentCacheSize {
+		for cached, enrichment := range e.cache {
+			if !now.Before(enrichment.expiry) {
+				delete(e.cache, cached)
+			}
+		}
+		if len(e.cache) >= ipEnrichmentCacheSize {
+			e.cache = make(map[string]ipEnrichment)
+		}
+	}
+	e.cache[ip] = ipEnrichment{attrs: attrs, expiry: now.Add(ipEnrichmentTTL)}
+
+	return attrs
+}
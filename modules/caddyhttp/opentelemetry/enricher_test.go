@@ -0,0 +1,147 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package opentelemetry
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+func init() {
+	caddy.RegisterModule(new(fakeIPEnricher))
+}
+
+// fakeIPEnricher returns the country of the known IP addresses and counts the lookups.
+type fakeIPEnricher struct {
+	Countries map[string]string `json:"countries,omitempty"`
+	lookups   int
+}
+
+func (*fakeIPEnricher) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.opentelemetry.ip_enrichers.fake",
+		New: func() caddy.Module { return new(fakeIPEnricher) },
+	}
+}
+
+// UnmarshalCaddyfile sets the countries from `<ip> <country>` lines.
+func (e *fakeIPEnricher) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	e.Countries = make(map[string]string)
+	for d.Next() {
+		for d.NextBlock(0) {
+			ip := d.Val()
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			e.Countries[ip] = d.Val()
+		}
+	}
+	return nil
+}
+
+func (e *fakeIPEnricher) EnrichIP(_ context.Context, ip string) []attribute.KeyValue {
+	e.lookups++
+	country, ok := e.Countries[ip]
+	if !ok {
+		return nil
+	}
+	return []attribute.KeyValue{attribute.String("client.geo.country_iso_code", country)}
+}
+
+func TestOpenTelemetryWrapper_ServeHTTP_ipEnricher(t *testing.T) {
+	enricher := &fakeIPEnricher{Countries: map[string]string{"192.0.2.1": "NL"}}
+	enrichments := newIPEnrichments(enricher)
+
+	tests := []struct {
+		remoteAddr string
+		expected   string
+	}{
+		{remoteAddr: "192.0.2.1:1234", expected: "NL"},
+		{remoteAddr: "198.51.100.1:1234"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.remoteAddr, func(t *testing.T) {
+			otw, exporter := newTestOpenTelemetryWrapper()
+			otw.ipEnrichments = enrichments
+
+			req := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+			req.RemoteAddr = tt.remoteAddr
+
+			err := otw.ServeHTTP(httptest.NewRecorder(), req, caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error {
+				return nil
+			}))
+			if err != nil {
+				t.Fatalf("ServeHTTP() error = %v", err)
+			}
+
+			if got := spanAttribute(t, exporter, "client.geo.country_iso_code"); got != tt.expected {
+				t.Errorf("client.geo.country_iso_code = %q, expected %q", got, tt.expected)
+			}
+		})
+	}
+
+	// the attributes of an address are cached
+	lookups := enricher.lookups
+	enrichments.enrich(context.Background(), "192.0.2.1")
+	if enricher.lookups != lookups {
+		t.Errorf("got %d lookups, expected the cached attributes to be reused", enricher.lookups-lookups)
+	}
+}
+
+func TestOpenTelemetryWrapper_ServeHTTP_ipEnricherNotRecording(t *testing.T) {
+	enricher := &fakeIPEnricher{Countries: map[string]string{"192.0.2.1": "NL"}}
+	otw, _ := newTestOpenTelemetryWrapper()
+	otw.tracer = sdktrace.NewTracerProvider(sdktrace.WithSampler(sdktrace.NeverSample())).Tracer("test")
+	otw.ipEnrichments = newIPEnrichments(enricher)
+
+	req := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+
+	err := otw.ServeHTTP(httptest.NewRecorder(), req, caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error {
+		return nil
+	}))
+	if err != nil {
+		t.Fatalf("ServeHTTP() error = %v", err)
+	}
+
+	if enricher.lookups != 0 {
+		t.Errorf("got %d lookups, expected none for a span not recorded", enricher.lookups)
+	}
+}
+
+func TestOpenTelemetry_UnmarshalCaddyfile_ipEnricher(t *testing.T) {
+	ot := &OpenTelemetry{}
+	err := ot.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`opentelemetry {
+	ip_enricher fake {
+		192.0.2.1 NL
+	}
+}`))
+	if err != nil {
+		t.Fatalf("UnmarshalCaddyfile() error = %v", err)
+	}
+
+	expected := `{"countries":{"192.0.2.1":"NL"},"enricher":"fake"}`
+	if string(ot.IPEnricherRaw) != expected {
+		t.Errorf("IPEnricherRaw = %s, expected %s", ot.IPEnricherRaw, expected)
+	}
+}
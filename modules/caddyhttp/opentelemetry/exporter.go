@@ -0,0 +1,50 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package opentelemetry
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// attributesExporter rewrites the attributes of the spans before passing
+// them to the wrapped exporter. Ended spans are read-only, so this is the
+// last point at which their attributes can be changed.
+type attributesExporter struct {
+	sdktrace.SpanExporter
+	rewrite func([]attribute.KeyValue) []attribute.KeyValue
+}
+
+// ExportSpans implements sdktrace.SpanExporter.
+func (e attributesExporter) ExportSpans(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+	rewritten := make([]sdktrace.ReadOnlySpan, len(spans))
+	for i, s := range spans {
+		rewritten[i] = rewrittenSpan{ReadOnlySpan: s, attributes: e.rewrite(s.Attributes())}
+	}
+	return e.SpanExporter.ExportSpans(ctx, rewritten)
+}
+
+// rewrittenSpan overrides the attributes of the wrapped span.
+type rewrittenSpan struct {
+	sdktrace.ReadOnlySpan
+	attributes []attribute.KeyValue
+}
+
+// Attributes implements sdktrace.ReadOnlySpan.
+func (s rewrittenSpan) Attributes() []attribute.KeyValue {
+	return s.attributes
+}
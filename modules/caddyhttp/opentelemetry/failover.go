@@ -0,0 +1,104 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package opentelemetry
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// defaultFailoverRetryInterval is how long a failing exporter is skipped
+// before it is tried again.
+const defaultFailoverRetryInterval = 30 * time.Second
+
+// failoverExporter exports the spans with the first healthy of its
+// exporters, in order of priority. An exporter failing to export is
+// skipped for retryInterval, after which it is tried again so that the
+// spans go back to it once it has recovered. The last exporter is always
+// tried if all the others failed.
+type failoverExporter struct {
+	exporters     []sdktrace.SpanExporter
+	retryInterval time.Duration
+
+	mu sync.Mutex
+	// failedAt holds when each exporter last failed, zero if it is healthy.
+	failedAt []time.Time
+	// now returns the current time, it is replaced in tests.
+	now func() time.Time
+}
+
+// newFailoverExporter returns a failoverExporter skipping a failing
+// exporter for retryInterval, defaultFailoverRetryInterval if zero.
+func newFailoverExporter(retryInterval time.Duration, exporters ...sdktrace.SpanExporter) *failoverExporter {
+	if retryInterval <= 0 {
+		retryInterval = defaultFailoverRetryInterval
+	}
+	return &failoverExporter{
+		exporters:     exporters,
+		retryInterval: retryInterval,
+		failedAt:      make([]time.Time, len(exporters)),
+		now:           time.Now,
+	}
+}
+
+// ExportSpans implements sdktrace.SpanExporter.
+func (e *failoverExporter) ExportSpans(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+	var err error
+	for i, exporter := range e.exporters {
+		if i < len(e.exporters)-1 && !e.healthy(i) {
+			continue
+		}
+
+		err = exporter.ExportSpans(ctx, spans)
+
+		e.mu.Lock()
+		if err == nil {
+			e.failedAt[i] = time.Time{}
+		} else {
+			e.failedAt[i] = e.now()
+		}
+		e.mu.Unlock()
+
+		if err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// healthy returns true if the exporter at index i may be used.
+func (e *failoverExporter) healthy(i int) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.failedAt[i].IsZero() || e.now().Sub(e.failedAt[i]) >= e.retryInterval
+}
+
+// Shutdown implements sdktrace.SpanExporter.
+func (e *failoverExporter) Shutdown(ctx context.Context) error {
+	var firstErr error
+	for _, exporter := range e.exporters {
+		if err := exporter.Shutdown(ctx); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Interface guard
+var _ sdktrace.SpanExporter = (*failoverExporter)(nil)
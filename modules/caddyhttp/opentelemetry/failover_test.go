@@ -0,0 +1,92 @@
+package opentelemetry
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestFailoverExporter(t *testing.T) {
+	primary := &flakyExporter{InMemoryExporter: tracetest.NewInMemoryExporter()}
+	secondary := &flakyExporter{InMemoryExporter: tracetest.NewInMemoryExporter()}
+
+	now := time.Now()
+	exporter := newFailoverExporter(time.Minute, primary, secondary)
+	exporter.now = func() time.Time { return now }
+
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	export := func() {
+		_, span := tp.Tracer("test").Start(context.Background(), "span")
+		span.End()
+	}
+	expectSpans := func(step string, primarySpans, secondarySpans int) {
+		t.Helper()
+		if got := len(primary.GetSpans()); got != primarySpans {
+			t.Errorf("%s: primary got %d spans, expected %d", step, got, primarySpans)
+		}
+		if got := len(secondary.GetSpans()); got != secondarySpans {
+			t.Errorf("%s: secondary got %d spans, expected %d", step, got, secondarySpans)
+		}
+	}
+
+	export()
+	expectSpans("healthy primary", 1, 0)
+
+	primary.failing = true
+	export()
+	expectSpans("failing primary", 1, 1)
+
+	// the primary is skipped until the retry interval elapsed, even once recovered
+	primary.failing = false
+	export()
+	expectSpans("primary in retry interval", 1, 2)
+
+	now = now.Add(time.Minute)
+	export()
+	expectSpans("recovered primary", 2, 2)
+}
+
+func TestFailoverExporter_defaultRetryInterval(t *testing.T) {
+	exporter := newFailoverExporter(0, tracetest.NewInMemoryExporter())
+	if exporter.retryInterval != defaultFailoverRetryInterval {
+		t.Errorf("retryInterval = %v, expected %v", exporter.retryInterval, defaultFailoverRetryInterval)
+	}
+}
+
+func TestGetTracerExporters_failoverEndpointURL(t *testing.T) {
+	collector, endpoint := startTraceCollector(t)
+
+	// the primary endpoint refuses the connections, the failover one is a URL
+	exporters, err := getTracerExporters(context.Background(), tracerExporterConfig{
+		protocol:          "grpc",
+		endpoint:          "127.0.0.1:1",
+		insecure:          true,
+		timeout:           time.Second,
+		retry:             &ExporterRetry{},
+		failoverEndpoints: []string{"http://" + endpoint},
+	})
+	if err != nil {
+		t.Fatalf("getTracerExporters() error = %v", err)
+	}
+
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporters[0]))
+	_, span := tp.Tracer("test").Start(context.Background(), "span")
+	span.End()
+	if err := tp.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown() error = %v", err)
+	}
+	if got := collector.count(); got != 1 {
+		t.Errorf("collector received %d spans, expected 1", got)
+	}
+
+	_, err = getTracerExporters(context.Background(), tracerExporterConfig{
+		protocol:          "grpc",
+		failoverEndpoints: []string{"ftp://collector:4317"},
+	})
+	if err == nil {
+		t.Errorf("getTracerExporters() expected an error for an unsupported failover endpoint scheme")
+	}
+}
@@ -0,0 +1,118 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package opentelemetry
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const heartbeatSpanName = "caddy.heartbeat"
+
+// heartbeatAttribute marks the heartbeat spans, which the span filters let
+// through whatever their duration.
+var heartbeatAttribute = attribute.Bool("caddy.heartbeat", true)
+
+// heartbeatCtxKey is the context key marking the start of a heartbeat
+// span, for the heartbeatSampler to sample it.
+type heartbeatCtxKey struct{}
+
+// heartbeatSampler samples the heartbeat spans, and leaves the decision for
+// the other spans to its sampler. The heartbeats of the handlers using a
+// provider of the otel app go through the sampler of the provider instead.
+type heartbeatSampler struct {
+	sdktrace.Sampler
+}
+
+// ShouldSample implements sdktrace.Sampler.
+func (s heartbeatSampler) ShouldSample(p sdktrace.SamplingParameters) sdktrace.SamplingResult {
+	if p.ParentContext.Value(heartbeatCtxKey{}) != nil {
+		return sdktrace.SamplingResult{
+			Decision:   sdktrace.RecordAndSample,
+			Tracestate: trace.SpanContextFromContext(p.ParentContext).TraceState(),
+		}
+	}
+	return s.Sampler.ShouldSample(p)
+}
+
+// Description implements sdktrace.Sampler.
+func (s heartbeatSampler) Description() string {
+	return fmt.Sprintf("HeartbeatSampler{%s}", s.Sampler.Description())
+}
+
+// isHeartbeat returns true if s is a heartbeat span.
+func isHeartbeat(s sdktrace.ReadOnlySpan) bool {
+	for _, attr := range s.Attributes() {
+		if attr == heartbeatAttribute {
+			return true
+		}
+	}
+	return false
+}
+
+// heartbeat periodically emits a synthetic span, so that the delivery
+// of the spans to the collector can be verified continuously. The
+// heartbeat spans are always sampled, and never filtered out for their
+// duration.
+//
+// A cached tracer provider has a single heartbeat, whatever the number
+// of the handlers using it.
+type heartbeat struct {
+	quit chan struct{}
+	done chan struct{}
+}
+
+// startHeartbeat starts emitting a heartbeat span with tracer at every
+// interval until the heartbeat is stopped.
+func startHeartbeat(tracer trace.Tracer, interval time.Duration) *heartbeat {
+	hb := &heartbeat{
+		quit: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+
+	go func() {
+		defer close(hb.done)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-hb.quit:
+				return
+			case <-ticker.C:
+				ctx := context.WithValue(context.Background(), heartbeatCtxKey{}, true)
+				_, span := tracer.Start(ctx, heartbeatSpanName, trace.WithAttributes(heartbeatAttribute))
+				span.End()
+			}
+		}
+	}()
+
+	return hb
+}
+
+// stop stops the heartbeat, if not nil, and waits for its goroutine to exit.
+func (hb *heartbeat) stop() {
+	if hb == nil {
+		return
+	}
+	close(hb.quit)
+	<-hb.done
+}
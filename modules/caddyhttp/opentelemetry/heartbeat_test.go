@@ -0,0 +1,130 @@
+package opentelemetry
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestOpenTelemetryWrapper_heartbeat(t *testing.T) {
+	otw, exporter := newTestOpenTelemetryWrapper()
+
+	hb := startHeartbeat(otw.tracer, 5*time.Millisecond)
+	otw.heartbeat = hb
+
+	deadline := time.Now().Add(time.Second)
+	for len(exporter.GetSpans()) < 2 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if err := otw.cleanup(nil); err != nil {
+		t.Fatalf("cleanup() error = %v", err)
+	}
+
+	spans := exporter.GetSpans()
+	if len(spans) < 2 {
+		t.Fatalf("expected at least 2 heartbeat spans, got %d", len(spans))
+	}
+	for _, s := range spans {
+		if s.Name != heartbeatSpanName {
+			t.Errorf("span name = %s, expected %s", s.Name, heartbeatSpanName)
+		}
+	}
+
+	select {
+	case <-hb.done:
+	default:
+		t.Fatalf("heartbeat goroutine still running after cleanup")
+	}
+
+	count := len(exporter.GetSpans())
+	time.Sleep(20 * time.Millisecond)
+	if got := len(exporter.GetSpans()); got != count {
+		t.Errorf("heartbeat spans emitted after cleanup: %d, expected %d", got, count)
+	}
+}
+
+func TestOpenTelemetryWrapper_heartbeatSampledAndKept(t *testing.T) {
+	// neither the sampler nor the minimum duration let the other spans through
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithSampler(heartbeatSampler{Sampler: sdktrace.NeverSample()}),
+		sdktrace.WithSpanProcessor(filterSpanProcessor(sdktrace.NewSimpleSpanProcessor(exporter), time.Hour)),
+	)
+	defer tp.Shutdown(context.Background())
+	otw := &openTelemetryWrapper{tracer: tp.Tracer("test")}
+
+	_, span := otw.tracer.Start(context.Background(), "request")
+	span.End()
+
+	hb := startHeartbeat(otw.tracer, 5*time.Millisecond)
+	deadline := time.Now().Add(time.Second)
+	for len(exporter.GetSpans()) < 1 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	hb.stop()
+
+	spans := exporter.GetSpans()
+	if len(spans) == 0 {
+		t.Fatalf("no heartbeat span exported")
+	}
+	for _, s := range spans {
+		if s.Name != heartbeatSpanName {
+			t.Errorf("span %s exported, expected the heartbeats only", s.Name)
+		}
+	}
+}
+
+func TestTracerProviderCache_heartbeatShared(t *testing.T) {
+	cache := newTracerProviderCache()
+	interval := 10 * time.Millisecond
+	key := tracerProviderKey{serviceName: "test", heartbeatInterval: interval}
+
+	// two handlers share the provider, and so its heartbeat
+	exporter := tracetest.NewInMemoryExporter()
+	start := time.Now()
+	cache.getTracerProvider(key, nil, sdktrace.WithSyncer(exporter))
+	cache.getTracerProvider(key, nil, sdktrace.WithSyncer(exporter))
+
+	if len(cache.tracerProvidersHeartbeat) != 1 {
+		t.Fatalf("heartbeats = %d, expected 1", len(cache.tracerProvidersHeartbeat))
+	}
+	hb := cache.tracerProvidersHeartbeat[key]
+
+	time.Sleep(10 * interval)
+
+	// the heartbeat outlives the first handler
+	if err := cache.cleanupTracerProvider(key, 0, 0, nil); err != nil {
+		t.Fatalf("cleanupTracerProvider() error = %v", err)
+	}
+	select {
+	case <-hb.done:
+		t.Fatalf("heartbeat stopped while the provider is still used")
+	default:
+	}
+
+	if err := cache.cleanupTracerProvider(key, 0, 0, nil); err != nil {
+		t.Fatalf("cleanupTracerProvider() error = %v", err)
+	}
+	elapsed := time.Since(start)
+	select {
+	case <-hb.done:
+	default:
+		t.Fatalf("heartbeat still running once the provider is unused")
+	}
+	if len(cache.tracerProvidersHeartbeat) != 0 {
+		t.Errorf("heartbeat should be removed once the provider is unused")
+	}
+
+	// a single stream ticks at most once per interval
+	heartbeats := len(exporter.GetSpans())
+	if heartbeats == 0 {
+		t.Fatalf("no heartbeat span exported")
+	}
+	if max := int(elapsed / interval); heartbeats > max {
+		t.Errorf("heartbeat spans = %d, expected at most %d of a single stream", heartbeats, max)
+	}
+}
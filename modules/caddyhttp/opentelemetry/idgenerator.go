@@ -0,0 +1,105 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package opentelemetry
+
+import (
+	"context"
+	crand "crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"sync"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// prefixedIDGenerator generates random trace IDs starting with a fixed
+// prefix, recognizable in integration tests, and random span IDs.
+type prefixedIDGenerator struct {
+	prefix []byte
+
+	mu   sync.Mutex
+	rand *rand.Rand
+}
+
+// newPrefixedIDGenerator returns a generator of trace IDs starting with the
+// prefix, which must be shorter than a trace ID.
+func newPrefixedIDGenerator(prefix []byte) (*prefixedIDGenerator, error) {
+	if len(prefix) >= len(trace.TraceID{}) {
+		return nil, fmt.Errorf("trace ID prefix must be shorter than %d bytes, got %d", len(trace.TraceID{}), len(prefix))
+	}
+
+	var seed int64
+	if err := binary.Read(crand.Reader, binary.LittleEndian, &seed); err != nil {
+		return nil, fmt.Errorf("seeding ID generator: %w", err)
+	}
+
+	return &prefixedIDGenerator{
+		prefix: prefix,
+		rand:   rand.New(rand.NewSource(seed)),
+	}, nil
+}
+
+// NewIDs implements sdktrace.IDGenerator.
+func (g *prefixedIDGenerator) NewIDs(ctx context.Context) (trace.TraceID, trace.SpanID) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	var traceID trace.TraceID
+	_, _ = g.rand.Read(traceID[:])
+	copy(traceID[:], g.prefix)
+
+	var spanID trace.SpanID
+	_, _ = g.rand.Read(spanID[:])
+
+	return traceID, spanID
+}
+
+// NewSpanID implements sdktrace.IDGenerator.
+func (g *prefixedIDGenerator) NewSpanID(ctx context.Context, traceID trace.TraceID) trace.SpanID {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	var spanID trace.SpanID
+	_, _ = g.rand.Read(spanID[:])
+
+	return spanID
+}
+
+// presampledIDsCtxKey is the context key under which the IDs of a span,
+// generated before it is started to sample it, are given to the
+// presampledIDGenerator.
+type presampledIDsCtxKey struct{}
+
+// presampledIDs are the IDs of a span generated before it is started.
+type presampledIDs struct {
+	traceID trace.TraceID
+	spanID  trace.SpanID
+}
+
+// presampledIDGenerator returns the IDs generated before the span is
+// started, if any, or generates them with the wrapped generator.
+type presampledIDGenerator struct {
+	sdktrace.IDGenerator
+}
+
+// NewIDs implements sdktrace.IDGenerator.
+func (g presampledIDGenerator) NewIDs(ctx context.Context) (trace.TraceID, trace.SpanID) {
+	if ids, ok := ctx.Value(presampledIDsCtxKey{}).(presampledIDs); ok {
+		return ids.traceID, ids.spanID
+	}
+	return g.IDGenerator.NewIDs(ctx)
+}
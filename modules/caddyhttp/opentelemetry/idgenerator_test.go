@@ -0,0 +1,111 @@
+package opentelemetry
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestPrefixedIDGenerator(t *testing.T) {
+	prefix := []byte{0xca, 0xd0}
+	idGenerator, err := newPrefixedIDGenerator(prefix)
+	if err != nil {
+		t.Fatalf("newPrefixedIDGenerator() error = %v", err)
+	}
+
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter), sdktrace.WithIDGenerator(idGenerator))
+	for i := 0; i < 3; i++ {
+		_, span := tp.Tracer("test").Start(context.Background(), "span")
+		span.End()
+	}
+
+	for _, span := range exporter.GetSpans() {
+		traceID := span.SpanContext.TraceID()
+		if !bytes.HasPrefix(traceID[:], prefix) {
+			t.Errorf("trace ID %s does not start with the prefix %x", traceID, prefix)
+		}
+		if !span.SpanContext.IsValid() {
+			t.Errorf("span context %v is not valid", span.SpanContext)
+		}
+	}
+}
+
+func TestNewPrefixedIDGenerator_prefixTooLong(t *testing.T) {
+	if _, err := newPrefixedIDGenerator(make([]byte, 16)); err == nil {
+		t.Errorf("newPrefixedIDGenerator() expected an error for a prefix as long as a trace ID")
+	}
+}
+
+func TestOpenTelemetryWrapper_newOpenTelemetryWrapper_traceIDPrefix(t *testing.T) {
+	otw, err := newOpenTelemetryWrapper(context.Background(), tracerConfig{
+		traceIDPrefix: "CAD0",
+		exporter:      tracerExporterConfig{insecure: true},
+	})
+	if err != nil {
+		t.Fatalf("newOpenTelemetryWrapper() error = %v", err)
+	}
+	defer otw.cleanup(nil)
+
+	if otw.tracerProviderKey.traceIDPrefix != "cad0" {
+		t.Errorf("tracer provider key prefix = %q, expected %q", otw.tracerProviderKey.traceIDPrefix, "cad0")
+	}
+
+	_, span := otw.tracer.Start(context.Background(), "span")
+	span.End()
+	if traceID := span.SpanContext().TraceID(); !bytes.HasPrefix(traceID[:], []byte{0xca, 0xd0}) {
+		t.Errorf("trace ID %s does not start with the prefix cad0", traceID)
+	}
+}
+
+func TestOpenTelemetryWrapper_newOpenTelemetryWrapper_xrayIDGenerator(t *testing.T) {
+	otw, err := newOpenTelemetryWrapper(context.Background(), tracerConfig{
+		idGenerator: idGeneratorXRay,
+		exporter:    tracerExporterConfig{insecure: true},
+	})
+	if err != nil {
+		t.Fatalf("newOpenTelemetryWrapper() error = %v", err)
+	}
+	defer otw.cleanup(nil)
+
+	if otw.tracerProviderKey.idGenerator != idGeneratorXRay {
+		t.Errorf("tracer provider key ID generator = %q, expected %q", otw.tracerProviderKey.idGenerator, idGeneratorXRay)
+	}
+
+	before := time.Now().Unix()
+	_, span := otw.tracer.Start(context.Background(), "span")
+	span.End()
+	// the X-Ray trace IDs start with the time they were generated at, in seconds
+	traceID := span.SpanContext().TraceID()
+	if epoch := int64(binary.BigEndian.Uint32(traceID[:4])); epoch < before || epoch > time.Now().Unix() {
+		t.Errorf("trace ID %s does not start with the current time", traceID)
+	}
+}
+
+func TestOpenTelemetryWrapper_newOpenTelemetryWrapper_invalidIDGenerator(t *testing.T) {
+	for _, cfg := range []tracerConfig{
+		{idGenerator: "snowflake"},
+		{idGenerator: idGeneratorXRay, traceIDPrefix: "cad0"},
+	} {
+		cfg.exporter = tracerExporterConfig{insecure: true}
+		if _, err := newOpenTelemetryWrapper(context.Background(), cfg); err == nil {
+			t.Errorf("newOpenTelemetryWrapper() with ID generator %q and prefix %q expected an error", cfg.idGenerator, cfg.traceIDPrefix)
+		}
+	}
+}
+
+func TestOpenTelemetryWrapper_newOpenTelemetryWrapper_invalidTraceIDPrefix(t *testing.T) {
+	for _, prefix := range []string{"not hex", "000102030405060708090a0b0c0d0e0f"} {
+		if _, err := newOpenTelemetryWrapper(context.Background(), tracerConfig{
+			traceIDPrefix: prefix,
+			exporter:      tracerExporterConfig{insecure: true},
+		}); err == nil {
+			t.Errorf("newOpenTelemetryWrapper() with prefix %q expected an error", prefix)
+		}
+	}
+}
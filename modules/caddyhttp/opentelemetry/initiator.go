@@ -0,0 +1,56 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package opentelemetry
+
+import (
+	"context"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// InitiatorSpanCtxKey is the context key under which ContextWithInitiator
+// stores, as a trace.SpanContext, the span which initiated an internal
+// request.
+const InitiatorSpanCtxKey caddy.CtxKey = "initiator_span"
+
+// ContextWithInitiator returns a copy of ctx for an internal request, e.g.
+// a sub-request or a health check Caddy makes to itself, initiated while
+// the span of ctx is current. The span of the internal request starts its
+// own trace instead of being a child of the initiating span; it is linked
+// to the initiating span if the handler is configured with LinkInitiator.
+// ctx is returned as is if it has no span.
+func ContextWithInitiator(ctx context.Context) context.Context {
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.IsValid() {
+		return ctx
+	}
+	ctx = trace.ContextWithSpanContext(ctx, trace.SpanContext{})
+	return context.WithValue(ctx, InitiatorSpanCtxKey, sc)
+}
+
+// initiatorLink returns the link to the span which initiated the request,
+// false if the request is not an internal one.
+func initiatorLink(ctx context.Context) (trace.Link, bool) {
+	sc, ok := ctx.Value(InitiatorSpanCtxKey).(trace.SpanContext)
+	if !ok || !sc.IsValid() {
+		return trace.Link{}, false
+	}
+	return trace.Link{
+		SpanContext: sc,
+		Attributes:  []attribute.KeyValue{attribute.String("caddy.link.type", "initiator")},
+	}, true
+}
@@ -0,0 +1,70 @@
+package opentelemetry
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestOpenTelemetryWrapper_ServeHTTP_linkInitiator(t *testing.T) {
+	otw, exporter := newTestOpenTelemetryWrapper()
+	otw.linkInitiator = true
+
+	// the span current while the internal request is initiated, e.g. by a handler
+	ctx, initiator := sdktrace.NewTracerProvider().Tracer("test").Start(context.Background(), "initiator")
+	defer initiator.End()
+
+	req := httptest.NewRequest(http.MethodGet, "https://example.com/health", nil)
+	req = req.WithContext(ContextWithInitiator(ctx))
+
+	err := otw.ServeHTTP(httptest.NewRecorder(), req, caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error {
+		return nil
+	}))
+	if err != nil {
+		t.Fatalf("ServeHTTP() error = %v", err)
+	}
+
+	span := exporter.GetSpans()[0]
+	if span.Parent.IsValid() || span.SpanContext.TraceID() == initiator.SpanContext().TraceID() {
+		t.Errorf("expected the internal request to start its own trace")
+	}
+	if len(span.Links) != 1 || !span.Links[0].SpanContext.Equal(initiator.SpanContext()) {
+		t.Errorf("links = %v, expected a link to the initiating span", span.Links)
+	}
+}
+
+func TestOpenTelemetryWrapper_ServeHTTP_linkInitiatorDisabled(t *testing.T) {
+	otw, exporter := newTestOpenTelemetryWrapper()
+
+	ctx, initiator := sdktrace.NewTracerProvider().Tracer("test").Start(context.Background(), "initiator")
+	defer initiator.End()
+
+	req := httptest.NewRequest(http.MethodGet, "https://example.com/health", nil)
+	req = req.WithContext(ContextWithInitiator(ctx))
+
+	err := otw.ServeHTTP(httptest.NewRecorder(), req, caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error {
+		return nil
+	}))
+	if err != nil {
+		t.Fatalf("ServeHTTP() error = %v", err)
+	}
+
+	if links := exporter.GetSpans()[0].Links; len(links) != 0 {
+		t.Errorf("links = %v, expected none", links)
+	}
+}
+
+func TestContextWithInitiator_noSpan(t *testing.T) {
+	ctx := context.Background()
+	if got := ContextWithInitiator(ctx); got != ctx {
+		t.Errorf("ContextWithInitiator() expected the context as is without a span")
+	}
+	if _, ok := initiatorLink(trace.ContextWithSpanContext(ctx, trace.SpanContext{})); ok {
+		t.Errorf("initiatorLink() expected no link")
+	}
+}
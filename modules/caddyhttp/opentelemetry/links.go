@@ -0,0 +1,65 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package opentelemetry
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+// headerLinks returns the links to the trace contexts carried by the
+// headers of the request, in the W3C traceparent format, e.g. the traces
+// of the requests a gateway batched into this one. A header may carry
+// several comma separated trace contexts. The malformed ones are skipped
+// and logged with logger, if not nil.
+func headerLinks(r *http.Request, headers []string, logger *zap.Logger) []trace.Link {
+	var links []trace.Link
+	for _, header := range headers {
+		for _, value := range r.Header.Values(header) {
+			for _, traceparent := range strings.Split(value, ",") {
+				traceparent = strings.TrimSpace(traceparent)
+				if traceparent == "" {
+					continue
+				}
+
+				carrier := propagation.HeaderCarrier{"Traceparent": []string{traceparent}}
+				sc := trace.SpanContextFromContext(propagation.TraceContext{}.Extract(context.Background(), carrier))
+				if !sc.IsValid() {
+					if logger != nil {
+						logger.Debug("skipping malformed span link",
+							zap.String("header", header),
+							zap.String("value", traceparent))
+					}
+					continue
+				}
+
+				links = append(links, trace.Link{
+					SpanContext: sc,
+					Attributes: []attribute.KeyValue{
+						attribute.String("caddy.link.type", "header"),
+						attribute.String("caddy.link.header", header),
+					},
+				})
+			}
+		}
+	}
+	return links
+}
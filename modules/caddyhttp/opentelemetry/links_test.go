@@ -0,0 +1,44 @@
+package opentelemetry
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+func TestOpenTelemetryWrapper_ServeHTTP_spanLinks(t *testing.T) {
+	otw, exporter := newTestOpenTelemetryWrapper()
+	otw.spanLinks = []string{"X-Batch-Traces", "X-Origin-Trace"}
+	otw.logger = zap.NewNop()
+
+	req := httptest.NewRequest(http.MethodPost, "https://example.com/batch", nil)
+	req.Header.Set("X-Batch-Traces", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01, not-a-traceparent")
+	req.Header.Add("X-Batch-Traces", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	// an all-zero trace ID is invalid
+	req.Header.Set("X-Origin-Trace", "00-00000000000000000000000000000000-b7ad6b7169203331-01")
+
+	err := otw.ServeHTTP(httptest.NewRecorder(), req, caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error {
+		return nil
+	}))
+	if err != nil {
+		t.Fatalf("ServeHTTP() error = %v", err)
+	}
+
+	span := exporter.GetSpans()[0]
+	if len(span.Links) != 2 {
+		t.Fatalf("links = %v, expected the 2 valid trace contexts", span.Links)
+	}
+	expected := []string{"0af7651916cd43dd8448eb211c80319c", "4bf92f3577b34da6a3ce929d0e0e4736"}
+	for i, link := range span.Links {
+		if got := link.SpanContext.TraceID().String(); got != expected[i] {
+			t.Errorf("link %d trace ID = %s, expected %s", i, got, expected[i])
+		}
+	}
+	// the links do not make the span a child of the linked traces
+	if span.Parent.IsValid() {
+		t.Errorf("expected a root span, got parent %v", span.Parent)
+	}
+}
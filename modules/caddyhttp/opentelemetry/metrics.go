@@ -0,0 +1,43 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package opentelemetry
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/metric"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+)
+
+// observeTracerProviders reports the state of the tracer providers of the
+// cache with meter: the number of providers, and the number of handlers
+// using them by service name.
+func observeTracerProviders(meter metric.Meter, cache *tracerProviderCache) {
+	must := metric.Must(meter)
+
+	must.NewInt64GaugeObserver("caddy.opentelemetry.tracer_providers",
+		func(_ context.Context, result metric.Int64ObserverResult) {
+			result.Observe(int64(cache.len()))
+		},
+		metric.WithDescription("Number of tracer providers currently in use."))
+
+	must.NewInt64GaugeObserver("caddy.opentelemetry.tracer_provider_references",
+		func(_ context.Context, result metric.Int64ObserverResult) {
+			for serviceName, references := range cache.references() {
+				result.Observe(int64(references), semconv.ServiceNameKey.String(serviceName))
+			}
+		},
+		metric.WithDescription("Number of handlers using the tracer providers of a service."))
+}
@@ -0,0 +1,48 @@
+package opentelemetry
+
+import (
+	"context"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.opentelemetry.io/otel/metric/metrictest"
+)
+
+func TestObserveTracerProviders(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	handlers := []*OpenTelemetry{
+		{ServiceName: "metrics-a", ExporterInsecure: "true"},
+		{ServiceName: "metrics-a", ExporterInsecure: "true"},
+		{ServiceName: "metrics-b", ExporterInsecure: "true"},
+	}
+	for _, ot := range handlers {
+		if err := ot.Provision(ctx); err != nil {
+			t.Fatalf("Provision() error = %v", err)
+		}
+		defer ot.Cleanup()
+	}
+
+	meterProvider := metrictest.NewMeterProvider()
+	observeTracerProviders(meterProvider.Meter("test"), defaultTracerProviderCache)
+	meterProvider.RunAsyncInstruments()
+
+	references := map[string]int64{}
+	var tracerProviders int64
+	for _, m := range metrictest.AsStructs(meterProvider.MeasurementBatches) {
+		switch m.Name {
+		case "caddy.opentelemetry.tracer_providers":
+			tracerProviders = m.Number.AsInt64()
+		case "caddy.opentelemetry.tracer_provider_references":
+			references[m.Labels["service.name"].AsString()] = m.Number.AsInt64()
+		}
+	}
+
+	if expected := int64(defaultTracerProviderCache.len()); tracerProviders != expected {
+		t.Errorf("tracer_providers = %d, expected %d", tracerProviders, expected)
+	}
+	if references["metrics-a"] != 2 || references["metrics-b"] != 1 {
+		t.Errorf("tracer_provider_references = %v, expected 2 for metrics-a and 1 for metrics-b", references)
+	}
+}
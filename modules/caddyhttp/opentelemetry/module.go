@@ -0,0 +1,1585 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package opentelemetry
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(OpenTelemetry{})
+	httpcaddyfile.RegisterDirective("opentelemetry", parseCaddyfileRoute)
+	httpcaddyfile.RegisterGlobalOption("opentelemetry", parseGlobalOption)
+}
+
+// OpenTelemetry implements an HTTP handler that adds support for the
+// OpenTelemetry tracing. It is responsible for the injection and
+// propagation of the tracing context.
+//
+// The span of the request is current in the context of the request seen
+// by the next handlers, so the spans they start are its children, and
+// its tracing context is injected in the request headers which the
+// reverse_proxy handler forwards upstream.
+//
+// The module can be configured with the standard OpenTelemetry environment
+// variables described at https://github.com/open-telemetry/opentelemetry-specification/blob/main/specification/sdk-environment-variables.md;
+// values set in the module config take precedence over them.
+type OpenTelemetry struct {
+	// SpanName is the name of the span created for each request. It SHOULD
+	// follow the naming guideline at https://github.com/open-telemetry/opentelemetry-specification/blob/main/specification/trace/api.md#span
+	//
+	// Placeholders are resolved for each request, e.g.
+	// "{http.request.method} {http.request.uri.path}". Beware that
+	// placeholders with unbounded values, like the request path, produce
+	// an unbounded number of span names, which most trace backends
+	// aggregate poorly; prefer low-cardinality values such as the method
+	// or a matched route pattern. Default: "HTTP" followed by the method
+	// of the request, e.g. "HTTP GET".
+	SpanName string `json:"span_name,omitempty"`
+
+	// SpanNameSource selects where the span name comes from: "static"
+	// (default) uses SpanName, "route" uses the pattern of the matched
+	// route, stored in the "route_pattern" request variable (e.g. with
+	// `vars route_pattern /users/{id}`), and "method" uses the method and
+	// the path of the request, e.g. "GET /users/42". It may be a comma
+	// separated list, e.g. "route,method,static", whose sources are tried
+	// in order until one gives a name; SpanName is used when none does.
+	// Route patterns keep the number of distinct span names bounded on
+	// REST APIs.
+	SpanNameSource string `json:"span_name_source,omitempty"`
+
+	// RoutePattern is the pattern of the route the handler is in, e.g.
+	// "/api/*", used as the span name by the "route" SpanNameSource when
+	// no "route_pattern" request variable is set. In the Caddyfile, it
+	// defaults to the path of the matcher of the directive, if it has a
+	// single one.
+	RoutePattern string `json:"route_pattern,omitempty"`
+
+	// SpanNameFromResponseHeader is a response header, e.g. set by the
+	// backend of a reverse proxy to its operation name, which renames the
+	// span once the request is handled, whatever the SpanNameSource. Only
+	// the name changes: the sampling decision, made when the span starts,
+	// saw the name given by the other settings.
+	SpanNameFromResponseHeader string `json:"span_name_from_response_header,omitempty"`
+
+	// ServiceName is the logical name of the service. Overrides
+	// OTEL_SERVICE_NAME and the service.name in OTEL_RESOURCE_ATTRIBUTES.
+	//
+	// It may contain {http.vars.*} and {env.*} placeholders, resolved for
+	// each request, e.g. "{http.vars.service}" set by the vars handler of
+	// the routes of each site for a service per site. The other
+	// placeholders are rejected, as the values of some are controlled by
+	// the clients, e.g. the Host header: since the service name is part of
+	// the resource, each distinct value gets a tracer provider of its own,
+	// with its exporters and span counts, bounded by MaxServiceNames. The
+	// provider of a new value is created in the background, the first
+	// requests with it, those for which it resolves to an empty value, and
+	// the request metrics, use the service name of the environment or the
+	// default one.
+	ServiceName string `json:"service_name,omitempty"`
+
+	// MaxServiceNames is the maximum number of tracer providers kept for
+	// a ServiceName with placeholders, the least recently used one being
+	// shut down beyond it. Default: 100.
+	MaxServiceNames int `json:"max_service_names,omitempty"`
+
+	// ServiceVersion is the version of the service, e.g. the version of
+	// the deployed application rather than the one of Caddy. Omitted by
+	// default.
+	ServiceVersion string `json:"service_version,omitempty"`
+
+	// Provider is the name of a provider of the otel app whose tracer
+	// and meter providers the handler uses, instead of building its own.
+	// The service, exporter and sampler settings are then the ones of the
+	// provider: the handler cannot set its own.
+	Provider string `json:"provider,omitempty"`
+
+	// ExporterTracesEndpoint is the target to which the exporter sends
+	// spans. Overrides ExporterEndpoint, OTEL_EXPORTER_OTLP_TRACES_ENDPOINT
+	// and OTEL_EXPORTER_OTLP_ENDPOINT, in this order of precedence. Either
+	// a host:port or a URL such as https://otel.example.com:4318/v1/traces,
+	// whose http scheme implies ExporterInsecure and https scheme a secure
+	// connection. The path of the URL is only used by the http/protobuf
+	// protocol.
+	ExporterTracesEndpoint string `json:"exporter_traces_endpoint,omitempty"`
+
+	// ExporterEndpoint is the target of all the signals, used unless
+	// ExporterTracesEndpoint is set. Like OTEL_EXPORTER_OTLP_ENDPOINT,
+	// which it overrides along with OTEL_EXPORTER_OTLP_TRACES_ENDPOINT,
+	// the path of its URL is a base to which the http/protobuf protocol
+	// appends /v1/traces.
+	ExporterEndpoint string `json:"exporter_endpoint,omitempty"`
+
+	// ExporterFailoverEndpoints receive the spans, with the same protocol
+	// and settings, only when the endpoints before them fail to export,
+	// in order of priority after ExporterTracesEndpoint: the order is the
+	// only preference, the spans are not spread among the endpoints. Like
+	// ExporterTracesEndpoint, each is either a host:port or a URL.
+	ExporterFailoverEndpoints []string `json:"exporter_failover_endpoints,omitempty"`
+
+	// ExporterFailoverRetryInterval is how long a failing endpoint of the
+	// failover is skipped before it is tried again, so that the spans go
+	// back to it once it has recovered. Default: 30s.
+	ExporterFailoverRetryInterval caddy.Duration `json:"exporter_failover_retry_interval,omitempty"`
+
+	// ExporterTracesProtocol is the transport protocol of the exporter,
+	// either "grpc" (default), "http/protobuf" or "stdout" to print the
+	// spans, e.g. while debugging without a collector. A comma separated
+	// list, e.g. "grpc,stdout", exports the spans with several exporters
+	// at once. Overrides OTEL_EXPORTER_OTLP_PROTOCOL and
+	// OTEL_EXPORTER_OTLP_TRACES_PROTOCOL.
+	ExporterTracesProtocol string `json:"exporter_traces_protocol,omitempty"`
+
+	// ExporterStdoutFile is the path of the file the spans are appended
+	// to by the "stdout" protocol. Default: standard error.
+	ExporterStdoutFile string `json:"exporter_stdout_file,omitempty"`
+
+	// ExporterCertificate is the path to a PEM encoded CA certificate
+	// used to verify the collector's TLS certificate. Overrides
+	// OTEL_EXPORTER_OTLP_CERTIFICATE and OTEL_EXPORTER_OTLP_TRACES_CERTIFICATE.
+	ExporterCertificate string `json:"exporter_certificate,omitempty"`
+
+	// ExporterClientCertificate and ExporterClientKey are the paths of the
+	// PEM encoded client certificate and key presented to a collector
+	// requiring mutual TLS. They must be set together.
+	ExporterClientCertificate string `json:"exporter_client_certificate,omitempty"`
+	ExporterClientKey         string `json:"exporter_client_key,omitempty"`
+
+	// ExporterTLSSkipVerify disables the verification of the certificate
+	// of the collector, e.g. a self-signed one in staging, while the spans
+	// are still exported over TLS. Unlike ExporterInsecure, which disables
+	// TLS entirely. Do not use in production.
+	ExporterTLSSkipVerify bool `json:"exporter_tls_skip_verify,omitempty"`
+
+	// ExporterServerNameOverride is the name the certificate of the collector
+	// is verified against, and sent as SNI, instead of the host of the
+	// endpoint, e.g. when the certificate was issued for another name.
+	ExporterServerNameOverride string `json:"exporter_server_name_override,omitempty"`
+
+	// ExporterHeaders are sent with each export request, e.g. the API key
+	// of a managed backend such as `x-honeycomb-team`.
+	ExporterHeaders map[string]string `json:"exporter_headers,omitempty"`
+
+	// ExporterTimeout bounds each export of spans to the collector.
+	// Overrides OTEL_EXPORTER_OTLP_TIMEOUT and
+	// OTEL_EXPORTER_OTLP_TRACES_TIMEOUT. Default: 10s.
+	ExporterTimeout caddy.Duration `json:"exporter_timeout,omitempty"`
+
+	// ExporterRetry configures the retries of the failed exports over
+	// gRPC, e.g. to bound them while the collector restarts. The
+	// exporter's default retries are used if not set.
+	ExporterRetry *ExporterRetry `json:"exporter_retry,omitempty"`
+
+	// ExporterCompression is the compression of the exported spans,
+	// either "gzip" or "none" (default). Overrides
+	// OTEL_EXPORTER_OTLP_COMPRESSION and
+	// OTEL_EXPORTER_OTLP_TRACES_COMPRESSION.
+	ExporterCompression string `json:"exporter_compression,omitempty"`
+
+	// ExporterInsecure disables client transport security for the
+	// exporter's connection. Overrides OTEL_EXPORTER_OTLP_INSECURE and
+	// OTEL_EXPORTER_OTLP_TRACES_INSECURE. The value is a boolean as
+	// accepted by strconv.ParseBool, e.g. "true" or "1"; other values
+	// fail the provisioning.
+	ExporterInsecure string `json:"exporter_insecure,omitempty"`
+
+	// Propagators is a comma-separated list of the propagators used to
+	// extract and inject the tracing context. Supported values are
+	// "tracecontext", "baggage", "jaeger", "xray" for the AWS X-Ray
+	// trace header and "b3" for the B3 headers of Zipkin. Default:
+	// "tracecontext,baggage". The context is injected with all of them,
+	// and extracted with each of them in order: when a request carries
+	// the headers of several propagators, the context of the last one
+	// listed prevails.
+	Propagators string `json:"propagators,omitempty"`
+
+	// Sampler is the name of the sampler deciding which traces are
+	// recorded. Supported values are "always_on", "always_off",
+	// "traceidratio", "parentbased_always_on", "parentbased_always_off"
+	// "parentbased_traceidratio" and "rate_limited". The parent based
+	// samplers honor the sampling decision carried by an incoming tracing
+	// context, as does the rate limited one, which samples up to
+	// TracesPerSecond traces.
+	// Overrides OTEL_TRACES_SAMPLER. When neither is set, every trace is
+	// sampled, or the SamplingRatio is applied if it is set.
+	Sampler string `json:"sampler,omitempty"`
+
+	// SamplingRatio is the fraction of traces to sample, between 0.0 and
+	// 1.0 inclusive, used by the ratio based samplers. Overrides
+	// OTEL_TRACES_SAMPLER_ARG. When not set, every trace is sampled.
+	SamplingRatio *float64 `json:"sampling_ratio,omitempty"`
+
+	// TracesPerSecond is the number of traces sampled per second by the
+	// "rate_limited" sampler, the traces beyond it being dropped. The spans
+	// with a parent, e.g. from an incoming tracing context, follow its
+	// decision and do not count. Overrides OTEL_TRACES_SAMPLER_ARG.
+	TracesPerSecond float64 `json:"traces_per_second,omitempty"`
+
+	// ClientSamplingRatio is the fraction of clients, selected by the hash
+	// of their IP address, whose requests are all traced, while no span is
+	// created for the requests of the other clients. Unlike SamplingRatio,
+	// it follows the same clients across requests. Disabled by default.
+	ClientSamplingRatio *float64 `json:"client_sampling_ratio,omitempty"`
+
+	// TargetSpansPerSecond is the budget of root spans sampled per second,
+	// so that traffic spikes do not overwhelm the collector. The fraction
+	// of the sampled traces adapts to the recent request rate to keep
+	// about this many spans. Zero, the default, disables the budget.
+	TargetSpansPerSecond float64 `json:"target_spans_per_second,omitempty"`
+
+	// RolloutPercentage is the percentage of the routes traced, from 0 to
+	// 100, for a gradual rollout of the tracing. The routes are selected at
+	// provisioning by the hash of their RoutePattern, or of their SpanName
+	// without one, so that the same routes stay traced across reloads. No
+	// span is created by the handlers of the other routes. Default: 100.
+	RolloutPercentage *float64 `json:"rollout_percentage,omitempty"`
+
+	// MethodSamplingRatios are the fractions of traces to sample for the
+	// requests of the given HTTP methods, e.g. 1.0 for POST and 0.01 for
+	// GET. The requests of the methods not listed are sampled by the
+	// Sampler, which defaults to sampling all of them. If the Sampler is
+	// parent based, the default one included, the requests with a parent
+	// span in their trace context follow its decision whatever their
+	// method; otherwise the ratios override the decision of the parent.
+	MethodSamplingRatios map[string]float64 `json:"method_sampling_ratios,omitempty"`
+
+	// PathSamplingRules are the fractions of traces to sample for the
+	// requests whose path matches a regular expression. The rules are
+	// evaluated in order and the first matching one decides, before the
+	// MethodSamplingRatios; the requests matching no rule are sampled by
+	// the MethodSamplingRatios, then the Sampler. As for the methods, the
+	// rules follow the decision of the parent span if the Sampler is
+	// parent based.
+	PathSamplingRules []PathSamplingRule `json:"path_sampling_rules,omitempty"`
+
+	// HostRedaction hides the requested host from the exported spans,
+	// which may reveal the identity of a tenant in shared environments.
+	// Set to "hash" to replace the http.host and net.host.name attributes
+	// with their HMAC-SHA256 keyed with HostRedactionKey, or "drop" to
+	// remove them.
+	HostRedaction string `json:"host_redaction,omitempty"`
+
+	// HostRedactionKey is the secret key of the host hashes, e.g.
+	// "{env.OTEL_HOST_REDACTION_KEY}", for the hashes of the instances
+	// sharing it to match. Without it, the hosts could be recovered by
+	// hashing a list of candidates. By default, a random key is generated
+	// on startup: the hashes of a host match until Caddy restarts.
+	HostRedactionKey string `json:"host_redaction_key,omitempty"`
+
+	// TruncationStrategy is the way string attributes longer than
+	// TruncationLength are cut: "raw" (default) cuts them at the limit,
+	// "smart" cuts URL attributes such as http.target at the last path or
+	// query boundary that fits, to keep them meaningful.
+	TruncationStrategy string `json:"truncation_strategy,omitempty"`
+
+	// TruncationLength is the maximum length of the string attributes.
+	// Zero, the default, disables the truncation.
+	TruncationLength int `json:"truncation_length,omitempty"`
+
+	// TLSIssuerContextKey is the name of the context key (a caddy.CtxKey)
+	// under which a listener wrapper or an earlier handler stores, as a
+	// string, the issuer of the certificate served for the request, e.g.
+	// the ACME CA or the internal issuer. It is recorded on the HTTPS
+	// requests as the tls.issuer span attribute.
+	TLSIssuerContextKey string `json:"tls_issuer_context_key,omitempty"`
+
+	// QueueEnteredContextKey is the name of the context key (a caddy.CtxKey)
+	// under which a concurrency limiting handler stores, as a time.Time,
+	// the moment the request was queued. The time the request waited
+	// until this handler ran is recorded as the caddy.queue.delay_ms span
+	// attribute.
+	QueueEnteredContextKey string `json:"queue_entered_context_key,omitempty"`
+
+	// TLSHandshakeContextKey is the name of the context key (a caddy.CtxKey)
+	// under which a listener wrapper or an earlier handler stores, as a
+	// time.Duration, the time spent in the TLS handshake of the connection.
+	// It is recorded on the HTTPS requests as the tls.handshake_ms span
+	// attribute.
+	TLSHandshakeContextKey string `json:"tls_handshake_context_key,omitempty"`
+
+	// LogIDContextKey is the name of the context key (a caddy.CtxKey)
+	// under which an earlier handler stores, as a string, the ID it also
+	// adds to the access log entry of the request. It is recorded as the
+	// caddy.log.id span attribute, so that the span is found from the log
+	// entry and the other way around.
+	LogIDContextKey string `json:"log_id_context_key,omitempty"`
+
+	// ALPNOfferedContextKey is the name of the context key (a
+	// caddy.CtxKey) under which a listener wrapper or an earlier handler
+	// stores, as a []string, the application protocols the client offered
+	// in its TLS handshake, most preferred first. Whether the negotiated
+	// protocol is not the one the client preferred, e.g. HTTP/1.1 while
+	// it preferred h2, is recorded on the HTTPS requests as the
+	// caddy.alpn.fallback span attribute.
+	ALPNOfferedContextKey string `json:"alpn_offered_context_key,omitempty"`
+
+	// SpanAttributeValueLengthLimit is the maximum length of the string
+	// attribute values of a span, longer ones are cut at the limit, to
+	// keep the spans within the size accepted by the trace backend.
+	// Zero, the default, leaves the values unlimited.
+	SpanAttributeValueLengthLimit int `json:"span_attribute_value_length_limit,omitempty"`
+
+	// SpanAttributeCountLimit is the maximum number of attributes of a
+	// span, the attributes set beyond it are dropped. Zero, the default,
+	// keeps the limit of the OpenTelemetry SDK.
+	SpanAttributeCountLimit int `json:"span_attribute_count_limit,omitempty"`
+
+	// RequestIDContextKey is the name of the context key (a caddy.CtxKey)
+	// under which an earlier handler stores the ID of the request as a
+	// string. The request ID is recorded as the caddy.request_id span
+	// attribute. Caddy does not generate request IDs itself: without a
+	// handler setting it, the attribute is never recorded.
+	RequestIDContextKey string `json:"request_id_context_key,omitempty"`
+
+	// RequestIDBaggage adds the request ID, stored in the request context
+	// under RequestIDContextKey, as the caddy.request_id baggage member so
+	// that it is propagated with the tracing context.
+	RequestIDBaggage bool `json:"request_id_baggage,omitempty"`
+
+	// HeartbeatInterval is the interval at which a synthetic
+	// "caddy.heartbeat" span is emitted to verify that the spans reach
+	// the collector. The heartbeats are always sampled, and kept whatever
+	// the MinSpanDuration, except with a Provider, whose sampler decides.
+	// The handlers sharing a tracer provider emit a single heartbeat.
+	// Disabled by default.
+	HeartbeatInterval caddy.Duration `json:"heartbeat_interval,omitempty"`
+
+	// DrainTimeout is how long, on cleanup, the spans still queued are
+	// flushed until they are all exported, the spans whose export fails
+	// meanwhile being exported again. By default, the queue is flushed
+	// once, and spans that fail to export are dropped.
+	DrainTimeout caddy.Duration `json:"drain_timeout,omitempty"`
+
+	// ShutdownTimeout bounds the flush and the shutdown of the tracer
+	// provider on cleanup, after the drain if any, so that an unreachable
+	// collector cannot delay the stop of Caddy. Default: 5s.
+	ShutdownTimeout caddy.Duration `json:"shutdown_timeout,omitempty"`
+
+	// MinSpanDuration is the duration under which the spans are dropped
+	// instead of exported, e.g. 1ms to reduce the noise of trivially short
+	// requests. The spans whose status is an error are always exported.
+	// Disabled by default.
+	MinSpanDuration caddy.Duration `json:"min_span_duration,omitempty"`
+
+	// BypassHeader is the name of a request header which, when set to a
+	// true value, lets the client opt out of the tracing of its request.
+	BypassHeader string `json:"bypass_header,omitempty"`
+
+	// ForceSampleHeader is the name of a request header which, when set
+	// to a true value, e.g. `X-Debug-Trace: 1`, samples the span of the
+	// request whatever the sampler, for selective debugging.
+	ForceSampleHeader string `json:"force_sample_header,omitempty"`
+
+	// SkipSampleHeader is the name of a request header which, when set to
+	// a true value, drops the span of the request whatever the sampler.
+	// ForceSampleHeader prevails if both are set.
+	SkipSampleHeader string `json:"skip_sample_header,omitempty"`
+
+	// PerRequestService is resolved for each request, and may thus contain
+	// placeholders, to record the service the request is for as the
+	// peer.service span attribute. Unlike ServiceName, which is stable for
+	// all the spans, it lets a gateway tell apart the services it fronts,
+	// e.g. with `{http.request.uri.path.0}`.
+	PerRequestService string `json:"per_request_service,omitempty"`
+
+	// ResourceAttributes are added to the resource describing the
+	// service, e.g. `deployment.environment`. They take precedence over
+	// the default resource attributes.
+	ResourceAttributes map[string]string `json:"resource_attributes,omitempty"`
+
+	// SetBaggage are the members added to the W3C baggage of the trace
+	// context propagated to the next handlers and upstreams, e.g.
+	// `deployment canary`. They are only propagated by the "baggage"
+	// propagator; a warning is logged if it is not enabled.
+	SetBaggage map[string]string `json:"set_baggage,omitempty"`
+
+	// RecordCacheControl records the Cache-Control header of the response
+	// as the http.response.cache_control span attribute.
+	RecordCacheControl bool `json:"record_cache_control,omitempty"`
+
+	// RecordReceivedAt records the time the request was received, in
+	// RFC 3339 format, as the caddy.request.received_at span attribute,
+	// for the systems correlating requests by a readable time.
+	RecordReceivedAt bool `json:"record_received_at,omitempty"`
+
+	// BaggageAsAttributes records the members of the W3C baggage of the
+	// request, e.g. a tenant set by a client, as span attributes prefixed
+	// with "baggage.". The baggage is only extracted by the "baggage"
+	// propagator.
+	BaggageAsAttributes bool `json:"baggage_as_attributes,omitempty"`
+
+	// BaggageMaxLength is the maximum length of the baggage values recorded
+	// as span attributes, longer ones are truncated. Default: 256.
+	BaggageMaxLength int `json:"baggage_max_length,omitempty"`
+
+	// MissingHost is the http.host span attribute of the requests without
+	// a Host header, e.g. HTTP/1.0 ones, or "drop" to omit the attribute.
+	// By default, an empty http.host is recorded.
+	MissingHost string `json:"missing_host,omitempty"`
+
+	// SpanProcessor is how the spans are handed to the exporter: "batch"
+	// (default) exports them in batches in the background, "simple" exports
+	// each span synchronously when it ends. The simple processor loses no
+	// span on shutdown and makes the export deterministic, at the cost of
+	// the throughput since each request waits for the export of its span;
+	// it suits tests and low volume services.
+	SpanProcessor string `json:"span_processor,omitempty"`
+
+	// SharedProvider, when false, gives the handler a tracer provider of
+	// its own, with its own exporters and batching, instead of sharing one
+	// with the handlers of identical settings. Each dedicated provider
+	// holds its own span queue and export connections, so the memory and
+	// the connections grow with the number of handlers. Default: true.
+	SharedProvider *bool `json:"shared_provider,omitempty"`
+
+	// SkipUnsampled does not start the spans of the requests the sampler
+	// drops, instead of starting unsampled spans which still cost
+	// allocations. The requests are handled as if untraced; it suits high
+	// throughput services sampling a small part of their requests.
+	SkipUnsampled bool `json:"skip_unsampled,omitempty"`
+
+	// ExistingSpan is what to do when the request context already carries
+	// a non-recording span, e.g. started by an upstream library: "child"
+	// (default) starts the span of the request as its child, "replace"
+	// starts a new trace, ignoring it, and "skip" does not trace the
+	// request. With a parent based sampler, the default one, the child of
+	// an unsampled span is not sampled either: it is started but neither
+	// recorded nor exported.
+	ExistingSpan string `json:"existing_span,omitempty"`
+
+	// DuplicateTraceparent is the traceparent header used when a request
+	// has several, e.g. added by different proxies: "first" (default) or
+	// "last". The headers which are not valid W3C traceparents are
+	// ignored; if none is valid, the request starts a new trace.
+	DuplicateTraceparent string `json:"duplicate_traceparent,omitempty"`
+
+	// TrustLevelContextKey is the name of the context key (a caddy.CtxKey)
+	// under which an earlier handler stores the trust level of the request,
+	// as a string or an int. The trust level is recorded as the
+	// security.trust_level span attribute.
+	TrustLevelContextKey string `json:"trust_level_context_key,omitempty"`
+
+	// AuthResultContextKey is the name of the context key (a caddy.CtxKey)
+	// of the outcome of the authentication of the request, e.g. "allowed",
+	// "denied" or "anonymous", recorded as the caddy.auth.result span
+	// attribute once the next handlers completed. The outcome is read from
+	// the context, where an earlier handler stores it, or else from the
+	// request variable of the same name, which the handlers after this one,
+	// such as an authentication handler, can set.
+	AuthResultContextKey string `json:"auth_result_context_key,omitempty"`
+
+	// AuthDeniedError sets the status of the span to error when the
+	// authentication outcome is "denied".
+	AuthDeniedError bool `json:"auth_denied_error,omitempty"`
+
+	// LinkInitiator links the span of an internal request, e.g. a
+	// sub-request a module serves in process, whose context the module
+	// prepared with ContextWithInitiator, to the span which initiated it.
+	LinkInitiator bool `json:"link_initiator,omitempty"`
+
+	// SpanLinks are the request headers carrying the trace contexts, in
+	// the W3C traceparent format and comma separated if several, of other
+	// traces the span is linked to, e.g. the ones of the requests a
+	// gateway batched into this one. The malformed values are skipped.
+	SpanLinks []string `json:"span_links,omitempty"`
+
+	// TraceIDHeader is the name of a response header, e.g. `Trace-Id`, set
+	// to the ID of the trace of the request so that users can report it.
+	// It is only set when the trace is sampled, and thus exported.
+	// Disabled by default.
+	TraceIDHeader string `json:"trace_id_header,omitempty"`
+
+	// TraceIDPrefix is the hex encoded prefix, e.g. `cad0`, of the IDs of
+	// the traces started by the handler, which are otherwise random, so
+	// that they are recognizable, e.g. in integration tests. It must be
+	// shorter than a trace ID, 16 bytes.
+	TraceIDPrefix string `json:"trace_id_prefix,omitempty"`
+
+	// IDGenerator is the generator of the trace and span IDs: "xray"
+	// generates the trace IDs prefixed with their start time expected by
+	// AWS X-Ray, e.g. with the "xray" propagator. The IDs are random by
+	// default. It cannot be used with TraceIDPrefix.
+	IDGenerator string `json:"id_generator,omitempty"`
+
+	// RecordTrailers are the names of the response trailers, e.g.
+	// `grpc-status`, recorded as the http.response.trailer.<name> span
+	// attributes once the response is complete.
+	RecordTrailers []string `json:"record_trailers,omitempty"`
+
+	// CaptureClientIP records the IP address of the client as the
+	// net.peer.ip and client.address span attributes. This is the address
+	// of the peer of the connection: behind a proxy, it is the one of the
+	// proxy. Disabled by default, for privacy.
+	CaptureClientIP bool `json:"capture_client_ip,omitempty"`
+
+	// ServerName is the name of the server block the handler is in,
+	// recorded as the caddy.server span attribute to tell which one handled
+	// the request. It may contain the global placeholders, e.g. "{env.SITE}",
+	// resolved when the handler is provisioned.
+	ServerName string `json:"server_name,omitempty"`
+
+	// IPEnricherRaw is the module looking up attributes of the client IP
+	// address, e.g. its country from a GeoIP database, recorded on the
+	// spans. It is asked only for the recorded spans, and its results are
+	// cached for a minute.
+	IPEnricherRaw json.RawMessage `json:"ip_enricher,omitempty" caddy:"namespace=http.handlers.opentelemetry.ip_enrichers inline_key=enricher"`
+
+	// CaptureBodySizes records the Content-Length of the request as the
+	// http.request_content_length span attribute, and the number of bytes
+	// of the response body written as http.response_content_length. The
+	// bodies themselves are never recorded.
+	CaptureBodySizes bool `json:"capture_body_sizes,omitempty"`
+
+	// ExcludePaths are the paths of the requests not traced, e.g. the
+	// ones of the health checks. A path ending with `*` is a prefix:
+	// `/healthz` excludes only this path, `/internal/*` all the paths
+	// under /internal/.
+	ExcludePaths []string `json:"exclude_paths,omitempty"`
+
+	// SpanEvents adds the "request.start" event to the span when the
+	// request is passed to the next handler, and the "response.written"
+	// event, with the number of bytes written, once it has responded.
+	SpanEvents bool `json:"span_events,omitempty"`
+
+	// Metrics, if set, enables the export over OTLP of the count and the
+	// duration of the requests, with the exporter settings of the spans,
+	// along with the number of tracer providers shared by the handlers and
+	// of their users.
+	Metrics *Metrics `json:"metrics,omitempty"`
+
+	// otel implements the OpenTelemetry related logic.
+	otel openTelemetryWrapper
+
+	logger *zap.Logger
+}
+
+// Metrics configures the request metrics.
+type Metrics struct {
+	// CollectPeriod is the interval at which the metrics are collected
+	// and exported. Default: 10s.
+	CollectPeriod caddy.Duration `json:"collect_period,omitempty"`
+}
+
+// ExporterRetry configures the retries, with an exponential backoff, of
+// the exports which failed with a retryable error.
+type ExporterRetry struct {
+	// Enabled enables the retries, disabled if false.
+	Enabled bool `json:"enabled,omitempty"`
+
+	// InitialInterval is the time to wait before the first retry.
+	InitialInterval caddy.Duration `json:"initial_interval,omitempty"`
+
+	// MaxInterval is the upper bound of the time between two retries.
+	// It must not be less than InitialInterval.
+	MaxInterval caddy.Duration `json:"max_interval,omitempty"`
+
+	// MaxElapsedTime is the time after which the export is given up,
+	// retries included.
+	MaxElapsedTime caddy.Duration `json:"max_elapsed_time,omitempty"`
+}
+
+// validate checks that the intervals of the retries are consistent.
+func (r ExporterRetry) validate() error {
+	if r.InitialInterval < 0 || r.MaxInterval < 0 || r.MaxElapsedTime < 0 {
+		return fmt.Errorf("exporter retry durations must not be negative")
+	}
+	if r.MaxInterval < r.InitialInterval {
+		return fmt.Errorf("exporter retry max_interval %v must not be less than initial_interval %v",
+			time.Duration(r.MaxInterval), time.Duration(r.InitialInterval))
+	}
+	return nil
+}
+
+// PathSamplingRule is the fraction of traces to sample for the requests
+// whose path matches a regular expression.
+type PathSamplingRule struct {
+	// Regexp is the regular expression matched against the path of the
+	// request, without its query.
+	Regexp string `json:"regexp"`
+
+	// Ratio is the fraction of traces to sample, from 0.0 to 1.0.
+	Ratio float64 `json:"ratio"`
+}
+
+// CaddyModule returns the Caddy module information.
+func (OpenTelemetry) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.opentelemetry",
+		New: func() caddy.Module { return new(OpenTelemetry) },
+	}
+}
+
+// Provision implements caddy.Provisioner.
+func (ot *OpenTelemetry) Provision(ctx caddy.Context) error {
+	ot.logger = ctx.Logger(ot)
+
+	if ot.SamplingRatio != nil && (*ot.SamplingRatio < 0 || *ot.SamplingRatio > 1) {
+		return fmt.Errorf("sampling ratio must be between 0.0 and 1.0, got %v", *ot.SamplingRatio)
+	}
+	if ot.ClientSamplingRatio != nil && (*ot.ClientSamplingRatio < 0 || *ot.ClientSamplingRatio > 1) {
+		return fmt.Errorf("client sampling ratio must be between 0.0 and 1.0, got %v", *ot.ClientSamplingRatio)
+	}
+	if ot.TracesPerSecond < 0 {
+		return fmt.Errorf("traces per second must not be negative, got %v", ot.TracesPerSecond)
+	}
+	if ot.TargetSpansPerSecond < 0 {
+		return fmt.Errorf("target spans per second must not be negative, got %v", ot.TargetSpansPerSecond)
+	}
+	if ot.RolloutPercentage != nil && (*ot.RolloutPercentage < 0 || *ot.RolloutPercentage > 100) {
+		return fmt.Errorf("rollout percentage must be between 0 and 100, got %v", *ot.RolloutPercentage)
+	}
+	if ot.Provider != "" {
+		if settings := ot.providerSettings(); len(settings) > 0 {
+			return fmt.Errorf("the handler uses provider '%s', it cannot set %s", ot.Provider, strings.Join(settings, ", "))
+		}
+	}
+
+	if (ot.ExporterClientCertificate == "") != (ot.ExporterClientKey == "") {
+		return fmt.Errorf("exporter client certificate and key must be set together")
+	}
+	if ot.ExporterRetry != nil {
+		if err := ot.ExporterRetry.validate(); err != nil {
+			return err
+		}
+	}
+
+	if len(ot.SetBaggage) > 0 && !propagatorEnabled(ot.Propagators, "baggage") {
+		ot.logger.Warn("set_baggage has no effect without the baggage propagator",
+			zap.String("propagators", ot.Propagators))
+	}
+
+	insecure, err := parseExporterInsecure(ot.ExporterInsecure)
+	if err != nil {
+		return err
+	}
+
+	var ipEnricher IPEnricher
+	if ot.IPEnricherRaw != nil {
+		mod, err := ctx.LoadModule(ot, "IPEnricherRaw")
+		if err != nil {
+			return fmt.Errorf("loading IP enricher: %v", err)
+		}
+		ipEnricher = mod.(IPEnricher)
+	}
+
+	cfg := tracerConfig{
+		spanName:       ot.SpanName,
+		spanNameSource: ot.SpanNameSource,
+		routePattern:   ot.RoutePattern,
+		serviceName:    ot.ServiceName,
+		serviceVersion: ot.ServiceVersion,
+		propagators:    ot.Propagators,
+		sampler:        ot.Sampler,
+		samplingRatio:  ot.SamplingRatio,
+		hostRedaction:  ot.HostRedaction,
+		logger:         ot.logger,
+
+		spanNameFromResponseHeader: ot.SpanNameFromResponseHeader,
+
+		tracesPerSecond: ot.TracesPerSecond,
+		maxServiceNames: ot.MaxServiceNames,
+
+		methodSamplingRatios: ot.MethodSamplingRatios,
+		pathSamplingRules:    ot.PathSamplingRules,
+		targetSpansPerSecond: ot.TargetSpansPerSecond,
+		hostRedactionKey:     []byte(caddy.NewReplacer().ReplaceAll(ot.HostRedactionKey, "")),
+		tlsIssuerCtxKey:      caddy.CtxKey(ot.TLSIssuerContextKey),
+		queueEnteredCtxKey:   caddy.CtxKey(ot.QueueEnteredContextKey),
+		tlsHandshakeCtxKey:   caddy.CtxKey(ot.TLSHandshakeContextKey),
+		logIDCtxKey:          caddy.CtxKey(ot.LogIDContextKey),
+		alpnOfferedCtxKey:    caddy.CtxKey(ot.ALPNOfferedContextKey),
+
+		truncationStrategy: ot.TruncationStrategy,
+		truncationLength:   ot.TruncationLength,
+
+		spanAttributeValueLengthLimit: ot.SpanAttributeValueLengthLimit,
+		spanAttributeCountLimit:       ot.SpanAttributeCountLimit,
+
+		requestIDCtxKey:   caddy.CtxKey(ot.RequestIDContextKey),
+		requestIDBaggage:  ot.RequestIDBaggage,
+		heartbeatInterval: time.Duration(ot.HeartbeatInterval),
+		drainTimeout:      time.Duration(ot.DrainTimeout),
+		shutdownTimeout:   time.Duration(ot.ShutdownTimeout),
+		minSpanDuration:   time.Duration(ot.MinSpanDuration),
+		bypassHeader:      ot.BypassHeader,
+		forceSampleHeader: ot.ForceSampleHeader,
+		skipSampleHeader:  ot.SkipSampleHeader,
+		perRequestService: ot.PerRequestService,
+
+		resourceAttributes: ot.ResourceAttributes,
+		setBaggage:         ot.SetBaggage,
+		recordCacheControl: ot.RecordCacheControl,
+		recordReceivedAt:   ot.RecordReceivedAt,
+
+		baggageAsAttributes:  ot.BaggageAsAttributes,
+		baggageMaxLength:     ot.BaggageMaxLength,
+		missingHost:          ot.MissingHost,
+		spanProcessor:        ot.SpanProcessor,
+		dedicatedProvider:    ot.SharedProvider != nil && !*ot.SharedProvider,
+		existingSpan:         ot.ExistingSpan,
+		duplicateTraceparent: ot.DuplicateTraceparent,
+		skipUnsampled:        ot.SkipUnsampled,
+		trustLevelCtxKey:     caddy.CtxKey(ot.TrustLevelContextKey),
+		authResultCtxKey:     caddy.CtxKey(ot.AuthResultContextKey),
+		authDeniedError:      ot.AuthDeniedError,
+		linkInitiator:        ot.LinkInitiator,
+		spanLinks:            ot.SpanLinks,
+
+		clientSamplingRatio: ot.ClientSamplingRatio,
+		rolloutPercentage:   ot.RolloutPercentage,
+		spanEvents:          ot.SpanEvents,
+		traceIDHeader:       ot.TraceIDHeader,
+		traceIDPrefix:       ot.TraceIDPrefix,
+		idGenerator:         ot.IDGenerator,
+		trailers:            ot.RecordTrailers,
+		captureClientIP:     ot.CaptureClientIP,
+		serverName:          caddy.NewReplacer().ReplaceAll(ot.ServerName, ""),
+		ipEnricher:          ipEnricher,
+		captureBodySizes:    ot.CaptureBodySizes,
+		excludePaths:        ot.ExcludePaths,
+		exporter: tracerExporterConfig{
+			endpoint:    ot.ExporterTracesEndpoint,
+			protocol:    ot.ExporterTracesProtocol,
+			certificate: ot.ExporterCertificate,
+			headers:     ot.ExporterHeaders,
+			timeout:     time.Duration(ot.ExporterTimeout),
+			compression: ot.ExporterCompression,
+
+			clientCertificate: ot.ExporterClientCertificate,
+			clientKey:         ot.ExporterClientKey,
+			tlsSkipVerify:     ot.ExporterTLSSkipVerify,
+			serverName:        ot.ExporterServerNameOverride,
+			failoverEndpoints: ot.ExporterFailoverEndpoints,
+			genericEndpoint:   ot.ExporterEndpoint,
+			retry:             ot.ExporterRetry,
+			stdoutFile:        ot.ExporterStdoutFile,
+			insecure:          insecure,
+
+			failoverRetryInterval: time.Duration(ot.ExporterFailoverRetryInterval),
+		},
+	}
+	if ot.Metrics != nil {
+		cfg.metrics = true
+		cfg.metricsCollectPeriod = time.Duration(ot.Metrics.CollectPeriod)
+	}
+
+	if ot.Provider != "" {
+		appIface, err := ctx.App("otel")
+		if err != nil {
+			return fmt.Errorf("getting otel app: %v", err)
+		}
+		app := appIface.(*App)
+		cfg.tracerProvider, err = app.TracerProvider(ot.Provider)
+		if err != nil {
+			return err
+		}
+		// the meter provider is only created for the handlers recording metrics
+		if cfg.metrics {
+			cfg.meterProvider, err = app.MeterProvider(ot.Provider)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	ot.otel, err = newOpenTelemetryWrapper(ctx, cfg)
+
+	return err
+}
+
+// parseExporterInsecure parses the exporter_insecure setting, which falls
+// back to the environment.
+func parseExporterInsecure(value string) (bool, error) {
+	if value == "" {
+		value = getEnv(envExporterTracesInsecure, envExporterInsecure)
+	}
+	if value == "" {
+		return false, nil
+	}
+	insecure, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("parsing exporter_insecure %q: %v", value, err)
+	}
+	return insecure, nil
+}
+
+// Cleanup implements caddy.CleanerUpper and closes any idle connections. It
+// calls Shutdown method for a trace provider https://github.com/open-telemetry/opentelemetry-specification/blob/main/specification/trace/sdk.md#shutdown.
+func (ot *OpenTelemetry) Cleanup() error {
+	if err := ot.otel.cleanup(ot.logger); err != nil {
+		return fmt.Errorf("tracerProvider shutdown: %w", err)
+	}
+	return nil
+}
+
+// ServeHTTP implements caddyhttp.MiddlewareHandler.
+func (ot *OpenTelemetry) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	return ot.otel.ServeHTTP(w, r, next)
+}
+
+// UnmarshalCaddyfile sets up the module from Caddyfile tokens. Syntax:
+//
+//     opentelemetry [<matcher>] [<protocol> [<endpoint>]] {
+//         span_name                   <name>
+//         span_name_source            static|route|method...
+//         route_pattern               <pattern>
+//         span_name_from_response_header <header>
+//         service_name                <name>
+//         service_version             <version>
+//         provider                    <name>
+//         max_service_names           <count>
+//         exporter_traces_endpoint    <endpoint>
+//         exporter_endpoint           <endpoint>
+//         exporter_traces_protocol    grpc|http/protobuf|stdout[,...]
+//         exporter_stdout_file        <path>
+//         exporter_failover_endpoints <endpoints...>
+//         exporter_failover_retry_interval <duration>
+//         exporter_certificate        <path>
+//         exporter_client_certificate <path>
+//         exporter_client_key         <path>
+//         exporter_tls_skip_verify
+//         exporter_server_name_override <name>
+//         exporter_headers {
+//             <name> <value>
+//         }
+//         exporter_insecure           <bool>
+//         exporter_timeout            <duration>
+//         exporter_retry {
+//             enabled          <bool>
+//             initial_interval <duration>
+//             max_interval     <duration>
+//             max_elapsed_time <duration>
+//         }
+//         exporter_compression        gzip|none
+//         propagators                 <list>
+//         sampler                     <name>
+//         sampling_ratio              <ratio>
+//         traces_per_second           <traces>
+//         client_sampling_ratio       <ratio>
+//         target_spans_per_second     <spans>
+//         rollout_percentage          <percentage>
+//         method_sampling_ratios {
+//             <method> <ratio>
+//         }
+//         path_sampling               <regexp> <ratio>
+//         host_redaction              hash|drop
+//         host_redaction_key          <key>
+//         truncation_strategy         raw|smart
+//         truncation_length           <length>
+//         tls_issuer_context_key      <key>
+//         queue_entered_context_key   <key>
+//         tls_handshake_context_key   <key>
+//         log_id_context_key          <key>
+//         alpn_offered_context_key    <key>
+//         request_id_context_key      <key>
+//         span_attribute_value_length_limit <length>
+//         span_attribute_count_limit  <count>
+//         request_id_baggage
+//         heartbeat_interval          <duration>
+//         drain_timeout               <duration>
+//         shutdown_timeout            <duration>
+//         min_span_duration           <duration>
+//         bypass_header               <header>
+//         force_sample_header         <header>
+//         skip_sample_header          <header>
+//         per_request_service         <service>
+//         resource_attributes {
+//             <key> <value>
+//         }
+//         set_baggage {
+//             <key> <value>
+//         }
+//         record_cache_control
+//         record_received_at
+//         baggage_as_attributes       [<max_length>]
+//         missing_host                <host>|drop
+//         span_processor              batch|simple
+//         shared_provider             <bool>
+//         existing_span               child|replace|skip
+//         duplicate_traceparent       first|last
+//         skip_unsampled
+//         trust_level_context_key     <key>
+//         auth_result_context_key     <key>
+//         auth_denied_error
+//         link_initiator
+//         span_links                  <headers...>
+//         trace_id_header             <header>
+//         trace_id_prefix             <hex>
+//         id_generator                xray
+//         record_trailers             <trailers...>
+//         capture_client_ip
+//         server_name                 <name>
+//         ip_enricher                 <module> ...
+//         capture_body_sizes
+//         exclude_paths               <paths...>
+//         span_events
+//         metrics {
+//             collect_period <duration>
+//         }
+//     }
+//
+// The protocol and the endpoint of the exporter may be given as arguments,
+// e.g. `opentelemetry grpc localhost:4317`, without a block; they cannot be
+// set again in the block.
+func (ot *OpenTelemetry) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	setParameter := func(d *caddyfile.Dispenser, val *string) error {
+		if d.NextArg() {
+			*val = d.Val()
+		} else {
+			return d.ArgErr()
+		}
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		return nil
+	}
+
+	// setKeyValues sets the key/value pairs of the block of the current subdirective into dst
+	setKeyValues := func(d *caddyfile.Dispenser, dst map[string]string) error {
+		subdirective := d.Val()
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		for nesting := d.Nesting(); d.NextBlock(nesting); {
+			key := d.Val()
+			var value string
+			if err := setParameter(d, &value); err != nil {
+				return err
+			}
+			if key == "" || value == "" {
+				return d.Errf("%s must have a non-empty key and value", subdirective)
+			}
+			dst[key] = value
+		}
+		return nil
+	}
+
+	// paramsMap is a mapping between "string" parameter from the Caddyfile and its destination within the module
+	paramsMap := map[string]*string{
+		"span_name":                     &ot.SpanName,
+		"route_pattern":                 &ot.RoutePattern,
+		"service_name":                  &ot.ServiceName,
+		"service_version":               &ot.ServiceVersion,
+		"provider":                      &ot.Provider,
+		"exporter_traces_endpoint":      &ot.ExporterTracesEndpoint,
+		"exporter_endpoint":             &ot.ExporterEndpoint,
+		"exporter_traces_protocol":      &ot.ExporterTracesProtocol,
+		"exporter_stdout_file":          &ot.ExporterStdoutFile,
+		"exporter_certificate":          &ot.ExporterCertificate,
+		"exporter_client_certificate":   &ot.ExporterClientCertificate,
+		"exporter_client_key":           &ot.ExporterClientKey,
+		"exporter_server_name_override": &ot.ExporterServerNameOverride,
+		"exporter_insecure":             &ot.ExporterInsecure,
+		"exporter_compression":          &ot.ExporterCompression,
+		"sampler":                       &ot.Sampler,
+		"host_redaction":                &ot.HostRedaction,
+		"host_redaction_key":            &ot.HostRedactionKey,
+		"truncation_strategy":           &ot.TruncationStrategy,
+		"tls_issuer_context_key":        &ot.TLSIssuerContextKey,
+		"queue_entered_context_key":     &ot.QueueEnteredContextKey,
+		"tls_handshake_context_key":     &ot.TLSHandshakeContextKey,
+		"log_id_context_key":            &ot.LogIDContextKey,
+		"alpn_offered_context_key":      &ot.ALPNOfferedContextKey,
+		"request_id_context_key":        &ot.RequestIDContextKey,
+		"bypass_header":                 &ot.BypassHeader,
+		"force_sample_header":           &ot.ForceSampleHeader,
+		"skip_sample_header":            &ot.SkipSampleHeader,
+		"per_request_service":           &ot.PerRequestService,
+		"missing_host":                  &ot.MissingHost,
+		"span_processor":                &ot.SpanProcessor,
+		"existing_span":                 &ot.ExistingSpan,
+		"duplicate_traceparent":         &ot.DuplicateTraceparent,
+		"trust_level_context_key":       &ot.TrustLevelContextKey,
+		"auth_result_context_key":       &ot.AuthResultContextKey,
+		"trace_id_header":               &ot.TraceIDHeader,
+		"server_name":                   &ot.ServerName,
+		"trace_id_prefix":               &ot.TraceIDPrefix,
+		"id_generator":                  &ot.IDGenerator,
+
+		"span_name_from_response_header": &ot.SpanNameFromResponseHeader,
+	}
+
+	for d.Next() {
+		// the shorthand form, e.g. `opentelemetry grpc localhost:4317`, sets the exporter
+		args := d.RemainingArgs()
+		if len(args) > 2 {
+			return d.ArgErr()
+		}
+		shorthand := make(map[string]bool)
+		if len(args) > 0 {
+			ot.ExporterTracesProtocol = args[0]
+			shorthand["exporter_traces_protocol"] = true
+		}
+		if len(args) > 1 {
+			ot.ExporterTracesEndpoint = args[1]
+			shorthand["exporter_traces_endpoint"] = true
+		}
+
+		for d.NextBlock(0) {
+			if shorthand[d.Val()] {
+				return d.Errf("%s is already set by the arguments of the directive", d.Val())
+			}
+			if dst, ok := paramsMap[d.Val()]; ok {
+				if err := setParameter(d, dst); err != nil {
+					return err
+				}
+				continue
+			}
+
+			switch d.Val() {
+			case "sampling_ratio", "client_sampling_ratio":
+				subdirective := d.Val()
+				var ratioStr string
+				if err := setParameter(d, &ratioStr); err != nil {
+					return err
+				}
+				ratio, err := strconv.ParseFloat(ratioStr, 64)
+				if err != nil {
+					return d.Errf("parsing %s: %v", subdirective, err)
+				}
+				if ratio < 0 || ratio > 1 {
+					return d.Errf("%s must be between 0.0 and 1.0, got %v", subdirective, ratio)
+				}
+				if subdirective == "sampling_ratio" {
+					ot.SamplingRatio = &ratio
+				} else {
+					ot.ClientSamplingRatio = &ratio
+				}
+			case "target_spans_per_second", "traces_per_second":
+				subdirective := d.Val()
+				var targetStr string
+				if err := setParameter(d, &targetStr); err != nil {
+					return err
+				}
+				target, err := strconv.ParseFloat(targetStr, 64)
+				if err != nil {
+					return d.Errf("parsing %s: %v", subdirective, err)
+				}
+				if target <= 0 {
+					return d.Errf("%s must be positive, got %v", subdirective, target)
+				}
+				if subdirective == "target_spans_per_second" {
+					ot.TargetSpansPerSecond = target
+				} else {
+					ot.TracesPerSecond = target
+				}
+			case "rollout_percentage":
+				var percentageStr string
+				if err := setParameter(d, &percentageStr); err != nil {
+					return err
+				}
+				percentage, err := strconv.ParseFloat(percentageStr, 64)
+				if err != nil {
+					return d.Errf("parsing rollout_percentage: %v", err)
+				}
+				if percentage < 0 || percentage > 100 {
+					return d.Errf("rollout_percentage must be between 0 and 100, got %v", percentage)
+				}
+				ot.RolloutPercentage = &percentage
+			case "truncation_length", "span_attribute_value_length_limit", "span_attribute_count_limit", "max_service_names":
+				subdirective := d.Val()
+				var lengthStr string
+				if err := setParameter(d, &lengthStr); err != nil {
+					return err
+				}
+				length, err := strconv.Atoi(lengthStr)
+				if err != nil {
+					return d.Errf("parsing %s: %v", subdirective, err)
+				}
+				if length < 0 {
+					return d.Errf("%s must not be negative, got %d", subdirective, length)
+				}
+				switch subdirective {
+				case "truncation_length":
+					ot.TruncationLength = length
+				case "span_attribute_value_length_limit":
+					ot.SpanAttributeValueLengthLimit = length
+				case "span_attribute_count_limit":
+					ot.SpanAttributeCountLimit = length
+				case "max_service_names":
+					ot.MaxServiceNames = length
+				}
+			case "request_id_baggage":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				ot.RequestIDBaggage = true
+			case "metrics":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				ot.Metrics = new(Metrics)
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					switch d.Val() {
+					case "collect_period":
+						var periodStr string
+						if err := setParameter(d, &periodStr); err != nil {
+							return err
+						}
+						period, err := caddy.ParseDuration(periodStr)
+						if err != nil {
+							return d.Errf("bad duration value %s: %v", periodStr, err)
+						}
+						ot.Metrics.CollectPeriod = caddy.Duration(period)
+					default:
+						return d.Errf("unrecognized metrics subdirective '%s'", d.Val())
+					}
+				}
+			case "ip_enricher":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				name := d.Val()
+				unm, err := caddyfile.UnmarshalModule(d, "http.handlers.opentelemetry.ip_enrichers."+name)
+				if err != nil {
+					return err
+				}
+				enricher, ok := unm.(IPEnricher)
+				if !ok {
+					return d.Errf("module %s (%T) is not an IP enricher", name, unm)
+				}
+				ot.IPEnricherRaw = caddyconfig.JSONModuleObject(enricher, "enricher", name, nil)
+			case "exporter_retry":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				ot.ExporterRetry = new(ExporterRetry)
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					subdirective := d.Val()
+					var value string
+					if err := setParameter(d, &value); err != nil {
+						return err
+					}
+					if subdirective == "enabled" {
+						enabled, err := strconv.ParseBool(value)
+						if err != nil {
+							return d.Errf("bad boolean value %s: %v", value, err)
+						}
+						ot.ExporterRetry.Enabled = enabled
+						continue
+					}
+					dur, err := caddy.ParseDuration(value)
+					if err != nil {
+						return d.Errf("bad duration value %s: %v", value, err)
+					}
+					switch subdirective {
+					case "initial_interval":
+						ot.ExporterRetry.InitialInterval = caddy.Duration(dur)
+					case "max_interval":
+						ot.ExporterRetry.MaxInterval = caddy.Duration(dur)
+					case "max_elapsed_time":
+						ot.ExporterRetry.MaxElapsedTime = caddy.Duration(dur)
+					default:
+						return d.Errf("unrecognized exporter_retry subdirective '%s'", subdirective)
+					}
+				}
+				if err := ot.ExporterRetry.validate(); err != nil {
+					return d.Err(err.Error())
+				}
+			case "exporter_tls_skip_verify":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				ot.ExporterTLSSkipVerify = true
+			case "method_sampling_ratios":
+				ratios := make(map[string]string)
+				if err := setKeyValues(d, ratios); err != nil {
+					return err
+				}
+				if ot.MethodSamplingRatios == nil {
+					ot.MethodSamplingRatios = make(map[string]float64)
+				}
+				for method, ratioStr := range ratios {
+					ratio, err := strconv.ParseFloat(ratioStr, 64)
+					if err != nil {
+						return d.Errf("parsing sampling ratio of method %s: %v", method, err)
+					}
+					if ratio < 0 || ratio > 1 {
+						return d.Errf("sampling ratio of method %s must be between 0.0 and 1.0, got %v", method, ratio)
+					}
+					ot.MethodSamplingRatios[strings.ToUpper(method)] = ratio
+				}
+			case "path_sampling":
+				args := d.RemainingArgs()
+				if len(args) != 2 {
+					return d.ArgErr()
+				}
+				if _, err := regexp.Compile(args[0]); err != nil {
+					return d.Errf("compiling path sampling regexp %q: %v", args[0], err)
+				}
+				ratio, err := strconv.ParseFloat(args[1], 64)
+				if err != nil {
+					return d.Errf("parsing sampling ratio of path %q: %v", args[0], err)
+				}
+				if ratio < 0 || ratio > 1 {
+					return d.Errf("sampling ratio of path %q must be between 0.0 and 1.0, got %v", args[0], ratio)
+				}
+				ot.PathSamplingRules = append(ot.PathSamplingRules, PathSamplingRule{Regexp: args[0], Ratio: ratio})
+			case "span_links":
+				headers := d.RemainingArgs()
+				if len(headers) == 0 {
+					return d.ArgErr()
+				}
+				ot.SpanLinks = append(ot.SpanLinks, headers...)
+			case "record_trailers":
+				trailers := d.RemainingArgs()
+				if len(trailers) == 0 {
+					return d.ArgErr()
+				}
+				ot.RecordTrailers = append(ot.RecordTrailers, trailers...)
+			case "exporter_failover_endpoints":
+				endpoints := d.RemainingArgs()
+				if len(endpoints) == 0 {
+					return d.ArgErr()
+				}
+				ot.ExporterFailoverEndpoints = append(ot.ExporterFailoverEndpoints, endpoints...)
+			case "propagators":
+				if err := setParameter(d, &ot.Propagators); err != nil {
+					return err
+				}
+				// reject a typo with the line number, Provision checks them again
+				if _, err := getPropagators(ot.Propagators); err != nil {
+					return d.Errf("parsing propagators: %v", err)
+				}
+			case "shared_provider":
+				var value string
+				if err := setParameter(d, &value); err != nil {
+					return err
+				}
+				shared, err := strconv.ParseBool(value)
+				if err != nil {
+					return d.Errf("bad boolean value %s: %v", value, err)
+				}
+				ot.SharedProvider = &shared
+			case "span_name_source":
+				sources := d.RemainingArgs()
+				if len(sources) == 0 {
+					return d.ArgErr()
+				}
+				ot.SpanNameSource = strings.Join(sources, ",")
+				if _, err := parseSpanNameSources(ot.SpanNameSource); err != nil {
+					return d.Errf("parsing span_name_source: %v", err)
+				}
+			case "exclude_paths":
+				paths := d.RemainingArgs()
+				if len(paths) == 0 {
+					return d.ArgErr()
+				}
+				for _, path := range paths {
+					if err := validateExcludePath(path); err != nil {
+						return d.Errf("parsing exclude_paths: %v", err)
+					}
+				}
+				ot.ExcludePaths = append(ot.ExcludePaths, paths...)
+			case "skip_unsampled":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				ot.SkipUnsampled = true
+			case "auth_denied_error":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				ot.AuthDeniedError = true
+			case "link_initiator":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				ot.LinkInitiator = true
+			case "capture_client_ip":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				ot.CaptureClientIP = true
+			case "capture_body_sizes":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				ot.CaptureBodySizes = true
+			case "span_events":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				ot.SpanEvents = true
+			case "record_cache_control":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				ot.RecordCacheControl = true
+			case "baggage_as_attributes":
+				ot.BaggageAsAttributes = true
+				if d.NextArg() {
+					length, err := strconv.Atoi(d.Val())
+					if err != nil {
+						return d.Errf("parsing baggage_as_attributes max length: %v", err)
+					}
+					if length <= 0 {
+						return d.Errf("baggage_as_attributes max length must be positive, got %d", length)
+					}
+					ot.BaggageMaxLength = length
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "record_received_at":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				ot.RecordReceivedAt = true
+			case "heartbeat_interval", "drain_timeout", "shutdown_timeout", "min_span_duration", "exporter_timeout", "exporter_failover_retry_interval":
+				subdirective := d.Val()
+				var durStr string
+				if err := setParameter(d, &durStr); err != nil {
+					return err
+				}
+				dur, err := caddy.ParseDuration(durStr)
+				if err != nil {
+					return d.Errf("bad duration value %s: %v", durStr, err)
+				}
+				switch subdirective {
+				case "heartbeat_interval":
+					ot.HeartbeatInterval = caddy.Duration(dur)
+				case "drain_timeout":
+					ot.DrainTimeout = caddy.Duration(dur)
+				case "shutdown_timeout":
+					ot.ShutdownTimeout = caddy.Duration(dur)
+				case "min_span_duration":
+					ot.MinSpanDuration = caddy.Duration(dur)
+				case "exporter_timeout":
+					ot.ExporterTimeout = caddy.Duration(dur)
+				case "exporter_failover_retry_interval":
+					ot.ExporterFailoverRetryInterval = caddy.Duration(dur)
+				}
+			case "resource_attributes":
+				if ot.ResourceAttributes == nil {
+					ot.ResourceAttributes = make(map[string]string)
+				}
+				if err := setKeyValues(d, ot.ResourceAttributes); err != nil {
+					return err
+				}
+			case "set_baggage":
+				if ot.SetBaggage == nil {
+					ot.SetBaggage = make(map[string]string)
+				}
+				if err := setKeyValues(d, ot.SetBaggage); err != nil {
+					return err
+				}
+			case "exporter_headers":
+				if ot.ExporterHeaders == nil {
+					ot.ExporterHeaders = make(map[string]string)
+				}
+				if err := setKeyValues(d, ot.ExporterHeaders); err != nil {
+					return err
+				}
+			default:
+				return d.Errf("unrecognized subdirective '%s'", d.Val())
+			}
+		}
+	}
+	return nil
+}
+
+func parseCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+	var m OpenTelemetry
+	err := m.UnmarshalCaddyfile(h.Dispenser)
+	if err != nil {
+		return nil, err
+	}
+	if defaults, ok := h.Option("opentelemetry").(*OpenTelemetry); ok {
+		m.inheritDefaults(defaults)
+	}
+	return &m, nil
+}
+
+// providerSettings returns the names of the settings set on the handler
+// which configure the tracer provider it builds, so that a provider of
+// the otel app would ignore them.
+func (ot *OpenTelemetry) providerSettings() []string {
+	settings := []struct {
+		name string
+		set  bool
+	}{
+		{"service_name", ot.ServiceName != ""},
+		{"max_service_names", ot.MaxServiceNames != 0},
+		{"service_version", ot.ServiceVersion != ""},
+		{"exporter_traces_endpoint", ot.ExporterTracesEndpoint != ""},
+		{"exporter_endpoint", ot.ExporterEndpoint != ""},
+		{"exporter_failover_endpoints", len(ot.ExporterFailoverEndpoints) > 0},
+		{"exporter_failover_retry_interval", ot.ExporterFailoverRetryInterval != 0},
+		{"exporter_traces_protocol", ot.ExporterTracesProtocol != ""},
+		{"exporter_stdout_file", ot.ExporterStdoutFile != ""},
+		{"exporter_certificate", ot.ExporterCertificate != ""},
+		{"exporter_client_certificate", ot.ExporterClientCertificate != ""},
+		{"exporter_client_key", ot.ExporterClientKey != ""},
+		{"exporter_tls_skip_verify", ot.ExporterTLSSkipVerify},
+		{"exporter_server_name_override", ot.ExporterServerNameOverride != ""},
+		{"exporter_headers", len(ot.ExporterHeaders) > 0},
+		{"exporter_timeout", ot.ExporterTimeout != 0},
+		{"exporter_retry", ot.ExporterRetry != nil},
+		{"exporter_compression", ot.ExporterCompression != ""},
+		{"exporter_insecure", ot.ExporterInsecure != ""},
+		{"sampler", ot.Sampler != ""},
+		{"sampling_ratio", ot.SamplingRatio != nil},
+		{"traces_per_second", ot.TracesPerSecond != 0},
+		{"target_spans_per_second", ot.TargetSpansPerSecond != 0},
+		{"method_sampling_ratios", len(ot.MethodSamplingRatios) > 0},
+		{"path_sampling_rules", len(ot.PathSamplingRules) > 0},
+		{"force_sample_header", ot.ForceSampleHeader != ""},
+		{"skip_sample_header", ot.SkipSampleHeader != ""},
+		{"skip_unsampled", ot.SkipUnsampled},
+		{"host_redaction", ot.HostRedaction != ""},
+		{"host_redaction_key", ot.HostRedactionKey != ""},
+		{"truncation_strategy", ot.TruncationStrategy != ""},
+		{"truncation_length", ot.TruncationLength != 0},
+		{"span_attribute_value_length_limit", ot.SpanAttributeValueLengthLimit != 0},
+		{"span_attribute_count_limit", ot.SpanAttributeCountLimit != 0},
+		{"drain_timeout", ot.DrainTimeout != 0},
+		{"shutdown_timeout", ot.ShutdownTimeout != 0},
+		{"min_span_duration", ot.MinSpanDuration != 0},
+		{"resource_attributes", len(ot.ResourceAttributes) > 0},
+		{"span_processor", ot.SpanProcessor != ""},
+		{"shared_provider", ot.SharedProvider != nil},
+		{"trace_id_prefix", ot.TraceIDPrefix != ""},
+		{"id_generator", ot.IDGenerator != ""},
+		{"metrics.collect_period", ot.Metrics != nil && ot.Metrics.CollectPeriod != 0},
+	}
+
+	var names []string
+	for _, setting := range settings {
+		if setting.set {
+			names = append(names, setting.name)
+		}
+	}
+	return names
+}
+
+// parseGlobalOption sets up the defaults of the opentelemetry handlers of
+// the Caddyfile, which they inherit unless they set their own. Syntax:
+//
+//     opentelemetry {
+//         exporter_traces_endpoint <endpoint>
+//         exporter_traces_protocol <protocol>
+//         propagators              <list>
+//         service_name             <name>
+//     }
+//
+func parseGlobalOption(d *caddyfile.Dispenser, _ interface{}) (interface{}, error) {
+	defaults := new(OpenTelemetry)
+	params := map[string]*string{
+		"exporter_traces_endpoint": &defaults.ExporterTracesEndpoint,
+		"exporter_traces_protocol": &defaults.ExporterTracesProtocol,
+		"propagators":              &defaults.Propagators,
+		"service_name":             &defaults.ServiceName,
+	}
+
+	for d.Next() {
+		if d.NextArg() {
+			return nil, d.ArgErr()
+		}
+		for d.NextBlock(0) {
+			dst, ok := params[d.Val()]
+			if !ok {
+				return nil, d.Errf("unrecognized global opentelemetry option '%s'", d.Val())
+			}
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			*dst = d.Val()
+			if d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			if dst == &defaults.Propagators {
+				if _, err := getPropagators(defaults.Propagators); err != nil {
+					return nil, d.Errf("parsing propagators: %v", err)
+				}
+			}
+		}
+	}
+	return defaults, nil
+}
+
+// inheritDefaults sets the fields of the global option which the handler
+// does not set itself.
+func (ot *OpenTelemetry) inheritDefaults(defaults *OpenTelemetry) {
+	inherit := func(field *string, value string) {
+		if *field == "" {
+			*field = value
+		}
+	}
+	inherit(&ot.Propagators, defaults.Propagators)
+	// the service and the exporter of a provider are its own
+	if ot.Provider != "" {
+		return
+	}
+	inherit(&ot.ExporterTracesEndpoint, defaults.ExporterTracesEndpoint)
+	inherit(&ot.ExporterTracesProtocol, defaults.ExporterTracesProtocol)
+	inherit(&ot.ServiceName, defaults.ServiceName)
+}
+
+// parseCaddyfileRoute sets up the handler in a route like a handler
+// directive does, and defaults its route pattern to the path of the
+// matcher of the directive, if it has a single one.
+func parseCaddyfileRoute(h httpcaddyfile.Helper) ([]httpcaddyfile.ConfigValue, error) {
+	if !h.Next() {
+		return nil, h.ArgErr()
+	}
+
+	matcherSet, err := h.ExtractMatcherSet()
+	if err != nil {
+		return nil, err
+	}
+
+	handler, err := parseCaddyfile(h)
+	if err != nil {
+		return nil, err
+	}
+
+	if ot := handler.(*OpenTelemetry); ot.RoutePattern == "" {
+		ot.RoutePattern = matcherPath(matcherSet)
+	}
+
+	return h.NewRoute(matcherSet, handler), nil
+}
+
+// matcherPath returns the path of the path matcher of the set, empty if
+// there is none or if it matches several paths.
+func matcherPath(matcherSet caddy.ModuleMap) string {
+	var paths caddyhttp.MatchPath
+	if err := json.Unmarshal(matcherSet["path"], &paths); err != nil || len(paths) != 1 {
+		return ""
+	}
+	return paths[0]
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner           = (*OpenTelemetry)(nil)
+	_ caddy.CleanerUpper          = (*OpenTelemetry)(nil)
+	_ caddyhttp.MiddlewareHandler = (*OpenTelemetry)(nil)
+	_ caddyfile.Unmarshaler       = (*OpenTelemetry)(nil)
+)
@@ -0,0 +1,829 @@
+package opentelemetry
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+)
+
+func TestOpenTelemetry_UnmarshalCaddyfile(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected OpenTelemetry
+		wantErr  bool
+	}{
+		{
+			name: "Full config",
+			input: `opentelemetry {
+	span_name my-span
+	service_name my-service
+	exporter_traces_endpoint localhost:4317
+	exporter_traces_protocol grpc
+	exporter_certificate /etc/ssl/ca.pem
+	exporter_insecure true
+	propagators tracecontext,baggage
+	sampler parentbased_traceidratio
+	sampling_ratio 0.25
+}`,
+			expected: OpenTelemetry{
+				SpanName:               "my-span",
+				ServiceName:            "my-service",
+				ExporterTracesEndpoint: "localhost:4317",
+				ExporterTracesProtocol: "grpc",
+				ExporterCertificate:    "/etc/ssl/ca.pem",
+				ExporterInsecure:       "true",
+				Propagators:            "tracecontext,baggage",
+				Sampler:                "parentbased_traceidratio",
+				SamplingRatio:          floatPtr(0.25),
+			},
+		},
+		{
+			name: "Request ID context key",
+			input: `opentelemetry {
+	request_id_context_key request_id
+	request_id_baggage
+}`,
+			expected: OpenTelemetry{
+				RequestIDContextKey: "request_id",
+				RequestIDBaggage:    true,
+			},
+		},
+		{
+			name: "Only span name",
+			input: `opentelemetry {
+	span_name my-span
+}`,
+			expected: OpenTelemetry{
+				SpanName: "my-span",
+			},
+		},
+		{
+			name: "Empty parameter",
+			input: `opentelemetry {
+	span_name
+}`,
+			wantErr: true,
+		},
+		{
+			name: "Too many arguments",
+			input: `opentelemetry {
+	span_name one two
+}`,
+			wantErr: true,
+		},
+		{
+			name: "Unknown subdirective",
+			input: `opentelemetry {
+	foo bar
+}`,
+			wantErr: true,
+		},
+		{
+			name: "Invalid heartbeat interval",
+			input: `opentelemetry {
+	heartbeat_interval often
+}`,
+			wantErr: true,
+		},
+		{
+			name: "Resource attribute without value",
+			input: `opentelemetry {
+	resource_attributes {
+		deployment.environment
+	}
+}`,
+			wantErr: true,
+		},
+		{
+			name: "Resource attribute with too many values",
+			input: `opentelemetry {
+	resource_attributes {
+		deployment.environment production staging
+	}
+}`,
+			wantErr: true,
+		},
+		{
+			name: "Invalid exporter timeout",
+			input: `opentelemetry {
+	exporter_timeout 5
+}`,
+			wantErr: true,
+		},
+		{
+			name: "Sampling ratio is not a number",
+			input: `opentelemetry {
+	sampling_ratio half
+}`,
+			wantErr: true,
+		},
+		{
+			name: "Sampling ratio out of range",
+			input: `opentelemetry {
+	sampling_ratio 1.5
+}`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ot := &OpenTelemetry{}
+			err := ot.UnmarshalCaddyfile(caddyfile.NewTestDispenser(tt.input))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("UnmarshalCaddyfile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			if ot.SpanName != tt.expected.SpanName ||
+				ot.ServiceName != tt.expected.ServiceName ||
+				ot.ExporterTracesEndpoint != tt.expected.ExporterTracesEndpoint ||
+				ot.ExporterTracesProtocol != tt.expected.ExporterTracesProtocol ||
+				ot.ExporterCertificate != tt.expected.ExporterCertificate ||
+				ot.ExporterInsecure != tt.expected.ExporterInsecure ||
+				ot.Propagators != tt.expected.Propagators ||
+				ot.Sampler != tt.expected.Sampler {
+				t.Errorf("UnmarshalCaddyfile() = %+v, expected %+v", *ot, tt.expected)
+			}
+
+			if (ot.SamplingRatio == nil) != (tt.expected.SamplingRatio == nil) ||
+				(ot.SamplingRatio != nil && *ot.SamplingRatio != *tt.expected.SamplingRatio) {
+				t.Errorf("SamplingRatio = %v, expected %v", ot.SamplingRatio, tt.expected.SamplingRatio)
+			}
+		})
+	}
+}
+
+func TestOpenTelemetry_Provision(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	ot := &OpenTelemetry{
+		SpanName:         "my-span",
+		ExporterInsecure: "true",
+		SamplingRatio:    floatPtr(0.5),
+	}
+
+	if err := ot.Provision(ctx); err != nil {
+		t.Fatalf("Provision() error = %v", err)
+	}
+	defer ot.Cleanup()
+
+	if ot.otel.spanName != "my-span" {
+		t.Errorf("spanName = %s, expected my-span", ot.otel.spanName)
+	}
+	if ot.otel.tracerProviderKey.sampler == "" {
+		t.Errorf("expected the sampling ratio to be part of the tracer provider key")
+	}
+}
+
+func TestOpenTelemetry_Provision_InvalidSamplingRatio(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	ot := &OpenTelemetry{
+		SamplingRatio: floatPtr(-0.1),
+	}
+
+	if err := ot.Provision(ctx); err == nil {
+		t.Errorf("Provision() expected an error for a negative sampling ratio")
+	}
+}
+
+func TestOpenTelemetry_Provision_ExporterInsecure(t *testing.T) {
+	tests := []struct {
+		value    string
+		insecure bool
+		wantErr  bool
+	}{
+		{value: "true", insecure: true},
+		{value: "True", insecure: true},
+		{value: "1", insecure: true},
+		{value: "false"},
+		{value: ""},
+		{value: "yes please", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+			defer cancel()
+
+			ot := &OpenTelemetry{ExporterInsecure: tt.value}
+
+			err := ot.Provision(ctx)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Provision() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			defer ot.Cleanup()
+
+			if ot.otel.tracerProviderKey.insecure != tt.insecure {
+				t.Errorf("insecure = %v, expected %v", ot.otel.tracerProviderKey.insecure, tt.insecure)
+			}
+		})
+	}
+}
+
+func TestOpenTelemetry_Provision_ExporterInsecureFromEnv(t *testing.T) {
+	tests := []struct {
+		name     string
+		value    string
+		env      string
+		insecure bool
+		wantErr  bool
+	}{
+		{name: "env only", env: "true", insecure: true},
+		{name: "config only", value: "true", insecure: true},
+		{name: "config over env", value: "false", env: "true"},
+		{name: "invalid env", env: "yes please", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Setenv("OTEL_EXPORTER_OTLP_INSECURE", tt.env)
+			defer os.Unsetenv("OTEL_EXPORTER_OTLP_INSECURE")
+
+			ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+			defer cancel()
+
+			ot := &OpenTelemetry{ExporterInsecure: tt.value}
+
+			err := ot.Provision(ctx)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Provision() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			defer ot.Cleanup()
+
+			if ot.otel.tracerProviderKey.insecure != tt.insecure {
+				t.Errorf("insecure = %v, expected %v", ot.otel.tracerProviderKey.insecure, tt.insecure)
+			}
+		})
+	}
+
+	// the variable of the traces takes precedence over the generic one
+	os.Setenv("OTEL_EXPORTER_OTLP_INSECURE", "false")
+	defer os.Unsetenv("OTEL_EXPORTER_OTLP_INSECURE")
+	os.Setenv("OTEL_EXPORTER_OTLP_TRACES_INSECURE", "true")
+	defer os.Unsetenv("OTEL_EXPORTER_OTLP_TRACES_INSECURE")
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	ot := &OpenTelemetry{}
+	if err := ot.Provision(ctx); err != nil {
+		t.Fatalf("Provision() error = %v", err)
+	}
+	defer ot.Cleanup()
+
+	if !ot.otel.tracerProviderKey.insecure {
+		t.Errorf("insecure = false, expected OTEL_EXPORTER_OTLP_TRACES_INSECURE to be used")
+	}
+}
+
+func TestOpenTelemetry_UnmarshalCaddyfile_resourceAttributes(t *testing.T) {
+	ot := &OpenTelemetry{}
+	err := ot.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`opentelemetry {
+	resource_attributes {
+		deployment.environment production
+		team payments
+	}
+	heartbeat_interval 10s
+	exporter_timeout 3s
+}`))
+	if err != nil {
+		t.Fatalf("UnmarshalCaddyfile() error = %v", err)
+	}
+
+	if len(ot.ResourceAttributes) != 2 ||
+		ot.ResourceAttributes["deployment.environment"] != "production" ||
+		ot.ResourceAttributes["team"] != "payments" {
+		t.Errorf("ResourceAttributes = %v", ot.ResourceAttributes)
+	}
+	if ot.ExporterTimeout != caddy.Duration(3*time.Second) {
+		t.Errorf("ExporterTimeout = %v, expected 3s", ot.ExporterTimeout)
+	}
+	if ot.HeartbeatInterval != caddy.Duration(10*time.Second) {
+		t.Errorf("HeartbeatInterval = %v, expected 10s", ot.HeartbeatInterval)
+	}
+}
+
+func TestOpenTelemetry_UnmarshalCaddyfile_exporterHeaders(t *testing.T) {
+	ot := &OpenTelemetry{}
+	err := ot.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`opentelemetry {
+	exporter_headers {
+		x-honeycomb-team my-api-key
+	}
+}`))
+	if err != nil {
+		t.Fatalf("UnmarshalCaddyfile() error = %v", err)
+	}
+
+	if len(ot.ExporterHeaders) != 1 || ot.ExporterHeaders["x-honeycomb-team"] != "my-api-key" {
+		t.Errorf("ExporterHeaders = %v", ot.ExporterHeaders)
+	}
+}
+
+func TestOpenTelemetry_UnmarshalCaddyfile_failover(t *testing.T) {
+	ot := &OpenTelemetry{}
+	err := ot.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`opentelemetry {
+	exporter_failover_endpoints backup-a:4317 https://backup-b:4317
+	exporter_failover_retry_interval 5s
+}`))
+	if err != nil {
+		t.Fatalf("UnmarshalCaddyfile() error = %v", err)
+	}
+	if expected := []string{"backup-a:4317", "https://backup-b:4317"}; !reflect.DeepEqual(ot.ExporterFailoverEndpoints, expected) {
+		t.Errorf("ExporterFailoverEndpoints = %v, expected %v", ot.ExporterFailoverEndpoints, expected)
+	}
+	if ot.ExporterFailoverRetryInterval != caddy.Duration(5*time.Second) {
+		t.Errorf("ExporterFailoverRetryInterval = %v, expected 5s", ot.ExporterFailoverRetryInterval)
+	}
+}
+
+func TestOpenTelemetry_Provision_IncompleteClientKeyPair(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	ot := &OpenTelemetry{
+		ExporterClientCertificate: "/etc/ssl/client.pem",
+	}
+
+	err := ot.Provision(ctx)
+	if err == nil || !strings.Contains(err.Error(), "client certificate and key") {
+		t.Errorf("Provision() error = %v, expected an error about the incomplete client key pair", err)
+	}
+}
+
+func TestOpenTelemetry_UnmarshalCaddyfile_metrics(t *testing.T) {
+	ot := &OpenTelemetry{}
+	err := ot.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`opentelemetry {
+	metrics {
+		collect_period 30s
+	}
+}`))
+	if err != nil {
+		t.Fatalf("UnmarshalCaddyfile() error = %v", err)
+	}
+
+	if ot.Metrics == nil || ot.Metrics.CollectPeriod != caddy.Duration(30*time.Second) {
+		t.Errorf("Metrics = %+v, expected a collect period of 30s", ot.Metrics)
+	}
+}
+
+func TestOpenTelemetry_UnmarshalCaddyfile_exporterRetry(t *testing.T) {
+	ot := &OpenTelemetry{}
+	err := ot.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`opentelemetry {
+	exporter_retry {
+		enabled true
+		initial_interval 1s
+		max_interval 10s
+		max_elapsed_time 1m
+	}
+}`))
+	if err != nil {
+		t.Fatalf("UnmarshalCaddyfile() error = %v", err)
+	}
+
+	expected := &ExporterRetry{
+		Enabled:         true,
+		InitialInterval: caddy.Duration(time.Second),
+		MaxInterval:     caddy.Duration(10 * time.Second),
+		MaxElapsedTime:  caddy.Duration(time.Minute),
+	}
+	if !reflect.DeepEqual(ot.ExporterRetry, expected) {
+		t.Errorf("ExporterRetry = %+v, expected %+v", ot.ExporterRetry, expected)
+	}
+
+	for _, block := range []string{
+		"initial_interval 10s\n\t\tmax_interval 1s",
+		"enabled maybe",
+		"max_interval forever",
+		"backoff 2",
+	} {
+		ot := &OpenTelemetry{}
+		err := ot.UnmarshalCaddyfile(caddyfile.NewTestDispenser("opentelemetry {\n\texporter_retry {\n\t\t" + block + "\n\t}\n}"))
+		if err == nil {
+			t.Errorf("UnmarshalCaddyfile() with exporter retry %q, expected an error", block)
+		}
+	}
+}
+
+func TestOpenTelemetry_Provision_InvalidExporterRetry(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	ot := &OpenTelemetry{
+		ExporterRetry: &ExporterRetry{
+			Enabled:         true,
+			InitialInterval: caddy.Duration(10 * time.Second),
+			MaxInterval:     caddy.Duration(time.Second),
+		},
+	}
+
+	if err := ot.Provision(ctx); err == nil {
+		t.Errorf("Provision() expected an error for a max interval less than the initial one")
+	}
+}
+
+func TestOpenTelemetry_UnmarshalCaddyfile_spanLimits(t *testing.T) {
+	ot := &OpenTelemetry{}
+	err := ot.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`opentelemetry {
+	span_attribute_value_length_limit 1024
+	span_attribute_count_limit 64
+}`))
+	if err != nil {
+		t.Fatalf("UnmarshalCaddyfile() error = %v", err)
+	}
+	if ot.SpanAttributeValueLengthLimit != 1024 || ot.SpanAttributeCountLimit != 64 {
+		t.Errorf("span limits = %d, %d, expected 1024, 64", ot.SpanAttributeValueLengthLimit, ot.SpanAttributeCountLimit)
+	}
+
+	ot = &OpenTelemetry{}
+	err = ot.UnmarshalCaddyfile(caddyfile.NewTestDispenser("opentelemetry {\n\tspan_attribute_count_limit -1\n}"))
+	if err == nil {
+		t.Errorf("UnmarshalCaddyfile() with a negative limit, expected an error")
+	}
+}
+
+func TestOpenTelemetry_UnmarshalCaddyfile_spanNameSource(t *testing.T) {
+	ot := &OpenTelemetry{}
+	err := ot.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`opentelemetry {
+	span_name_source route method static
+}`))
+	if err != nil {
+		t.Fatalf("UnmarshalCaddyfile() error = %v", err)
+	}
+	if ot.SpanNameSource != "route,method,static" {
+		t.Errorf("SpanNameSource = %q, expected %q", ot.SpanNameSource, "route,method,static")
+	}
+
+	ot = &OpenTelemetry{}
+	err = ot.UnmarshalCaddyfile(caddyfile.NewTestDispenser("opentelemetry {\n\tspan_name_source route header\n}"))
+	if err == nil {
+		t.Errorf("UnmarshalCaddyfile() with an unsupported span name source, expected an error")
+	}
+}
+
+func TestOpenTelemetry_UnmarshalCaddyfile_shorthand(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected OpenTelemetry
+		wantErr  bool
+	}{
+		{
+			name:     "protocol and endpoint",
+			input:    `opentelemetry grpc localhost:4317`,
+			expected: OpenTelemetry{ExporterTracesProtocol: "grpc", ExporterTracesEndpoint: "localhost:4317"},
+		},
+		{
+			name:     "protocol only",
+			input:    `opentelemetry http/protobuf`,
+			expected: OpenTelemetry{ExporterTracesProtocol: "http/protobuf"},
+		},
+		{
+			name: "merged with a block",
+			input: `opentelemetry grpc localhost:4317 {
+	span_name my-span
+}`,
+			expected: OpenTelemetry{ExporterTracesProtocol: "grpc", ExporterTracesEndpoint: "localhost:4317", SpanName: "my-span"},
+		},
+		{
+			name: "endpoint set twice",
+			input: `opentelemetry grpc localhost:4317 {
+	exporter_traces_endpoint collector:4317
+}`,
+			wantErr: true,
+		},
+		{
+			name: "protocol set twice",
+			input: `opentelemetry grpc {
+	exporter_traces_protocol http/protobuf
+}`,
+			wantErr: true,
+		},
+		{
+			name:    "too many arguments",
+			input:   `opentelemetry grpc localhost:4317 extra`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ot := OpenTelemetry{}
+			err := ot.UnmarshalCaddyfile(caddyfile.NewTestDispenser(tt.input))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("UnmarshalCaddyfile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(ot, tt.expected) {
+				t.Errorf("UnmarshalCaddyfile() = %+v, expected %+v", ot, tt.expected)
+			}
+		})
+	}
+}
+
+func TestOpenTelemetry_UnmarshalCaddyfile_captureBodySizes(t *testing.T) {
+	ot := &OpenTelemetry{}
+	err := ot.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`opentelemetry {
+	capture_body_sizes
+}`))
+	if err != nil {
+		t.Fatalf("UnmarshalCaddyfile() error = %v", err)
+	}
+	if !ot.CaptureBodySizes {
+		t.Errorf("CaptureBodySizes = false, expected true")
+	}
+}
+
+func TestOpenTelemetry_UnmarshalCaddyfile_tracesPerSecond(t *testing.T) {
+	ot := &OpenTelemetry{}
+	err := ot.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`opentelemetry {
+	sampler rate_limited
+	traces_per_second 20
+}`))
+	if err != nil {
+		t.Fatalf("UnmarshalCaddyfile() error = %v", err)
+	}
+	if ot.Sampler != "rate_limited" || ot.TracesPerSecond != 20 {
+		t.Errorf("Sampler = %q, TracesPerSecond = %v, expected rate_limited and 20", ot.Sampler, ot.TracesPerSecond)
+	}
+
+	err = ot.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`opentelemetry {
+	traces_per_second 0
+}`))
+	if err == nil {
+		t.Errorf("UnmarshalCaddyfile() expected an error for a zero traces_per_second")
+	}
+}
+
+func TestOpenTelemetry_UnmarshalCaddyfile_serviceNamePlaceholder(t *testing.T) {
+	ot := &OpenTelemetry{}
+	err := ot.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`opentelemetry {
+	service_name "{http.vars.service}"
+	max_service_names 20
+}`))
+	if err != nil {
+		t.Fatalf("UnmarshalCaddyfile() error = %v", err)
+	}
+	if ot.ServiceName != "{http.vars.service}" || ot.MaxServiceNames != 20 {
+		t.Errorf("ServiceName = %q, MaxServiceNames = %d, expected {http.vars.service} and 20", ot.ServiceName, ot.MaxServiceNames)
+	}
+}
+
+func TestOpenTelemetry_UnmarshalCaddyfile_spanNameFromResponseHeader(t *testing.T) {
+	ot := &OpenTelemetry{}
+	err := ot.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`opentelemetry {
+	span_name_from_response_header X-Operation-Name
+}`))
+	if err != nil {
+		t.Fatalf("UnmarshalCaddyfile() error = %v", err)
+	}
+	if ot.SpanNameFromResponseHeader != "X-Operation-Name" {
+		t.Errorf("SpanNameFromResponseHeader = %q, expected X-Operation-Name", ot.SpanNameFromResponseHeader)
+	}
+}
+
+func TestOpenTelemetry_UnmarshalCaddyfile_exporterEndpoint(t *testing.T) {
+	ot := &OpenTelemetry{}
+	err := ot.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`opentelemetry {
+	exporter_endpoint https://otel.example.com:4318
+}`))
+	if err != nil {
+		t.Fatalf("UnmarshalCaddyfile() error = %v", err)
+	}
+	if ot.ExporterEndpoint != "https://otel.example.com:4318" {
+		t.Errorf("ExporterEndpoint = %q, expected https://otel.example.com:4318", ot.ExporterEndpoint)
+	}
+}
+
+func TestOpenTelemetry_UnmarshalCaddyfile_spanLinks(t *testing.T) {
+	ot := &OpenTelemetry{}
+	err := ot.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`opentelemetry {
+	span_links X-Batch-Traces X-Origin-Trace
+}`))
+	if err != nil {
+		t.Fatalf("UnmarshalCaddyfile() error = %v", err)
+	}
+	if !reflect.DeepEqual(ot.SpanLinks, []string{"X-Batch-Traces", "X-Origin-Trace"}) {
+		t.Errorf("SpanLinks = %v, expected [X-Batch-Traces X-Origin-Trace]", ot.SpanLinks)
+	}
+}
+
+func TestOpenTelemetry_UnmarshalCaddyfile_sharedProvider(t *testing.T) {
+	ot := &OpenTelemetry{}
+	err := ot.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`opentelemetry {
+	shared_provider false
+}`))
+	if err != nil {
+		t.Fatalf("UnmarshalCaddyfile() error = %v", err)
+	}
+	if ot.SharedProvider == nil || *ot.SharedProvider {
+		t.Errorf("SharedProvider = %v, expected false", ot.SharedProvider)
+	}
+
+	ot = &OpenTelemetry{}
+	err = ot.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`opentelemetry {
+	shared_provider maybe
+}`))
+	if err == nil {
+		t.Errorf("UnmarshalCaddyfile() expected an error for a bad boolean")
+	}
+}
+
+func TestOpenTelemetry_UnmarshalCaddyfile_propagators(t *testing.T) {
+	ot := &OpenTelemetry{}
+	err := ot.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`opentelemetry {
+	propagators tracecontext,baggage
+}`))
+	if err != nil {
+		t.Fatalf("UnmarshalCaddyfile() error = %v", err)
+	}
+	if ot.Propagators != "tracecontext,baggage" {
+		t.Errorf("Propagators = %q, expected %q", ot.Propagators, "tracecontext,baggage")
+	}
+
+	ot = &OpenTelemetry{}
+	err = ot.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`opentelemetry {
+	span_name my-span
+	propagators tracecontext,tracecontex
+}`))
+	// the error points at the line of the offending propagator
+	if err == nil || !strings.Contains(err.Error(), ":3 - ") || !strings.Contains(err.Error(), `"tracecontex"`) {
+		t.Errorf("UnmarshalCaddyfile() error = %v, expected an error at line 3 about \"tracecontex\"", err)
+	}
+}
+
+func TestOpenTelemetry_UnmarshalCaddyfile_excludePaths(t *testing.T) {
+	ot := &OpenTelemetry{}
+	err := ot.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`opentelemetry {
+	exclude_paths /healthz /internal/*
+}`))
+	if err != nil {
+		t.Fatalf("UnmarshalCaddyfile() error = %v", err)
+	}
+
+	expected := []string{"/healthz", "/internal/*"}
+	if !reflect.DeepEqual(ot.ExcludePaths, expected) {
+		t.Errorf("ExcludePaths = %v, expected %v", ot.ExcludePaths, expected)
+	}
+
+	for _, path := range []string{"healthz", "/*/metrics"} {
+		ot := &OpenTelemetry{}
+		err := ot.UnmarshalCaddyfile(caddyfile.NewTestDispenser("opentelemetry {\n\texclude_paths " + path + "\n}"))
+		if err == nil {
+			t.Errorf("UnmarshalCaddyfile() with excluded path %q, expected an error", path)
+		}
+	}
+}
+
+func TestOpenTelemetry_UnmarshalCaddyfile_pathSampling(t *testing.T) {
+	ot := &OpenTelemetry{}
+	err := ot.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`opentelemetry {
+	path_sampling ^/api/ 1
+	path_sampling ^/static/ 0.1
+}`))
+	if err != nil {
+		t.Fatalf("UnmarshalCaddyfile() error = %v", err)
+	}
+
+	expected := []PathSamplingRule{{Regexp: "^/api/", Ratio: 1}, {Regexp: "^/static/", Ratio: 0.1}}
+	if !reflect.DeepEqual(ot.PathSamplingRules, expected) {
+		t.Errorf("PathSamplingRules = %v, expected %v", ot.PathSamplingRules, expected)
+	}
+
+	for _, rule := range []string{"^/api/( 1", "^/api/ 2", "^/api/"} {
+		ot := &OpenTelemetry{}
+		err := ot.UnmarshalCaddyfile(caddyfile.NewTestDispenser("opentelemetry {\n\tpath_sampling " + rule + "\n}"))
+		if err == nil {
+			t.Errorf("UnmarshalCaddyfile() with path sampling %q, expected an error", rule)
+		}
+	}
+}
+
+func TestOpenTelemetry_Provision_InvalidPathSampling(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	ot := &OpenTelemetry{
+		PathSamplingRules: []PathSamplingRule{{Regexp: "^/api/(", Ratio: 1}},
+	}
+
+	if err := ot.Provision(ctx); err == nil {
+		t.Errorf("Provision() expected an error for an invalid path sampling regexp")
+	}
+}
+
+func TestOpenTelemetry_globalOption(t *testing.T) {
+	input := `{
+	opentelemetry {
+		exporter_traces_endpoint collector:4317
+		exporter_traces_protocol grpc
+		propagators tracecontext,baggage,b3
+		service_name edge
+	}
+}
+
+:8080 {
+	opentelemetry
+}
+
+:8081 {
+	opentelemetry http/protobuf collector:4318 {
+		service_name api
+	}
+}`
+	adapter := caddyfile.Adapter{ServerType: httpcaddyfile.ServerType{}}
+	out, _, err := adapter.Adapt([]byte(input), nil)
+	if err != nil {
+		t.Fatalf("Adapt() error = %v", err)
+	}
+
+	for _, expected := range []string{
+		// inherited
+		`"exporter_traces_endpoint":"collector:4317","exporter_traces_protocol":"grpc","handler":"opentelemetry","propagators":"tracecontext,baggage,b3","service_name":"edge"`,
+		`"propagators":"tracecontext,baggage,b3"`,
+		// overridden
+		`"exporter_traces_endpoint":"collector:4318","exporter_traces_protocol":"http/protobuf","handler":"opentelemetry","propagators":"tracecontext,baggage,b3","service_name":"api"`,
+	} {
+		if !strings.Contains(string(out), expected) {
+			t.Errorf("Adapt() = %s, expected it to contain %s", out, expected)
+		}
+	}
+
+	_, _, err = adapter.Adapt([]byte("{\n\topentelemetry {\n\t\tspan_name global\n\t}\n}\n:8080 {\n\topentelemetry\n}"), nil)
+	if err == nil {
+		t.Errorf("Adapt() with an unsupported global option expected an error")
+	}
+}
+
+func TestOpenTelemetry_Provision_providerSettings(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	ot := &OpenTelemetry{Provider: "shared", Sampler: "always_on", SkipUnsampled: true}
+	err := ot.Provision(ctx)
+	if err == nil || !strings.Contains(err.Error(), "sampler, skip_unsampled") {
+		t.Errorf("Provision() error = %v, expected the settings of the provider to be rejected", err)
+	}
+}
+
+func TestOpenTelemetry_parseCaddyfileRoute(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{name: "path matcher", input: "opentelemetry /api/*", expected: `"route_pattern":"/api/*"`},
+		{name: "configured", input: "opentelemetry /api/* {\n\troute_pattern /api/{version}/*\n}", expected: `"route_pattern":"/api/{version}/*"`},
+		{name: "no matcher", input: "opentelemetry"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			adapter := caddyfile.Adapter{ServerType: httpcaddyfile.ServerType{}}
+			out, _, err := adapter.Adapt([]byte(":8080 {\n"+tt.input+"\n}"), nil)
+			if err != nil {
+				t.Fatalf("Adapt() error = %v", err)
+			}
+
+			if tt.expected == "" {
+				if strings.Contains(string(out), "route_pattern") {
+					t.Errorf("Adapt() = %s, expected no route pattern", out)
+				}
+				return
+			}
+			if !strings.Contains(string(out), tt.expected) {
+				t.Errorf("Adapt() = %s, expected it to contain %s", out, tt.expected)
+			}
+		})
+	}
+}
+
+func floatPtr(f float64) *float64 {
+	return &f
+}
+
+func TestOpenTelemetry_UnmarshalCaddyfile_serverName(t *testing.T) {
+	ot := &OpenTelemetry{}
+	err := ot.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`opentelemetry {
+	server_name api
+}`))
+	if err != nil {
+		t.Fatalf("UnmarshalCaddyfile() error = %v", err)
+	}
+	if ot.ServerName != "api" {
+		t.Errorf("ServerName = %q, expected api", ot.ServerName)
+	}
+}
@@ -0,0 +1,282 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package opentelemetry
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/metric"
+	controller "go.opentelemetry.io/otel/sdk/metric/controller/basic"
+	processor "go.opentelemetry.io/otel/sdk/metric/processor/basic"
+	"go.opentelemetry.io/otel/sdk/metric/selector/simple"
+	"go.opentelemetry.io/otel/sdk/resource"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"google.golang.org/grpc/credentials"
+)
+
+// requestMetrics records the count and the duration of the requests.
+type requestMetrics struct {
+	requests metric.Int64Counter
+	duration metric.Float64Histogram
+
+	// controller collects and exports the metrics, nil if they are recorded
+	// by a meter provider of the otel app.
+	controller *controller.Controller
+}
+
+// newRequestMetrics returns the request metrics recorded with meter.
+func newRequestMetrics(meter metric.Meter) *requestMetrics {
+	must := metric.Must(meter)
+	return &requestMetrics{
+		requests: must.NewInt64Counter("http.server.request_count",
+			metric.WithDescription("Number of HTTP requests handled.")),
+		duration: must.NewFloat64Histogram("http.server.duration",
+			metric.WithDescription("Duration of the HTTP requests."),
+			metric.WithUnit("ms")),
+	}
+}
+
+// defaultMeterProviderCache is shared by all the handlers of the module, so
+// that the handlers exporting their request metrics with the same settings
+// share a meter provider, which reports the tracer providers once.
+var defaultMeterProviderCache = newMeterProviderCache()
+
+// meterProviderKey identifies a meter provider by the exporter settings,
+// the resource and the collect period it was built with.
+type meterProviderKey struct {
+	endpoint    string
+	protocol    string
+	certificate string
+	insecure    bool
+	timeout     time.Duration
+	compression string
+
+	clientCertificate string
+	clientKey         string
+	tlsSkipVerify     bool
+	serverName        string
+	// headersHash is the hash of the exporter headers, which may contain secrets.
+	headersHash string
+
+	resource      attribute.Distinct
+	collectPeriod time.Duration
+}
+
+// meterProviderCache keeps track of the request metrics exported over OTLP,
+// each with a meter provider of its own, and of the number of handlers
+// recording each of them.
+type meterProviderCache struct {
+	mu sync.Mutex
+
+	metrics         map[meterProviderKey]*requestMetrics
+	metricsCounters map[meterProviderKey]int
+}
+
+func newMeterProviderCache() *meterProviderCache {
+	return &meterProviderCache{
+		metrics:         make(map[meterProviderKey]*requestMetrics),
+		metricsCounters: make(map[meterProviderKey]int),
+	}
+}
+
+// getRequestMetrics creates or returns the cached request metrics exported
+// over OTLP with the exporter settings of the spans, every collectPeriod if
+// not zero, and increments the number of their users. The key is the one
+// to release them with.
+func (c *meterProviderCache) getRequestMetrics(ctx context.Context, cfg tracerExporterConfig, res *resource.Resource, collectPeriod time.Duration) (*requestMetrics, meterProviderKey, error) {
+	key := meterProviderKey{
+		endpoint:          cfg.endpoint,
+		protocol:          cfg.protocol,
+		certificate:       cfg.certificate,
+		insecure:          cfg.insecure,
+		timeout:           cfg.timeout,
+		compression:       cfg.compression,
+		clientCertificate: cfg.clientCertificate,
+		clientKey:         cfg.clientKey,
+		tlsSkipVerify:     cfg.tlsSkipVerify,
+		serverName:        cfg.serverName,
+		headersHash:       headersHash(cfg.headers),
+		resource:          res.Equivalent(),
+		collectPeriod:     collectPeriod,
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if m, ok := c.metrics[key]; ok {
+		c.metricsCounters[key]++
+		return m, key, nil
+	}
+
+	cont, err := newMetricController(ctx, cfg, res, collectPeriod)
+	if err != nil {
+		return nil, meterProviderKey{}, err
+	}
+
+	meter := cont.Meter("github.com/caddyserver/caddy/v2/modules/caddyhttp/opentelemetry")
+	m := newRequestMetrics(meter)
+	m.controller = cont
+	observeTracerProviders(meter, defaultTracerProviderCache)
+
+	c.metrics[key] = m
+	c.metricsCounters[key] = 1
+	return m, key, nil
+}
+
+// release decrements the number of users of the request metrics for the
+// key, and stops them within timeout once they are no longer used.
+func (c *meterProviderCache) release(key meterProviderKey, timeout time.Duration) error {
+	c.mu.Lock()
+	m, ok := c.metrics[key]
+	if !ok {
+		c.mu.Unlock()
+		return nil
+	}
+	c.metricsCounters[key]--
+	if c.metricsCounters[key] > 0 {
+		c.mu.Unlock()
+		return nil
+	}
+	delete(c.metrics, key)
+	delete(c.metricsCounters, key)
+	c.mu.Unlock()
+
+	return m.stop(timeout)
+}
+
+// len returns the number of meter providers in the cache.
+func (c *meterProviderCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len(c.metrics)
+}
+
+// newMetricController returns a started controller, the meter provider
+// whose metrics are exported over OTLP with the exporter settings of the
+// spans, every collectPeriod if not zero.
+func newMetricController(ctx context.Context, cfg tracerExporterConfig, res *resource.Resource, collectPeriod time.Duration) (*controller.Controller, error) {
+	client, err := getMetricClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	exporter, err := otlpmetric.New(ctx, client)
+	if err != nil {
+		return nil, fmt.Errorf("creating metric exporter: %w", err)
+	}
+
+	opts := []controller.Option{
+		controller.WithExporter(exporter),
+		controller.WithResource(res),
+	}
+	if collectPeriod > 0 {
+		opts = append(opts, controller.WithCollectPeriod(collectPeriod))
+	}
+
+	cont := controller.New(processor.NewFactory(simple.NewWithHistogramDistribution(), exporter), opts...)
+	if err := cont.Start(ctx); err != nil {
+		return nil, fmt.Errorf("starting metric controller: %w", err)
+	}
+
+	return cont, nil
+}
+
+// getMetricClient returns the protocol specific OTLP metric client.
+func getMetricClient(cfg tracerExporterConfig) (otlpmetric.Client, error) {
+	switch cfg.protocol {
+	case protocolGRPC, "":
+		var opts []otlpmetricgrpc.Option
+		if cfg.endpoint != "" {
+			opts = append(opts, otlpmetricgrpc.WithEndpoint(cfg.endpoint))
+		}
+		if len(cfg.headers) > 0 {
+			opts = append(opts, otlpmetricgrpc.WithHeaders(cfg.headers))
+		}
+		if cfg.timeout > 0 {
+			opts = append(opts, otlpmetricgrpc.WithTimeout(cfg.timeout))
+		}
+		if cfg.compression == compressionGzip {
+			opts = append(opts, otlpmetricgrpc.WithCompressor(compressionGzip))
+		}
+		if cfg.insecure {
+			opts = append(opts, otlpmetricgrpc.WithInsecure())
+		} else if cfg.customTLS() {
+			tlsConfig, err := newTLSConfig(cfg)
+			if err != nil {
+				return nil, err
+			}
+			opts = append(opts, otlpmetricgrpc.WithTLSCredentials(credentials.NewTLS(tlsConfig)))
+		}
+		return otlpmetricgrpc.NewClient(opts...), nil
+
+	case protocolHTTPProtobuf:
+		var opts []otlpmetrichttp.Option
+		if cfg.endpoint != "" {
+			opts = append(opts, otlpmetrichttp.WithEndpoint(cfg.endpoint))
+		}
+		if len(cfg.headers) > 0 {
+			opts = append(opts, otlpmetrichttp.WithHeaders(cfg.headers))
+		}
+		if cfg.timeout > 0 {
+			opts = append(opts, otlpmetrichttp.WithTimeout(cfg.timeout))
+		}
+		if cfg.compression == compressionGzip {
+			opts = append(opts, otlpmetrichttp.WithCompression(otlpmetrichttp.GzipCompression))
+		}
+		if cfg.insecure {
+			opts = append(opts, otlpmetrichttp.WithInsecure())
+		} else if cfg.customTLS() {
+			tlsConfig, err := newTLSConfig(cfg)
+			if err != nil {
+				return nil, err
+			}
+			opts = append(opts, otlpmetrichttp.WithTLSClientConfig(tlsConfig))
+		}
+		return otlpmetrichttp.NewClient(opts...), nil
+
+	default:
+		return nil, fmt.Errorf("unsupported metrics protocol %q", cfg.protocol)
+	}
+}
+
+// record records a request of the method answered with the status, zero if unknown, in duration.
+func (m *requestMetrics) record(ctx context.Context, method string, status int, duration time.Duration) {
+	attrs := []attribute.KeyValue{semconv.HTTPMethodKey.String(method)}
+	if status != 0 {
+		attrs = append(attrs, semconv.HTTPStatusCodeKey.Int(status))
+	}
+
+	m.requests.Add(ctx, 1, attrs...)
+	m.duration.Record(ctx, float64(duration)/float64(time.Millisecond), attrs...)
+}
+
+// stop exports the remaining metrics and stops their collection, within
+// timeout so that an unreachable collector does not block the cleanup.
+func (m *requestMetrics) stop(timeout time.Duration) error {
+	if m.controller == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return m.controller.Stop(ctx)
+}
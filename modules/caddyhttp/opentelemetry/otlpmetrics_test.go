@@ -0,0 +1,106 @@
+package opentelemetry
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.opentelemetry.io/otel/metric/metrictest"
+	"go.opentelemetry.io/otel/sdk/resource"
+)
+
+func TestOpenTelemetryWrapper_ServeHTTP_requestMetrics(t *testing.T) {
+	meterProvider := metrictest.NewMeterProvider()
+
+	otw, _ := newTestOpenTelemetryWrapper()
+	otw.metrics = newRequestMetrics(meterProvider.Meter("test"))
+
+	req := httptest.NewRequest(http.MethodPost, "https://example.com/", nil)
+	err := otw.ServeHTTP(httptest.NewRecorder(), req, caddyhttp.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) error {
+		w.WriteHeader(http.StatusCreated)
+		return nil
+	}))
+	if err != nil {
+		t.Fatalf("ServeHTTP() error = %v", err)
+	}
+
+	recorded := map[string]bool{}
+	for _, m := range metrictest.AsStructs(meterProvider.MeasurementBatches) {
+		if m.Labels["http.method"].AsString() != http.MethodPost || m.Labels["http.status_code"].AsInt64() != http.StatusCreated {
+			t.Errorf("%s labels = %v, expected the method and the status of the request", m.Name, m.Labels)
+		}
+		recorded[m.Name] = true
+	}
+	if !recorded["http.server.request_count"] || !recorded["http.server.duration"] {
+		t.Errorf("recorded metrics = %v, expected the request count and duration", recorded)
+	}
+}
+
+func TestRequestMetrics_stopTimeout(t *testing.T) {
+	// the collector never answers
+	release := make(chan struct{})
+	collector := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		<-release
+	}))
+	defer collector.Close()
+	defer close(release)
+
+	cfg := tracerExporterConfig{
+		protocol: protocolHTTPProtobuf,
+		endpoint: strings.TrimPrefix(collector.URL, "http://"),
+		insecure: true,
+	}
+	cache := newMeterProviderCache()
+	m, key, err := cache.getRequestMetrics(context.Background(), cfg, resource.Empty(), time.Hour)
+	if err != nil {
+		t.Fatalf("getRequestMetrics() error = %v", err)
+	}
+	m.record(context.Background(), http.MethodGet, http.StatusOK, time.Millisecond)
+
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		_ = cache.release(key, 50*time.Millisecond)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("stop() did not return within its timeout")
+	}
+}
+
+func TestMeterProviderCache_shared(t *testing.T) {
+	cache := newMeterProviderCache()
+	cfg := tracerExporterConfig{protocol: protocolHTTPProtobuf, endpoint: "localhost:4318", insecure: true}
+	res := resource.Empty()
+
+	first, key, err := cache.getRequestMetrics(context.Background(), cfg, res, time.Hour)
+	if err != nil {
+		t.Fatalf("getRequestMetrics() error = %v", err)
+	}
+	// a second handler exporting with the same settings shares the meter provider
+	second, sameKey, err := cache.getRequestMetrics(context.Background(), cfg, res, time.Hour)
+	if err != nil {
+		t.Fatalf("getRequestMetrics() error = %v", err)
+	}
+	if second != first || sameKey != key || cache.len() != 1 {
+		t.Fatalf("getRequestMetrics() created %d meter providers, expected a shared one", cache.len())
+	}
+
+	if err := cache.release(key, time.Second); err != nil {
+		t.Fatalf("release() error = %v", err)
+	}
+	if cache.len() != 1 {
+		t.Errorf("meter provider stopped while still used")
+	}
+	if err := cache.release(key, time.Second); err != nil {
+		t.Fatalf("release() error = %v", err)
+	}
+	if cache.len() != 0 {
+		t.Errorf("meter provider kept once no longer used")
+	}
+}
@@ -0,0 +1,48 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package opentelemetry
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TraceContextStore stores serialized trace contexts, e.g. in Redis or
+// another key/value store, so that asynchronous work started by a traced
+// request can later continue its trace.
+type TraceContextStore interface {
+	// StoreTraceContext stores the traceparent under the key.
+	StoreTraceContext(ctx context.Context, key, traceparent string) error
+}
+
+// PublishTraceContext serializes the trace context of ctx as a W3C
+// traceparent and stores it under the key, e.g. the ID of the job enqueued
+// by the request. A downstream handler passes the context of its request,
+// which carries the span of this handler. A worker can then extract the
+// trace context from the traceparent with the tracecontext propagator to
+// continue the trace.
+func PublishTraceContext(ctx context.Context, store TraceContextStore, key string) error {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return fmt.Errorf("no trace context to publish")
+	}
+
+	carrier := propagation.HeaderCarrier{}
+	propagation.TraceContext{}.Inject(ctx, carrier)
+
+	return store.StoreTraceContext(ctx, key, carrier.Get("traceparent"))
+}
@@ -0,0 +1,56 @@
+package opentelemetry
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// fakeTraceContextStore keeps the stored trace contexts in memory.
+type fakeTraceContextStore map[string]string
+
+func (s fakeTraceContextStore) StoreTraceContext(_ context.Context, key, traceparent string) error {
+	s[key] = traceparent
+	return nil
+}
+
+func TestPublishTraceContext(t *testing.T) {
+	otw, _ := newTestOpenTelemetryWrapper()
+	store := fakeTraceContextStore{}
+
+	var spanContext trace.SpanContext
+	req := httptest.NewRequest(http.MethodGet, "https://example.com/jobs", nil)
+	err := otw.ServeHTTP(httptest.NewRecorder(), req, caddyhttp.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) error {
+		ctx := otw.propagators.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		spanContext = trace.SpanContextFromContext(ctx)
+		return PublishTraceContext(ctx, store, "job-42")
+	}))
+	if err != nil {
+		t.Fatalf("ServeHTTP() error = %v", err)
+	}
+
+	traceparent, ok := store["job-42"]
+	if !ok {
+		t.Fatalf("expected the trace context to be stored under the job ID")
+	}
+
+	ctx := propagation.TraceContext{}.Extract(context.Background(), propagation.HeaderCarrier{"Traceparent": []string{traceparent}})
+	if got := trace.SpanContextFromContext(ctx); got.TraceID() != spanContext.TraceID() || got.SpanID() != spanContext.SpanID() {
+		t.Errorf("stored trace context %s does not match the one of the request", traceparent)
+	}
+}
+
+func TestPublishTraceContext_noTraceContext(t *testing.T) {
+	store := fakeTraceContextStore{}
+	if err := PublishTraceContext(context.Background(), store, "job-42"); err == nil {
+		t.Errorf("PublishTraceContext() expected an error without trace context")
+	}
+	if len(store) != 0 {
+		t.Errorf("expected nothing to be stored, got %v", store)
+	}
+}
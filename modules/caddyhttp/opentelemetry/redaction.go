@@ -0,0 +1,92 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package opentelemetry
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sync"
+
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+)
+
+const (
+	hostRedactionHash = "hash"
+	hostRedactionDrop = "drop"
+)
+
+// hostAttributeKeys are the attributes that may reveal the requested host.
+var hostAttributeKeys = map[attribute.Key]struct{}{
+	semconv.HTTPHostKey:    {},
+	semconv.NetHostNameKey: {},
+}
+
+// defaultHostRedactionKey is the key of the host hashes of the handlers
+// configuring none, generated once per process.
+var defaultHostRedactionKey struct {
+	once sync.Once
+	key  []byte
+	err  error
+}
+
+// hostRedactionKey returns key, or the random default key if key is empty.
+func hostRedactionKey(key []byte) ([]byte, error) {
+	if len(key) > 0 {
+		return key, nil
+	}
+	defaultHostRedactionKey.once.Do(func() {
+		key := make([]byte, sha256.Size)
+		if _, err := rand.Read(key); err != nil {
+			defaultHostRedactionKey.err = fmt.Errorf("generating host redaction key: %w", err)
+			return
+		}
+		defaultHostRedactionKey.key = key
+	})
+	return defaultHostRedactionKey.key, defaultHostRedactionKey.err
+}
+
+// validateHostRedaction returns an error if mode is not a supported host redaction mode.
+func validateHostRedaction(mode string) error {
+	switch mode {
+	case "", hostRedactionHash, hostRedactionDrop:
+		return nil
+	default:
+		return fmt.Errorf("unsupported host redaction %q", mode)
+	}
+}
+
+// redactHostAttributes returns a copy of attrs with the host attributes
+// hashed or dropped according to mode. The hosts are hashed with an
+// HMAC-SHA256 of key, so that they cannot be recovered by hashing a
+// dictionary of hosts without it.
+func redactHostAttributes(attrs []attribute.KeyValue, mode string, key []byte) []attribute.KeyValue {
+	result := make([]attribute.KeyValue, 0, len(attrs))
+	for _, attr := range attrs {
+		if _, ok := hostAttributeKeys[attr.Key]; !ok {
+			result = append(result, attr)
+			continue
+		}
+		if mode == hostRedactionHash {
+			mac := hmac.New(sha256.New, key)
+			mac.Write([]byte(attr.Value.Emit()))
+			result = append(result, attr.Key.String(hex.EncodeToString(mac.Sum(nil))))
+		}
+	}
+	return result
+}
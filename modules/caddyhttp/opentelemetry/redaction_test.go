@@ -0,0 +1,115 @@
+package opentelemetry
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+)
+
+func TestRedactHostAttributes(t *testing.T) {
+	key := []byte("secret")
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("tenant.example.com"))
+	hashed := hex.EncodeToString(mac.Sum(nil))
+
+	tests := []struct {
+		mode     string
+		expected map[string]string
+	}{
+		{
+			mode: hostRedactionHash,
+			expected: map[string]string{
+				string(semconv.HTTPHostKey):    hashed,
+				string(semconv.NetHostNameKey): hashed,
+				string(semconv.HTTPMethodKey):  "GET",
+			},
+		},
+		{
+			mode: hostRedactionDrop,
+			expected: map[string]string{
+				string(semconv.HTTPMethodKey): "GET",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			exporter := tracetest.NewInMemoryExporter()
+			tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(attributesExporter{
+				SpanExporter: exporter,
+				rewrite: func(attrs []attribute.KeyValue) []attribute.KeyValue {
+					return redactHostAttributes(attrs, tt.mode, key)
+				},
+			}))
+			defer tp.Shutdown(context.Background())
+
+			_, span := tp.Tracer("test").Start(context.Background(), "test")
+			span.SetAttributes(
+				semconv.HTTPHostKey.String("tenant.example.com"),
+				semconv.NetHostNameKey.String("tenant.example.com"),
+				semconv.HTTPMethodKey.String("GET"),
+			)
+			span.End()
+
+			spans := exporter.GetSpans()
+			if len(spans) != 1 {
+				t.Fatalf("expected 1 span, got %d", len(spans))
+			}
+
+			got := make(map[string]string)
+			for _, attr := range spans[0].Attributes {
+				got[string(attr.Key)] = attr.Value.Emit()
+			}
+			if len(got) != len(tt.expected) {
+				t.Fatalf("attributes = %v, expected %v", got, tt.expected)
+			}
+			for k, v := range tt.expected {
+				if got[k] != v {
+					t.Errorf("attribute %s = %s, expected %s", k, got[k], v)
+				}
+			}
+		})
+	}
+}
+
+func TestHostRedactionKey(t *testing.T) {
+	configured := []byte("secret")
+	if key, err := hostRedactionKey(configured); err != nil || !bytes.Equal(key, configured) {
+		t.Errorf("hostRedactionKey() = %x, %v, expected the configured key", key, err)
+	}
+
+	// the default key is random, and the same for all the handlers of the process
+	first, err := hostRedactionKey(nil)
+	if err != nil {
+		t.Fatalf("hostRedactionKey() error = %v", err)
+	}
+	second, _ := hostRedactionKey(nil)
+	if len(first) != sha256.Size || !bytes.Equal(first, second) {
+		t.Errorf("hostRedactionKey() = %x then %x, expected the same random key", first, second)
+	}
+
+	// without the key, the hash of a host is not its plain SHA-256
+	sum := sha256.Sum256([]byte("tenant.example.com"))
+	redacted := redactHostAttributes([]attribute.KeyValue{semconv.HTTPHostKey.String("tenant.example.com")}, hostRedactionHash, first)
+	if redacted[0].Value.AsString() == hex.EncodeToString(sum[:]) {
+		t.Errorf("host hashed without a key")
+	}
+}
+
+func TestValidateHostRedaction(t *testing.T) {
+	for _, mode := range []string{"", "hash", "drop"} {
+		if err := validateHostRedaction(mode); err != nil {
+			t.Errorf("validateHostRedaction(%q) error = %v", mode, err)
+		}
+	}
+	if err := validateHostRedaction("mask"); err == nil {
+		t.Errorf("validateHostRedaction(\"mask\") expected an error")
+	}
+}
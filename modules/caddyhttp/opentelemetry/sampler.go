@@ -0,0 +1,435 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package opentelemetry
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// methodSampler samples the spans with the ratio configured for the
+// http.method attribute they are started with, or with the fallback
+// sampler for the other methods.
+type methodSampler struct {
+	methods  map[string]sdktrace.Sampler
+	fallback sdktrace.Sampler
+}
+
+// newMethodSampler returns a sampler applying the ratios to the spans of
+// their method. The spans of the other methods are sampled by fallback,
+// or by the default sampler of the SDK if fallback is nil.
+//
+// If parentBased, i.e. the configured sampler follows the decision of the
+// parent, see samplerParentBased, so do the ratios: the spans with a
+// parent follow its decision whatever their method.
+func newMethodSampler(ratios map[string]float64, fallback sdktrace.Sampler, parentBased bool) (sdktrace.Sampler, error) {
+	if fallback == nil {
+		fallback = sdktrace.ParentBased(sdktrace.AlwaysSample())
+	}
+
+	methods := make(map[string]sdktrace.Sampler, len(ratios))
+	for method, ratio := range ratios {
+		if ratio < 0 || ratio > 1 {
+			return nil, fmt.Errorf("sampling ratio of method %s must be between 0.0 and 1.0, got %v", method, ratio)
+		}
+		sampler := sdktrace.TraceIDRatioBased(ratio)
+		if parentBased {
+			sampler = sdktrace.ParentBased(sampler)
+		}
+		methods[strings.ToUpper(method)] = sampler
+	}
+
+	return methodSampler{methods: methods, fallback: fallback}, nil
+}
+
+// ShouldSample implements sdktrace.Sampler.
+func (s methodSampler) ShouldSample(p sdktrace.SamplingParameters) sdktrace.SamplingResult {
+	for _, attr := range p.Attributes {
+		if attr.Key != semconv.HTTPMethodKey {
+			continue
+		}
+		if sampler, ok := s.methods[attr.Value.AsString()]; ok {
+			return sampler.ShouldSample(p)
+		}
+		break
+	}
+	return s.fallback.ShouldSample(p)
+}
+
+// Description implements sdktrace.Sampler.
+func (s methodSampler) Description() string {
+	methods := make([]string, 0, len(s.methods))
+	for method, sampler := range s.methods {
+		methods = append(methods, method+":"+sampler.Description())
+	}
+	sort.Strings(methods)
+	return fmt.Sprintf("MethodSampler{%s,default:%s}", strings.Join(methods, ","), s.fallback.Description())
+}
+
+// pathSamplingRule samples the spans whose path matches the regular
+// expression with sampler.
+type pathSamplingRule struct {
+	regexp  *regexp.Regexp
+	sampler sdktrace.Sampler
+}
+
+// pathSampler samples the spans with the first rule matching the path of
+// the http.target attribute they are started with, or with the fallback
+// sampler if none matches.
+type pathSampler struct {
+	rules    []pathSamplingRule
+	fallback sdktrace.Sampler
+}
+
+// newPathSampler returns a sampler applying the ratios of the rules, in
+// order, to the spans of the requests whose path matches their regular
+// expression. The spans of the other paths are sampled by fallback, or by
+// the default sampler of the SDK if fallback is nil.
+//
+// As for the methods, if parentBased, so are the ratios.
+func newPathSampler(rules []PathSamplingRule, fallback sdktrace.Sampler, parentBased bool) (sdktrace.Sampler, error) {
+	if fallback == nil {
+		fallback = sdktrace.ParentBased(sdktrace.AlwaysSample())
+	}
+
+	compiled := make([]pathSamplingRule, 0, len(rules))
+	for _, rule := range rules {
+		re, err := regexp.Compile(rule.Regexp)
+		if err != nil {
+			return nil, fmt.Errorf("compiling path sampling regexp %q: %w", rule.Regexp, err)
+		}
+		if rule.Ratio < 0 || rule.Ratio > 1 {
+			return nil, fmt.Errorf("sampling ratio of path %q must be between 0.0 and 1.0, got %v", rule.Regexp, rule.Ratio)
+		}
+		sampler := sdktrace.TraceIDRatioBased(rule.Ratio)
+		if parentBased {
+			sampler = sdktrace.ParentBased(sampler)
+		}
+		compiled = append(compiled, pathSamplingRule{regexp: re, sampler: sampler})
+	}
+
+	return pathSampler{rules: compiled, fallback: fallback}, nil
+}
+
+// ShouldSample implements sdktrace.Sampler.
+func (s pathSampler) ShouldSample(p sdktrace.SamplingParameters) sdktrace.SamplingResult {
+	for _, attr := range p.Attributes {
+		if attr.Key != semconv.HTTPTargetKey {
+			continue
+		}
+		path := attr.Value.AsString()
+		if i := strings.IndexByte(path, '?'); i >= 0 {
+			path = path[:i]
+		}
+		for _, rule := range s.rules {
+			if rule.regexp.MatchString(path) {
+				return rule.sampler.ShouldSample(p)
+			}
+		}
+		break
+	}
+	return s.fallback.ShouldSample(p)
+}
+
+// Description implements sdktrace.Sampler.
+func (s pathSampler) Description() string {
+	rules := make([]string, 0, len(s.rules))
+	for _, rule := range s.rules {
+		rules = append(rules, rule.regexp.String()+":"+rule.sampler.Description())
+	}
+	return fmt.Sprintf("PathSampler{%s,default:%s}", strings.Join(rules, ","), s.fallback.Description())
+}
+
+const (
+	// adaptiveWindow is the period over which the adaptive sampler measures the request rate.
+	adaptiveWindow = time.Second
+	// adaptiveSmoothing is the weight of the last window in the estimated request rate.
+	adaptiveSmoothing = 0.5
+)
+
+// adaptiveSampler limits the root spans sampled by the fallback sampler to a
+// budget of spans per second. The ratio of the spans kept follows, window
+// after window, the budget divided by the estimated request rate, and a
+// token bucket refilled at the budget absorbs the spikes within a window.
+// The spans with a parent follow the fallback sampler, their trace having
+// been budgeted where it started.
+type adaptiveSampler struct {
+	target   float64
+	fallback sdktrace.Sampler
+	now      func() time.Time
+
+	mu sync.Mutex
+	// windowStart is the start of the window whose requests are counted.
+	windowStart time.Time
+	requests    float64
+	// rate is the estimated number of requests per second, zero until the first window elapsed.
+	rate  float64
+	ratio float64
+
+	tokens     float64
+	lastRefill time.Time
+}
+
+// newAdaptiveSampler returns a sampler keeping about target spans per
+// second among the root spans sampled by fallback, or by the default
+// sampler of the SDK if fallback is nil.
+func newAdaptiveSampler(target float64, fallback sdktrace.Sampler) (*adaptiveSampler, error) {
+	if target <= 0 || math.IsInf(target, 0) || math.IsNaN(target) {
+		return nil, fmt.Errorf("target spans per second must be positive, got %v", target)
+	}
+	if fallback == nil {
+		fallback = sdktrace.ParentBased(sdktrace.AlwaysSample())
+	}
+	return &adaptiveSampler{target: target, fallback: fallback, now: time.Now, ratio: 1}, nil
+}
+
+// ShouldSample implements sdktrace.Sampler.
+func (s *adaptiveSampler) ShouldSample(p sdktrace.SamplingParameters) sdktrace.SamplingResult {
+	result := s.fallback.ShouldSample(p)
+	psc := trace.SpanContextFromContext(p.ParentContext)
+	if psc.IsValid() || result.Decision != sdktrace.RecordAndSample {
+		return result
+	}
+
+	s.mu.Lock()
+	now := s.now()
+	s.observe(now)
+	s.refill(now)
+	keep := traceIDBelow(p.TraceID, s.ratio) && s.tokens >= 1
+	if keep {
+		s.tokens--
+	}
+	s.mu.Unlock()
+
+	if !keep {
+		return sdktrace.SamplingResult{Decision: sdktrace.Drop, Tracestate: psc.TraceState()}
+	}
+	return result
+}
+
+// observe counts a request and, at the end of each window, updates the
+// estimated request rate and the ratio of the spans kept. s.mu must be held.
+func (s *adaptiveSampler) observe(now time.Time) {
+	if s.windowStart.IsZero() {
+		s.windowStart = now
+		s.lastRefill = now
+		s.tokens = s.capacity()
+	}
+	s.requests++
+
+	elapsed := now.Sub(s.windowStart)
+	if elapsed < adaptiveWindow {
+		return
+	}
+	observed := s.requests / elapsed.Seconds()
+	if s.rate == 0 {
+		s.rate = observed
+	} else {
+		s.rate = adaptiveSmoothing*observed + (1-adaptiveSmoothing)*s.rate
+	}
+	s.ratio = math.Min(1, s.target/s.rate)
+	s.requests = 0
+	s.windowStart = now
+}
+
+// refill adds the tokens earned since the last refill to the bucket. s.mu must be held.
+func (s *adaptiveSampler) refill(now time.Time) {
+	s.tokens = math.Min(s.capacity(), s.tokens+now.Sub(s.lastRefill).Seconds()*s.target)
+	s.lastRefill = now
+}
+
+// capacity is the size of the token bucket, the budget of a second.
+func (s *adaptiveSampler) capacity() float64 {
+	return math.Max(1, s.target)
+}
+
+// Description implements sdktrace.Sampler.
+func (s *adaptiveSampler) Description() string {
+	return fmt.Sprintf("AdaptiveSampler{target:%v,default:%s}", s.target, s.fallback.Description())
+}
+
+// rateLimitedSampler samples at most tracesPerSecond traces per second,
+// taking a token from a bucket refilled at this rate for each root span
+// sampled, and drops the traces beyond the limit. The spans with a parent
+// follow its decision, the way the parent based samplers do.
+type rateLimitedSampler struct {
+	tracesPerSecond float64
+	now             func() time.Time
+
+	mu         sync.Mutex
+	tokens     float64
+	lastRefill time.Time
+}
+
+// newRateLimitedSampler returns a sampler keeping at most tracesPerSecond traces per second.
+func newRateLimitedSampler(tracesPerSecond float64) (*rateLimitedSampler, error) {
+	if tracesPerSecond <= 0 || math.IsInf(tracesPerSecond, 0) || math.IsNaN(tracesPerSecond) {
+		return nil, fmt.Errorf("traces per second must be positive, got %v", tracesPerSecond)
+	}
+	return &rateLimitedSampler{tracesPerSecond: tracesPerSecond, now: time.Now}, nil
+}
+
+// ShouldSample implements sdktrace.Sampler.
+func (s *rateLimitedSampler) ShouldSample(p sdktrace.SamplingParameters) sdktrace.SamplingResult {
+	psc := trace.SpanContextFromContext(p.ParentContext)
+	if psc.IsValid() {
+		if !psc.IsSampled() {
+			return sdktrace.SamplingResult{Decision: sdktrace.Drop, Tracestate: psc.TraceState()}
+		}
+		return sdktrace.SamplingResult{Decision: sdktrace.RecordAndSample, Tracestate: psc.TraceState()}
+	}
+	if !s.take() {
+		return sdktrace.SamplingResult{Decision: sdktrace.Drop, Tracestate: psc.TraceState()}
+	}
+	return sdktrace.SamplingResult{Decision: sdktrace.RecordAndSample, Tracestate: psc.TraceState()}
+}
+
+// take refills the bucket with the tokens earned since the last call and
+// returns true if a token was left for the span.
+func (s *rateLimitedSampler) take() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	// the bucket starts full, the budget of a second
+	capacity := math.Max(1, s.tracesPerSecond)
+	if s.lastRefill.IsZero() {
+		s.tokens = capacity
+	} else if elapsed := now.Sub(s.lastRefill); elapsed > 0 {
+		s.tokens = math.Min(capacity, s.tokens+elapsed.Seconds()*s.tracesPerSecond)
+	}
+	s.lastRefill = now
+
+	if s.tokens < 1 {
+		return false
+	}
+	s.tokens--
+	return true
+}
+
+// Description implements sdktrace.Sampler.
+func (s *rateLimitedSampler) Description() string {
+	return fmt.Sprintf("RateLimitedSampler{%v}", s.tracesPerSecond)
+}
+
+// traceIDBelow returns true if the trace ID falls within the ratio, the way
+// the trace ID ratio based sampler of the SDK decides.
+func traceIDBelow(traceID trace.TraceID, ratio float64) bool {
+	if ratio >= 1 {
+		return true
+	}
+	upperBound := uint64(ratio * (1 << 63))
+	return binary.BigEndian.Uint64(traceID[8:16])>>1 < upperBound
+}
+
+// samplingResultCtxKey is the context key under which the sampling result,
+// decided before the span is started, is given to the presampledSampler.
+type samplingResultCtxKey struct{}
+
+// presampledSampler returns the sampling result decided before the span is
+// started, if any, so that a span is sampled with a single decision, or
+// samples the span with the wrapped sampler.
+type presampledSampler struct {
+	sdktrace.Sampler
+}
+
+// ShouldSample implements sdktrace.Sampler.
+func (s presampledSampler) ShouldSample(p sdktrace.SamplingParameters) sdktrace.SamplingResult {
+	if p.ParentContext != nil {
+		if result, ok := p.ParentContext.Value(samplingResultCtxKey{}).(sdktrace.SamplingResult); ok {
+			return result
+		}
+	}
+	return s.Sampler.ShouldSample(p)
+}
+
+// Description implements sdktrace.Sampler.
+func (s presampledSampler) Description() string {
+	return fmt.Sprintf("Presampled{%s}", s.Sampler.Description())
+}
+
+// presample returns the sampling decision of sampler for a span started
+// with ctx, without starting it, and the context to start the span with,
+// if sampled, for the provider to reuse the decision. Without a parent
+// span, the IDs of the span are generated by idGenerator, which must be the
+// presampledIDGenerator of the provider, so that the decision is taken for
+// the trace ID of the span.
+func presample(ctx context.Context, sampler sdktrace.Sampler, idGenerator sdktrace.IDGenerator, name string, attrs []attribute.KeyValue) (sdktrace.SamplingResult, context.Context) {
+	traceID := trace.SpanContextFromContext(ctx).TraceID()
+	if !traceID.IsValid() {
+		var spanID trace.SpanID
+		traceID, spanID = idGenerator.NewIDs(ctx)
+		ctx = context.WithValue(ctx, presampledIDsCtxKey{}, presampledIDs{traceID: traceID, spanID: spanID})
+	}
+
+	result := sampler.ShouldSample(sdktrace.SamplingParameters{
+		ParentContext: ctx,
+		TraceID:       traceID,
+		Name:          name,
+		Kind:          trace.SpanKindServer,
+		Attributes:    attrs,
+	})
+	return result, context.WithValue(ctx, samplingResultCtxKey{}, result)
+}
+
+// sampleOverride is the sampling decision a header of the request forces.
+type sampleOverride int
+
+const (
+	sampleOverrideForce sampleOverride = iota + 1
+	sampleOverrideSkip
+)
+
+// sampleOverrideCtxKey is the context key under which the sampling decision
+// forced by the request is given to the overrideSampler.
+type sampleOverrideCtxKey struct{}
+
+// overrideSampler samples the spans whose request forces it, drops the ones
+// whose request suppresses it, and leaves the decision for the other spans
+// to the wrapped sampler.
+type overrideSampler struct {
+	sdktrace.Sampler
+}
+
+// ShouldSample implements sdktrace.Sampler.
+func (s overrideSampler) ShouldSample(p sdktrace.SamplingParameters) sdktrace.SamplingResult {
+	if p.ParentContext != nil {
+		tracestate := trace.SpanContextFromContext(p.ParentContext).TraceState()
+		switch p.ParentContext.Value(sampleOverrideCtxKey{}) {
+		case sampleOverrideForce:
+			return sdktrace.SamplingResult{Decision: sdktrace.RecordAndSample, Tracestate: tracestate}
+		case sampleOverrideSkip:
+			return sdktrace.SamplingResult{Decision: sdktrace.Drop, Tracestate: tracestate}
+		}
+	}
+	return s.Sampler.ShouldSample(p)
+}
+
+// Description implements sdktrace.Sampler.
+func (s overrideSampler) Description() string {
+	return fmt.Sprintf("Override{%s}", s.Sampler.Description())
+}
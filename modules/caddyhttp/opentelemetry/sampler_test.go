@@ -0,0 +1,509 @@
+package opentelemetry
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestMethodSampler(t *testing.T) {
+	sampler, err := newMethodSampler(map[string]float64{"post": 1, "GET": 0}, nil, true)
+	if err != nil {
+		t.Fatalf("newMethodSampler() error = %v", err)
+	}
+
+	tests := []struct {
+		method   string
+		expected int
+	}{
+		{method: http.MethodPost, expected: 10},
+		{method: http.MethodGet, expected: 0},
+		// not listed, sampled by the default sampler
+		{method: http.MethodPut, expected: 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method, func(t *testing.T) {
+			exporter := tracetest.NewInMemoryExporter()
+			tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter), sdktrace.WithSampler(sampler))
+
+			otw, _ := newTestOpenTelemetryWrapper()
+			otw.tracer = tp.Tracer("test")
+
+			for i := 0; i < 10; i++ {
+				req := httptest.NewRequest(tt.method, "https://example.com/", nil)
+				err := otw.ServeHTTP(httptest.NewRecorder(), req, caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error {
+					return nil
+				}))
+				if err != nil {
+					t.Fatalf("ServeHTTP() error = %v", err)
+				}
+			}
+
+			if got := len(exporter.GetSpans()); got != tt.expected {
+				t.Errorf("got %d sampled spans, expected %d", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestMethodSampler_parentBased(t *testing.T) {
+	parent := trace.ContextWithRemoteSpanContext(context.Background(), trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    trace.TraceID{0x01},
+		SpanID:     trace.SpanID{0x01},
+		TraceFlags: trace.FlagsSampled,
+	}))
+	params := sdktrace.SamplingParameters{
+		ParentContext: parent,
+		TraceID:       trace.TraceID{0x01},
+		Attributes:    []attribute.KeyValue{semconv.HTTPMethodKey.String(http.MethodGet)},
+	}
+
+	tests := []struct {
+		name        string
+		fallback    sdktrace.Sampler
+		parentBased bool
+		expected    sdktrace.SamplingDecision
+	}{
+		{name: "default", parentBased: true, expected: sdktrace.RecordAndSample},
+		{name: "parent based", fallback: sdktrace.ParentBased(sdktrace.NeverSample()), parentBased: true, expected: sdktrace.RecordAndSample},
+		{name: "not parent based", fallback: sdktrace.AlwaysSample(), expected: sdktrace.Drop},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sampler, err := newMethodSampler(map[string]float64{"GET": 0}, tt.fallback, tt.parentBased)
+			if err != nil {
+				t.Fatalf("newMethodSampler() error = %v", err)
+			}
+			if got := sampler.ShouldSample(params).Decision; got != tt.expected {
+				t.Errorf("decision = %v, expected %v", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestNewMethodSampler_invalidRatio(t *testing.T) {
+	if _, err := newMethodSampler(map[string]float64{"GET": 2}, nil, true); err == nil {
+		t.Errorf("newMethodSampler() expected an error for a ratio above 1.0")
+	}
+}
+
+func TestSamplerParentBased(t *testing.T) {
+	ratio := 0.5
+	tests := []struct {
+		name     string
+		ratio    *float64
+		expected bool
+	}{
+		{name: "", expected: true},
+		{name: "", ratio: &ratio, expected: false},
+		{name: samplerAlwaysOn, expected: false},
+		{name: samplerTraceIDRatio, ratio: &ratio, expected: false},
+		{name: samplerParentBasedAlwaysOff, expected: true},
+		{name: samplerParentBasedTraceIDRatio, ratio: &ratio, expected: true},
+		{name: samplerRateLimited, expected: true},
+	}
+	for _, tt := range tests {
+		if got := samplerParentBased(tt.name, tt.ratio); got != tt.expected {
+			t.Errorf("samplerParentBased(%q, %v) = %v, expected %v", tt.name, tt.ratio, got, tt.expected)
+		}
+	}
+}
+
+func TestPathSampler(t *testing.T) {
+	sampler, err := newPathSampler([]PathSamplingRule{
+		{Regexp: `^/api/v[0-9]+/health$`, Ratio: 0},
+		{Regexp: `^/api/`, Ratio: 1},
+		{Regexp: `^/static/`, Ratio: 0},
+	}, sdktrace.NeverSample(), false)
+	if err != nil {
+		t.Fatalf("newPathSampler() error = %v", err)
+	}
+
+	tests := []struct {
+		target   string
+		expected sdktrace.SamplingDecision
+	}{
+		// the first matching rule decides
+		{target: "/api/v2/health", expected: sdktrace.Drop},
+		{target: "/api/v2/users?id=1", expected: sdktrace.RecordAndSample},
+		{target: "/static/app.js", expected: sdktrace.Drop},
+		// matching no rule, sampled by the fallback sampler
+		{target: "/login", expected: sdktrace.Drop},
+		// the query is not part of the path
+		{target: "/login?next=/api/", expected: sdktrace.Drop},
+	}
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			got := sampler.ShouldSample(sdktrace.SamplingParameters{
+				ParentContext: context.Background(),
+				TraceID:       trace.TraceID{0x01},
+				Attributes:    []attribute.KeyValue{semconv.HTTPTargetKey.String(tt.target)},
+			}).Decision
+			if got != tt.expected {
+				t.Errorf("decision = %v, expected %v", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestPathSampler_parentBased(t *testing.T) {
+	// the fallback is the method sampler, whose description does not tell it is parent based
+	fallback, err := newMethodSampler(map[string]float64{"POST": 1}, sdktrace.ParentBased(sdktrace.AlwaysSample()), true)
+	if err != nil {
+		t.Fatalf("newMethodSampler() error = %v", err)
+	}
+	sampler, err := newPathSampler([]PathSamplingRule{{Regexp: `^/health$`, Ratio: 0}}, fallback, true)
+	if err != nil {
+		t.Fatalf("newPathSampler() error = %v", err)
+	}
+
+	parent := trace.ContextWithRemoteSpanContext(context.Background(), trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    trace.TraceID{0x01},
+		SpanID:     trace.SpanID{0x01},
+		TraceFlags: trace.FlagsSampled,
+	}))
+	got := sampler.ShouldSample(sdktrace.SamplingParameters{
+		ParentContext: parent,
+		TraceID:       trace.TraceID{0x01},
+		Attributes:    []attribute.KeyValue{semconv.HTTPTargetKey.String("/health")},
+	}).Decision
+	if got != sdktrace.RecordAndSample {
+		t.Errorf("decision = %v, expected the span to follow its sampled parent", got)
+	}
+}
+
+func TestNewPathSampler_invalid(t *testing.T) {
+	if _, err := newPathSampler([]PathSamplingRule{{Regexp: `^/api/(`, Ratio: 1}}, nil, true); err == nil {
+		t.Errorf("newPathSampler() expected an error for an invalid regexp")
+	}
+	if _, err := newPathSampler([]PathSamplingRule{{Regexp: `^/api/`, Ratio: 1.5}}, nil, true); err == nil {
+		t.Errorf("newPathSampler() expected an error for a ratio above 1.0")
+	}
+}
+
+// countingSampler counts the sampling decisions of the wrapped sampler.
+type countingSampler struct {
+	sdktrace.Sampler
+	calls *int
+}
+
+func (s countingSampler) ShouldSample(p sdktrace.SamplingParameters) sdktrace.SamplingResult {
+	*s.calls++
+	return s.Sampler.ShouldSample(p)
+}
+
+func TestAdaptiveSampler(t *testing.T) {
+	const target = 100
+
+	sampler, err := newAdaptiveSampler(target, nil)
+	if err != nil {
+		t.Fatalf("newAdaptiveSampler() error = %v", err)
+	}
+	now := time.Unix(0, 0)
+	sampler.now = func() time.Time { return now }
+	random := rand.New(rand.NewSource(1))
+
+	// the request rate ramps up, the sampled rate converges toward the target once it exceeds it
+	for _, rate := range []int{50, 500, 5000, 20000} {
+		var sampled int
+		for second := 0; second < 10; second++ {
+			for i := 0; i < rate; i++ {
+				now = now.Add(time.Second / time.Duration(rate))
+				var traceID trace.TraceID
+				random.Read(traceID[:])
+				result := sampler.ShouldSample(sdktrace.SamplingParameters{ParentContext: context.Background(), TraceID: traceID})
+				// the first seconds of each rate are left for the sampler to adapt
+				if second >= 5 && result.Decision == sdktrace.RecordAndSample {
+					sampled++
+				}
+			}
+		}
+
+		got := float64(sampled) / 5
+		expected := math.Min(float64(rate), target)
+		if math.Abs(got-expected) > 0.2*expected {
+			t.Errorf("at %d requests per second, got %v sampled spans per second, expected about %v", rate, got, expected)
+		}
+	}
+}
+
+func TestAdaptiveSampler_parent(t *testing.T) {
+	sampler, err := newAdaptiveSampler(1, nil)
+	if err != nil {
+		t.Fatalf("newAdaptiveSampler() error = %v", err)
+	}
+
+	// the spans with a sampled parent follow it, whatever the budget
+	parent := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    trace.TraceID{1},
+		SpanID:     trace.SpanID{1},
+		TraceFlags: trace.FlagsSampled,
+	})
+	ctx := trace.ContextWithRemoteSpanContext(context.Background(), parent)
+	for i := 0; i < 10; i++ {
+		result := sampler.ShouldSample(sdktrace.SamplingParameters{ParentContext: ctx, TraceID: parent.TraceID()})
+		if result.Decision != sdktrace.RecordAndSample {
+			t.Fatalf("span %d with a sampled parent was dropped", i)
+		}
+	}
+}
+
+func TestNewAdaptiveSampler_invalidTarget(t *testing.T) {
+	for _, target := range []float64{0, -1, math.Inf(1)} {
+		if _, err := newAdaptiveSampler(target, nil); err == nil {
+			t.Errorf("newAdaptiveSampler(%v) expected an error", target)
+		}
+	}
+}
+
+func TestPresampledSampler(t *testing.T) {
+	tests := []struct {
+		name     string
+		sampler  sdktrace.Sampler
+		expected int
+	}{
+		{name: "sampled", sampler: sdktrace.AlwaysSample(), expected: 10},
+		{name: "dropped", sampler: sdktrace.NeverSample(), expected: 0},
+		{name: "ratio", sampler: sdktrace.TraceIDRatioBased(0.5), expected: -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			sampler := presampledSampler{Sampler: countingSampler{Sampler: tt.sampler, calls: &calls}}
+			exporter := tracetest.NewInMemoryExporter()
+			idGenerator, err := newPrefixedIDGenerator(nil)
+			if err != nil {
+				t.Fatalf("newPrefixedIDGenerator() error = %v", err)
+			}
+			presampledIDs := presampledIDGenerator{IDGenerator: idGenerator}
+			tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter), sdktrace.WithSampler(sampler), sdktrace.WithIDGenerator(presampledIDs))
+
+			otw, _ := newTestOpenTelemetryWrapper()
+			otw.tracer = tp.Tracer("test")
+			otw.presampler = sampler
+			otw.presampledIDGenerator = presampledIDs
+
+			handled := 0
+			for i := 0; i < 10; i++ {
+				req := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+				err := otw.ServeHTTP(httptest.NewRecorder(), req, caddyhttp.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) error {
+					handled++
+					if r.Context().Value(samplingResultCtxKey{}) != nil || r.Context().Value(presampledIDsCtxKey{}) != nil {
+						t.Errorf("the presampling values are passed to the next handler")
+					}
+					return nil
+				}))
+				if err != nil {
+					t.Fatalf("ServeHTTP() error = %v", err)
+				}
+			}
+
+			if handled != 10 {
+				t.Errorf("next handler called %d times, expected 10", handled)
+			}
+			// a single decision per request, the started spans are not sampled again
+			if calls != 10 {
+				t.Errorf("sampler called %d times, expected 10", calls)
+			}
+			if got := len(exporter.GetSpans()); tt.expected >= 0 && got != tt.expected {
+				t.Errorf("got %d sampled spans, expected %d", got, tt.expected)
+			}
+			// the decision was taken for the trace ID of the span
+			for _, span := range exporter.GetSpans() {
+				decision := tt.sampler.ShouldSample(sdktrace.SamplingParameters{ParentContext: context.Background(), TraceID: span.SpanContext.TraceID()}).Decision
+				if decision != sdktrace.RecordAndSample {
+					t.Errorf("span of trace %s is sampled, but its trace ID is not", span.SpanContext.TraceID())
+				}
+			}
+		})
+	}
+}
+
+func TestOpenTelemetryWrapper_newOpenTelemetryWrapper_skipUnsampled(t *testing.T) {
+	otw, err := newOpenTelemetryWrapper(context.Background(), tracerConfig{
+		skipUnsampled: true,
+		exporter:      tracerExporterConfig{insecure: true},
+	})
+	if err != nil {
+		t.Fatalf("newOpenTelemetryWrapper() error = %v", err)
+	}
+	defer otw.cleanup(nil)
+
+	if otw.presampler == nil {
+		t.Fatalf("expected a presampler")
+	}
+	if otw.tracerProviderKey.sampler != otw.presampler.Description() {
+		t.Errorf("tracer provider sampler = %q, expected %q", otw.tracerProviderKey.sampler, otw.presampler.Description())
+	}
+}
+
+func TestOpenTelemetryWrapper_ServeHTTP_sampleOverride(t *testing.T) {
+	tests := []struct {
+		name     string
+		sampler  sdktrace.Sampler
+		headers  map[string]string
+		expected int
+	}{
+		{name: "forced", sampler: sdktrace.NeverSample(), headers: map[string]string{"X-Debug-Trace": "1"}, expected: 1},
+		{name: "not forced", sampler: sdktrace.NeverSample(), headers: map[string]string{"X-Debug-Trace": "0"}, expected: 0},
+		{name: "skipped", sampler: sdktrace.AlwaysSample(), headers: map[string]string{"X-No-Trace": "true"}, expected: 0},
+		{name: "no header", sampler: sdktrace.AlwaysSample(), expected: 1},
+		{name: "forced over skipped", sampler: sdktrace.AlwaysSample(), headers: map[string]string{"X-Debug-Trace": "1", "X-No-Trace": "1"}, expected: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			exporter := tracetest.NewInMemoryExporter()
+			tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter), sdktrace.WithSampler(overrideSampler{Sampler: tt.sampler}))
+			otw := &openTelemetryWrapper{
+				tracer:            tp.Tracer("test"),
+				propagators:       propagation.TraceContext{},
+				spanName:          "test-span",
+				forceSampleHeader: "X-Debug-Trace",
+				skipSampleHeader:  "X-No-Trace",
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+			for header, value := range tt.headers {
+				req.Header.Set(header, value)
+			}
+			var sampled bool
+			err := otw.ServeHTTP(httptest.NewRecorder(), req, caddyhttp.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) error {
+				sampled = trace.SpanContextFromContext(r.Context()).IsSampled()
+				return nil
+			}))
+			if err != nil {
+				t.Fatalf("ServeHTTP() error = %v", err)
+			}
+
+			if got := len(exporter.GetSpans()); got != tt.expected {
+				t.Errorf("exported spans = %d, expected %d", got, tt.expected)
+			}
+			if sampled != (tt.expected == 1) {
+				t.Errorf("sampled = %v, expected %v", sampled, tt.expected == 1)
+			}
+		})
+	}
+}
+
+func TestRateLimitedSampler(t *testing.T) {
+	sampler, err := newRateLimitedSampler(10)
+	if err != nil {
+		t.Fatalf("newRateLimitedSampler() error = %v", err)
+	}
+	now := time.Unix(0, 0)
+	sampler.now = func() time.Time { return now }
+
+	sample := func(n int) int {
+		var sampled int
+		for i := 0; i < n; i++ {
+			result := sampler.ShouldSample(sdktrace.SamplingParameters{ParentContext: context.Background()})
+			if result.Decision == sdktrace.RecordAndSample {
+				sampled++
+			}
+		}
+		return sampled
+	}
+
+	// the bucket starts full
+	if got := sample(20); got != 10 {
+		t.Errorf("first second, got %d sampled spans, expected 10", got)
+	}
+	// a token is earned every tenth of a second
+	now = now.Add(250 * time.Millisecond)
+	if got := sample(20); got != 2 {
+		t.Errorf("after 250ms, got %d sampled spans, expected 2", got)
+	}
+	// the unused tokens do not pile up beyond the budget of a second
+	now = now.Add(time.Minute)
+	if got := sample(100); got != 10 {
+		t.Errorf("after a minute, got %d sampled spans, expected 10", got)
+	}
+}
+
+func TestRateLimitedSampler_parent(t *testing.T) {
+	sampler, err := newRateLimitedSampler(1)
+	if err != nil {
+		t.Fatalf("newRateLimitedSampler() error = %v", err)
+	}
+	now := time.Unix(0, 0)
+	sampler.now = func() time.Time { return now }
+
+	parent := func(flags trace.TraceFlags) context.Context {
+		return trace.ContextWithRemoteSpanContext(context.Background(), trace.NewSpanContext(trace.SpanContextConfig{
+			TraceID:    trace.TraceID{1},
+			SpanID:     trace.SpanID{1},
+			TraceFlags: flags,
+		}))
+	}
+
+	// the spans of a sampled trace are all kept, without taking the token of a new trace
+	for i := 0; i < 5; i++ {
+		result := sampler.ShouldSample(sdktrace.SamplingParameters{ParentContext: parent(trace.FlagsSampled)})
+		if result.Decision != sdktrace.RecordAndSample {
+			t.Fatalf("span %d with a sampled parent was dropped", i)
+		}
+	}
+	if result := sampler.ShouldSample(sdktrace.SamplingParameters{ParentContext: parent(0)}); result.Decision != sdktrace.Drop {
+		t.Errorf("span with a parent not sampled was sampled")
+	}
+	if result := sampler.ShouldSample(sdktrace.SamplingParameters{ParentContext: context.Background()}); result.Decision != sdktrace.RecordAndSample {
+		t.Errorf("root span dropped, expected the spans with a parent to leave its token")
+	}
+}
+
+func TestRateLimitedSampler_concurrent(t *testing.T) {
+	const limit = 50
+
+	sampler, err := newRateLimitedSampler(limit)
+	if err != nil {
+		t.Fatalf("newRateLimitedSampler() error = %v", err)
+	}
+	now := time.Unix(0, 0)
+	sampler.now = func() time.Time { return now }
+
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		sampled int
+	)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				result := sampler.ShouldSample(sdktrace.SamplingParameters{ParentContext: context.Background()})
+				if result.Decision == sdktrace.RecordAndSample {
+					mu.Lock()
+					sampled++
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if sampled != limit {
+		t.Errorf("got %d sampled spans, expected %d", sampled, limit)
+	}
+}
+
+func TestNewRateLimitedSampler_invalidLimit(t *testing.T) {
+	for _, limit := range []float64{0, -1, math.Inf(1), math.NaN()} {
+		if _, err := newRateLimitedSampler(limit); err == nil {
+			t.Errorf("newRateLimitedSampler(%v) expected an error", limit)
+		}
+	}
+}
@@ -0,0 +1,247 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package opentelemetry
+
+import (
+	"container/list"
+	"fmt"
+	"strings"
+	"sync"
+
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+// defaultMaxServiceNames bounds the tracer providers of a handler whose
+// service name has placeholders, unless configured otherwise.
+const defaultMaxServiceNames = 100
+
+// serviceNamePlaceholders are the prefixes of the placeholders a service
+// name may contain. Their values are set by the config, e.g. by the vars
+// handler of the routes of each site, rather than by the clients, which
+// could otherwise create a tracer provider, its exporters and its metric
+// series for each value they send, e.g. in the Host header.
+var serviceNamePlaceholders = []string{"{http.vars.", "{env."}
+
+// validateServiceNamePlaceholders returns an error if the service name has
+// a placeholder other than the ones of serviceNamePlaceholders.
+func validateServiceNamePlaceholders(serviceName string) error {
+	for rest := serviceName; ; {
+		start := strings.Index(rest, "{")
+		if start < 0 {
+			return nil
+		}
+		end := strings.Index(rest[start:], "}")
+		if end < 0 {
+			return nil
+		}
+		placeholder := rest[start : start+end+1]
+		allowed := false
+		for _, prefix := range serviceNamePlaceholders {
+			if strings.HasPrefix(placeholder, prefix) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return fmt.Errorf("service name placeholder %s is not supported, only {http.vars.*} and {env.*} are", placeholder)
+		}
+		rest = rest[start+end+1:]
+	}
+}
+
+// serviceTracers keeps the tracers of the service names resolved for the
+// requests, each from a tracer provider of its own since the service name is
+// part of the resource. The tracer of a new service name is created in the
+// background, the requests use the tracer of the handler meanwhile. Beyond
+// max service names, the least recently used one is evicted, and its tracer
+// provider released once the requests using its tracer are done.
+type serviceTracers struct {
+	max int
+	// newTracer returns the tracer of the service name and the key of its provider in the cache.
+	newTracer func(serviceName string) (trace.Tracer, tracerProviderKey, error)
+	// release releases the provider of the key, once evicted or on cleanup.
+	release func(key tracerProviderKey) error
+	logger  *zap.Logger
+
+	mu sync.Mutex
+	// order lists the serviceTracer entries, the most recently used first.
+	order   *list.List
+	entries map[string]*list.Element
+	// creating are the service names whose tracer is being created.
+	creating map[string]struct{}
+	closed   bool
+	// creations waits for the creations in progress.
+	creations sync.WaitGroup
+}
+
+// serviceTracer is an entry of serviceTracers.
+type serviceTracer struct {
+	serviceName string
+	tracer      trace.Tracer
+	key         tracerProviderKey
+
+	// users is the number of requests using the tracer, guarded by the
+	// mutex of serviceTracers as is evicted.
+	users int
+	// evicted is true once the entry is removed, its provider is then
+	// released by its last user.
+	evicted bool
+}
+
+func newServiceTracers(
+	max int,
+	newTracer func(serviceName string) (trace.Tracer, tracerProviderKey, error),
+	release func(key tracerProviderKey) error,
+	logger *zap.Logger,
+) *serviceTracers {
+	if max <= 0 {
+		max = defaultMaxServiceNames
+	}
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	return &serviceTracers{
+		max:       max,
+		newTracer: newTracer,
+		release:   release,
+		logger:    logger,
+		order:     list.New(),
+		entries:   make(map[string]*list.Element),
+		creating:  make(map[string]struct{}),
+	}
+}
+
+// get returns the tracer of the service name and the function to call once
+// the request is done with it. It returns false if the tracer is not
+// created yet, its creation being started if needed.
+func (s *serviceTracers) get(serviceName string) (trace.Tracer, func(), bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry := s.lookup(serviceName)
+	if entry == nil {
+		if _, ok := s.creating[serviceName]; !ok && !s.closed {
+			s.creating[serviceName] = struct{}{}
+			s.creations.Add(1)
+			// creating the provider, e.g. dialing its collector, must not delay the request
+			go s.create(serviceName)
+		}
+		return nil, nil, false
+	}
+	entry.users++
+	return entry.tracer, func() { s.done(entry) }, true
+}
+
+// create creates the tracer of the service name and adds its entry,
+// evicting the least recently used one beyond max.
+func (s *serviceTracers) create(serviceName string) {
+	defer s.creations.Done()
+
+	tracer, key, err := s.newTracer(serviceName)
+
+	s.mu.Lock()
+	delete(s.creating, serviceName)
+	if err != nil {
+		s.mu.Unlock()
+		s.logger.Error("creating tracer provider of service name",
+			zap.String("service_name", serviceName),
+			zap.Error(err))
+		return
+	}
+	entry := &serviceTracer{serviceName: serviceName, tracer: tracer, key: key}
+	s.entries[serviceName] = s.order.PushFront(entry)
+	var evicted *serviceTracer
+	if s.order.Len() > s.max {
+		evicted = s.evict(s.order.Back())
+	}
+	s.mu.Unlock()
+
+	if evicted != nil {
+		s.releaseTracer(evicted.serviceName, evicted.key)
+	}
+}
+
+// lookup returns the entry of the service name, now the most recently
+// used one, nil if there is none. s.mu must be held.
+func (s *serviceTracers) lookup(serviceName string) *serviceTracer {
+	elem, ok := s.entries[serviceName]
+	if !ok {
+		return nil
+	}
+	s.order.MoveToFront(elem)
+	return elem.Value.(*serviceTracer)
+}
+
+// evict removes the entry of elem, returning it if its provider can be
+// released now, nil if it is left to its last user. s.mu must be held.
+func (s *serviceTracers) evict(elem *list.Element) *serviceTracer {
+	entry := s.order.Remove(elem).(*serviceTracer)
+	delete(s.entries, entry.serviceName)
+	entry.evicted = true
+	if entry.users > 0 {
+		return nil
+	}
+	return entry
+}
+
+// done ends the use of the tracer of entry by a request, releasing its
+// provider if it is the last user of an evicted entry.
+func (s *serviceTracers) done(entry *serviceTracer) {
+	s.mu.Lock()
+	entry.users--
+	release := entry.evicted && entry.users == 0
+	s.mu.Unlock()
+
+	if release {
+		go s.releaseTracer(entry.serviceName, entry.key)
+	}
+}
+
+// releaseTracer releases the provider of the key, logging the error if any.
+func (s *serviceTracers) releaseTracer(serviceName string, key tracerProviderKey) {
+	if err := s.release(key); err != nil {
+		s.logger.Error("releasing tracer provider of evicted service name",
+			zap.String("service_name", serviceName),
+			zap.Error(err))
+	}
+}
+
+// close waits for the creations in progress and releases the providers of
+// all the service names, returning the first error. The providers still
+// used by requests are released once they are done.
+func (s *serviceTracers) close() error {
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+	s.creations.Wait()
+
+	s.mu.Lock()
+	var released []*serviceTracer
+	for s.order.Len() > 0 {
+		if entry := s.evict(s.order.Front()); entry != nil {
+			released = append(released, entry)
+		}
+	}
+	s.mu.Unlock()
+
+	var firstErr error
+	for _, entry := range released {
+		if err := s.release(entry.key); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
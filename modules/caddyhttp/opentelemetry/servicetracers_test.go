@@ -0,0 +1,237 @@
+package opentelemetry
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestServiceTracers_eviction(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		created  []string
+		released []string
+	)
+	tracers := newServiceTracers(2, func(serviceName string) (trace.Tracer, tracerProviderKey, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		created = append(created, serviceName)
+		return trace.NewNoopTracerProvider().Tracer("test"), tracerProviderKey{serviceName: serviceName}, nil
+	}, func(key tracerProviderKey) error {
+		mu.Lock()
+		defer mu.Unlock()
+		released = append(released, key.serviceName)
+		return nil
+	}, nil)
+
+	for _, serviceName := range []string{"a.example.com", "b.example.com", "a.example.com", "c.example.com"} {
+		_, done := waitServiceTracer(t, tracers, serviceName)
+		done()
+	}
+
+	// b is the least recently used one when c is added
+	mu.Lock()
+	if expected := []string{"a.example.com", "b.example.com", "c.example.com"}; !reflect.DeepEqual(created, expected) {
+		t.Errorf("created = %v, expected %v", created, expected)
+	}
+	mu.Unlock()
+	deadline := time.Now().Add(time.Second)
+	for {
+		mu.Lock()
+		evicted := append([]string(nil), released...)
+		mu.Unlock()
+		if reflect.DeepEqual(evicted, []string{"b.example.com"}) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("released = %v, expected [b.example.com]", evicted)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := tracers.close(); err != nil {
+		t.Fatalf("close() error = %v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if expected := []string{"b.example.com", "c.example.com", "a.example.com"}; !reflect.DeepEqual(released, expected) {
+		t.Errorf("released = %v, expected %v", released, expected)
+	}
+}
+
+func TestServiceTracers_error(t *testing.T) {
+	tracers := newServiceTracers(0, func(serviceName string) (trace.Tracer, tracerProviderKey, error) {
+		return nil, tracerProviderKey{}, fmt.Errorf("no exporter")
+	}, func(tracerProviderKey) error {
+		t.Errorf("release called for a tracer never created")
+		return nil
+	}, nil)
+
+	if _, _, ok := tracers.get("example.com"); ok {
+		t.Errorf("get() returned a tracer whose creation fails")
+	}
+	if err := tracers.close(); err != nil {
+		t.Errorf("close() error = %v", err)
+	}
+	if _, _, ok := tracers.get("example.com"); ok {
+		t.Errorf("get() returned a tracer whose creation fails")
+	}
+}
+
+func TestServiceTracers_evictionInFlight(t *testing.T) {
+	released := make(chan string, 1)
+	tracers := newServiceTracers(1, func(serviceName string) (trace.Tracer, tracerProviderKey, error) {
+		return trace.NewNoopTracerProvider().Tracer("test"), tracerProviderKey{serviceName: serviceName}, nil
+	}, func(key tracerProviderKey) error {
+		released <- key.serviceName
+		return nil
+	}, nil)
+
+	_, doneA := waitServiceTracer(t, tracers, "a.example.com")
+	_, doneB := waitServiceTracer(t, tracers, "b.example.com")
+	defer doneB()
+
+	// a is evicted, but its provider is kept while its request is in flight
+	select {
+	case serviceName := <-released:
+		t.Fatalf("released %s while its tracer is used", serviceName)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	doneA()
+	select {
+	case serviceName := <-released:
+		if serviceName != "a.example.com" {
+			t.Errorf("released %s, expected a.example.com", serviceName)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("the provider of a.example.com was not released once its request was done")
+	}
+}
+
+func TestServiceTracers_createInBackground(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		created int
+	)
+	unblock := make(chan struct{})
+	tracers := newServiceTracers(0, func(serviceName string) (trace.Tracer, tracerProviderKey, error) {
+		mu.Lock()
+		created++
+		mu.Unlock()
+		<-unblock
+		return trace.NewNoopTracerProvider().Tracer("test"), tracerProviderKey{serviceName: serviceName}, nil
+	}, func(tracerProviderKey) error { return nil }, nil)
+	defer tracers.close()
+
+	// the requests do not wait for the creation of the provider, nor start another one
+	for i := 0; i < 2; i++ {
+		if _, _, ok := tracers.get("example.com"); ok {
+			t.Fatalf("get() returned a tracer still being created")
+		}
+	}
+
+	close(unblock)
+	_, done := waitServiceTracer(t, tracers, "example.com")
+	done()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if created != 1 {
+		t.Errorf("created %d providers, expected 1", created)
+	}
+}
+
+func TestValidateServiceNamePlaceholders(t *testing.T) {
+	tests := []struct {
+		serviceName string
+		valid       bool
+	}{
+		{serviceName: "api", valid: true},
+		{serviceName: "{http.vars.service}", valid: true},
+		{serviceName: "{env.SERVICE}-{http.vars.site}", valid: true},
+		{serviceName: "{http.request.host}", valid: false},
+		{serviceName: "site-{http.vars.site}-{http.request.header.X-Service}", valid: false},
+	}
+	for _, tt := range tests {
+		err := validateServiceNamePlaceholders(tt.serviceName)
+		if (err == nil) != tt.valid {
+			t.Errorf("validateServiceNamePlaceholders(%q) error = %v, expected valid %v", tt.serviceName, err, tt.valid)
+		}
+	}
+}
+
+func TestOpenTelemetryWrapper_ServeHTTP_serviceName(t *testing.T) {
+	otw, exporter := newTestOpenTelemetryWrapper()
+	otw.serviceName = "{http.vars.service}"
+	otw.serviceTracers = newServiceTracers(0, func(serviceName string) (trace.Tracer, tracerProviderKey, error) {
+		res, err := newResource(context.Background(), serviceName, "", nil)
+		if err != nil {
+			return nil, tracerProviderKey{}, err
+		}
+		tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter), sdktrace.WithResource(res))
+		return tp.Tracer("test"), tracerProviderKey{serviceName: serviceName}, nil
+	}, func(tracerProviderKey) error { return nil }, nil)
+
+	for _, service := range []string{"shop", "blog"} {
+		// the first requests of a service use the tracer of the handler while its provider is created
+		_, done := waitServiceTracer(t, otw.serviceTracers, service)
+		done()
+
+		req := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+		req = req.WithContext(context.WithValue(req.Context(), caddyhttp.VarsCtxKey, map[string]interface{}{"service": service}))
+		caddyhttp.NewTestReplacer(req)
+
+		err := otw.ServeHTTP(httptest.NewRecorder(), req, caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error {
+			return nil
+		}))
+		if err != nil {
+			t.Fatalf("ServeHTTP() error = %v", err)
+		}
+	}
+
+	spans := exporter.GetSpans()
+	if len(spans) != 2 {
+		t.Fatalf("got %d spans, expected 2", len(spans))
+	}
+	for i, expected := range []string{"shop", "blog"} {
+		if got := serviceNameOf(spans[i]); got != expected {
+			t.Errorf("span %d service.name = %q, expected %q", i, got, expected)
+		}
+	}
+}
+
+// waitServiceTracer returns the tracer of the service name, once created.
+func waitServiceTracer(t *testing.T, tracers *serviceTracers, serviceName string) (trace.Tracer, func()) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		if tracer, done, ok := tracers.get(serviceName); ok {
+			return tracer, done
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the tracer of %s was not created", serviceName)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func serviceNameOf(span tracetest.SpanStub) string {
+	for _, attr := range span.Resource.Attributes() {
+		if attr.Key == semconv.ServiceNameKey {
+			return attr.Value.AsString()
+		}
+	}
+	return ""
+}
@@ -0,0 +1,73 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package opentelemetry
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// spanCounts counts the spans handed to the exporters, surfaced by the
+// metrics endpoint of Caddy, for the operators to tune the span processing.
+//
+// Each span is counted once by exporter. The spans enqueued but neither
+// exported, given up after failed exports nor dropped are still queued.
+// The spans dropped because the queue of a processor is full are counted
+// once the processor is handed more spans than it holds, see enqueue.
+var spanCounts = struct {
+	enqueued     *prometheus.CounterVec
+	exported     *prometheus.CounterVec
+	exportFailed *prometheus.CounterVec
+	dropped      *prometheus.CounterVec
+}{}
+
+func init() {
+	const ns, sub = "caddy", "opentelemetry"
+
+	labels := []string{"service_name"}
+	spanCounts.enqueued = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "spans_enqueued_total",
+		Help:      "Number of sampled spans handed to the span processors, once by exporter.",
+	}, labels)
+	spanCounts.exported = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "spans_exported_total",
+		Help:      "Number of spans successfully exported.",
+	}, labels)
+	spanCounts.exportFailed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "spans_export_failed_total",
+		Help:      "Number of spans given up after their export failed.",
+	}, labels)
+	spanCounts.dropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "spans_dropped_total",
+		Help:      "Number of sampled spans dropped because the queue of a span processor was full.",
+	}, labels)
+}
+
+// deleteSpanCounts deletes the span counts of the service name, once it has
+// no tracer provider anymore, e.g. evicted from the serviceTracers.
+func deleteSpanCounts(serviceName string) {
+	spanCounts.enqueued.DeleteLabelValues(serviceName)
+	spanCounts.exported.DeleteLabelValues(serviceName)
+	spanCounts.exportFailed.DeleteLabelValues(serviceName)
+	spanCounts.dropped.DeleteLabelValues(serviceName)
+}
@@ -0,0 +1,78 @@
+package opentelemetry
+
+import (
+	"context"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestSpanCounts(t *testing.T) {
+	exporter := &flakyExporter{InMemoryExporter: tracetest.NewInMemoryExporter()}
+	queue := &spanQueue{serviceName: "span-counts"}
+	queued := queue.exporter(exporter)
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(queued.processor(sdktrace.NewSimpleSpanProcessor(queued))))
+
+	export := func() {
+		_, span := tp.Tracer("test").Start(context.Background(), "span")
+		span.End()
+	}
+	export()
+	export()
+	exporter.failing = true
+	export()
+	// the failed span is given up on shutdown
+	_ = tp.Shutdown(context.Background())
+
+	for _, tt := range []struct {
+		name     string
+		got      float64
+		expected float64
+	}{
+		{name: "enqueued", got: testutil.ToFloat64(spanCounts.enqueued.WithLabelValues("span-counts")), expected: 3},
+		{name: "exported", got: testutil.ToFloat64(spanCounts.exported.WithLabelValues("span-counts")), expected: 2},
+		{name: "export failed", got: testutil.ToFloat64(spanCounts.exportFailed.WithLabelValues("span-counts")), expected: 1},
+		{name: "dropped", got: testutil.ToFloat64(spanCounts.dropped.WithLabelValues("span-counts")), expected: 0},
+	} {
+		if tt.got != tt.expected {
+			t.Errorf("%s spans = %v, expected %v", tt.name, tt.got, tt.expected)
+		}
+	}
+}
+
+func TestSpanCounts_queueFull(t *testing.T) {
+	queue := &spanQueue{serviceName: "span-counts-queue-full"}
+	queued := queue.exporter(tracetest.NewInMemoryExporter())
+	queued.maxQueued = 1
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(queued.processor(&stepProcessor{exporter: queued, max: 1})))
+	defer tp.Shutdown(context.Background())
+
+	// the processor exports on flush only, the second span finds its queue full
+	for i := 0; i < 2; i++ {
+		_, span := tp.Tracer("test").Start(context.Background(), "span")
+		span.End()
+	}
+
+	if got := testutil.ToFloat64(spanCounts.enqueued.WithLabelValues("span-counts-queue-full")); got != 2 {
+		t.Errorf("enqueued spans = %v, expected 2", got)
+	}
+	if queue.len() != 1 {
+		t.Errorf("queue length = %d, expected 1", queue.len())
+	}
+	if got := testutil.ToFloat64(spanCounts.dropped.WithLabelValues("span-counts-queue-full")); got != 1 {
+		t.Errorf("dropped spans = %v, expected 1", got)
+	}
+}
+
+func TestDeleteSpanCounts(t *testing.T) {
+	spanCounts.exported.WithLabelValues("span-counts-deleted").Add(2)
+
+	deleteSpanCounts("span-counts-deleted")
+
+	// the series is created again from zero
+	if got := testutil.ToFloat64(spanCounts.exported.WithLabelValues("span-counts-deleted")); got != 0 {
+		t.Errorf("exported spans = %v, expected the series to be deleted", got)
+	}
+}
@@ -0,0 +1,48 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package opentelemetry
+
+import (
+	"time"
+
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// minDurationProcessor drops the spans shorter than minDuration before
+// they reach the wrapped processor, unless their status is an error or
+// they are heartbeats, so that trivially short spans do not add noise to
+// the traces.
+type minDurationProcessor struct {
+	sdktrace.SpanProcessor
+	minDuration time.Duration
+}
+
+// OnEnd implements sdktrace.SpanProcessor.
+func (p minDurationProcessor) OnEnd(s sdktrace.ReadOnlySpan) {
+	if s.Status().Code != codes.Error && s.EndTime().Sub(s.StartTime()) < p.minDuration && !isHeartbeat(s) {
+		return
+	}
+	p.SpanProcessor.OnEnd(s)
+}
+
+// filterSpanProcessor wraps processor to drop the spans shorter than
+// minDuration, processor is returned as is if minDuration is zero.
+func filterSpanProcessor(processor sdktrace.SpanProcessor, minDuration time.Duration) sdktrace.SpanProcessor {
+	if minDuration <= 0 {
+		return processor
+	}
+	return minDurationProcessor{SpanProcessor: processor, minDuration: minDuration}
+}
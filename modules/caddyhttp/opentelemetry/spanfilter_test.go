@@ -0,0 +1,64 @@
+package opentelemetry
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestMinDurationProcessor(t *testing.T) {
+	tests := []struct {
+		name     string
+		duration time.Duration
+		status   codes.Code
+		expected bool
+	}{
+		{
+			name:     "fast successful span",
+			duration: 100 * time.Microsecond,
+			status:   codes.Ok,
+			expected: false,
+		},
+		{
+			name:     "fast errored span",
+			duration: 100 * time.Microsecond,
+			status:   codes.Error,
+			expected: true,
+		},
+		{
+			name:     "slow span",
+			duration: 5 * time.Millisecond,
+			status:   codes.Unset,
+			expected: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			exporter := tracetest.NewInMemoryExporter()
+			processor := filterSpanProcessor(sdktrace.NewSimpleSpanProcessor(exporter), time.Millisecond)
+			tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(processor))
+			defer tp.Shutdown(context.Background())
+
+			start := time.Now()
+			_, span := tp.Tracer("test").Start(context.Background(), "span", trace.WithTimestamp(start))
+			span.SetStatus(tt.status, "")
+			span.End(trace.WithTimestamp(start.Add(tt.duration)))
+
+			if got := len(exporter.GetSpans()) == 1; got != tt.expected {
+				t.Errorf("span exported = %v, expected %v", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestFilterSpanProcessor_disabled(t *testing.T) {
+	processor := sdktrace.NewSimpleSpanProcessor(tracetest.NewInMemoryExporter())
+	if got := filterSpanProcessor(processor, 0); got != processor {
+		t.Errorf("filterSpanProcessor() = %v, expected the processor as is", got)
+	}
+}
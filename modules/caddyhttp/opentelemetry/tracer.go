@@ -0,0 +1,2248 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package opentelemetry
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.opentelemetry.io/contrib/propagators/aws/xray"
+	"go.opentelemetry.io/contrib/propagators/b3"
+	"go.opentelemetry.io/contrib/propagators/jaeger"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/baggage"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/credentials"
+)
+
+const (
+	webEngineName      = "Caddy"
+	defaultServiceName = "caddy"
+
+	// defaultSpanNamePrefix is followed by the method of the request in the span name, unless one is configured.
+	defaultSpanNamePrefix = "HTTP "
+
+	// defaultBaggageMaxLength is the maximum length of the baggage values recorded as span attributes.
+	defaultBaggageMaxLength = 256
+
+	defaultPropagators = "tracecontext,baggage"
+
+	protocolGRPC         = "grpc"
+	protocolHTTPProtobuf = "http/protobuf"
+	protocolStdout       = "stdout"
+
+	// the default endpoints of the exporters
+	defaultGRPCEndpoint = "localhost:4317"
+	defaultHTTPEndpoint = "localhost:4318"
+	defaultHTTPURLPath  = "/v1/traces"
+
+	compressionGzip = "gzip"
+	compressionNone = "none"
+
+	spanProcessorBatch  = "batch"
+	spanProcessorSimple = "simple"
+
+	existingSpanChild   = "child"
+	existingSpanReplace = "replace"
+	existingSpanSkip    = "skip"
+
+	duplicateTraceparentFirst = "first"
+	duplicateTraceparentLast  = "last"
+
+	envExporterEndpoint          = "OTEL_EXPORTER_OTLP_ENDPOINT"
+	envExporterTracesEndpoint    = "OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"
+	envExporterProtocol          = "OTEL_EXPORTER_OTLP_PROTOCOL"
+	envExporterTracesProtocol    = "OTEL_EXPORTER_OTLP_TRACES_PROTOCOL"
+	envExporterCertificate       = "OTEL_EXPORTER_OTLP_CERTIFICATE"
+	envExporterTracesCertificate = "OTEL_EXPORTER_OTLP_TRACES_CERTIFICATE"
+	envExporterTimeout           = "OTEL_EXPORTER_OTLP_TIMEOUT"
+	envExporterTracesTimeout     = "OTEL_EXPORTER_OTLP_TRACES_TIMEOUT"
+	envExporterCompression       = "OTEL_EXPORTER_OTLP_COMPRESSION"
+	envExporterTracesCompression = "OTEL_EXPORTER_OTLP_TRACES_COMPRESSION"
+	envExporterInsecure          = "OTEL_EXPORTER_OTLP_INSECURE"
+	envExporterTracesInsecure    = "OTEL_EXPORTER_OTLP_TRACES_INSECURE"
+	envServiceNameVar            = "OTEL_SERVICE_NAME"
+	envTracesSampler             = "OTEL_TRACES_SAMPLER"
+	envTracesSamplerArg          = "OTEL_TRACES_SAMPLER_ARG"
+
+	samplerAlwaysOn                = "always_on"
+	samplerAlwaysOff               = "always_off"
+	samplerTraceIDRatio            = "traceidratio"
+	samplerParentBasedAlwaysOn     = "parentbased_always_on"
+	samplerParentBasedAlwaysOff    = "parentbased_always_off"
+	samplerParentBasedTraceIDRatio = "parentbased_traceidratio"
+	samplerRateLimited             = "rate_limited"
+)
+
+// buildCommit is the commit Caddy was built from, recorded with its version
+// in the caddy.build resource attribute. It is set at build time with:
+//
+//     -ldflags "-X github.com/caddyserver/caddy/v2/modules/caddyhttp/opentelemetry.buildCommit=<commit>"
+var buildCommit string
+
+// RoutePatternVar is the name of the request variable (see caddyhttp.SetVar and
+// the vars handler) holding the low-cardinality pattern of the matched route,
+// e.g. "/users/{id}". Caddy does not record which route matched a request, so
+// the pattern has to be set by the configuration or by another handler.
+const RoutePatternVar = "route_pattern"
+
+const (
+	spanNameSourceStatic = "static"
+	spanNameSourceRoute  = "route"
+	spanNameSourceMethod = "method"
+)
+
+// idGeneratorXRay generates the time prefixed trace IDs of AWS X-Ray.
+const idGeneratorXRay = "xray"
+
+// authResultDenied is the authentication outcome of the denied requests.
+const authResultDenied = "denied"
+
+// requestIDKey is the span attribute and baggage member key of the request ID.
+const requestIDKey = "caddy.request_id"
+
+// missingHostDrop drops the http.host attribute of the requests without a host.
+const missingHostDrop = "drop"
+
+// tracerConfig holds the settings used to build an openTelemetryWrapper.
+type tracerConfig struct {
+	spanName string
+	// spanNameFromResponseHeader is the response header renaming the span once the request is handled, if set.
+	spanNameFromResponseHeader string
+	// serviceName may contain placeholders, resolved for each request, each
+	// service name resolved getting a tracer provider of its own.
+	serviceName string
+	// maxServiceNames bounds the tracer providers of a service name with placeholders, defaultMaxServiceNames if zero.
+	maxServiceNames int
+	// serviceVersion is the version of the service, omitted from the resource if empty.
+	serviceVersion string
+	propagators    string
+
+	// sampler is the name of the sampler, empty means the SDK default one.
+	sampler string
+
+	// samplingRatio is the ratio of sampled traces; nil means always sample.
+	samplingRatio *float64
+	// tracesPerSecond is the limit of the rate limited sampler.
+	tracesPerSecond float64
+	// methodSamplingRatios are the sampling ratios of the methods, the other ones use the sampler.
+	methodSamplingRatios map[string]float64
+	// pathSamplingRules are the sampling rules of the paths, evaluated before the methodSamplingRatios.
+	pathSamplingRules []PathSamplingRule
+	// targetSpansPerSecond is the budget of the adaptive sampler, zero disables it.
+	targetSpansPerSecond float64
+
+	// hostRedaction is either "hash", "drop" or empty to export the host as is.
+	hostRedaction string
+	// hostRedactionKey is the key of the host hashes, a random one if empty.
+	hostRedactionKey []byte
+
+	// truncationStrategy is either "raw" or "smart", see truncateAttributes.
+	truncationStrategy string
+	// truncationLength is the maximum length of the string attributes, zero disables the truncation.
+	truncationLength int
+
+	// spanAttributeValueLengthLimit is the maximum length of the string attribute values, zero if unlimited.
+	spanAttributeValueLengthLimit int
+	// spanAttributeCountLimit is the maximum number of attributes of a span, zero for the SDK's default.
+	spanAttributeCountLimit int
+
+	// requestIDCtxKey is the context key of the ID of the request, if any.
+	requestIDCtxKey caddy.CtxKey
+	// spanNameSource is the comma separated list of the span name sources, see resolveSpanName.
+	spanNameSource string
+	// routePattern is the pattern of the route of the handler, used by the "route" source when the request has none.
+	routePattern string
+
+	// requestIDBaggage adds the request ID to the propagated baggage.
+	requestIDBaggage bool
+
+	// heartbeatInterval is the interval of the heartbeat span, zero disables it.
+	heartbeatInterval time.Duration
+
+	drainTimeout time.Duration
+	// shutdownTimeout bounds the flush and the shutdown of the tracer provider, defaultShutdownTimeout if zero.
+	shutdownTimeout time.Duration
+
+	// minSpanDuration is the duration under which the spans are not exported, unless they failed.
+	minSpanDuration time.Duration
+
+	// bypassHeader is the request header that disables the tracing when set to a true value.
+	bypassHeader string
+
+	// forceSampleHeader and skipSampleHeader are the request headers which, when set to a true value,
+	// sample or drop the span whatever the sampler, see overrideSampler.
+	forceSampleHeader string
+	skipSampleHeader  string
+
+	// perRequestService is resolved by the replacer for each request and recorded as the peer.service attribute.
+	perRequestService string
+
+	// resourceAttributes are merged into the resource, over its default attributes.
+	resourceAttributes map[string]string
+
+	// setBaggage are the members added to the baggage of the propagated trace context.
+	setBaggage map[string]string
+
+	// recordCacheControl records the Cache-Control response header.
+	recordCacheControl bool
+
+	// recordReceivedAt records the time the request was received.
+	recordReceivedAt bool
+
+	// baggageAsAttributes records the baggage members as span attributes, truncated to baggageMaxLength.
+	baggageAsAttributes bool
+	baggageMaxLength    int
+
+	// missingHost is either "drop" or the host recorded for the requests without one, see requestAttributes.
+	missingHost string
+
+	// spanProcessor is either "batch", the default, or "simple" to export each span when it ends.
+	spanProcessor string
+
+	// traceIDPrefix is the hex encoded prefix of the generated trace IDs, if any.
+	traceIDPrefix string
+	// idGenerator is either "xray" or empty for the random IDs of the SDK.
+	idGenerator string
+
+	// trustLevelCtxKey is the context key of the trust level of the request, if any.
+	trustLevelCtxKey caddy.CtxKey
+	// authResultCtxKey is the context key, and request variable, of the authentication outcome, if any.
+	authResultCtxKey caddy.CtxKey
+	// authDeniedError sets the status of the span to error for the denied requests.
+	authDeniedError bool
+	// linkInitiator links the spans of the internal requests to the span which initiated them.
+	linkInitiator bool
+	// spanLinks are the request headers whose trace contexts the spans are linked to.
+	spanLinks []string
+
+	// clientSamplingRatio is the fraction of the client IPs traced, nil to trace all of them.
+	clientSamplingRatio *float64
+	// rolloutPercentage is the percentage of the routes traced, nil to trace all of them, see routeRolledOut.
+	rolloutPercentage *float64
+
+	// traceIDHeader is the response header set to the trace ID, if any.
+	traceIDHeader string
+
+	// trailers are the response trailers recorded as span attributes.
+	trailers []string
+
+	// captureClientIP records the IP address of the client.
+	captureClientIP bool
+
+	// captureBodySizes records the Content-Length of the request and the size of the response written.
+	captureBodySizes bool
+
+	// skipUnsampled does not start the spans the sampler drops, instead of starting unsampled ones.
+	skipUnsampled bool
+
+	// serverName is the name of the server block recorded as caddy.server, if set.
+	serverName string
+
+	// ipEnricher looks up the attributes of the client IP addresses, if set.
+	ipEnricher IPEnricher
+
+	// existingSpan is what to do when the request context already carries a non-recording span:
+	// "child", the default, to start a child of it, "replace" to start a new trace, or "skip" not to trace.
+	existingSpan string
+	// duplicateTraceparent is the traceparent header used when there are several, "first" or "last".
+	duplicateTraceparent string
+
+	// excludePaths are the paths, or the path prefixes when ending with *, of the requests not traced.
+	excludePaths []string
+
+	// spanEvents adds events to the span when the request is passed to the next handler and when the response is written.
+	spanEvents bool
+
+	// metrics enables the request metrics, exported every metricsCollectPeriod if not zero.
+	metrics              bool
+	metricsCollectPeriod time.Duration
+
+	// dedicatedProvider builds a tracer provider owned by the handler, instead of sharing the cached one.
+	dedicatedProvider bool
+
+	// tracerProvider and meterProvider are the providers of the otel app the handler uses,
+	// nil to build its own from the exporter settings. The app owns them and shuts them down.
+	tracerProvider trace.TracerProvider
+	meterProvider  metric.MeterProvider
+
+	exporter tracerExporterConfig
+
+	// logger logs the errors of the initialization which are not returned, a no-op one is used if nil.
+	logger *zap.Logger
+
+	// tlsIssuerCtxKey is the context key of the issuer of the certificate served for the request, if any.
+	tlsIssuerCtxKey caddy.CtxKey
+	// queueEnteredCtxKey is the context key of the time the request was queued, if any.
+	queueEnteredCtxKey caddy.CtxKey
+	// tlsHandshakeCtxKey is the context key of the duration of the TLS handshake of the connection, if any.
+	tlsHandshakeCtxKey caddy.CtxKey
+	// logIDCtxKey is the context key of the ID of the access log entry of the request, if any.
+	logIDCtxKey caddy.CtxKey
+	// alpnOfferedCtxKey is the context key of the application protocols offered by the client, if any.
+	alpnOfferedCtxKey caddy.CtxKey
+}
+
+// tracerExporterConfig holds the settings of the span exporter.
+type tracerExporterConfig struct {
+	// endpoint is the host:port of the collector, see parseEndpoint.
+	endpoint string
+	// genericEndpoint is the endpoint of all the signals, see resolveEndpoint.
+	genericEndpoint string
+	// urlPath is the path of the URL the spans are sent to over HTTP, the exporter's default one if empty.
+	urlPath     string
+	protocol    string
+	certificate string
+	insecure    bool
+	headers     map[string]string
+	// timeout bounds each export, the exporter's default one is used if zero.
+	timeout time.Duration
+	// compression is either "gzip" or "none", empty meaning none.
+	compression string
+	// clientCertificate and clientKey are the paths of the client key pair for mutual TLS.
+	clientCertificate string
+	clientKey         string
+	// tlsSkipVerify disables the verification of the collector certificate, unlike insecure which disables TLS.
+	tlsSkipVerify bool
+	// serverName overrides the host of the endpoint as the name the collector certificate is verified against.
+	serverName string
+	// failoverEndpoints receive the spans, in order, when the endpoints before them are failing.
+	failoverEndpoints []string
+
+	// failoverRetryInterval is how long a failing endpoint is skipped, defaultFailoverRetryInterval if zero.
+	failoverRetryInterval time.Duration
+	// retry configures the retries of the gRPC exporter, its default one is used if nil.
+	retry *ExporterRetry
+	// stdoutFile is the path of the file the stdout exporter appends the spans to, standard error if empty.
+	stdoutFile string
+}
+
+// parseEndpoint normalizes an endpoint given as a URL, e.g.
+// https://otel.example.com:4318/v1/traces, to the host:port expected by
+// the exporters. The http scheme implies an insecure connection and the
+// https one a secure connection, whatever the insecure setting. The path
+// of the URL is kept for the HTTP export, and ignored by the gRPC one.
+// An endpoint without a scheme is used as is.
+func (cfg *tracerExporterConfig) parseEndpoint() error {
+	if !strings.Contains(cfg.endpoint, "://") {
+		return nil
+	}
+
+	u, err := url.Parse(cfg.endpoint)
+	if err != nil {
+		return fmt.Errorf("parsing exporter endpoint %q: %w", cfg.endpoint, err)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("exporter endpoint %q has no host", cfg.endpoint)
+	}
+	switch u.Scheme {
+	case "http":
+		cfg.insecure = true
+	case "https":
+		cfg.insecure = false
+	default:
+		return fmt.Errorf("unsupported exporter endpoint scheme %q in %q, expected http or https", u.Scheme, cfg.endpoint)
+	}
+
+	cfg.endpoint = u.Host
+	if u.Path != "" && u.Path != "/" {
+		cfg.urlPath = u.Path
+	}
+	return nil
+}
+
+// effectiveEndpoint returns the endpoints the spans are exported to, one by
+// protocol, the default ones of the exporters if none is configured.
+func (cfg tracerExporterConfig) effectiveEndpoint() string {
+	var endpoints []string
+	for _, protocol := range strings.Split(cfg.protocol, ",") {
+		endpoint := cfg.endpoint
+		switch strings.TrimSpace(protocol) {
+		case protocolStdout:
+			endpoint = protocolStdout
+		case protocolHTTPProtobuf:
+			if endpoint == "" {
+				endpoint = defaultHTTPEndpoint
+			}
+			if cfg.urlPath != "" {
+				endpoint += cfg.urlPath
+			} else {
+				endpoint += defaultHTTPURLPath
+			}
+		default:
+			if endpoint == "" {
+				endpoint = defaultGRPCEndpoint
+			}
+		}
+		endpoints = append(endpoints, endpoint)
+	}
+	return strings.Join(endpoints, ",")
+}
+
+// customTLS returns true if the exporter needs a TLS configuration of its own.
+func (cfg tracerExporterConfig) customTLS() bool {
+	return cfg.certificate != "" || cfg.clientCertificate != "" || cfg.tlsSkipVerify || cfg.serverName != ""
+}
+
+// openTelemetryWrapper is responsible for the tracing injection, extraction and propagation.
+type openTelemetryWrapper struct {
+	tracer      trace.Tracer
+	propagators propagation.TextMapPropagator
+
+	spanName string
+	// spanNameHasPlaceholders is true if spanName must be resolved by the replacer.
+	spanNameHasPlaceholders bool
+	// spanNameSources are tried in order to name the span, the static span name being the last resort.
+	spanNameSources []string
+	routePattern    string
+	// spanNameFromResponseHeader is the response header renaming the span, if any.
+	spanNameFromResponseHeader string
+
+	tlsIssuerCtxKey    caddy.CtxKey
+	queueEnteredCtxKey caddy.CtxKey
+	tlsHandshakeCtxKey caddy.CtxKey
+	logIDCtxKey        caddy.CtxKey
+	alpnOfferedCtxKey  caddy.CtxKey
+
+	requestIDCtxKey  caddy.CtxKey
+	requestIDBaggage bool
+
+	// tracerProviderKey identifies the tracer provider in the cache.
+	tracerProviderKey tracerProviderKey
+	// serviceName is the service name with placeholders, resolved for each request, empty if static.
+	serviceName string
+	// serviceTracers are the tracers of the resolved service names, nil if the service name is static.
+	serviceTracers *serviceTracers
+	// appProvider is true if the tracer provider belongs to the otel app, rather than to the cache.
+	appProvider bool
+	// dedicatedProvider is the tracer provider owned by the handler, nil if it comes from the cache.
+	dedicatedProvider *sdktrace.TracerProvider
+	dedicatedQueue    *spanQueue
+
+	// heartbeat is the heartbeat of a dedicated or otel app provider, the cache runs the one of a shared provider.
+	heartbeat *heartbeat
+
+	// drainTimeout bounds the export of the queued spans on cleanup, zero flushes them once.
+	drainTimeout    time.Duration
+	shutdownTimeout time.Duration
+
+	bypassHeader string
+
+	forceSampleHeader string
+	skipSampleHeader  string
+
+	perRequestService string
+
+	recordCacheControl bool
+	recordReceivedAt   bool
+
+	baggageAsAttributes bool
+	baggageMaxLength    int
+
+	missingHost string
+
+	trustLevelCtxKey caddy.CtxKey
+	authResultCtxKey caddy.CtxKey
+	authDeniedError  bool
+	linkInitiator    bool
+	spanLinks        []string
+
+	// logger logs the issues of the requests which do not fail them, e.g. malformed span links, if not nil.
+	logger *zap.Logger
+
+	clientSamplingRatio *float64
+
+	// disabled is true if the route of the handler is not among the traced ones.
+	disabled bool
+
+	// setBaggage are the members added to the baggage of the propagated trace context.
+	setBaggage []baggage.Member
+
+	spanEvents bool
+
+	traceIDHeader string
+
+	trailers []string
+
+	captureClientIP  bool
+	captureBodySizes bool
+
+	serverName string
+
+	// ipEnrichments are the attributes of the client IP addresses, nil without an enricher.
+	ipEnrichments *ipEnrichments
+
+	existingSpan string
+
+	// lastTraceparent uses the last valid traceparent header of the request instead of the first one.
+	lastTraceparent bool
+
+	// presampler decides whether to start the spans, nil to always start them.
+	presampler sdktrace.Sampler
+	// presampledIDGenerator generates the IDs of the spans presampled without a parent.
+	presampledIDGenerator sdktrace.IDGenerator
+
+	// excludedPaths and excludedPathPrefixes are the request paths not traced.
+	excludedPaths        map[string]struct{}
+	excludedPathPrefixes []string
+
+	// metrics records the request metrics, nil if disabled.
+	metrics *requestMetrics
+	// metricsKey is the key of the metrics in defaultMeterProviderCache, unless recorded by the otel app.
+	metricsKey meterProviderKey
+}
+
+// newOpenTelemetryWrapper is responsible for the openTelemetryWrapper initialization using provided configuration.
+func newOpenTelemetryWrapper(
+	ctx context.Context,
+	cfg tracerConfig,
+) (openTelemetryWrapper, error) {
+	if cfg.logger == nil {
+		cfg.logger = zap.NewNop()
+	}
+
+	if cfg.baggageMaxLength <= 0 {
+		cfg.baggageMaxLength = defaultBaggageMaxLength
+	}
+
+	// the provider of the requests whose service name resolves to nothing gets the one of the environment
+	var serviceNameTemplate string
+	if strings.Contains(cfg.serviceName, "{") {
+		if err := validateServiceNamePlaceholders(cfg.serviceName); err != nil {
+			return openTelemetryWrapper{}, err
+		}
+		serviceNameTemplate = cfg.serviceName
+		cfg.serviceName = ""
+	}
+
+	if err := cfg.resolveExporter(ctx); err != nil {
+		return openTelemetryWrapper{}, err
+	}
+
+	if cfg.propagators == "" {
+		cfg.propagators = defaultPropagators
+	}
+
+	if err := validateHostRedaction(cfg.hostRedaction); err != nil {
+		return openTelemetryWrapper{}, err
+	}
+	if cfg.hostRedaction == hostRedactionHash {
+		key, err := hostRedactionKey(cfg.hostRedactionKey)
+		if err != nil {
+			return openTelemetryWrapper{}, err
+		}
+		cfg.hostRedactionKey = key
+	}
+
+	excludedPaths := make(map[string]struct{})
+	var excludedPathPrefixes []string
+	for _, path := range cfg.excludePaths {
+		if err := validateExcludePath(path); err != nil {
+			return openTelemetryWrapper{}, err
+		}
+		if prefix := strings.TrimSuffix(path, "*"); prefix != path {
+			excludedPathPrefixes = append(excludedPathPrefixes, prefix)
+		} else {
+			excludedPaths[path] = struct{}{}
+		}
+	}
+
+	if err := validateTruncationStrategy(cfg.truncationStrategy); err != nil {
+		return openTelemetryWrapper{}, err
+	}
+
+	switch cfg.spanProcessor {
+	case "", spanProcessorBatch, spanProcessorSimple:
+	default:
+		return openTelemetryWrapper{}, fmt.Errorf("unsupported span processor %q", cfg.spanProcessor)
+	}
+
+	switch cfg.existingSpan {
+	case "", existingSpanChild, existingSpanReplace, existingSpanSkip:
+	default:
+		return openTelemetryWrapper{}, fmt.Errorf("unsupported existing span policy %q", cfg.existingSpan)
+	}
+
+	switch cfg.duplicateTraceparent {
+	case "", duplicateTraceparentFirst, duplicateTraceparentLast:
+	default:
+		return openTelemetryWrapper{}, fmt.Errorf("unsupported duplicate traceparent policy %q", cfg.duplicateTraceparent)
+	}
+
+	spanNameSources, err := parseSpanNameSources(cfg.spanNameSource)
+	if err != nil {
+		return openTelemetryWrapper{}, err
+	}
+
+	propagators, err := getPropagators(cfg.propagators)
+	if err != nil {
+		return openTelemetryWrapper{}, fmt.Errorf("creating propagators error: %w", err)
+	}
+
+	setBaggage, err := newBaggageMembers(cfg.setBaggage)
+	if err != nil {
+		return openTelemetryWrapper{}, err
+	}
+
+	var idGenerator sdktrace.IDGenerator
+	switch cfg.idGenerator {
+	case "":
+	case idGeneratorXRay:
+		if cfg.traceIDPrefix != "" {
+			return openTelemetryWrapper{}, fmt.Errorf("trace ID prefix cannot be used with the %s ID generator", cfg.idGenerator)
+		}
+		idGenerator = xray.NewIDGenerator()
+	default:
+		return openTelemetryWrapper{}, fmt.Errorf("unsupported ID generator %q", cfg.idGenerator)
+	}
+	if cfg.traceIDPrefix != "" {
+		prefix, err := hex.DecodeString(cfg.traceIDPrefix)
+		if err != nil {
+			return openTelemetryWrapper{}, fmt.Errorf("decoding trace ID prefix: %w", err)
+		}
+		idGenerator, err = newPrefixedIDGenerator(prefix)
+		if err != nil {
+			return openTelemetryWrapper{}, fmt.Errorf("creating ID generator error: %w", err)
+		}
+	}
+
+	// the route is identified by its pattern, or by the span name the handlers of the route share
+	routeID := cfg.routePattern
+	if routeID == "" {
+		routeID = cfg.spanName
+	}
+
+	ot := openTelemetryWrapper{
+		spanName:                cfg.spanName,
+		spanNameHasPlaceholders: strings.Contains(cfg.spanName, "{"),
+		propagators:             propagators,
+		tlsIssuerCtxKey:         cfg.tlsIssuerCtxKey,
+		queueEnteredCtxKey:      cfg.queueEnteredCtxKey,
+		tlsHandshakeCtxKey:      cfg.tlsHandshakeCtxKey,
+		logIDCtxKey:             cfg.logIDCtxKey,
+		alpnOfferedCtxKey:       cfg.alpnOfferedCtxKey,
+		spanNameSources:         spanNameSources,
+		routePattern:            cfg.routePattern,
+		requestIDCtxKey:         cfg.requestIDCtxKey,
+		requestIDBaggage:        cfg.requestIDBaggage,
+		drainTimeout:            cfg.drainTimeout,
+		shutdownTimeout:         cfg.shutdownTimeout,
+		bypassHeader:            cfg.bypassHeader,
+		forceSampleHeader:       cfg.forceSampleHeader,
+		skipSampleHeader:        cfg.skipSampleHeader,
+		perRequestService:       cfg.perRequestService,
+		recordCacheControl:      cfg.recordCacheControl,
+		recordReceivedAt:        cfg.recordReceivedAt,
+		baggageAsAttributes:     cfg.baggageAsAttributes,
+		baggageMaxLength:        cfg.baggageMaxLength,
+		missingHost:             cfg.missingHost,
+		trustLevelCtxKey:        cfg.trustLevelCtxKey,
+		authResultCtxKey:        cfg.authResultCtxKey,
+		authDeniedError:         cfg.authDeniedError,
+		linkInitiator:           cfg.linkInitiator,
+		spanLinks:               cfg.spanLinks,
+		logger:                  cfg.logger,
+		clientSamplingRatio:     cfg.clientSamplingRatio,
+		setBaggage:              setBaggage,
+		disabled:                cfg.rolloutPercentage != nil && !routeRolledOut(routeID, *cfg.rolloutPercentage),
+		spanEvents:              cfg.spanEvents,
+		traceIDHeader:           cfg.traceIDHeader,
+		trailers:                cfg.trailers,
+		captureClientIP:         cfg.captureClientIP,
+		serverName:              cfg.serverName,
+		captureBodySizes:        cfg.captureBodySizes,
+		existingSpan:            cfg.existingSpan,
+		lastTraceparent:         cfg.duplicateTraceparent == duplicateTraceparentLast,
+		excludedPaths:           excludedPaths,
+		excludedPathPrefixes:    excludedPathPrefixes,
+
+		spanNameFromResponseHeader: cfg.spanNameFromResponseHeader,
+	}
+	if cfg.ipEnricher != nil {
+		ot.ipEnrichments = newIPEnrichments(cfg.ipEnricher)
+	}
+
+	if cfg.sampler == "" {
+		cfg.sampler = os.Getenv(envTracesSampler)
+	}
+
+	sampler, err := newSampler(cfg.sampler, cfg.samplingRatio, cfg.tracesPerSecond)
+	if err != nil {
+		return openTelemetryWrapper{}, fmt.Errorf("creating sampler error: %w", err)
+	}
+
+	parentBased := samplerParentBased(cfg.sampler, cfg.samplingRatio)
+
+	if len(cfg.methodSamplingRatios) > 0 {
+		sampler, err = newMethodSampler(cfg.methodSamplingRatios, sampler, parentBased)
+		if err != nil {
+			return openTelemetryWrapper{}, fmt.Errorf("creating sampler error: %w", err)
+		}
+	}
+
+	if len(cfg.pathSamplingRules) > 0 {
+		sampler, err = newPathSampler(cfg.pathSamplingRules, sampler, parentBased)
+		if err != nil {
+			return openTelemetryWrapper{}, fmt.Errorf("creating sampler error: %w", err)
+		}
+	}
+
+	// the budget applies to the spans the other samplers keep
+	if cfg.targetSpansPerSecond != 0 {
+		sampler, err = newAdaptiveSampler(cfg.targetSpansPerSecond, sampler)
+		if err != nil {
+			return openTelemetryWrapper{}, fmt.Errorf("creating sampler error: %w", err)
+		}
+	}
+
+	// the headers of the request prevail over the other samplers
+	if cfg.forceSampleHeader != "" || cfg.skipSampleHeader != "" {
+		if sampler == nil {
+			sampler = sdktrace.ParentBased(sdktrace.AlwaysSample())
+		}
+		sampler = overrideSampler{Sampler: sampler}
+	}
+
+	if cfg.skipUnsampled {
+		if sampler == nil {
+			sampler = sdktrace.ParentBased(sdktrace.AlwaysSample())
+		}
+		sampler = presampledSampler{Sampler: sampler}
+		ot.presampler = sampler
+
+		// the IDs are generated before the span is started, for the decision to follow from its trace ID
+		if idGenerator == nil {
+			if idGenerator, err = newPrefixedIDGenerator(nil); err != nil {
+				return openTelemetryWrapper{}, fmt.Errorf("creating ID generator error: %w", err)
+			}
+		}
+		idGenerator = presampledIDGenerator{IDGenerator: idGenerator}
+		ot.presampledIDGenerator = idGenerator
+	}
+
+	// the heartbeats verify the delivery of the spans, none of them is dropped
+	if cfg.heartbeatInterval > 0 {
+		if sampler == nil {
+			sampler = sdktrace.ParentBased(sdktrace.AlwaysSample())
+		}
+		sampler = heartbeatSampler{Sampler: sampler}
+	}
+
+	if cfg.tracerProvider != nil {
+		// the exporter and the sampler of the provider are the ones of the otel app
+		ot.tracer = cfg.tracerProvider.Tracer("github.com/caddyserver/caddy/v2/modules/caddyhttp/opentelemetry")
+		ot.appProvider = true
+
+		if cfg.metrics {
+			if cfg.meterProvider == nil {
+				return openTelemetryWrapper{}, fmt.Errorf("creating request metrics error: the provider has no meter provider")
+			}
+			ot.metrics = newRequestMetrics(cfg.meterProvider.Meter("github.com/caddyserver/caddy/v2/modules/caddyhttp/opentelemetry"))
+		}
+
+		if cfg.heartbeatInterval > 0 {
+			ot.heartbeat = startHeartbeat(ot.tracer, cfg.heartbeatInterval)
+		}
+
+		return ot, nil
+	}
+
+	// the key is only kept once the provider is obtained: the wrapper of a failed
+	// initialization, cleaned up nonetheless, must not release another one
+	key := tracerProviderKey{
+		serviceName:    cfg.serviceName,
+		serviceVersion: cfg.serviceVersion,
+		endpoint:       cfg.exporter.endpoint,
+		urlPath:        cfg.exporter.urlPath,
+		protocol:       cfg.exporter.protocol,
+		certificate:    cfg.exporter.certificate,
+		insecure:       cfg.exporter.insecure,
+		timeout:        cfg.exporter.timeout,
+		compression:    cfg.exporter.compression,
+
+		clientCertificate: cfg.exporter.clientCertificate,
+		clientKey:         cfg.exporter.clientKey,
+		tlsSkipVerify:     cfg.exporter.tlsSkipVerify,
+		serverName:        cfg.exporter.serverName,
+		failoverEndpoints: strings.Join(cfg.exporter.failoverEndpoints, ","),
+		retry:             retryDescription(cfg.exporter.retry),
+		stdoutFile:        cfg.exporter.stdoutFile,
+
+		failoverRetryInterval: cfg.exporter.failoverRetryInterval,
+
+		hostRedaction:        cfg.hostRedaction,
+		hostRedactionKeyHash: keyHash(cfg.hostRedactionKey),
+
+		truncationStrategy: cfg.truncationStrategy,
+		truncationLength:   cfg.truncationLength,
+
+		spanAttributeValueLengthLimit: cfg.spanAttributeValueLengthLimit,
+		spanAttributeCountLimit:       cfg.spanAttributeCountLimit,
+
+		resourceAttributes: mapDescription(cfg.resourceAttributes),
+		headersHash:        headersHash(cfg.exporter.headers),
+
+		simpleSpanProcessor: cfg.spanProcessor == spanProcessorSimple,
+		minSpanDuration:     cfg.minSpanDuration,
+		traceIDPrefix:       strings.ToLower(cfg.traceIDPrefix),
+		idGenerator:         cfg.idGenerator,
+
+		heartbeatInterval: cfg.heartbeatInterval,
+	}
+	if sampler != nil {
+		key.sampler = sampler.Description()
+	}
+
+	setup, err := newTracerProviderSetup(ctx, cfg, sampler, idGenerator)
+	if err != nil {
+		return openTelemetryWrapper{}, err
+	}
+
+	if serviceNameTemplate != "" && cfg.dedicatedProvider {
+		return openTelemetryWrapper{}, fmt.Errorf("a service name with placeholders requires the shared tracer provider")
+	}
+
+	var tracerProvider *sdktrace.TracerProvider
+	if cfg.dedicatedProvider {
+		tracerProvider = sdktrace.NewTracerProvider(setup.opts...)
+		ot.dedicatedProvider = tracerProvider
+		ot.dedicatedQueue = setup.queue
+	} else {
+		var cached bool
+		tracerProvider, cached = defaultTracerProviderCache.getTracerProvider(key, setup.queue, setup.opts...)
+		ot.tracerProviderKey = key
+		if cached {
+			// the cached provider was built with the same key, the options of this
+			// handler are ignored and the provider exports with its own exporters
+			cfg.logger.Debug("reusing cached tracer provider, ignoring the options of this handler",
+				zap.String("service_name", key.serviceName),
+				zap.Int("ignored_options", len(setup.opts)))
+			for _, traceExporter := range setup.exporters {
+				if err := traceExporter.Shutdown(ctx); err != nil {
+					cfg.logger.Error("shutting down unused exporter", zap.Error(err))
+				}
+			}
+		}
+	}
+
+	ot.tracer = tracerProvider.Tracer("github.com/caddyserver/caddy/v2/modules/caddyhttp/opentelemetry")
+
+	if cfg.metrics {
+		// the metrics are exported with the first exporter of the spans
+		metricsExporter := cfg.exporter
+		metricsExporter.protocol = strings.TrimSpace(strings.Split(cfg.exporter.protocol, ",")[0])
+
+		ot.metrics, ot.metricsKey, err = defaultMeterProviderCache.getRequestMetrics(ctx, metricsExporter, setup.res, cfg.metricsCollectPeriod)
+		if err != nil {
+			if err := ot.releaseTracerProvider(cfg.logger); err != nil {
+				cfg.logger.Error("releasing tracer provider", zap.Error(err))
+			}
+			return openTelemetryWrapper{}, fmt.Errorf("creating request metrics error: %w", err)
+		}
+	}
+
+	// the cache runs the heartbeat of a shared provider
+	if cfg.dedicatedProvider && cfg.heartbeatInterval > 0 {
+		ot.heartbeat = startHeartbeat(ot.tracer, cfg.heartbeatInterval)
+	}
+
+	if serviceNameTemplate != "" {
+		ot.serviceName = serviceNameTemplate
+		ot.serviceTracers = newServiceTracers(cfg.maxServiceNames, func(serviceName string) (trace.Tracer, tracerProviderKey, error) {
+			serviceCfg := cfg
+			serviceCfg.serviceName = serviceName
+			serviceKey := key
+			serviceKey.serviceName = serviceName
+
+			serviceSetup, err := newTracerProviderSetup(ctx, serviceCfg, sampler, idGenerator)
+			if err != nil {
+				return nil, tracerProviderKey{}, err
+			}
+			tp, cached := defaultTracerProviderCache.getTracerProvider(serviceKey, serviceSetup.queue, serviceSetup.opts...)
+			if cached {
+				for _, traceExporter := range serviceSetup.exporters {
+					if err := traceExporter.Shutdown(ctx); err != nil {
+						cfg.logger.Error("shutting down unused exporter", zap.Error(err))
+					}
+				}
+			}
+			return tp.Tracer("github.com/caddyserver/caddy/v2/modules/caddyhttp/opentelemetry"), serviceKey, nil
+		}, func(serviceKey tracerProviderKey) error {
+			err := defaultTracerProviderCache.cleanupTracerProvider(serviceKey, cfg.drainTimeout, cfg.shutdownTimeout, cfg.logger)
+			// the span counts of an evicted service name are not exported forever
+			if !defaultTracerProviderCache.hasServiceName(serviceKey.serviceName) {
+				deleteSpanCounts(serviceKey.serviceName)
+			}
+			return err
+		}, cfg.logger)
+	}
+
+	return ot, nil
+}
+
+// resolveExporter sets the service name and the settings of the exporter
+// left empty to the ones of the environment, or to their defaults, and
+// validates them.
+func (cfg *tracerConfig) resolveExporter(ctx context.Context) error {
+	// OTEL_SERVICE_NAME takes precedence over the service.name of OTEL_RESOURCE_ATTRIBUTES
+	if cfg.serviceName == "" {
+		cfg.serviceName = os.Getenv(envServiceNameVar)
+	}
+
+	// the service name of OTEL_RESOURCE_ATTRIBUTES is kept unless one is configured
+	if cfg.serviceName == "" && envServiceName(ctx) == "" {
+		cfg.serviceName = defaultServiceName
+	}
+
+	// the endpoint is resolved here rather than by the exporter, for it to be part of the tracer provider key
+	endpoint, generic := resolveEndpoint(cfg.exporter.endpoint, cfg.exporter.genericEndpoint)
+	cfg.exporter.endpoint = endpoint
+
+	if err := cfg.exporter.parseEndpoint(); err != nil {
+		return err
+	}
+
+	// the path of a generic endpoint is the base of the ones of the signals
+	if generic && cfg.exporter.urlPath != "" {
+		cfg.exporter.urlPath = strings.TrimSuffix(cfg.exporter.urlPath, "/") + defaultHTTPURLPath
+	}
+
+	if cfg.exporter.protocol == "" {
+		cfg.exporter.protocol = getEnv(envExporterTracesProtocol, envExporterProtocol)
+	}
+
+	if cfg.exporter.certificate == "" {
+		cfg.exporter.certificate = getEnv(envExporterTracesCertificate, envExporterCertificate)
+	}
+
+	if cfg.exporter.compression == "" {
+		cfg.exporter.compression = getEnv(envExporterTracesCompression, envExporterCompression)
+	}
+
+	switch cfg.exporter.compression {
+	case "", compressionGzip, compressionNone:
+	default:
+		return fmt.Errorf("unsupported exporter compression %q", cfg.exporter.compression)
+	}
+
+	if cfg.exporter.timeout == 0 {
+		// the timeout of the environment is in milliseconds
+		if timeout := getEnv(envExporterTracesTimeout, envExporterTimeout); timeout != "" {
+			ms, err := strconv.Atoi(timeout)
+			if err != nil || ms < 0 {
+				return fmt.Errorf("invalid exporter timeout %q, expected milliseconds", timeout)
+			}
+			cfg.exporter.timeout = time.Duration(ms) * time.Millisecond
+		}
+	}
+
+	return nil
+}
+
+// tracerProviderSetup holds what a tracer provider is built from.
+type tracerProviderSetup struct {
+	opts []sdktrace.TracerProviderOption
+	res  *resource.Resource
+	// exporters must be shut down by the owner of the setup if the options are not used.
+	exporters []sdktrace.SpanExporter
+	// queue tracks the spans to export of the provider built with the options.
+	queue *spanQueue
+}
+
+// newTracerProviderSetup creates the resource and the exporters of the
+// tracer provider of cfg, which is shared by the handlers and the otel app.
+func newTracerProviderSetup(
+	ctx context.Context,
+	cfg tracerConfig,
+	sampler sdktrace.Sampler,
+	idGenerator sdktrace.IDGenerator,
+) (tracerProviderSetup, error) {
+	res, err := newResource(ctx, cfg.serviceName, cfg.serviceVersion, cfg.resourceAttributes)
+	if err != nil {
+		return tracerProviderSetup{}, fmt.Errorf("creating resource error: %w", err)
+	}
+	// the endpoint after the precedence of the configuration and the environment, to confirm where the spans go
+	res, err = resource.Merge(res, resource.NewSchemaless(attribute.String("caddy.otel.exporter_endpoint", cfg.exporter.effectiveEndpoint())))
+	if err != nil {
+		return tracerProviderSetup{}, fmt.Errorf("creating resource error: %w", err)
+	}
+
+	traceExporters, err := getTracerExporters(ctx, cfg.exporter)
+	if err != nil {
+		return tracerProviderSetup{}, fmt.Errorf("creating trace exporter error: %w", err)
+	}
+
+	queue := &spanQueue{serviceName: cfg.serviceName}
+
+	opts := []sdktrace.TracerProviderOption{
+		sdktrace.WithResource(res),
+	}
+
+	for _, traceExporter := range traceExporters {
+		if cfg.hostRedaction != "" {
+			traceExporter = attributesExporter{
+				SpanExporter: traceExporter,
+				rewrite: func(attrs []attribute.KeyValue) []attribute.KeyValue {
+					return redactHostAttributes(attrs, cfg.hostRedaction, cfg.hostRedactionKey)
+				},
+			}
+		}
+
+		if cfg.truncationLength > 0 {
+			traceExporter = attributesExporter{
+				SpanExporter: traceExporter,
+				rewrite: func(attrs []attribute.KeyValue) []attribute.KeyValue {
+					return truncateAttributes(attrs, cfg.truncationStrategy, cfg.truncationLength)
+				},
+			}
+		}
+
+		// the SDK does not limit the length of the attribute values, they are cut before the export
+		if cfg.spanAttributeValueLengthLimit > 0 {
+			traceExporter = attributesExporter{
+				SpanExporter: traceExporter,
+				rewrite: func(attrs []attribute.KeyValue) []attribute.KeyValue {
+					return truncateAttributes(attrs, truncationRaw, cfg.spanAttributeValueLengthLimit)
+				},
+			}
+		}
+
+		queued := queue.exporter(traceExporter)
+		var processor sdktrace.SpanProcessor
+		if cfg.spanProcessor == spanProcessorSimple {
+			processor = sdktrace.NewSimpleSpanProcessor(queued)
+		} else {
+			processor = sdktrace.NewBatchSpanProcessor(queued)
+		}
+		// the filtered spans are not counted in the queue, so that they are not waited for
+		opts = append(opts, sdktrace.WithSpanProcessor(filterSpanProcessor(queued.processor(processor), cfg.minSpanDuration)))
+	}
+	if sampler != nil {
+		opts = append(opts, sdktrace.WithSampler(sampler))
+	}
+	if cfg.spanAttributeCountLimit > 0 {
+		// the limits left to zero keep the SDK's defaults
+		opts = append(opts, sdktrace.WithSpanLimits(sdktrace.SpanLimits{AttributeCountLimit: cfg.spanAttributeCountLimit}))
+	}
+	if idGenerator != nil {
+		opts = append(opts, sdktrace.WithIDGenerator(idGenerator))
+	}
+
+	return tracerProviderSetup{opts: opts, res: res, exporters: traceExporters, queue: queue}, nil
+}
+
+// ServeHTTP extract current tracing context or create a new one, then method propagates it to the wrapped next handler.
+func (ot *openTelemetryWrapper) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	if ot.disabled || ot.bypassed(r) || ot.excluded(r) || !ot.clientSampled(r) {
+		return next.ServeHTTP(w, r)
+	}
+
+	ctx := r.Context()
+	// a non-recording span started upstream, e.g. by a library, is not ours to override blindly
+	if existing := trace.SpanFromContext(ctx); existing.SpanContext().IsValid() && !existing.IsRecording() {
+		switch ot.existingSpan {
+		case existingSpanSkip:
+			return next.ServeHTTP(w, r)
+		case existingSpanReplace:
+			ctx = trace.ContextWithSpanContext(ctx, trace.SpanContext{})
+		}
+	}
+
+	start := time.Now()
+
+	carrier := propagation.HeaderCarrier(r.Header)
+	// the propagators read the first header only, whether it is valid or not
+	if traceparents := r.Header.Values(traceparentHeader); len(traceparents) > 1 {
+		carrier = propagation.HeaderCarrier(r.Header.Clone())
+		carrier.Set(traceparentHeader, selectTraceparent(traceparents, ot.lastTraceparent))
+	}
+	ctx = ot.propagators.Extract(ctx, carrier)
+	spanName, spanNameSource := ot.resolveSpanName(r)
+	// the request attributes are given at start, for the samplers to see them
+	attrs := requestAttributes(r, ot.missingHost)
+
+	// the decision is taken once, the tracer provider reuses it and the IDs it was taken for from the context
+	startCtx := ctx
+	// the override only applies to the span of the request, not to the ones of the next handlers
+	if override := ot.sampleOverride(r); override != 0 {
+		startCtx = context.WithValue(startCtx, sampleOverrideCtxKey{}, override)
+	}
+	if ot.presampler != nil {
+		var result sdktrace.SamplingResult
+		result, startCtx = presample(startCtx, ot.presampler, ot.presampledIDGenerator, spanName, attrs)
+		if result.Decision == sdktrace.Drop {
+			return next.ServeHTTP(w, r)
+		}
+	}
+
+	startOpts := []trace.SpanStartOption{trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(attrs...)}
+	if ot.linkInitiator {
+		if link, ok := initiatorLink(ctx); ok {
+			startOpts = append(startOpts, trace.WithLinks(link))
+		}
+	}
+	if len(ot.spanLinks) > 0 {
+		if links := headerLinks(r, ot.spanLinks, ot.logger); len(links) > 0 {
+			startOpts = append(startOpts, trace.WithLinks(links...))
+		}
+	}
+	tracer, tracerDone := ot.requestTracer(r)
+	defer tracerDone()
+	_, span := tracer.Start(startCtx, spanName, startOpts...)
+	// the presampling values are not passed on, the spans of the next handlers are sampled on their own
+	ctx = trace.ContextWithSpan(ctx, span)
+	defer span.End()
+
+	// the attributes no sampler needs are only computed for the spans which are recorded
+	if span.IsRecording() {
+		span.SetAttributes(
+			attribute.Bool("http.request.chunked", chunked(r)),
+			// only the number of cookies, their names and values may be sensitive
+			attribute.Int("http.request.cookie_count", cookieCount(r.Header)),
+		)
+	}
+
+	// the baggage extracted from the request, before this handler adds its own members
+	if ot.baggageAsAttributes {
+		for _, member := range baggage.FromContext(ctx).Members() {
+			value := member.Value()
+			if len(value) > ot.baggageMaxLength {
+				value = truncateString(value, ot.baggageMaxLength)
+			}
+			span.SetAttributes(attribute.String("baggage."+member.Key(), value))
+		}
+	}
+
+	if ot.recordReceivedAt {
+		span.SetAttributes(attribute.String("caddy.request.received_at", start.Format(time.RFC3339Nano)))
+	}
+
+	// the resource service.name is shared by all the spans, the service the request is for is recorded per span
+	if ot.perRequestService != "" {
+		if service := replacePlaceholders(r, ot.perRequestService); service != "" {
+			span.SetAttributes(semconv.PeerServiceKey.String(service))
+		}
+	}
+
+	if ot.tlsIssuerCtxKey != "" && r.TLS != nil {
+		if issuer, ok := r.Context().Value(ot.tlsIssuerCtxKey).(string); ok && issuer != "" {
+			span.SetAttributes(attribute.String("tls.issuer", issuer))
+		}
+	}
+
+	if ot.tlsHandshakeCtxKey != "" && r.TLS != nil {
+		if handshake, ok := r.Context().Value(ot.tlsHandshakeCtxKey).(time.Duration); ok {
+			span.SetAttributes(attribute.Int64("tls.handshake_ms", handshake.Milliseconds()))
+		}
+	}
+
+	if ot.queueEnteredCtxKey != "" {
+		if entered, ok := r.Context().Value(ot.queueEnteredCtxKey).(time.Time); ok && !entered.IsZero() {
+			span.SetAttributes(attribute.Int64("caddy.queue.delay_ms", start.Sub(entered).Milliseconds()))
+		}
+	}
+
+	if ot.logIDCtxKey != "" {
+		if logID, ok := r.Context().Value(ot.logIDCtxKey).(string); ok && logID != "" {
+			span.SetAttributes(attribute.String("caddy.log.id", logID))
+		}
+	}
+
+	if ot.alpnOfferedCtxKey != "" && r.TLS != nil {
+		if offered, ok := r.Context().Value(ot.alpnOfferedCtxKey).([]string); ok && len(offered) > 0 {
+			span.SetAttributes(attribute.Bool("caddy.alpn.fallback", alpnFallback(offered, r.TLS.NegotiatedProtocol)))
+		}
+	}
+
+	if ot.captureClientIP {
+		ip := remoteIP(r)
+		span.SetAttributes(semconv.NetPeerIPKey.String(ip), attribute.String("client.address", ip))
+	}
+
+	// the length is unknown, and not recorded, if the request has no Content-Length header
+	if ot.captureBodySizes && r.Header.Get("Content-Length") != "" && r.ContentLength >= 0 {
+		span.SetAttributes(semconv.HTTPRequestContentLengthKey.Int64(r.ContentLength))
+	}
+
+	// the lookup may be slow, it is skipped for the spans which are not recorded
+	if ot.ipEnrichments != nil && span.IsRecording() {
+		if attrs := ot.ipEnrichments.enrich(ctx, remoteIP(r)); len(attrs) > 0 {
+			span.SetAttributes(attrs...)
+		}
+	}
+
+	if ot.serverName != "" {
+		span.SetAttributes(attribute.String("caddy.server", ot.serverName))
+	}
+
+	if ot.trustLevelCtxKey != "" {
+		switch level := r.Context().Value(ot.trustLevelCtxKey).(type) {
+		case string:
+			span.SetAttributes(attribute.String("security.trust_level", level))
+		case int:
+			span.SetAttributes(attribute.Int("security.trust_level", level))
+		}
+	}
+
+	// the server stores the error in the context when it invokes the error routes
+	if r.Context().Value(caddyhttp.ErrorCtxKey) != nil {
+		span.SetAttributes(attribute.Bool("caddy.route.is_error", true))
+	}
+
+	if ot.requestIDCtxKey != "" {
+		if requestID, ok := r.Context().Value(ot.requestIDCtxKey).(string); ok && requestID != "" {
+			span.SetAttributes(attribute.String(requestIDKey, requestID))
+			if ot.requestIDBaggage {
+				ctx = contextWithBaggageMember(ctx, requestIDKey, requestID)
+			}
+		}
+	}
+
+	if len(ot.setBaggage) > 0 {
+		ctx = contextWithBaggageMembers(ctx, ot.setBaggage)
+	}
+
+	ot.propagators.Inject(ctx, propagation.HeaderCarrier(r.Header))
+
+	// the header must be set before the next handlers may write the response;
+	// the trace of an unsampled span is not exported, its ID would lead nowhere
+	if ot.traceIDHeader != "" && span.SpanContext().IsSampled() {
+		w.Header().Set(ot.traceIDHeader, span.SpanContext().TraceID().String())
+	}
+
+	if ot.spanEvents {
+		span.AddEvent("request.start")
+	}
+
+	rec := caddyhttp.NewResponseRecorder(w, nil, nil)
+	// the next handlers, e.g. the reverse proxy, see the span and the baggage of the request
+	r = r.WithContext(ctx)
+	err := next.ServeHTTP(rec, r)
+
+	if ot.spanEvents {
+		span.AddEvent("response.written", trace.WithAttributes(attribute.Int("http.response.bytes", rec.Size())))
+	}
+
+	if ot.captureBodySizes {
+		span.SetAttributes(semconv.HTTPResponseContentLengthKey.Int(rec.Size()))
+	}
+
+	status := rec.Status()
+	// net/http responds with 200 to a handler completing without writing anything
+	if status == 0 && err == nil {
+		status = http.StatusOK
+	}
+
+	// the route pattern may have been set by the handlers of the matched route,
+	// it prevails over the name given by the sources after the route one
+	if pattern := routePattern(r); pattern != "" && routeSourceBefore(ot.spanNameSources, spanNameSource) {
+		span.SetName(pattern)
+	}
+
+	// the backend knows its operation best, its name prevails; the sampling
+	// decision, made at the start of the span, does not follow the new name
+	if ot.spanNameFromResponseHeader != "" {
+		if name := rec.Header().Get(ot.spanNameFromResponseHeader); name != "" {
+			span.SetName(name)
+		}
+	}
+
+	// whatever the span name, the backends compute their metrics per http.route
+	if route := ot.matchedRoute(r); route != "" {
+		span.SetAttributes(semconv.HTTPRouteKey.String(route))
+	}
+
+	// once the handler completed, the trailers it set are in the header map of the response
+	for _, trailer := range ot.trailers {
+		if value := responseTrailer(rec.Header(), trailer); value != "" {
+			span.SetAttributes(attribute.String("http.response.trailer."+strings.ToLower(trailer), value))
+		}
+	}
+
+	if ot.recordCacheControl {
+		if cacheControl := rec.Header().Get("Cache-Control"); cacheControl != "" {
+			span.SetAttributes(attribute.String("http.response.cache_control", cacheControl))
+		}
+	}
+
+	// the encode handler, if any, set the content coding it applied in the header of the recorder
+	encoding := rec.Header().Get("Content-Encoding")
+	if encoding == "" || strings.EqualFold(encoding, "identity") {
+		encoding = compressionNone
+	}
+	span.SetAttributes(attribute.String("http.response.compression", encoding))
+
+	if ot.authResultCtxKey != "" {
+		if result := authResult(r, ot.authResultCtxKey); result != "" {
+			span.SetAttributes(attribute.String("caddy.auth.result", result))
+			if result == authResultDenied && ot.authDeniedError {
+				span.SetStatus(codes.Error, "authentication denied")
+			}
+		}
+	}
+
+	if status != 0 {
+		span.SetAttributes(semconv.HTTPStatusCodeKey.Int(status))
+		// per the HTTP semantic conventions, the status of server spans is left unset below 5xx, never Ok
+		if status >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+	}
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+
+		// the error handling of the server responds with the status of a handler error
+		var handlerErr caddyhttp.HandlerError
+		if errors.As(err, &handlerErr) && handlerErr.StatusCode != 0 {
+			status = handlerErr.StatusCode
+			span.SetAttributes(semconv.HTTPStatusCodeKey.Int(status))
+		}
+	}
+
+	if ot.metrics != nil {
+		ot.metrics.record(ctx, r.Method, status, time.Since(start))
+	}
+
+	return err
+}
+
+// bypassed returns true if the client asked, with the bypass header set to a true value, not to be traced.
+func (ot *openTelemetryWrapper) bypassed(r *http.Request) bool {
+	if ot.bypassHeader == "" {
+		return false
+	}
+	bypass, err := strconv.ParseBool(r.Header.Get(ot.bypassHeader))
+	return err == nil && bypass
+}
+
+// sampleOverride returns the sampling decision the headers of the request
+// force, zero if none. The force sample header prevails over the skip one.
+func (ot *openTelemetryWrapper) sampleOverride(r *http.Request) sampleOverride {
+	for _, override := range []struct {
+		header   string
+		decision sampleOverride
+	}{
+		{header: ot.forceSampleHeader, decision: sampleOverrideForce},
+		{header: ot.skipSampleHeader, decision: sampleOverrideSkip},
+	} {
+		if override.header == "" {
+			continue
+		}
+		if set, err := strconv.ParseBool(r.Header.Get(override.header)); err == nil && set {
+			return override.decision
+		}
+	}
+	return 0
+}
+
+// excluded returns true if the path of the request is excluded from the tracing.
+func (ot *openTelemetryWrapper) excluded(r *http.Request) bool {
+	if _, ok := ot.excludedPaths[r.URL.Path]; ok {
+		return true
+	}
+	for _, prefix := range ot.excludedPathPrefixes {
+		if strings.HasPrefix(r.URL.Path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateExcludePath returns an error if path is not a valid excluded path.
+func validateExcludePath(path string) error {
+	if !strings.HasPrefix(path, "/") {
+		return fmt.Errorf("excluded path %q must start with /", path)
+	}
+	if strings.Contains(strings.TrimSuffix(path, "*"), "*") {
+		return fmt.Errorf("excluded path %q may only end with a wildcard", path)
+	}
+	return nil
+}
+
+// remoteIP returns the IP address of the peer of the connection. Caddy has
+// no notion of trusted proxies, so this is the address of the last proxy,
+// if any, and the headers set by the proxies are deliberately ignored.
+func remoteIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
+
+// routeRolledOut returns true if the route is among the percentage of the
+// routes traced, selected by the hash of its identifier so that the same
+// routes stay traced across reloads.
+func routeRolledOut(routeID string, percentage float64) bool {
+	if percentage >= 100 {
+		return true
+	}
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(routeID))
+	return float64(h.Sum32()) < percentage/100*math.MaxUint32
+}
+
+// clientSampled returns true if the client of the request is among the traced ones,
+// selected by the hash of their IP address so that all their requests are traced.
+func (ot *openTelemetryWrapper) clientSampled(r *http.Request) bool {
+	if ot.clientSamplingRatio == nil {
+		return true
+	}
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(remoteIP(r)))
+	return float64(h.Sum32()) < *ot.clientSamplingRatio*math.MaxUint32
+}
+
+// getSpanName returns the span name of the request, see resolveSpanName.
+func (ot *openTelemetryWrapper) getSpanName(r *http.Request) string {
+	name, _ := ot.resolveSpanName(r)
+	return name
+}
+
+// resolveSpanName tries the span name sources in order and returns the first
+// non-empty name with the position of its source, or the static span name
+// with the number of sources if none gives a name. The sources are:
+//
+//   - "route", the matched route pattern when it is already known, or else
+//     the pattern of the route of the handler, if configured;
+//   - "method", the method and the path of the request, e.g. "GET /users/42";
+//   - "static", the span name with its placeholders, if any, resolved.
+func (ot *openTelemetryWrapper) resolveSpanName(r *http.Request) (string, int) {
+	for i, source := range ot.spanNameSources {
+		var name string
+		switch source {
+		case spanNameSourceRoute:
+			name = ot.matchedRoute(r)
+		case spanNameSourceMethod:
+			name = r.Method + " " + r.URL.Path
+		case spanNameSourceStatic:
+			name = ot.staticSpanName(r)
+		}
+		if name != "" {
+			return name, i
+		}
+	}
+	return ot.staticSpanName(r), len(ot.spanNameSources)
+}
+
+// matchedRoute returns the low-cardinality pattern of the route the request
+// matched. Caddy does not record which route matched: the pattern is read
+// from the RoutePatternVar request variable, in the caddyhttp.VarsCtxKey
+// table of the request context, which the handlers of the matched route
+// can set, or else is the pattern of the route of this handler, if known.
+func (ot *openTelemetryWrapper) matchedRoute(r *http.Request) string {
+	if pattern := routePattern(r); pattern != "" {
+		return pattern
+	}
+	return ot.routePattern
+}
+
+// requestTracer returns the tracer of the service name resolved for the
+// request, or the tracer of the handler if the service name is static,
+// resolves to nothing or its tracer is still being created, and the
+// function to call once its span has ended.
+func (ot *openTelemetryWrapper) requestTracer(r *http.Request) (trace.Tracer, func()) {
+	if ot.serviceTracers == nil {
+		return ot.tracer, func() {}
+	}
+	serviceName := replacePlaceholders(r, ot.serviceName)
+	if serviceName == "" {
+		return ot.tracer, func() {}
+	}
+	tracer, done, ok := ot.serviceTracers.get(serviceName)
+	if !ok {
+		return ot.tracer, func() {}
+	}
+	return tracer, done
+}
+
+// staticSpanName returns the span name with its placeholders, if any, resolved
+// for the request, or the method of the request, e.g. "HTTP GET", if no span
+// name is configured.
+func (ot *openTelemetryWrapper) staticSpanName(r *http.Request) string {
+	if ot.spanName == "" {
+		return defaultSpanNamePrefix + r.Method
+	}
+	if !ot.spanNameHasPlaceholders {
+		return ot.spanName
+	}
+	return replacePlaceholders(r, ot.spanName)
+}
+
+// parseSpanNameSources returns the span name sources of the comma separated
+// list, or an error if one is not supported. An empty list names the spans
+// with the static span name only.
+func parseSpanNameSources(sources string) ([]string, error) {
+	if sources == "" {
+		return nil, nil
+	}
+	var result []string
+	for _, source := range strings.Split(sources, ",") {
+		source = strings.TrimSpace(source)
+		switch source {
+		case spanNameSourceStatic, spanNameSourceRoute, spanNameSourceMethod:
+			result = append(result, source)
+		default:
+			return nil, fmt.Errorf("unsupported span name source %q", source)
+		}
+	}
+	return result, nil
+}
+
+// routeSourceBefore returns true if the "route" source is among the first n span name sources.
+func routeSourceBefore(sources []string, n int) bool {
+	for i := 0; i < n && i < len(sources); i++ {
+		if sources[i] == spanNameSourceRoute {
+			return true
+		}
+	}
+	return false
+}
+
+// replacePlaceholders returns s with its placeholders resolved by the replacer of the request, or s as is if there is none.
+func replacePlaceholders(r *http.Request, s string) string {
+	repl, ok := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	if !ok {
+		return s
+	}
+	return repl.ReplaceAll(s, "")
+}
+
+// routePattern returns the pattern of the matched route stored in the RoutePatternVar request variable, if any.
+func routePattern(r *http.Request) string {
+	pattern, _ := caddyhttp.GetVar(r.Context(), RoutePatternVar).(string)
+	return pattern
+}
+
+// contextWithBaggageMember returns a copy of ctx whose baggage contains the member,
+// or ctx itself if the member is not valid baggage.
+func contextWithBaggageMember(ctx context.Context, key, value string) context.Context {
+	member, err := baggage.NewMember(key, url.QueryEscape(value))
+	if err != nil {
+		return ctx
+	}
+	b, err := baggage.FromContext(ctx).SetMember(member)
+	if err != nil {
+		return ctx
+	}
+	return baggage.ContextWithBaggage(ctx, b)
+}
+
+// traceparentHeader is the header of the W3C trace context.
+const traceparentHeader = "traceparent"
+
+// traceparentRegexp matches the traceparent headers of the W3C trace context, all versions but the invalid one.
+var traceparentRegexp = regexp.MustCompile(`^(?:[0-9a-e][0-9a-f]|f[0-9a-e])-[0-9a-f]{32}-[0-9a-f]{16}-[0-9a-f]{2}(?:-.*)?$`)
+
+// selectTraceparent returns the first valid traceparent, or the last one if
+// last is true, empty if none is valid.
+func selectTraceparent(traceparents []string, last bool) string {
+	for i := range traceparents {
+		traceparent := traceparents[i]
+		if last {
+			traceparent = traceparents[len(traceparents)-1-i]
+		}
+		traceparent = strings.TrimSpace(traceparent)
+		if traceparentRegexp.MatchString(traceparent) {
+			return traceparent
+		}
+	}
+	return ""
+}
+
+// contextWithBaggageMembers returns a copy of ctx whose baggage contains the
+// members, built once at provisioning, replacing the members of the same keys.
+func contextWithBaggageMembers(ctx context.Context, members []baggage.Member) context.Context {
+	b := baggage.FromContext(ctx)
+	for _, member := range members {
+		var err error
+		if b, err = b.SetMember(member); err != nil {
+			return ctx
+		}
+	}
+	return baggage.ContextWithBaggage(ctx, b)
+}
+
+// newBaggageMembers returns the baggage members of the key/value pairs, sorted
+// by key, or an error if a key is not a valid baggage key.
+func newBaggageMembers(values map[string]string) ([]baggage.Member, error) {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	members := make([]baggage.Member, 0, len(keys))
+	for _, key := range keys {
+		member, err := baggage.NewMember(key, url.QueryEscape(values[key]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid baggage member %q: %w", key, err)
+		}
+		members = append(members, member)
+	}
+	return members, nil
+}
+
+// propagatorEnabled returns true if the propagator is among the "," separated
+// propagators, the default ones if empty.
+func propagatorEnabled(propagators, propagator string) bool {
+	if propagators == "" {
+		propagators = defaultPropagators
+	}
+	for _, p := range strings.Split(propagators, ",") {
+		if strings.TrimSpace(p) == propagator {
+			return true
+		}
+	}
+	return false
+}
+
+// requestAttributes returns the HTTP semantic attributes describing the request.
+//
+// If the request has no host, the http.host attribute is dropped if missingHost
+// is "drop", or set to missingHost otherwise.
+func requestAttributes(r *http.Request, missingHost string) []attribute.KeyValue {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+
+	attrs := []attribute.KeyValue{
+		semconv.HTTPMethodKey.String(r.Method),
+		semconv.HTTPTargetKey.String(r.URL.RequestURI()),
+		semconv.HTTPSchemeKey.String(scheme),
+		semconv.HTTPUserAgentKey.String(r.UserAgent()),
+	}
+
+	// only the configured fallback may drop the attribute, not a request with the "drop" host
+	host := r.Host
+	if host == "" {
+		if missingHost == missingHostDrop {
+			return attrs
+		}
+		host = missingHost
+	}
+	attrs = append(attrs, semconv.HTTPHostKey.String(host))
+
+	return attrs
+}
+
+// alpnFallback returns whether the negotiated protocol, empty if none was,
+// is not the protocol preferred among the offered ones. Without a negotiated
+// protocol, the connection falls back to HTTP/1.1.
+func alpnFallback(offered []string, negotiated string) bool {
+	if negotiated == "" {
+		negotiated = "http/1.1"
+	}
+	return negotiated != offered[0]
+}
+
+// responseTrailer returns the value of the trailer, either announced in the Trailer header
+// or set with the http.TrailerPrefix.
+func responseTrailer(header http.Header, trailer string) string {
+	// the prefixed keys are not canonicalized, the names are compared as given
+	for key, values := range header {
+		if len(values) > 0 && strings.HasPrefix(key, http.TrailerPrefix) &&
+			strings.EqualFold(strings.TrimPrefix(key, http.TrailerPrefix), trailer) {
+			return values[0]
+		}
+	}
+	for _, announced := range header.Values("Trailer") {
+		for _, name := range strings.Split(announced, ",") {
+			if strings.EqualFold(strings.TrimSpace(name), trailer) {
+				return header.Get(trailer)
+			}
+		}
+	}
+	return ""
+}
+
+// authResult returns the authentication outcome of the request stored under
+// key, in the context or else in the request variables, or "" if none.
+func authResult(r *http.Request, key caddy.CtxKey) string {
+	if result, ok := r.Context().Value(key).(string); ok && result != "" {
+		return result
+	}
+	result, _ := caddyhttp.GetVar(r.Context(), string(key)).(string)
+	return result
+}
+
+// chunked returns true if the request body is sent with the chunked transfer encoding.
+func chunked(r *http.Request) bool {
+	for _, encoding := range r.TransferEncoding {
+		if strings.EqualFold(encoding, "chunked") {
+			return true
+		}
+	}
+	return false
+}
+
+// cookieCount returns the number of the cookies of the request, the
+// non-empty ";" separated pairs of its Cookie headers, which are counted
+// without being parsed.
+func cookieCount(header http.Header) int {
+	count := 0
+	for _, line := range header["Cookie"] {
+		for line != "" {
+			pair := line
+			if i := strings.IndexByte(line, ';'); i >= 0 {
+				pair, line = line[:i], line[i+1:]
+			} else {
+				line = ""
+			}
+			if strings.TrimSpace(pair) != "" {
+				count++
+			}
+		}
+	}
+	return count
+}
+
+// cleanup flush all remaining data and shutdown a tracerProvider
+func (ot *openTelemetryWrapper) cleanup(logger *zap.Logger) error {
+	ot.heartbeat.stop()
+	ot.heartbeat = nil
+
+	// the initialization failed, the wrapper holds no tracer provider
+	if ot.tracer == nil {
+		return nil
+	}
+
+	// the otel app shuts its tracer and meter providers down itself
+	if ot.appProvider {
+		return nil
+	}
+
+	var metricsErr error
+	if ot.metrics != nil {
+		shutdownTimeout := ot.shutdownTimeout
+		if shutdownTimeout <= 0 {
+			shutdownTimeout = defaultShutdownTimeout
+		}
+		metricsErr = defaultMeterProviderCache.release(ot.metricsKey, shutdownTimeout)
+	}
+
+	if err := ot.releaseTracerProvider(logger); err != nil {
+		return err
+	}
+	if ot.serviceTracers != nil {
+		if err := ot.serviceTracers.close(); err != nil {
+			return err
+		}
+	}
+	if metricsErr != nil {
+		return fmt.Errorf("stopping request metrics: %w", metricsErr)
+	}
+	return nil
+}
+
+// releaseTracerProvider shuts down the dedicated tracer provider of the
+// handler, or releases the cached one.
+func (ot *openTelemetryWrapper) releaseTracerProvider(logger *zap.Logger) error {
+	if ot.dedicatedProvider == nil {
+		return defaultTracerProviderCache.cleanupTracerProvider(ot.tracerProviderKey, ot.drainTimeout, ot.shutdownTimeout, logger)
+	}
+
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	shutdownTimeout := ot.shutdownTimeout
+	if shutdownTimeout <= 0 {
+		shutdownTimeout = defaultShutdownTimeout
+	}
+	return shutdownTracerProvider(ot.dedicatedProvider, ot.dedicatedQueue, ot.drainTimeout, shutdownTimeout, logger)
+}
+
+// newResource creates a resource that describe current Caddy instance and merge it with a default attributes value.
+//
+// The attributes of OTEL_RESOURCE_ATTRIBUTES are merged over the default ones, then the ones
+// of the handler, the service name and version if not empty, and last the custom attributes.
+func newResource(
+	ctx context.Context,
+	serviceName string,
+	serviceVersion string,
+	customAttributes map[string]string,
+) (*resource.Resource, error) {
+	envResource, err := resource.New(ctx, resource.WithFromEnv())
+	if err != nil {
+		return nil, err
+	}
+
+	caddyAttributes := []attribute.KeyValue{
+		semconv.WebEngineNameKey.String(webEngineName),
+		semconv.WebEngineVersionKey.String(caddycmd.CaddyVersion()),
+		attribute.String("caddy.build", caddyBuild()),
+	}
+	if serviceName != "" {
+		caddyAttributes = append(caddyAttributes, semconv.ServiceNameKey.String(serviceName))
+	}
+	if serviceVersion != "" {
+		caddyAttributes = append(caddyAttributes, semconv.ServiceVersionKey.String(serviceVersion))
+	}
+
+	caddyResource, err := resource.New(ctx, resource.WithAttributes(caddyAttributes...))
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := resource.Merge(resource.Default(), envResource)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err = resource.Merge(res, caddyResource)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(customAttributes) == 0 {
+		return res, nil
+	}
+
+	attrs := make([]attribute.KeyValue, 0, len(customAttributes))
+	for key, value := range customAttributes {
+		attrs = append(attrs, attribute.String(key, value))
+	}
+
+	return resource.Merge(res, resource.NewSchemaless(attrs...))
+}
+
+// caddyBuild returns the version of Caddy and, if known, the commit it was built from.
+func caddyBuild() string {
+	if buildCommit == "" {
+		return caddycmd.CaddyVersion()
+	}
+	return caddycmd.CaddyVersion() + " (" + buildCommit + ")"
+}
+
+// envServiceName returns the service.name set in OTEL_RESOURCE_ATTRIBUTES, if any.
+func envServiceName(ctx context.Context) string {
+	res, err := resource.New(ctx, resource.WithFromEnv())
+	if err != nil {
+		return ""
+	}
+	// the set of an empty resource cannot be searched by key
+	for _, attr := range res.Attributes() {
+		if attr.Key == semconv.ServiceNameKey {
+			return attr.Value.AsString()
+		}
+	}
+	return ""
+}
+
+// mapDescription returns a comparable, stable description of m.
+func mapDescription(m map[string]string) string {
+	pairs := make([]string, 0, len(m))
+	for key, value := range m {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// retryDescription returns a comparable description of the retry config, empty if nil.
+func retryDescription(retry *ExporterRetry) string {
+	if retry == nil {
+		return ""
+	}
+	return fmt.Sprintf("%t,%v,%v,%v", retry.Enabled, time.Duration(retry.InitialInterval),
+		time.Duration(retry.MaxInterval), time.Duration(retry.MaxElapsedTime))
+}
+
+// headersHash returns the hash of the exporter headers, so that the secrets they may hold are not kept as is.
+func headersHash(headers map[string]string) string {
+	if len(headers) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(mapDescription(headers)))
+	return hex.EncodeToString(sum[:])
+}
+
+// samplerParentBased returns true if the sampler newSampler returns for the
+// given name follows the decision of the parent of the spans, which is the
+// case of the default sampler of the SDK.
+func samplerParentBased(name string, ratio *float64) bool {
+	switch name {
+	case "":
+		return ratio == nil
+	case samplerParentBasedAlwaysOn, samplerParentBasedAlwaysOff, samplerParentBasedTraceIDRatio, samplerRateLimited:
+		return true
+	default:
+		return false
+	}
+}
+
+// newSampler returns the sampler for the given name, or nil if the SDK default one should be used.
+//
+// The ratio of the ratio based samplers falls back to OTEL_TRACES_SAMPLER_ARG and then to 1.0.
+// The limit of the rate limited sampler falls back to OTEL_TRACES_SAMPLER_ARG as well.
+// When name is empty but the ratio is set, a plain TraceIDRatioBased sampler is returned.
+func newSampler(name string, ratio *float64, tracesPerSecond float64) (sdktrace.Sampler, error) {
+	getRatio := func() (float64, error) {
+		if ratio != nil {
+			return *ratio, nil
+		}
+		arg := os.Getenv(envTracesSamplerArg)
+		if arg == "" {
+			return 1, nil
+		}
+		r, err := strconv.ParseFloat(arg, 64)
+		if err != nil {
+			return 0, fmt.Errorf("parsing %s: %w", envTracesSamplerArg, err)
+		}
+		if r < 0 || r > 1 {
+			return 0, fmt.Errorf("%s must be between 0.0 and 1.0, got %v", envTracesSamplerArg, r)
+		}
+		return r, nil
+	}
+
+	switch name {
+	case "":
+		if ratio == nil {
+			return nil, nil
+		}
+		return sdktrace.TraceIDRatioBased(*ratio), nil
+	case samplerAlwaysOn:
+		return sdktrace.AlwaysSample(), nil
+	case samplerAlwaysOff:
+		return sdktrace.NeverSample(), nil
+	case samplerTraceIDRatio:
+		r, err := getRatio()
+		if err != nil {
+			return nil, err
+		}
+		return sdktrace.TraceIDRatioBased(r), nil
+	case samplerParentBasedAlwaysOn:
+		return sdktrace.ParentBased(sdktrace.AlwaysSample()), nil
+	case samplerParentBasedAlwaysOff:
+		return sdktrace.ParentBased(sdktrace.NeverSample()), nil
+	case samplerParentBasedTraceIDRatio:
+		r, err := getRatio()
+		if err != nil {
+			return nil, err
+		}
+		return sdktrace.ParentBased(sdktrace.TraceIDRatioBased(r)), nil
+	case samplerRateLimited:
+		if tracesPerSecond == 0 {
+			arg := os.Getenv(envTracesSamplerArg)
+			if arg == "" {
+				return nil, fmt.Errorf("the %s sampler requires the traces per second", samplerRateLimited)
+			}
+			var err error
+			tracesPerSecond, err = strconv.ParseFloat(arg, 64)
+			if err != nil {
+				return nil, fmt.Errorf("parsing %s: %w", envTracesSamplerArg, err)
+			}
+		}
+		return newRateLimitedSampler(tracesPerSecond)
+	default:
+		return nil, fmt.Errorf("unsupported sampler %q", name)
+	}
+}
+
+// getTracerExporters returns an exporter for each protocol of the comma separated list of cfg.
+//
+// If failover endpoints are configured, each exporter fails over to the same protocol at these endpoints.
+func getTracerExporters(ctx context.Context, cfg tracerExporterConfig) ([]sdktrace.SpanExporter, error) {
+	protocols := strings.Split(cfg.protocol, ",")
+
+	exporters := make([]sdktrace.SpanExporter, 0, len(protocols))
+	for _, protocol := range protocols {
+		protocolCfg := cfg
+		protocolCfg.protocol = strings.TrimSpace(protocol)
+
+		exporter, err := getTracerExporter(ctx, protocolCfg)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(cfg.failoverEndpoints) > 0 {
+			failover := []sdktrace.SpanExporter{exporter}
+			for _, endpoint := range cfg.failoverEndpoints {
+				// a failover endpoint is given like the primary one, the path of the latter does not apply to it
+				endpointCfg := protocolCfg
+				endpointCfg.endpoint = endpoint
+				endpointCfg.urlPath = ""
+				if err := endpointCfg.parseEndpoint(); err != nil {
+					return nil, err
+				}
+
+				exporter, err := getTracerExporter(ctx, endpointCfg)
+				if err != nil {
+					return nil, err
+				}
+				failover = append(failover, exporter)
+			}
+			exporter = newFailoverExporter(cfg.failoverRetryInterval, failover...)
+		}
+
+		exporters = append(exporters, exporter)
+	}
+
+	return exporters, nil
+}
+
+// getTracerExporter returns protocol specific exporter or error if the protocol is not supported by current module implementation.
+//
+// If the exporter endpoint is empty, the exporter's default endpoint is used.
+func getTracerExporter(ctx context.Context, cfg tracerExporterConfig) (sdktrace.SpanExporter, error) {
+	switch cfg.protocol {
+	case protocolGRPC, "":
+		var opts []otlptracegrpc.Option
+		if cfg.endpoint != "" {
+			opts = append(opts, otlptracegrpc.WithEndpoint(cfg.endpoint))
+		}
+		if len(cfg.headers) > 0 {
+			opts = append(opts, otlptracegrpc.WithHeaders(cfg.headers))
+		}
+		if cfg.timeout > 0 {
+			opts = append(opts, otlptracegrpc.WithTimeout(cfg.timeout))
+		}
+		if cfg.compression == compressionGzip {
+			opts = append(opts, otlptracegrpc.WithCompressor(compressionGzip))
+		}
+		if cfg.retry != nil {
+			opts = append(opts, otlptracegrpc.WithRetry(otlptracegrpc.RetryConfig{
+				Enabled:         cfg.retry.Enabled,
+				InitialInterval: time.Duration(cfg.retry.InitialInterval),
+				MaxInterval:     time.Duration(cfg.retry.MaxInterval),
+				MaxElapsedTime:  time.Duration(cfg.retry.MaxElapsedTime),
+			}))
+		}
+		if cfg.insecure {
+			opts = append(opts, otlptracegrpc.WithInsecure())
+		} else if cfg.customTLS() {
+			tlsConfig, err := newTLSConfig(cfg)
+			if err != nil {
+				return nil, err
+			}
+			opts = append(opts, otlptracegrpc.WithTLSCredentials(credentials.NewTLS(tlsConfig)))
+		}
+		return otlptracegrpc.New(ctx, opts...)
+
+	case protocolHTTPProtobuf:
+		var opts []otlptracehttp.Option
+		if cfg.endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpoint(cfg.endpoint))
+		}
+		if cfg.urlPath != "" {
+			opts = append(opts, otlptracehttp.WithURLPath(cfg.urlPath))
+		}
+		if len(cfg.headers) > 0 {
+			opts = append(opts, otlptracehttp.WithHeaders(cfg.headers))
+		}
+		if cfg.timeout > 0 {
+			opts = append(opts, otlptracehttp.WithTimeout(cfg.timeout))
+		}
+		if cfg.compression == compressionGzip {
+			opts = append(opts, otlptracehttp.WithCompression(otlptracehttp.GzipCompression))
+		}
+		if cfg.insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		} else if cfg.customTLS() {
+			tlsConfig, err := newTLSConfig(cfg)
+			if err != nil {
+				return nil, err
+			}
+			opts = append(opts, otlptracehttp.WithTLSClientConfig(tlsConfig))
+		}
+		return otlptracehttp.New(ctx, opts...)
+
+	case protocolStdout:
+		if cfg.stdoutFile == "" {
+			return stdouttrace.New(stdouttrace.WithWriter(os.Stderr), stdouttrace.WithPrettyPrint())
+		}
+		file, err := os.OpenFile(cfg.stdoutFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			return nil, fmt.Errorf("opening the stdout exporter file: %v", err)
+		}
+		exporter, err := stdouttrace.New(stdouttrace.WithWriter(file), stdouttrace.WithPrettyPrint())
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		return fileSpanExporter{SpanExporter: exporter, file: file}, nil
+
+	default:
+		return nil, fmt.Errorf("unsupported protocol %q", cfg.protocol)
+	}
+}
+
+// fileSpanExporter is a span exporter writing to a file, closed once the exporter is shut down.
+type fileSpanExporter struct {
+	sdktrace.SpanExporter
+	file *os.File
+}
+
+// Shutdown shuts the exporter down and closes its file.
+func (e fileSpanExporter) Shutdown(ctx context.Context) error {
+	err := e.SpanExporter.Shutdown(ctx)
+	if closeErr := e.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// newTLSConfig builds the TLS configuration used by the exporter to connect to the collector.
+func newTLSConfig(cfg tracerExporterConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: cfg.tlsSkipVerify,
+		ServerName:         cfg.serverName,
+	}
+
+	if cfg.certificate != "" {
+		pem, err := ioutil.ReadFile(cfg.certificate)
+		if err != nil {
+			return nil, fmt.Errorf("reading exporter certificate: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no valid certificates found in %s", cfg.certificate)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if cfg.clientCertificate != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.clientCertificate, cfg.clientKey)
+		if err != nil {
+			return nil, fmt.Errorf("loading exporter client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// getPropagators deduplicates propagators, according to the specification https://github.com/open-telemetry/opentelemetry-specification/blob/main/specification/sdk-environment-variables.md#general-sdk-configuration.
+// Parameter propagators is a "," separated string, ex: "baggage,tracecontext".
+// Current implementation supports "baggage", "tracecontext", "jaeger", "xray" and "b3" values,
+// an error is returned for any other value.
+//
+// The composite propagator keeps the configured order: the context is injected with each of
+// the propagators, and extracted with each of them in turn, so that the context extracted by
+// the last propagator finding its headers prevails.
+func getPropagators(propagators string) (propagation.TextMapPropagator, error) {
+	// deduplicationMap filters duplicated propagator
+	deduplicationMap := make(map[string]struct{})
+
+	// store unique values
+	var propagatorsList []propagation.TextMapPropagator
+
+	// unsupported collects the unrecognized names
+	var unsupported []string
+
+	for _, v := range strings.Split(propagators, ",") {
+		propagatorName := strings.TrimSpace(v)
+		if propagatorName == "" {
+			continue
+		}
+		if _, ok := deduplicationMap[propagatorName]; !ok {
+			deduplicationMap[propagatorName] = struct{}{}
+			switch propagatorName {
+			case "baggage":
+				propagatorsList = append(propagatorsList, propagation.Baggage{})
+			case "tracecontext":
+				propagatorsList = append(propagatorsList, propagation.TraceContext{})
+			case "jaeger":
+				propagatorsList = append(propagatorsList, jaeger.Jaeger{})
+			case "xray":
+				propagatorsList = append(propagatorsList, xray.Propagator{})
+			case "b3":
+				propagatorsList = append(propagatorsList, b3.New())
+			default:
+				unsupported = append(unsupported, strconv.Quote(propagatorName))
+			}
+		}
+	}
+
+	// report all the bad values at once, a typo must not silently disable the propagation
+	if len(unsupported) > 0 {
+		return nil, fmt.Errorf("unsupported propagators: %s", strings.Join(unsupported, ", "))
+	}
+
+	return propagation.NewCompositeTextMapPropagator(propagatorsList...), nil
+}
+
+// resolveEndpoint returns the endpoint of the traces following the
+// precedence of the OTLP exporter specification: the one configured for the
+// traces, the generic one configured, OTEL_EXPORTER_OTLP_TRACES_ENDPOINT and
+// last OTEL_EXPORTER_OTLP_ENDPOINT. An empty endpoint selects the default
+// one of the exporters.
+//
+// generic is true if the endpoint is a generic one, whose URL path is the
+// base of the paths of the signals rather than the path of the traces.
+func resolveEndpoint(tracesEndpoint, genericEndpoint string) (endpoint string, generic bool) {
+	if tracesEndpoint != "" {
+		return tracesEndpoint, false
+	}
+	if genericEndpoint != "" {
+		return genericEndpoint, true
+	}
+	if endpoint := os.Getenv(envExporterTracesEndpoint); endpoint != "" {
+		return endpoint, false
+	}
+	return os.Getenv(envExporterEndpoint), true
+}
+
+// getEnv returns the value of the first non-empty environment variable from the keys.
+func getEnv(keys ...string) string {
+	for _, key := range keys {
+		if v := os.Getenv(key); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// keyHash returns the hex encoded hash of the secret key, empty if there is none.
+func keyHash(key []byte) string {
+	if len(key) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:])
+}
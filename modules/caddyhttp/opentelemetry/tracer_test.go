@@ -0,0 +1,2698 @@
+package opentelemetry
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/baggage"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+)
+
+func TestOpenTelemetryWrapper_newOpenTelemetryWrapper(t *testing.T) {
+	ctx := context.Background()
+
+	otw, err := newOpenTelemetryWrapper(ctx, tracerConfig{
+		exporter: tracerExporterConfig{insecure: true},
+	})
+	if err != nil {
+		t.Fatalf("newOpenTelemetryWrapper() error = %v", err)
+	}
+	defer otw.cleanup(nil)
+
+	// the default span name is derived from the method of the request
+	req := httptest.NewRequest(http.MethodPost, "/", nil)
+	if name := otw.getSpanName(req); name != "HTTP POST" {
+		t.Errorf("span name = %q, expected %q", name, "HTTP POST")
+	}
+	if otw.tracer == nil {
+		t.Errorf("tracer should not be nil")
+	}
+	if otw.tracerProviderKey.serviceName != defaultServiceName {
+		t.Errorf("serviceName = %s, expected %s", otw.tracerProviderKey.serviceName, defaultServiceName)
+	}
+}
+
+func TestOpenTelemetryWrapper_newOpenTelemetryWrapper_samplingRatio(t *testing.T) {
+	ctx := context.Background()
+
+	alwaysSample, err := newOpenTelemetryWrapper(ctx, tracerConfig{
+		exporter: tracerExporterConfig{insecure: true},
+	})
+	if err != nil {
+		t.Fatalf("newOpenTelemetryWrapper() error = %v", err)
+	}
+	defer alwaysSample.cleanup(nil)
+
+	ratio := 0.1
+	sampled, err := newOpenTelemetryWrapper(ctx, tracerConfig{
+		samplingRatio: &ratio,
+		exporter:      tracerExporterConfig{insecure: true},
+	})
+	if err != nil {
+		t.Fatalf("newOpenTelemetryWrapper() error = %v", err)
+	}
+	defer sampled.cleanup(nil)
+
+	if alwaysSample.tracerProviderKey.sampler != "" {
+		t.Errorf("expected default sampler when the ratio is unset, got %s", alwaysSample.tracerProviderKey.sampler)
+	}
+	if alwaysSample.tracerProviderKey == sampled.tracerProviderKey {
+		t.Errorf("tracer providers with different sampling ratios must not share a key")
+	}
+}
+
+func TestOpenTelemetryWrapper_ServeHTTP(t *testing.T) {
+	otw, exporter := newTestOpenTelemetryWrapper()
+
+	req := httptest.NewRequest(http.MethodGet, "https://example.com/foo", nil)
+	rec := httptest.NewRecorder()
+
+	var traceparent string
+	handler := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		traceparent = r.Header.Get("traceparent")
+		return nil
+	})
+
+	if err := otw.ServeHTTP(rec, req, handler); err != nil {
+		t.Fatalf("ServeHTTP() error = %v", err)
+	}
+
+	if traceparent == "" {
+		t.Errorf("expected traceparent header to be injected into the request")
+	}
+
+	spans := exporter.GetSpans()
+	if len(spans) != 1 {
+		t.Fatalf("expected 1 span, got %d", len(spans))
+	}
+	if spans[0].Name != "test-span" {
+		t.Errorf("span name = %s, expected test-span", spans[0].Name)
+	}
+}
+
+func TestOpenTelemetryWrapper_getPropagators(t *testing.T) {
+	tests := []struct {
+		propagators string
+		fields      []string
+	}{
+		{"tracecontext", []string{"traceparent", "tracestate"}},
+		{"baggage", []string{"baggage"}},
+		{"tracecontext,baggage,tracecontext", []string{"traceparent", "tracestate", "baggage"}},
+		{"jaeger", []string{"uber-trace-id"}},
+		{"tracecontext, jaeger", []string{"traceparent", "tracestate", "uber-trace-id"}},
+		{"xray", []string{"X-Amzn-Trace-Id"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.propagators, func(t *testing.T) {
+			propagators, err := getPropagators(tt.propagators)
+			if err != nil {
+				t.Fatalf("getPropagators() error = %v", err)
+			}
+			// the composite propagator does not keep the order of the fields
+			got := propagators.Fields()
+			sort.Strings(got)
+			expected := append([]string(nil), tt.fields...)
+			sort.Strings(expected)
+			if !reflect.DeepEqual(got, expected) {
+				t.Errorf("Fields() = %v, expected %v", got, expected)
+			}
+		})
+	}
+}
+
+func TestOpenTelemetryWrapper_ServeHTTP_propagatorsOrder(t *testing.T) {
+	const (
+		traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+		spanID  = "00f067aa0ba902b7"
+	)
+
+	tests := []struct {
+		name     string
+		headers  map[string]string
+		expected string
+	}{
+		{
+			name:     "b3 headers only",
+			headers:  map[string]string{"X-B3-TraceId": traceID, "X-B3-SpanId": spanID, "X-B3-Sampled": "1"},
+			expected: traceID,
+		},
+		{
+			// the last propagator listed prevails
+			name: "b3 and tracecontext headers",
+			headers: map[string]string{
+				"X-B3-TraceId": traceID, "X-B3-SpanId": spanID, "X-B3-Sampled": "1",
+				"traceparent": "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01",
+			},
+			expected: "0af7651916cd43dd8448eb211c80319c",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			otw, exporter := newTestOpenTelemetryWrapper()
+			propagators, err := getPropagators("b3,tracecontext")
+			if err != nil {
+				t.Fatalf("getPropagators() error = %v", err)
+			}
+			otw.propagators = propagators
+
+			req := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+			for name, value := range tt.headers {
+				req.Header.Set(name, value)
+			}
+
+			var forwarded http.Header
+			err = otw.ServeHTTP(httptest.NewRecorder(), req, caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+				forwarded = r.Header.Clone()
+				return nil
+			}))
+			if err != nil {
+				t.Fatalf("ServeHTTP() error = %v", err)
+			}
+
+			span := exporter.GetSpans()[0]
+			if got := span.SpanContext.TraceID().String(); got != tt.expected {
+				t.Fatalf("trace ID = %s, expected %s", got, tt.expected)
+			}
+
+			// re-injected with both propagators, b3 in its single header by default
+			expected := fmt.Sprintf("%s-%s-1", tt.expected, span.SpanContext.SpanID())
+			if got := forwarded.Get("b3"); got != expected {
+				t.Errorf("b3 = %q, expected %q", got, expected)
+			}
+			expected = fmt.Sprintf("00-%s-%s-01", tt.expected, span.SpanContext.SpanID())
+			if got := forwarded.Get("traceparent"); got != expected {
+				t.Errorf("traceparent = %q, expected %q", got, expected)
+			}
+		})
+	}
+}
+
+func TestOpenTelemetryWrapper_getPropagators_unknown(t *testing.T) {
+	for _, propagators := range []string{"tracecontex", "tracecontext,tracestate"} {
+		if _, err := getPropagators(propagators); err == nil {
+			t.Errorf("getPropagators(%q) expected an error", propagators)
+		}
+	}
+}
+
+func TestOpenTelemetryWrapper_getPropagators_listsAllUnknown(t *testing.T) {
+	_, err := getPropagators("tracecontex,baggage,jeager")
+	if err == nil {
+		t.Fatalf("getPropagators() expected an error")
+	}
+	for _, name := range []string{`"tracecontex"`, `"jeager"`} {
+		if !strings.Contains(err.Error(), name) {
+			t.Errorf("error %q does not mention %s", err, name)
+		}
+	}
+}
+
+func TestOpenTelemetryWrapper_newOpenTelemetryWrapper_unknownPropagator(t *testing.T) {
+	_, err := newOpenTelemetryWrapper(context.Background(), tracerConfig{
+		propagators: "tracecontex",
+		exporter:    tracerExporterConfig{insecure: true},
+	})
+	if err == nil {
+		t.Errorf("newOpenTelemetryWrapper() expected an error for an unknown propagator")
+	}
+}
+
+// newTestOpenTelemetryWrapper returns a wrapper recording its spans synchronously into the returned exporter.
+func newTestOpenTelemetryWrapper() (*openTelemetryWrapper, *tracetest.InMemoryExporter) {
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+
+	return &openTelemetryWrapper{
+		tracer:      tp.Tracer("test"),
+		propagators: propagation.TraceContext{},
+		spanName:    "test-span",
+	}, exporter
+}
+
+func TestOpenTelemetryWrapper_ServeHTTP_nextContext(t *testing.T) {
+	otw, exporter := newTestOpenTelemetryWrapper()
+
+	req := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+
+	var next trace.SpanContext
+	err := otw.ServeHTTP(httptest.NewRecorder(), req, caddyhttp.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) error {
+		next = trace.SpanContextFromContext(r.Context())
+		return nil
+	}))
+	if err != nil {
+		t.Fatalf("ServeHTTP() error = %v", err)
+	}
+
+	if expected := exporter.GetSpans()[0].SpanContext; !next.Equal(expected) {
+		t.Errorf("span of the next handler = %v, expected %v", next, expected)
+	}
+}
+
+func TestOpenTelemetryWrapper_newSampler(t *testing.T) {
+	ratio := 0.25
+	tests := []struct {
+		name            string
+		sampler         string
+		ratio           *float64
+		envArg          string
+		tracesPerSecond float64
+		description     string
+		wantErr         bool
+	}{
+		{name: "default", description: ""},
+		{name: "ratio only", ratio: &ratio, description: sdktrace.TraceIDRatioBased(0.25).Description()},
+		{name: "always_on", sampler: "always_on", description: sdktrace.AlwaysSample().Description()},
+		{name: "always_off", sampler: "always_off", description: sdktrace.NeverSample().Description()},
+		{name: "traceidratio", sampler: "traceidratio", ratio: &ratio, description: sdktrace.TraceIDRatioBased(0.25).Description()},
+		{name: "parentbased_always_on", sampler: "parentbased_always_on", description: sdktrace.ParentBased(sdktrace.AlwaysSample()).Description()},
+		{name: "parentbased_always_off", sampler: "parentbased_always_off", description: sdktrace.ParentBased(sdktrace.NeverSample()).Description()},
+		{name: "parentbased_traceidratio", sampler: "parentbased_traceidratio", ratio: &ratio, description: sdktrace.ParentBased(sdktrace.TraceIDRatioBased(0.25)).Description()},
+		{name: "ratio from env", sampler: "traceidratio", envArg: "0.5", description: sdktrace.TraceIDRatioBased(0.5).Description()},
+		{name: "config ratio overrides env", sampler: "traceidratio", ratio: &ratio, envArg: "0.5", description: sdktrace.TraceIDRatioBased(0.25).Description()},
+		{name: "invalid env ratio", sampler: "traceidratio", envArg: "half", wantErr: true},
+		{name: "rate_limited", sampler: "rate_limited", tracesPerSecond: 10, description: "RateLimitedSampler{10}"},
+		{name: "rate_limited from env", sampler: "rate_limited", envArg: "5", description: "RateLimitedSampler{5}"},
+		{name: "rate_limited without limit", sampler: "rate_limited", wantErr: true},
+		{name: "unknown sampler", sampler: "sometimes", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Setenv(envTracesSamplerArg, tt.envArg)
+			defer os.Unsetenv(envTracesSamplerArg)
+
+			sampler, err := newSampler(tt.sampler, tt.ratio, tt.tracesPerSecond)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("newSampler() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			var description string
+			if sampler != nil {
+				description = sampler.Description()
+			}
+			if description != tt.description {
+				t.Errorf("newSampler() = %s, expected %s", description, tt.description)
+			}
+		})
+	}
+}
+
+func TestOpenTelemetryWrapper_newOpenTelemetryWrapper_samplerFromEnv(t *testing.T) {
+	os.Setenv(envTracesSampler, "parentbased_always_off")
+	defer os.Unsetenv(envTracesSampler)
+
+	otw, err := newOpenTelemetryWrapper(context.Background(), tracerConfig{
+		exporter: tracerExporterConfig{insecure: true},
+	})
+	if err != nil {
+		t.Fatalf("newOpenTelemetryWrapper() error = %v", err)
+	}
+	defer otw.cleanup(nil)
+
+	expected := sdktrace.ParentBased(sdktrace.NeverSample()).Description()
+	if otw.tracerProviderKey.sampler != expected {
+		t.Errorf("sampler = %s, expected %s", otw.tracerProviderKey.sampler, expected)
+	}
+}
+
+func TestOpenTelemetryWrapper_ServeHTTP_tlsIssuer(t *testing.T) {
+	const tlsIssuerCtxKey caddy.CtxKey = "tls_issuer"
+
+	tests := []struct {
+		name     string
+		url      string
+		issuer   string
+		expected string
+	}{
+		{name: "https with issuer", url: "https://example.com/", issuer: "acme-v02.api.letsencrypt.org", expected: "acme-v02.api.letsencrypt.org"},
+		{name: "https without issuer", url: "https://example.com/"},
+		{name: "plain http", url: "http://example.com/", issuer: "local"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			otw, exporter := newTestOpenTelemetryWrapper()
+			otw.tlsIssuerCtxKey = tlsIssuerCtxKey
+
+			req := httptest.NewRequest(http.MethodGet, tt.url, nil)
+			if tt.issuer != "" {
+				req = req.WithContext(context.WithValue(req.Context(), tlsIssuerCtxKey, tt.issuer))
+			}
+
+			err := otw.ServeHTTP(httptest.NewRecorder(), req, caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error {
+				return nil
+			}))
+			if err != nil {
+				t.Fatalf("ServeHTTP() error = %v", err)
+			}
+
+			if got := spanAttribute(t, exporter, "tls.issuer"); got != tt.expected {
+				t.Errorf("tls.issuer = %q, expected %q", got, tt.expected)
+			}
+		})
+	}
+}
+
+// spanAttribute returns the value of the attribute of the only exported span, or an empty string if it is not set.
+func spanAttribute(t *testing.T, exporter *tracetest.InMemoryExporter, key string) string {
+	t.Helper()
+
+	spans := exporter.GetSpans()
+	if len(spans) != 1 {
+		t.Fatalf("expected 1 span, got %d", len(spans))
+	}
+	for _, attr := range spans[0].Attributes {
+		if string(attr.Key) == key {
+			return attr.Value.Emit()
+		}
+	}
+	return ""
+}
+
+func TestOpenTelemetryWrapper_ServeHTTP_httpAttributes(t *testing.T) {
+	otw, exporter := newTestOpenTelemetryWrapper()
+
+	req := httptest.NewRequest(http.MethodPost, "https://example.com/foo?bar=baz", nil)
+	req.Header.Set("User-Agent", "test-agent")
+
+	err := otw.ServeHTTP(httptest.NewRecorder(), req, caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error {
+		return nil
+	}))
+	if err != nil {
+		t.Fatalf("ServeHTTP() error = %v", err)
+	}
+
+	expected := map[string]string{
+		"http.method":     "POST",
+		"http.target":     "/foo?bar=baz",
+		"http.scheme":     "https",
+		"http.host":       "example.com",
+		"http.user_agent": "test-agent",
+	}
+	for k, v := range expected {
+		if got := spanAttribute(t, exporter, k); got != v {
+			t.Errorf("%s = %q, expected %q", k, got, v)
+		}
+	}
+
+	if kind := exporter.GetSpans()[0].SpanKind; kind != trace.SpanKindServer {
+		t.Errorf("span kind = %v, expected %v", kind, trace.SpanKindServer)
+	}
+}
+
+func TestOpenTelemetryWrapper_ServeHTTP_statusCode(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     int // zero for a handler writing nothing
+		expected   int
+		spanStatus codes.Code
+	}{
+		{"OK", http.StatusOK, http.StatusOK, codes.Unset},
+		{"No Content", http.StatusNoContent, http.StatusNoContent, codes.Unset},
+		{"Moved Permanently", http.StatusMovedPermanently, http.StatusMovedPermanently, codes.Unset},
+		{"Not Modified", http.StatusNotModified, http.StatusNotModified, codes.Unset},
+		{"Not Found", http.StatusNotFound, http.StatusNotFound, codes.Unset},
+		{"Bad Gateway", http.StatusBadGateway, http.StatusBadGateway, codes.Error},
+		{"nothing written", 0, http.StatusOK, codes.Unset},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			otw, exporter := newTestOpenTelemetryWrapper()
+
+			req := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+			err := otw.ServeHTTP(httptest.NewRecorder(), req, caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+				if tt.status != 0 {
+					w.WriteHeader(tt.status)
+				}
+				return nil
+			}))
+			if err != nil {
+				t.Fatalf("ServeHTTP() error = %v", err)
+			}
+
+			if got := spanAttribute(t, exporter, "http.status_code"); got != strconv.Itoa(tt.expected) {
+				t.Errorf("http.status_code = %s, expected %d", got, tt.expected)
+			}
+			if got := exporter.GetSpans()[0].Status.Code; got != tt.spanStatus {
+				t.Errorf("span status = %v, expected %v", got, tt.spanStatus)
+			}
+		})
+	}
+}
+
+func TestOpenTelemetryWrapper_ServeHTTP_queueDelay(t *testing.T) {
+	const queueEnteredCtxKey caddy.CtxKey = "queue_entered"
+
+	otw, exporter := newTestOpenTelemetryWrapper()
+	otw.queueEnteredCtxKey = queueEnteredCtxKey
+
+	req := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+	req = req.WithContext(context.WithValue(req.Context(), queueEnteredCtxKey, time.Now().Add(-250*time.Millisecond)))
+
+	err := otw.ServeHTTP(httptest.NewRecorder(), req, caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error {
+		return nil
+	}))
+	if err != nil {
+		t.Fatalf("ServeHTTP() error = %v", err)
+	}
+
+	delay, err := strconv.Atoi(spanAttribute(t, exporter, "caddy.queue.delay_ms"))
+	if err != nil {
+		t.Fatalf("caddy.queue.delay_ms is not a number: %v", err)
+	}
+	if delay < 250 || delay > 1250 {
+		t.Errorf("caddy.queue.delay_ms = %d, expected about 250", delay)
+	}
+}
+
+func TestOpenTelemetryWrapper_ServeHTTP_noQueueDelay(t *testing.T) {
+	otw, exporter := newTestOpenTelemetryWrapper()
+	otw.queueEnteredCtxKey = "queue_entered"
+
+	req := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+	err := otw.ServeHTTP(httptest.NewRecorder(), req, caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error {
+		return nil
+	}))
+	if err != nil {
+		t.Fatalf("ServeHTTP() error = %v", err)
+	}
+
+	if got := spanAttribute(t, exporter, "caddy.queue.delay_ms"); got != "" {
+		t.Errorf("caddy.queue.delay_ms = %s, expected it to be omitted", got)
+	}
+}
+
+func TestOpenTelemetryWrapper_ServeHTTP_logID(t *testing.T) {
+	const logIDCtxKey caddy.CtxKey = "log_id"
+
+	tests := []struct {
+		name     string
+		logID    string
+		expected string
+	}{
+		{name: "with log id", logID: "log-42", expected: "log-42"},
+		{name: "without log id"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			otw, exporter := newTestOpenTelemetryWrapper()
+			otw.logIDCtxKey = logIDCtxKey
+
+			req := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+			if tt.logID != "" {
+				req = req.WithContext(context.WithValue(req.Context(), logIDCtxKey, tt.logID))
+			}
+
+			err := otw.ServeHTTP(httptest.NewRecorder(), req, caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error {
+				return nil
+			}))
+			if err != nil {
+				t.Fatalf("ServeHTTP() error = %v", err)
+			}
+
+			if got := spanAttribute(t, exporter, "caddy.log.id"); got != tt.expected {
+				t.Errorf("caddy.log.id = %q, expected %q", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestOpenTelemetryWrapper_ServeHTTP_handlerError(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		statusCode string
+	}{
+		{name: "plain error", err: errors.New("boom")},
+		{name: "handler error", err: caddyhttp.Error(http.StatusServiceUnavailable, errors.New("boom")), statusCode: "503"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			otw, exporter := newTestOpenTelemetryWrapper()
+
+			req := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+			err := otw.ServeHTTP(httptest.NewRecorder(), req, caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error {
+				return tt.err
+			}))
+			if err != tt.err {
+				t.Fatalf("ServeHTTP() error = %v, expected %v", err, tt.err)
+			}
+
+			span := exporter.GetSpans()[0]
+			if span.Status.Code != codes.Error {
+				t.Errorf("span status = %v, expected %v", span.Status.Code, codes.Error)
+			}
+			if span.Status.Description != tt.err.Error() {
+				t.Errorf("span status description = %q, expected %q", span.Status.Description, tt.err.Error())
+			}
+			if len(span.Events) != 1 || span.Events[0].Name != "exception" {
+				t.Errorf("expected the error to be recorded as an exception event, got %v", span.Events)
+			}
+			if got := spanAttribute(t, exporter, "http.status_code"); got != tt.statusCode {
+				t.Errorf("http.status_code = %q, expected %q", got, tt.statusCode)
+			}
+		})
+	}
+}
+
+func TestOpenTelemetryWrapper_getSpanName(t *testing.T) {
+	tests := []struct {
+		spanName string
+		expected string
+	}{
+		{spanName: "static-name", expected: "static-name"},
+		{spanName: "{http.request.method} {http.request.uri.path}", expected: "POST /foo/bar"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spanName, func(t *testing.T) {
+			otw, exporter := newTestOpenTelemetryWrapper()
+			otw.spanName = tt.spanName
+			otw.spanNameHasPlaceholders = strings.Contains(tt.spanName, "{")
+
+			req := httptest.NewRequest(http.MethodPost, "https://example.com/foo/bar", nil)
+			caddyhttp.NewTestReplacer(req)
+
+			err := otw.ServeHTTP(httptest.NewRecorder(), req, caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error {
+				return nil
+			}))
+			if err != nil {
+				t.Fatalf("ServeHTTP() error = %v", err)
+			}
+
+			if got := exporter.GetSpans()[0].Name; got != tt.expected {
+				t.Errorf("span name = %q, expected %q", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestOpenTelemetryWrapper_ServeHTTP_requestID(t *testing.T) {
+	otw, exporter := newTestOpenTelemetryWrapper()
+	otw.propagators = propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+	otw.requestIDCtxKey = "request_id"
+	otw.requestIDBaggage = true
+
+	req := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+	req = req.WithContext(context.WithValue(req.Context(), caddy.CtxKey("request_id"), "4b7cc8f0-1d1e-4d0c-9f7b-3f4e2c7d9a10"))
+
+	err := otw.ServeHTTP(httptest.NewRecorder(), req, caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error {
+		return nil
+	}))
+	if err != nil {
+		t.Fatalf("ServeHTTP() error = %v", err)
+	}
+
+	if got := spanAttribute(t, exporter, "caddy.request_id"); got != "4b7cc8f0-1d1e-4d0c-9f7b-3f4e2c7d9a10" {
+		t.Errorf("caddy.request_id = %q, expected the request ID", got)
+	}
+	if got := req.Header.Get("baggage"); got != "caddy.request_id=4b7cc8f0-1d1e-4d0c-9f7b-3f4e2c7d9a10" {
+		t.Errorf("baggage = %q, expected the request ID member", got)
+	}
+}
+
+func TestOpenTelemetryWrapper_ServeHTTP_downstreamSpan(t *testing.T) {
+	otw, exporter := newTestOpenTelemetryWrapper()
+
+	req := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+
+	var traceparent string
+	err := otw.ServeHTTP(httptest.NewRecorder(), req, caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		// e.g. the reverse proxy, forwarding the headers of the request
+		traceparent = r.Header.Get("traceparent")
+		_, child := otw.tracer.Start(r.Context(), "downstream")
+		child.End()
+		return nil
+	}))
+	if err != nil {
+		t.Fatalf("ServeHTTP() error = %v", err)
+	}
+
+	spans := exporter.GetSpans()
+	if len(spans) != 2 {
+		t.Fatalf("expected 2 spans, got %d", len(spans))
+	}
+	child, parent := spans[0], spans[1]
+	if child.Parent.SpanID() != parent.SpanContext.SpanID() || child.SpanContext.TraceID() != parent.SpanContext.TraceID() {
+		t.Errorf("downstream span parent = %v, expected the span of the request %v", child.Parent, parent.SpanContext)
+	}
+	expected := fmt.Sprintf("00-%s-%s-01", parent.SpanContext.TraceID(), parent.SpanContext.SpanID())
+	if traceparent != expected {
+		t.Errorf("traceparent = %q, expected %q", traceparent, expected)
+	}
+}
+
+func TestOpenTelemetryWrapper_ServeHTTP_httpRoute(t *testing.T) {
+	tests := []struct {
+		name         string
+		innerVar     string
+		handlerRoute string
+		expected     string
+	}{
+		{name: "pattern set by the route handlers", innerVar: "/users/{id}", expected: "/users/{id}"},
+		{name: "pattern of the handler route", handlerRoute: "/api/*", expected: "/api/*"},
+		{name: "no pattern"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			otw, exporter := newTestOpenTelemetryWrapper()
+			otw.spanNameSources = []string{spanNameSourceMethod}
+			otw.routePattern = tt.handlerRoute
+
+			req := httptest.NewRequest(http.MethodGet, "https://example.com/users/42", nil)
+			req = req.WithContext(context.WithValue(req.Context(), caddyhttp.VarsCtxKey, make(map[string]interface{})))
+
+			err := otw.ServeHTTP(httptest.NewRecorder(), req, caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+				if tt.innerVar != "" {
+					caddyhttp.SetVar(r.Context(), RoutePatternVar, tt.innerVar)
+				}
+				return nil
+			}))
+			if err != nil {
+				t.Fatalf("ServeHTTP() error = %v", err)
+			}
+
+			// the span keeps its descriptive name
+			if got := exporter.GetSpans()[0].Name; got != "GET /users/42" {
+				t.Errorf("span name = %q, expected %q", got, "GET /users/42")
+			}
+			if got := spanAttribute(t, exporter, "http.route"); got != tt.expected {
+				t.Errorf("http.route = %q, expected %q", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestOpenTelemetryWrapper_resolveSpanName(t *testing.T) {
+	tests := []struct {
+		name         string
+		sources      []string
+		routeVar     string
+		handlerRoute string
+		expected     string
+		source       int
+	}{
+		{name: "no source", expected: "test-span", source: 0},
+		{name: "route", sources: []string{"route"}, routeVar: "/users/{id}", expected: "/users/{id}", source: 0},
+		{name: "route of the handler", sources: []string{"route"}, handlerRoute: "/api/*", expected: "/api/*", source: 0},
+		{name: "no route", sources: []string{"route"}, expected: "test-span", source: 1},
+		{name: "route before method", sources: []string{"route", "method", "static"}, routeVar: "/users/{id}", expected: "/users/{id}", source: 0},
+		{name: "method fallback", sources: []string{"route", "method", "static"}, expected: "GET /users/42", source: 1},
+		{name: "static before method", sources: []string{"static", "method"}, expected: "test-span", source: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			otw, _ := newTestOpenTelemetryWrapper()
+			otw.spanNameSources = tt.sources
+			otw.routePattern = tt.handlerRoute
+
+			req := httptest.NewRequest(http.MethodGet, "https://example.com/users/42", nil)
+			req = req.WithContext(context.WithValue(req.Context(), caddyhttp.VarsCtxKey, make(map[string]interface{})))
+			if tt.routeVar != "" {
+				caddyhttp.SetVar(req.Context(), RoutePatternVar, tt.routeVar)
+			}
+
+			name, source := otw.resolveSpanName(req)
+			if name != tt.expected || source != tt.source {
+				t.Errorf("resolveSpanName() = %q, %d, expected %q, %d", name, source, tt.expected, tt.source)
+			}
+		})
+	}
+}
+
+func TestParseSpanNameSources(t *testing.T) {
+	sources, err := parseSpanNameSources("route, method,static")
+	if err != nil {
+		t.Fatalf("parseSpanNameSources() error = %v", err)
+	}
+	if expected := []string{"route", "method", "static"}; !reflect.DeepEqual(sources, expected) {
+		t.Errorf("parseSpanNameSources() = %v, expected %v", sources, expected)
+	}
+
+	if _, err := parseSpanNameSources("route,header"); err == nil {
+		t.Errorf("parseSpanNameSources() expected an error for an unsupported source")
+	}
+}
+
+func TestOpenTelemetryWrapper_ServeHTTP_spanNameFromRoute(t *testing.T) {
+	tests := []struct {
+		name         string
+		outerVar     string
+		innerVar     string
+		handlerRoute string
+		expected     string
+		fromRoutes   bool
+	}{
+		{name: "pattern known before", outerVar: "/users/{id}", fromRoutes: true, expected: "/users/{id}"},
+		{name: "pattern set by the route handlers", innerVar: "/orders/{id}", fromRoutes: true, expected: "/orders/{id}"},
+		{name: "no pattern", fromRoutes: true, expected: "test-span"},
+		{name: "pattern of the handler route", fromRoutes: true, handlerRoute: "/api/*", expected: "/api/*"},
+		{name: "pattern known before the handler route", outerVar: "/users/{id}", fromRoutes: true, handlerRoute: "/api/*", expected: "/users/{id}"},
+		{name: "static source", outerVar: "/users/{id}", expected: "test-span"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			otw, exporter := newTestOpenTelemetryWrapper()
+			if tt.fromRoutes {
+				otw.spanNameSources = []string{spanNameSourceRoute}
+			}
+			otw.routePattern = tt.handlerRoute
+
+			req := httptest.NewRequest(http.MethodGet, "https://example.com/users/42", nil)
+			req = req.WithContext(context.WithValue(req.Context(), caddyhttp.VarsCtxKey, make(map[string]interface{})))
+			if tt.outerVar != "" {
+				caddyhttp.SetVar(req.Context(), RoutePatternVar, tt.outerVar)
+			}
+
+			err := otw.ServeHTTP(httptest.NewRecorder(), req, caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+				if tt.innerVar != "" {
+					caddyhttp.SetVar(r.Context(), RoutePatternVar, tt.innerVar)
+				}
+				return nil
+			}))
+			if err != nil {
+				t.Fatalf("ServeHTTP() error = %v", err)
+			}
+
+			if got := exporter.GetSpans()[0].Name; got != tt.expected {
+				t.Errorf("span name = %q, expected %q", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestOpenTelemetryWrapper_ServeHTTP_errorRoute(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		expected string
+	}{
+		{name: "error route", err: caddyhttp.Error(http.StatusNotFound, nil), expected: "true"},
+		{name: "regular route"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			otw, exporter := newTestOpenTelemetryWrapper()
+
+			req := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+			if tt.err != nil {
+				req = req.WithContext(context.WithValue(req.Context(), caddyhttp.ErrorCtxKey, tt.err))
+			}
+
+			err := otw.ServeHTTP(httptest.NewRecorder(), req, caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error {
+				return nil
+			}))
+			if err != nil {
+				t.Fatalf("ServeHTTP() error = %v", err)
+			}
+
+			if got := spanAttribute(t, exporter, "caddy.route.is_error"); got != tt.expected {
+				t.Errorf("caddy.route.is_error = %q, expected %q", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestOpenTelemetryWrapper_ServeHTTP_bypassHeader(t *testing.T) {
+	tests := []struct {
+		name     string
+		header   string
+		expected int
+	}{
+		{name: "bypass header set", header: "true", expected: 0},
+		{name: "bypass header false", header: "false", expected: 1},
+		{name: "bypass header invalid", header: "maybe", expected: 1},
+		{name: "no bypass header", expected: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			otw, exporter := newTestOpenTelemetryWrapper()
+			otw.bypassHeader = "X-No-Trace"
+
+			req := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+			if tt.header != "" {
+				req.Header.Set("X-No-Trace", tt.header)
+			}
+
+			called := false
+			err := otw.ServeHTTP(httptest.NewRecorder(), req, caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error {
+				called = true
+				return nil
+			}))
+			if err != nil {
+				t.Fatalf("ServeHTTP() error = %v", err)
+			}
+			if !called {
+				t.Errorf("expected the next handler to be called")
+			}
+
+			if got := len(exporter.GetSpans()); got != tt.expected {
+				t.Errorf("got %d spans, expected %d", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestOpenTelemetryWrapper_ServeHTTP_spanNameFromResponseHeader(t *testing.T) {
+	otw, exporter := newTestOpenTelemetryWrapper()
+	otw.spanNameFromResponseHeader = "X-Operation-Name"
+
+	for _, operation := range []string{"GetUser", ""} {
+		req := httptest.NewRequest(http.MethodGet, "https://example.com/users/1", nil)
+		err := otw.ServeHTTP(httptest.NewRecorder(), req, caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+			if operation != "" {
+				w.Header().Set("X-Operation-Name", operation)
+			}
+			w.WriteHeader(http.StatusOK)
+			return nil
+		}))
+		if err != nil {
+			t.Fatalf("ServeHTTP() error = %v", err)
+		}
+	}
+
+	spans := exporter.GetSpans()
+	if len(spans) != 2 {
+		t.Fatalf("got %d spans, expected 2", len(spans))
+	}
+	// without the header, the span keeps its name
+	if spans[0].Name != "GetUser" || spans[1].Name != "test-span" {
+		t.Errorf("span names = %q, %q, expected GetUser and test-span", spans[0].Name, spans[1].Name)
+	}
+}
+
+func TestOpenTelemetryWrapper_ServeHTTP_perRequestService(t *testing.T) {
+	otw, exporter := newTestOpenTelemetryWrapper()
+	otw.perRequestService = "{http.request.uri.path.0}"
+
+	for _, target := range []string{"https://example.com/users/1", "https://example.com/orders/2"} {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		caddyhttp.NewTestReplacer(req)
+
+		err := otw.ServeHTTP(httptest.NewRecorder(), req, caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error {
+			return nil
+		}))
+		if err != nil {
+			t.Fatalf("ServeHTTP() error = %v", err)
+		}
+	}
+
+	spans := exporter.GetSpans()
+	if len(spans) != 2 {
+		t.Fatalf("got %d spans, expected 2", len(spans))
+	}
+
+	var services []string
+	for _, span := range spans {
+		for _, attr := range span.Attributes {
+			if attr.Key == "peer.service" {
+				services = append(services, attr.Value.Emit())
+			}
+		}
+	}
+	if len(services) != 2 || services[0] != "users" || services[1] != "orders" {
+		t.Errorf("peer.service = %v, expected [users orders]", services)
+	}
+}
+
+func TestOpenTelemetryWrapper_newResource_customAttributes(t *testing.T) {
+	res, err := newResource(context.Background(), "my-service", "", map[string]string{
+		"deployment.environment": "production",
+		"telemetry.sdk.language": "custom",
+	})
+	if err != nil {
+		t.Fatalf("newResource() error = %v", err)
+	}
+
+	attrs := map[string]string{}
+	for _, attr := range res.Attributes() {
+		attrs[string(attr.Key)] = attr.Value.Emit()
+	}
+	if attrs["deployment.environment"] != "production" {
+		t.Errorf("deployment.environment = %q, expected production", attrs["deployment.environment"])
+	}
+	if attrs["telemetry.sdk.language"] != "custom" {
+		t.Errorf("telemetry.sdk.language = %q, expected the custom value to override the default one", attrs["telemetry.sdk.language"])
+	}
+	if attrs["service.name"] != "my-service" {
+		t.Errorf("service.name = %q, expected my-service", attrs["service.name"])
+	}
+}
+
+func TestOpenTelemetryWrapper_newResource_fromEnv(t *testing.T) {
+	os.Setenv("OTEL_RESOURCE_ATTRIBUTES", "service.name=env-service,deployment.environment=staging")
+	defer os.Unsetenv("OTEL_RESOURCE_ATTRIBUTES")
+
+	tests := []struct {
+		name        string
+		serviceName string
+		expected    string
+	}{
+		{name: "service name from the environment", expected: "env-service"},
+		{name: "explicit service name", serviceName: "my-service", expected: "my-service"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := newResource(context.Background(), tt.serviceName, "", nil)
+			if err != nil {
+				t.Fatalf("newResource() error = %v", err)
+			}
+
+			attrs := map[string]string{}
+			for _, attr := range res.Attributes() {
+				attrs[string(attr.Key)] = attr.Value.Emit()
+			}
+			if attrs["service.name"] != tt.expected {
+				t.Errorf("service.name = %q, expected %q", attrs["service.name"], tt.expected)
+			}
+			if attrs["deployment.environment"] != "staging" {
+				t.Errorf("deployment.environment = %q, expected staging", attrs["deployment.environment"])
+			}
+		})
+	}
+}
+
+func TestOpenTelemetryWrapper_ServeHTTP_receivedAt(t *testing.T) {
+	otw, exporter := newTestOpenTelemetryWrapper()
+	otw.recordReceivedAt = true
+
+	req := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+	err := otw.ServeHTTP(httptest.NewRecorder(), req, caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error {
+		return nil
+	}))
+	if err != nil {
+		t.Fatalf("ServeHTTP() error = %v", err)
+	}
+
+	receivedAt, err := time.Parse(time.RFC3339, spanAttribute(t, exporter, "caddy.request.received_at"))
+	if err != nil {
+		t.Fatalf("caddy.request.received_at is not a RFC 3339 time: %v", err)
+	}
+	if since := time.Since(receivedAt); since < 0 || since > time.Minute {
+		t.Errorf("caddy.request.received_at = %v, expected about now", receivedAt)
+	}
+}
+
+func TestOpenTelemetryWrapper_ServeHTTP_baggageAsAttributes(t *testing.T) {
+	tests := []struct {
+		name     string
+		record   bool
+		expected string
+	}{
+		{name: "recorded", record: true, expected: "acme"},
+		{name: "not recorded"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			otw, exporter := newTestOpenTelemetryWrapper()
+			otw.propagators = propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+			otw.baggageAsAttributes = tt.record
+			otw.baggageMaxLength = 8
+
+			req := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+			req.Header.Set("baggage", "tenant=acme,note="+strings.Repeat("x", 20))
+
+			err := otw.ServeHTTP(httptest.NewRecorder(), req, caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error {
+				return nil
+			}))
+			if err != nil {
+				t.Fatalf("ServeHTTP() error = %v", err)
+			}
+
+			if got := spanAttribute(t, exporter, "baggage.tenant"); got != tt.expected {
+				t.Errorf("baggage.tenant = %q, expected %q", got, tt.expected)
+			}
+			if tt.record {
+				if got := spanAttribute(t, exporter, "baggage.note"); got != strings.Repeat("x", 8) {
+					t.Errorf("baggage.note = %q, expected it to be truncated to 8 bytes", got)
+				}
+			}
+		})
+	}
+}
+
+func TestOpenTelemetryWrapper_ServeHTTP_setBaggage(t *testing.T) {
+	members, err := newBaggageMembers(map[string]string{"deployment": "canary"})
+	if err != nil {
+		t.Fatalf("newBaggageMembers() error = %v", err)
+	}
+
+	otw, _ := newTestOpenTelemetryWrapper()
+	otw.propagators = propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+	otw.setBaggage = members
+
+	req := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+	req.Header.Set("baggage", "tenant=acme")
+
+	var propagated baggage.Baggage
+	err = otw.ServeHTTP(httptest.NewRecorder(), req, caddyhttp.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) error {
+		propagated = baggage.FromContext(propagation.Baggage{}.Extract(context.Background(), propagation.HeaderCarrier(r.Header)))
+		return nil
+	}))
+	if err != nil {
+		t.Fatalf("ServeHTTP() error = %v", err)
+	}
+
+	if got := propagated.Member("deployment").Value(); got != "canary" {
+		t.Errorf("propagated deployment = %q, expected canary", got)
+	}
+	if got := propagated.Member("tenant").Value(); got != "acme" {
+		t.Errorf("propagated tenant = %q, expected the member of the request to be kept", got)
+	}
+}
+
+func TestNewBaggageMembers_invalidKey(t *testing.T) {
+	if _, err := newBaggageMembers(map[string]string{"not a key": "value"}); err == nil {
+		t.Errorf("newBaggageMembers() expected an error for an invalid key")
+	}
+}
+
+func TestPropagatorEnabled(t *testing.T) {
+	tests := []struct {
+		propagators string
+		expected    bool
+	}{
+		{propagators: "", expected: true},
+		{propagators: "tracecontext, baggage", expected: true},
+		{propagators: "tracecontext,jaeger", expected: false},
+	}
+	for _, tt := range tests {
+		if got := propagatorEnabled(tt.propagators, "baggage"); got != tt.expected {
+			t.Errorf("propagatorEnabled(%q, baggage) = %v, expected %v", tt.propagators, got, tt.expected)
+		}
+	}
+}
+
+func TestOpenTelemetryWrapper_ServeHTTP_duplicateTraceparent(t *testing.T) {
+	const (
+		first   = "00-11111111111111111111111111111111-1111111111111111-01"
+		last    = "00-22222222222222222222222222222222-2222222222222222-01"
+		invalid = "00-not-a-trace-context"
+	)
+	tests := []struct {
+		name         string
+		last         bool
+		traceparents []string
+		expected     string
+	}{
+		{name: "first", traceparents: []string{first, last}, expected: "11111111111111111111111111111111"},
+		{name: "last", last: true, traceparents: []string{first, last}, expected: "22222222222222222222222222222222"},
+		{name: "first invalid", traceparents: []string{invalid, last}, expected: "22222222222222222222222222222222"},
+		{name: "last invalid", last: true, traceparents: []string{first, invalid}, expected: "11111111111111111111111111111111"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			otw, exporter := newTestOpenTelemetryWrapper()
+			otw.lastTraceparent = tt.last
+
+			req := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+			for _, traceparent := range tt.traceparents {
+				req.Header.Add("traceparent", traceparent)
+			}
+
+			err := otw.ServeHTTP(httptest.NewRecorder(), req, caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error {
+				return nil
+			}))
+			if err != nil {
+				t.Fatalf("ServeHTTP() error = %v", err)
+			}
+
+			if got := exporter.GetSpans()[0].SpanContext.TraceID().String(); got != tt.expected {
+				t.Errorf("trace ID = %s, expected %s", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestOpenTelemetryWrapper_ServeHTTP_cacheControl(t *testing.T) {
+	tests := []struct {
+		name     string
+		record   bool
+		expected string
+	}{
+		{name: "recorded", record: true, expected: "public, max-age=60"},
+		{name: "not recorded"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			otw, exporter := newTestOpenTelemetryWrapper()
+			otw.recordCacheControl = tt.record
+
+			req := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+
+			err := otw.ServeHTTP(httptest.NewRecorder(), req, caddyhttp.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) error {
+				w.Header().Set("Cache-Control", "public, max-age=60")
+				w.WriteHeader(http.StatusOK)
+				return nil
+			}))
+			if err != nil {
+				t.Fatalf("ServeHTTP() error = %v", err)
+			}
+
+			if got := spanAttribute(t, exporter, "http.response.cache_control"); got != tt.expected {
+				t.Errorf("http.response.cache_control = %q, expected %q", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestOpenTelemetryWrapper_ServeHTTP_compression(t *testing.T) {
+	tests := []struct {
+		name     string
+		encoding string
+		expected string
+	}{
+		{name: "gzip", encoding: "gzip", expected: "gzip"},
+		{name: "zstd", encoding: "zstd", expected: "zstd"},
+		{name: "identity", encoding: "identity", expected: "none"},
+		{name: "uncompressed", expected: "none"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			otw, exporter := newTestOpenTelemetryWrapper()
+
+			req := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+			req.Header.Set("Accept-Encoding", "gzip, zstd")
+
+			err := otw.ServeHTTP(httptest.NewRecorder(), req, caddyhttp.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) error {
+				body := []byte("hello")
+				if tt.encoding == "gzip" {
+					var buf bytes.Buffer
+					gz := gzip.NewWriter(&buf)
+					gz.Write(body)
+					gz.Close()
+					body = buf.Bytes()
+				}
+				if tt.encoding != "" {
+					w.Header().Set("Content-Encoding", tt.encoding)
+				}
+				w.WriteHeader(http.StatusOK)
+				_, err := w.Write(body)
+				return err
+			}))
+			if err != nil {
+				t.Fatalf("ServeHTTP() error = %v", err)
+			}
+
+			if got := spanAttribute(t, exporter, "http.response.compression"); got != tt.expected {
+				t.Errorf("http.response.compression = %q, expected %q", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestOpenTelemetryWrapper_newResource_serviceVersion(t *testing.T) {
+	tests := []struct {
+		name           string
+		serviceVersion string
+	}{
+		{name: "with version", serviceVersion: "1.2.3"},
+		{name: "without version"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := newResource(context.Background(), "my-service", tt.serviceVersion, nil)
+			if err != nil {
+				t.Fatalf("newResource() error = %v", err)
+			}
+
+			version, ok := res.Set().Value("service.version")
+			if ok != (tt.serviceVersion != "") || version.AsString() != tt.serviceVersion {
+				t.Errorf("service.version = %q (set: %v), expected %q", version.AsString(), ok, tt.serviceVersion)
+			}
+		})
+	}
+}
+
+func TestOpenTelemetryWrapper_newOpenTelemetryWrapper_exporterHeaders(t *testing.T) {
+	otw, err := newOpenTelemetryWrapper(context.Background(), tracerConfig{
+		exporter: tracerExporterConfig{
+			insecure: true,
+			headers:  map[string]string{"x-honeycomb-team": "my-api-key"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("newOpenTelemetryWrapper() error = %v", err)
+	}
+	defer otw.cleanup(nil)
+
+	key := otw.tracerProviderKey
+	if key.headersHash == "" {
+		t.Errorf("expected the headers to be part of the tracer provider key")
+	}
+	if strings.Contains(fmt.Sprintf("%+v", key), "my-api-key") {
+		t.Errorf("tracer provider key %+v should not contain the header values", key)
+	}
+}
+
+func TestOpenTelemetryWrapper_ServeHTTP_missingHost(t *testing.T) {
+	tests := []struct {
+		name        string
+		host        string
+		missingHost string
+		expected    string
+		dropped     bool
+	}{
+		{name: "host", host: "example.com", missingHost: "drop", expected: "example.com"},
+		{name: "no host", expected: ""},
+		{name: "no host with default", missingHost: "unknown", expected: "unknown"},
+		{name: "no host dropped", missingHost: "drop", dropped: true},
+		{name: "drop host", host: "drop", expected: "drop"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			otw, exporter := newTestOpenTelemetryWrapper()
+			otw.missingHost = tt.missingHost
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Host = tt.host
+
+			err := otw.ServeHTTP(httptest.NewRecorder(), req, caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error {
+				return nil
+			}))
+			if err != nil {
+				t.Fatalf("ServeHTTP() error = %v", err)
+			}
+
+			found := false
+			for _, attr := range exporter.GetSpans()[0].Attributes {
+				if attr.Key == "http.host" {
+					found = true
+					if got := attr.Value.AsString(); got != tt.expected {
+						t.Errorf("http.host = %q, expected %q", got, tt.expected)
+					}
+				}
+			}
+			if found == tt.dropped {
+				t.Errorf("http.host recorded = %v, expected %v", found, !tt.dropped)
+			}
+		})
+	}
+}
+
+// traceCollector is an OTLP gRPC collector counting the spans it receives.
+type traceCollector struct {
+	coltracepb.UnimplementedTraceServiceServer
+
+	mu    sync.Mutex
+	spans int
+}
+
+func (c *traceCollector) Export(_ context.Context, req *coltracepb.ExportTraceServiceRequest) (*coltracepb.ExportTraceServiceResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, resourceSpans := range req.ResourceSpans {
+		for _, librarySpans := range resourceSpans.InstrumentationLibrarySpans {
+			c.spans += len(librarySpans.Spans)
+		}
+	}
+	return &coltracepb.ExportTraceServiceResponse{}, nil
+}
+
+func (c *traceCollector) count() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.spans
+}
+
+// startTraceCollector starts a collector listening on a local address, stopped at the end of the test.
+func startTraceCollector(t *testing.T) (*traceCollector, string) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening: %v", err)
+	}
+	collector := new(traceCollector)
+	srv := grpc.NewServer()
+	coltracepb.RegisterTraceServiceServer(srv, collector)
+	go func() { _ = srv.Serve(ln) }()
+	t.Cleanup(srv.Stop)
+
+	return collector, ln.Addr().String()
+}
+
+func TestOpenTelemetryWrapper_getTracerExporters(t *testing.T) {
+	collector, endpoint := startTraceCollector(t)
+
+	// the stdout exporter writes to the standard error when created
+	stderr := os.Stderr
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("creating pipe: %v", err)
+	}
+	os.Stderr = w
+	exporters, err := getTracerExporters(context.Background(), tracerExporterConfig{
+		protocol: "grpc, stdout",
+		endpoint: endpoint,
+		insecure: true,
+	})
+	os.Stderr = stderr
+	if err != nil {
+		t.Fatalf("getTracerExporters() error = %v", err)
+	}
+	if len(exporters) != 2 {
+		t.Fatalf("got %d exporters, expected 2", len(exporters))
+	}
+
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporters[0]), sdktrace.WithSyncer(exporters[1]))
+	_, span := tp.Tracer("test").Start(context.Background(), "exported-span")
+	span.End()
+	if err := tp.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown() error = %v", err)
+	}
+	_ = w.Close()
+
+	printed, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("reading standard error: %v", err)
+	}
+	if !strings.Contains(string(printed), "exported-span") {
+		t.Errorf("standard error = %q, expected the span", printed)
+	}
+	if got := collector.count(); got != 1 {
+		t.Errorf("collector received %d spans, expected 1", got)
+	}
+
+	if _, err := getTracerExporters(context.Background(), tracerExporterConfig{protocol: "grpc,foo"}); err == nil {
+		t.Errorf("getTracerExporters() expected an error for an unsupported protocol")
+	}
+}
+
+func TestOpenTelemetryWrapper_newOpenTelemetryWrapper_timeoutFromEnv(t *testing.T) {
+	tests := []struct {
+		name     string
+		timeout  time.Duration
+		env      string
+		expected time.Duration
+		wantErr  bool
+	}{
+		{name: "from env", env: "2500", expected: 2500 * time.Millisecond},
+		{name: "configured", timeout: time.Second, env: "2500", expected: time.Second},
+		{name: "invalid env", env: "2s", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Setenv("OTEL_EXPORTER_OTLP_TRACES_TIMEOUT", tt.env)
+			defer os.Unsetenv("OTEL_EXPORTER_OTLP_TRACES_TIMEOUT")
+
+			otw, err := newOpenTelemetryWrapper(context.Background(), tracerConfig{
+				exporter: tracerExporterConfig{insecure: true, timeout: tt.timeout},
+			})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("newOpenTelemetryWrapper() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			defer otw.cleanup(nil)
+
+			if otw.tracerProviderKey.timeout != tt.expected {
+				t.Errorf("timeout = %v, expected %v", otw.tracerProviderKey.timeout, tt.expected)
+			}
+		})
+	}
+}
+
+func TestOpenTelemetryWrapper_newOpenTelemetryWrapper_endpointFromEnv(t *testing.T) {
+	tests := []struct {
+		name      string
+		endpoint  string
+		env       string
+		tracesEnv string
+		expected  string
+	}{
+		{name: "default"},
+		{name: "from env", env: "collector:4317", expected: "collector:4317"},
+		{name: "from traces env", env: "collector:4317", tracesEnv: "traces-collector:4317", expected: "traces-collector:4317"},
+		{name: "configured", endpoint: "configured:4317", env: "collector:4317", tracesEnv: "traces-collector:4317", expected: "configured:4317"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", tt.env)
+			defer os.Unsetenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+			os.Setenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", tt.tracesEnv)
+			defer os.Unsetenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+
+			otw, err := newOpenTelemetryWrapper(context.Background(), tracerConfig{
+				exporter: tracerExporterConfig{insecure: true, endpoint: tt.endpoint},
+			})
+			if err != nil {
+				t.Fatalf("newOpenTelemetryWrapper() error = %v", err)
+			}
+			defer otw.cleanup(nil)
+
+			if otw.tracerProviderKey.endpoint != tt.expected {
+				t.Errorf("endpoint = %q, expected %q", otw.tracerProviderKey.endpoint, tt.expected)
+			}
+		})
+	}
+}
+
+func TestResolveEndpoint(t *testing.T) {
+	tests := []struct {
+		name            string
+		tracesEndpoint  string
+		genericEndpoint string
+		tracesEnv       string
+		env             string
+		expected        string
+		generic         bool
+	}{
+		{name: "default", generic: true},
+		{name: "generic env", env: "env:4317", expected: "env:4317", generic: true},
+		{name: "traces env", tracesEnv: "traces-env:4317", expected: "traces-env:4317"},
+		{name: "traces env over generic env", tracesEnv: "traces-env:4317", env: "env:4317", expected: "traces-env:4317"},
+		{name: "generic config", genericEndpoint: "generic:4317", expected: "generic:4317", generic: true},
+		{name: "generic config over generic env", genericEndpoint: "generic:4317", env: "env:4317", expected: "generic:4317", generic: true},
+		{name: "generic config over traces env", genericEndpoint: "generic:4317", tracesEnv: "traces-env:4317", expected: "generic:4317", generic: true},
+		{name: "generic config over both envs", genericEndpoint: "generic:4317", tracesEnv: "traces-env:4317", env: "env:4317", expected: "generic:4317", generic: true},
+		{name: "traces config", tracesEndpoint: "traces:4317", expected: "traces:4317"},
+		{name: "traces config over generic env", tracesEndpoint: "traces:4317", env: "env:4317", expected: "traces:4317"},
+		{name: "traces config over traces env", tracesEndpoint: "traces:4317", tracesEnv: "traces-env:4317", expected: "traces:4317"},
+		{name: "traces config over both envs", tracesEndpoint: "traces:4317", tracesEnv: "traces-env:4317", env: "env:4317", expected: "traces:4317"},
+		{name: "traces config over generic config", tracesEndpoint: "traces:4317", genericEndpoint: "generic:4317", expected: "traces:4317"},
+		{name: "traces config over generic config and generic env", tracesEndpoint: "traces:4317", genericEndpoint: "generic:4317", env: "env:4317", expected: "traces:4317"},
+		{name: "traces config over generic config and traces env", tracesEndpoint: "traces:4317", genericEndpoint: "generic:4317", tracesEnv: "traces-env:4317", expected: "traces:4317"},
+		{name: "traces config over everything", tracesEndpoint: "traces:4317", genericEndpoint: "generic:4317", tracesEnv: "traces-env:4317", env: "env:4317", expected: "traces:4317"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", tt.env)
+			defer os.Unsetenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+			os.Setenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", tt.tracesEnv)
+			defer os.Unsetenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+
+			endpoint, generic := resolveEndpoint(tt.tracesEndpoint, tt.genericEndpoint)
+			if endpoint != tt.expected || generic != tt.generic {
+				t.Errorf("resolveEndpoint() = %q, %v, expected %q, %v", endpoint, generic, tt.expected, tt.generic)
+			}
+		})
+	}
+}
+
+func TestOpenTelemetryWrapper_newOpenTelemetryWrapper_genericEndpointPath(t *testing.T) {
+	tests := []struct {
+		name     string
+		exporter tracerExporterConfig
+		env      string
+		expected string
+	}{
+		{name: "generic config", exporter: tracerExporterConfig{genericEndpoint: "http://collector:4318/otlp/"}, expected: "/otlp/v1/traces"},
+		{name: "generic env", env: "http://collector:4318/otlp", expected: "/otlp/v1/traces"},
+		{name: "generic root", exporter: tracerExporterConfig{genericEndpoint: "http://collector:4318"}},
+		{name: "traces config", exporter: tracerExporterConfig{endpoint: "http://collector:4318/otlp/traces", genericEndpoint: "http://collector:4318/otlp"}, expected: "/otlp/traces"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", tt.env)
+			defer os.Unsetenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+
+			exporter := tt.exporter
+			exporter.protocol = protocolHTTPProtobuf
+			otw, err := newOpenTelemetryWrapper(context.Background(), tracerConfig{exporter: exporter})
+			if err != nil {
+				t.Fatalf("newOpenTelemetryWrapper() error = %v", err)
+			}
+			defer otw.cleanup(nil)
+
+			if otw.tracerProviderKey.urlPath != tt.expected {
+				t.Errorf("urlPath = %q, expected %q", otw.tracerProviderKey.urlPath, tt.expected)
+			}
+		})
+	}
+}
+
+func TestTracerExporterConfig_parseEndpoint(t *testing.T) {
+	tests := []struct {
+		name     string
+		endpoint string
+		insecure bool
+		expected tracerExporterConfig
+		wantErr  bool
+	}{
+		{name: "empty", expected: tracerExporterConfig{}},
+		{name: "host and port", endpoint: "collector:4317", insecure: true, expected: tracerExporterConfig{endpoint: "collector:4317", insecure: true}},
+		{name: "http", endpoint: "http://collector:4318", expected: tracerExporterConfig{endpoint: "collector:4318", insecure: true}},
+		{name: "https", endpoint: "https://otel.example.com:4317", insecure: true, expected: tracerExporterConfig{endpoint: "otel.example.com:4317"}},
+		{name: "path", endpoint: "https://otel.example.com/otlp/v1/traces", expected: tracerExporterConfig{endpoint: "otel.example.com", urlPath: "/otlp/v1/traces"}},
+		{name: "root path", endpoint: "https://otel.example.com:4318/", expected: tracerExporterConfig{endpoint: "otel.example.com:4318"}},
+		{name: "no host", endpoint: "https:///v1/traces", wantErr: true},
+		{name: "unsupported scheme", endpoint: "grpc://collector:4317", wantErr: true},
+		{name: "malformed", endpoint: "https://collector:port", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := tracerExporterConfig{endpoint: tt.endpoint, insecure: tt.insecure}
+			err := cfg.parseEndpoint()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseEndpoint() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if !reflect.DeepEqual(cfg, tt.expected) {
+				t.Errorf("parseEndpoint() = %+v, expected %+v", cfg, tt.expected)
+			}
+		})
+	}
+}
+
+func TestOpenTelemetryWrapper_newOpenTelemetryWrapper_endpointURL(t *testing.T) {
+	otw, err := newOpenTelemetryWrapper(context.Background(), tracerConfig{
+		exporter: tracerExporterConfig{protocol: protocolHTTPProtobuf, endpoint: "http://collector:4318/v1/traces"},
+	})
+	if err != nil {
+		t.Fatalf("newOpenTelemetryWrapper() error = %v", err)
+	}
+	defer otw.cleanup(nil)
+
+	key := otw.tracerProviderKey
+	if key.endpoint != "collector:4318" || key.urlPath != "/v1/traces" || !key.insecure {
+		t.Errorf("endpoint = %q, urlPath = %q, insecure = %v, expected collector:4318, /v1/traces and true", key.endpoint, key.urlPath, key.insecure)
+	}
+
+	if _, err := newOpenTelemetryWrapper(context.Background(), tracerConfig{
+		exporter: tracerExporterConfig{endpoint: "ftp://collector:4317"},
+	}); err == nil {
+		t.Errorf("newOpenTelemetryWrapper() expected an error for an unsupported endpoint scheme")
+	}
+}
+
+func TestOpenTelemetryWrapper_newOpenTelemetryWrapper_exporterEndpointAttribute(t *testing.T) {
+	tests := []struct {
+		name     string
+		exporter tracerExporterConfig
+		env      string
+		expected string
+	}{
+		{name: "default", expected: "localhost:4317"},
+		{name: "configured", exporter: tracerExporterConfig{endpoint: "collector:4317"}, env: "env-collector:4317", expected: "collector:4317"},
+		{name: "from env", env: "env-collector:4317", expected: "env-collector:4317"},
+		{name: "http url", exporter: tracerExporterConfig{protocol: protocolHTTPProtobuf, endpoint: "https://otel.example.com/otlp/v1/traces"}, expected: "otel.example.com/otlp/v1/traces"},
+		{name: "http default", exporter: tracerExporterConfig{protocol: protocolHTTPProtobuf}, expected: "localhost:4318/v1/traces"},
+		{name: "several protocols", exporter: tracerExporterConfig{protocol: "grpc,stdout", endpoint: "collector:4317"}, expected: "collector:4317,stdout"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", tt.env)
+			defer os.Unsetenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+
+			exporter := tt.exporter
+			exporter.insecure = true
+			otw, err := newOpenTelemetryWrapper(context.Background(), tracerConfig{exporter: exporter})
+			if err != nil {
+				t.Fatalf("newOpenTelemetryWrapper() error = %v", err)
+			}
+			defer otw.cleanup(nil)
+
+			// the resource of the provider is only exposed by its spans
+			_, span := otw.tracer.Start(context.Background(), "test")
+			defer span.End()
+			readOnlySpan, ok := span.(sdktrace.ReadOnlySpan)
+			if !ok {
+				t.Fatalf("expected a recording span")
+			}
+
+			var got string
+			for _, attr := range readOnlySpan.Resource().Attributes() {
+				if attr.Key == "caddy.otel.exporter_endpoint" {
+					got = attr.Value.AsString()
+				}
+			}
+			if got != tt.expected {
+				t.Errorf("caddy.otel.exporter_endpoint = %q, expected %q", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestOpenTelemetryWrapper_newOpenTelemetryWrapper_compression(t *testing.T) {
+	tests := []struct {
+		name        string
+		compression string
+		env         string
+		expected    string
+		wantErr     bool
+	}{
+		{name: "default", expected: ""},
+		{name: "gzip", compression: "gzip", expected: "gzip"},
+		{name: "from env", env: "gzip", expected: "gzip"},
+		{name: "configured over env", compression: "none", env: "gzip", expected: "none"},
+		{name: "unsupported", compression: "zstd", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Setenv("OTEL_EXPORTER_OTLP_COMPRESSION", tt.env)
+			defer os.Unsetenv("OTEL_EXPORTER_OTLP_COMPRESSION")
+
+			otw, err := newOpenTelemetryWrapper(context.Background(), tracerConfig{
+				exporter: tracerExporterConfig{insecure: true, compression: tt.compression},
+			})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("newOpenTelemetryWrapper() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			defer otw.cleanup(nil)
+
+			if otw.tracerProviderKey.compression != tt.expected {
+				t.Errorf("compression = %q, expected %q", otw.tracerProviderKey.compression, tt.expected)
+			}
+		})
+	}
+}
+
+func TestOpenTelemetryWrapper_ServeHTTP_tlsHandshake(t *testing.T) {
+	const tlsHandshakeCtxKey caddy.CtxKey = "tls_handshake"
+
+	tests := []struct {
+		name      string
+		url       string
+		handshake time.Duration
+		expected  string
+	}{
+		{name: "with handshake duration", url: "https://example.com/", handshake: 42 * time.Millisecond, expected: "42"},
+		{name: "without handshake duration", url: "https://example.com/"},
+		{name: "plain http", url: "http://example.com/", handshake: 42 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			otw, exporter := newTestOpenTelemetryWrapper()
+			otw.tlsHandshakeCtxKey = tlsHandshakeCtxKey
+
+			req := httptest.NewRequest(http.MethodGet, tt.url, nil)
+			if tt.handshake != 0 {
+				req = req.WithContext(context.WithValue(req.Context(), tlsHandshakeCtxKey, tt.handshake))
+			}
+
+			err := otw.ServeHTTP(httptest.NewRecorder(), req, caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error {
+				return nil
+			}))
+			if err != nil {
+				t.Fatalf("ServeHTTP() error = %v", err)
+			}
+
+			if got := spanAttribute(t, exporter, "tls.handshake_ms"); got != tt.expected {
+				t.Errorf("tls.handshake_ms = %q, expected %q", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestOpenTelemetryWrapper_ServeHTTP_alpnFallback(t *testing.T) {
+	const alpnOfferedCtxKey caddy.CtxKey = "alpn_offered"
+
+	tests := []struct {
+		name       string
+		offered    []string
+		negotiated string
+		plainHTTP  bool
+		expected   string
+	}{
+		{name: "h2 negotiated", offered: []string{"h2", "http/1.1"}, negotiated: "h2", expected: "false"},
+		{name: "h1 negotiated", offered: []string{"h2", "http/1.1"}, negotiated: "http/1.1", expected: "true"},
+		{name: "nothing negotiated", offered: []string{"h2", "http/1.1"}, expected: "true"},
+		{name: "h1 preferred", offered: []string{"http/1.1", "h2"}, negotiated: "http/1.1", expected: "false"},
+		{name: "offered protocols unknown", negotiated: "http/1.1"},
+		{name: "plain http", offered: []string{"h2"}, plainHTTP: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			otw, exporter := newTestOpenTelemetryWrapper()
+			otw.alpnOfferedCtxKey = alpnOfferedCtxKey
+
+			req := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+			req.TLS.NegotiatedProtocol = tt.negotiated
+			if tt.plainHTTP {
+				req.TLS = nil
+			}
+			if tt.offered != nil {
+				req = req.WithContext(context.WithValue(req.Context(), alpnOfferedCtxKey, tt.offered))
+			}
+
+			err := otw.ServeHTTP(httptest.NewRecorder(), req, caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error {
+				return nil
+			}))
+			if err != nil {
+				t.Fatalf("ServeHTTP() error = %v", err)
+			}
+
+			if got := spanAttribute(t, exporter, "caddy.alpn.fallback"); got != tt.expected {
+				t.Errorf("caddy.alpn.fallback = %q, expected %q", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestOpenTelemetryWrapper_newOpenTelemetryWrapper_spanProcessor(t *testing.T) {
+	tests := []struct {
+		spanProcessor string
+		simple        bool
+		wantErr       bool
+	}{
+		{spanProcessor: ""},
+		{spanProcessor: "batch"},
+		{spanProcessor: "simple", simple: true},
+		{spanProcessor: "async", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spanProcessor, func(t *testing.T) {
+			otw, err := newOpenTelemetryWrapper(context.Background(), tracerConfig{
+				spanProcessor: tt.spanProcessor,
+				exporter:      tracerExporterConfig{insecure: true},
+			})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("newOpenTelemetryWrapper() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			defer otw.cleanup(nil)
+
+			if otw.tracerProviderKey.simpleSpanProcessor != tt.simple {
+				t.Errorf("simpleSpanProcessor = %v, expected %v", otw.tracerProviderKey.simpleSpanProcessor, tt.simple)
+			}
+		})
+	}
+}
+
+func TestOpenTelemetryWrapper_ServeHTTP_trustLevel(t *testing.T) {
+	const trustLevelCtxKey caddy.CtxKey = "trust_level"
+
+	tests := []struct {
+		name     string
+		level    interface{}
+		expected string
+	}{
+		{name: "string trust level", level: "high", expected: "high"},
+		{name: "int trust level", level: 3, expected: "3"},
+		{name: "no trust level"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			otw, exporter := newTestOpenTelemetryWrapper()
+			otw.trustLevelCtxKey = trustLevelCtxKey
+
+			req := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+			if tt.level != nil {
+				req = req.WithContext(context.WithValue(req.Context(), trustLevelCtxKey, tt.level))
+			}
+
+			err := otw.ServeHTTP(httptest.NewRecorder(), req, caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error {
+				return nil
+			}))
+			if err != nil {
+				t.Fatalf("ServeHTTP() error = %v", err)
+			}
+
+			if got := spanAttribute(t, exporter, "security.trust_level"); got != tt.expected {
+				t.Errorf("security.trust_level = %q, expected %q", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestOpenTelemetryWrapper_ServeHTTP_authResult(t *testing.T) {
+	const authResultCtxKey caddy.CtxKey = "auth_result"
+
+	tests := []struct {
+		name        string
+		ctxResult   string
+		varResult   string
+		deniedError bool
+		expected    string
+		status      codes.Code
+	}{
+		{name: "allowed", ctxResult: "allowed", deniedError: true, expected: "allowed", status: codes.Unset},
+		{name: "anonymous", ctxResult: "anonymous", deniedError: true, expected: "anonymous", status: codes.Unset},
+		{name: "denied", ctxResult: "denied", expected: "denied", status: codes.Unset},
+		{name: "denied as error", ctxResult: "denied", deniedError: true, expected: "denied", status: codes.Error},
+		{name: "denied by a later handler", varResult: "denied", deniedError: true, expected: "denied", status: codes.Error},
+		{name: "no outcome", deniedError: true, status: codes.Unset},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			otw, exporter := newTestOpenTelemetryWrapper()
+			otw.authResultCtxKey = authResultCtxKey
+			otw.authDeniedError = tt.deniedError
+
+			req := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+			ctx := context.WithValue(req.Context(), caddyhttp.VarsCtxKey, make(map[string]interface{}))
+			if tt.ctxResult != "" {
+				ctx = context.WithValue(ctx, authResultCtxKey, tt.ctxResult)
+			}
+			req = req.WithContext(ctx)
+
+			err := otw.ServeHTTP(httptest.NewRecorder(), req, caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+				if tt.varResult != "" {
+					caddyhttp.SetVar(r.Context(), string(authResultCtxKey), tt.varResult)
+				}
+				return nil
+			}))
+			if err != nil {
+				t.Fatalf("ServeHTTP() error = %v", err)
+			}
+
+			if got := spanAttribute(t, exporter, "caddy.auth.result"); got != tt.expected {
+				t.Errorf("caddy.auth.result = %q, expected %q", got, tt.expected)
+			}
+			if got := exporter.GetSpans()[0].Status.Code; got != tt.status {
+				t.Errorf("span status = %v, expected %v", got, tt.status)
+			}
+		})
+	}
+}
+
+func TestOpenTelemetryWrapper_ServeHTTP_clientSampling(t *testing.T) {
+	tests := []struct {
+		name       string
+		remoteAddr string
+		expected   int
+	}{
+		{name: "selected client", remoteAddr: "192.0.2.1:1234", expected: 3},
+		{name: "unselected client", remoteAddr: "198.51.100.7:1234", expected: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			otw, exporter := newTestOpenTelemetryWrapper()
+			otw.clientSamplingRatio = floatPtr(0.1)
+
+			for i := 0; i < 3; i++ {
+				req := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+				req.RemoteAddr = tt.remoteAddr
+
+				err := otw.ServeHTTP(httptest.NewRecorder(), req, caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error {
+					return nil
+				}))
+				if err != nil {
+					t.Fatalf("ServeHTTP() error = %v", err)
+				}
+			}
+
+			if got := len(exporter.GetSpans()); got != tt.expected {
+				t.Errorf("got %d spans, expected %d", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestRouteRolledOut(t *testing.T) {
+	enabled := 0
+	for i := 0; i < 1000; i++ {
+		routeID := fmt.Sprintf("/api/v%d/*", i)
+		rolledOut := routeRolledOut(routeID, 10)
+		if routeRolledOut(routeID, 10) != rolledOut {
+			t.Fatalf("route %s is not consistently rolled out", routeID)
+		}
+		if rolledOut {
+			enabled++
+		}
+		if routeRolledOut(routeID, 0) {
+			t.Errorf("route %s rolled out at 0%%", routeID)
+		}
+		if !routeRolledOut(routeID, 100) {
+			t.Errorf("route %s not rolled out at 100%%", routeID)
+		}
+	}
+	if enabled < 50 || enabled > 150 {
+		t.Errorf("%d routes out of 1000 rolled out, expected about 100", enabled)
+	}
+}
+
+func TestOpenTelemetryWrapper_newOpenTelemetryWrapper_rolloutPercentage(t *testing.T) {
+	percentage := 10.0
+	routeID := "/api/*"
+	otw, err := newOpenTelemetryWrapper(context.Background(), tracerConfig{
+		routePattern:      routeID,
+		rolloutPercentage: &percentage,
+		exporter:          tracerExporterConfig{insecure: true},
+	})
+	if err != nil {
+		t.Fatalf("newOpenTelemetryWrapper() error = %v", err)
+	}
+	defer otw.cleanup(nil)
+
+	if otw.disabled == routeRolledOut(routeID, percentage) {
+		t.Errorf("disabled = %v, expected the route to be traced only if rolled out", otw.disabled)
+	}
+}
+
+func TestOpenTelemetryWrapper_ServeHTTP_disabled(t *testing.T) {
+	otw, exporter := newTestOpenTelemetryWrapper()
+	otw.disabled = true
+
+	called := false
+	req := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+	err := otw.ServeHTTP(httptest.NewRecorder(), req, caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error {
+		called = true
+		return nil
+	}))
+	if err != nil {
+		t.Fatalf("ServeHTTP() error = %v", err)
+	}
+
+	if !called {
+		t.Errorf("expected the next handler to be called")
+	}
+	if got := len(exporter.GetSpans()); got != 0 {
+		t.Errorf("got %d spans, expected none for a route not rolled out", got)
+	}
+}
+
+func TestOpenTelemetryWrapper_newTLSConfig_clientCertificate(t *testing.T) {
+	_, err := newTLSConfig(tracerExporterConfig{
+		clientCertificate: "testdata/missing.pem",
+		clientKey:         "testdata/missing.key",
+	})
+	if err == nil || !strings.Contains(err.Error(), "client certificate") {
+		t.Errorf("newTLSConfig() error = %v, expected an error loading the client certificate", err)
+	}
+}
+
+func TestOpenTelemetryWrapper_newTLSConfig_skipVerify(t *testing.T) {
+	cfg := tracerExporterConfig{tlsSkipVerify: true}
+	if !cfg.customTLS() {
+		t.Errorf("expected a TLS configuration when skipping the verification")
+	}
+
+	tlsConfig, err := newTLSConfig(cfg)
+	if err != nil {
+		t.Fatalf("newTLSConfig() error = %v", err)
+	}
+	if !tlsConfig.InsecureSkipVerify {
+		t.Errorf("InsecureSkipVerify = false, expected true")
+	}
+}
+
+func TestOpenTelemetryWrapper_newTLSConfig_serverName(t *testing.T) {
+	cfg := tracerExporterConfig{endpoint: "collector.internal:4317", serverName: "otel.example.com"}
+	if !cfg.customTLS() {
+		t.Errorf("expected a TLS configuration when overriding the server name")
+	}
+
+	tlsConfig, err := newTLSConfig(cfg)
+	if err != nil {
+		t.Fatalf("newTLSConfig() error = %v", err)
+	}
+	if tlsConfig.ServerName != "otel.example.com" {
+		t.Errorf("ServerName = %q, expected %q", tlsConfig.ServerName, "otel.example.com")
+	}
+}
+
+func TestOpenTelemetryWrapper_ServeHTTP_chunked(t *testing.T) {
+	tests := []struct {
+		name             string
+		transferEncoding []string
+		expected         string
+	}{
+		{name: "chunked", transferEncoding: []string{"chunked"}, expected: "true"},
+		{name: "content length", expected: "false"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			otw, exporter := newTestOpenTelemetryWrapper()
+
+			req := httptest.NewRequest(http.MethodPost, "https://example.com/", strings.NewReader("body"))
+			req.TransferEncoding = tt.transferEncoding
+
+			err := otw.ServeHTTP(httptest.NewRecorder(), req, caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error {
+				return nil
+			}))
+			if err != nil {
+				t.Fatalf("ServeHTTP() error = %v", err)
+			}
+
+			if got := spanAttribute(t, exporter, "http.request.chunked"); got != tt.expected {
+				t.Errorf("http.request.chunked = %q, expected %q", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestOpenTelemetryWrapper_ServeHTTP_spanEvents(t *testing.T) {
+	tests := []struct {
+		name       string
+		spanEvents bool
+		expected   []string
+	}{
+		{name: "enabled", spanEvents: true, expected: []string{"request.start", "response.written"}},
+		{name: "disabled"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			otw, exporter := newTestOpenTelemetryWrapper()
+			otw.spanEvents = tt.spanEvents
+
+			req := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+			err := otw.ServeHTTP(httptest.NewRecorder(), req, caddyhttp.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) error {
+				_, err := w.Write([]byte("hello"))
+				return err
+			}))
+			if err != nil {
+				t.Fatalf("ServeHTTP() error = %v", err)
+			}
+
+			events := exporter.GetSpans()[0].Events
+			if len(events) != len(tt.expected) {
+				t.Fatalf("got %d events, expected %d", len(events), len(tt.expected))
+			}
+			for i, event := range events {
+				if event.Name != tt.expected[i] {
+					t.Errorf("event %d = %q, expected %q", i, event.Name, tt.expected[i])
+				}
+			}
+			if len(events) == 2 {
+				attrs := events[1].Attributes
+				if len(attrs) != 1 || attrs[0].Key != "http.response.bytes" || attrs[0].Value.AsInt64() != 5 {
+					t.Errorf("response.written attributes = %v, expected 5 bytes written", attrs)
+				}
+			}
+		})
+	}
+}
+
+func TestOpenTelemetryWrapper_newResource_caddyBuild(t *testing.T) {
+	defer func(commit string) { buildCommit = commit }(buildCommit)
+	buildCommit = "abc1234"
+
+	res, err := newResource(context.Background(), "my-service", "", nil)
+	if err != nil {
+		t.Fatalf("newResource() error = %v", err)
+	}
+
+	build, ok := res.Set().Value("caddy.build")
+	if !ok {
+		t.Fatalf("expected the caddy.build attribute")
+	}
+	if !strings.Contains(build.AsString(), caddycmd.CaddyVersion()) || !strings.Contains(build.AsString(), "abc1234") {
+		t.Errorf("caddy.build = %q, expected the version and the commit", build.AsString())
+	}
+}
+
+func TestOpenTelemetryWrapper_ServeHTTP_traceIDHeader(t *testing.T) {
+	tests := []struct {
+		name          string
+		traceIDHeader string
+	}{
+		{name: "enabled", traceIDHeader: "Trace-Id"},
+		{name: "disabled"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			otw, exporter := newTestOpenTelemetryWrapper()
+			otw.traceIDHeader = tt.traceIDHeader
+
+			req := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+			w := httptest.NewRecorder()
+			err := otw.ServeHTTP(w, req, caddyhttp.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) error {
+				_, err := w.Write([]byte("hello"))
+				return err
+			}))
+			if err != nil {
+				t.Fatalf("ServeHTTP() error = %v", err)
+			}
+
+			if tt.traceIDHeader == "" {
+				if got := w.Header().Get("Trace-Id"); got != "" {
+					t.Errorf("Trace-Id = %q, expected no header", got)
+				}
+				return
+			}
+			expected := exporter.GetSpans()[0].SpanContext.TraceID().String()
+			if got := w.Result().Header.Get(tt.traceIDHeader); got != expected {
+				t.Errorf("%s = %q, expected %q", tt.traceIDHeader, got, expected)
+			}
+		})
+	}
+}
+
+func TestOpenTelemetryWrapper_ServeHTTP_traceIDHeader_unsampled(t *testing.T) {
+	otw, exporter := newTestOpenTelemetryWrapper()
+	otw.tracer = sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter), sdktrace.WithSampler(sdktrace.NeverSample())).Tracer("test")
+	otw.traceIDHeader = "Trace-Id"
+
+	req := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+	w := httptest.NewRecorder()
+	err := otw.ServeHTTP(w, req, caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error {
+		return nil
+	}))
+	if err != nil {
+		t.Fatalf("ServeHTTP() error = %v", err)
+	}
+
+	if got := w.Header().Get("Trace-Id"); got != "" {
+		t.Errorf("Trace-Id = %q, expected no header for an unsampled span", got)
+	}
+}
+
+func TestOpenTelemetryWrapper_ServeHTTP_trailers(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler caddyhttp.HandlerFunc
+	}{
+		{
+			name: "announced trailer",
+			handler: func(w http.ResponseWriter, _ *http.Request) error {
+				w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+				w.WriteHeader(http.StatusOK)
+				w.Header().Set("Grpc-Status", "5")
+				return nil
+			},
+		},
+		{
+			name: "prefixed trailer",
+			handler: func(w http.ResponseWriter, _ *http.Request) error {
+				w.WriteHeader(http.StatusOK)
+				w.Header().Set(http.TrailerPrefix+"Grpc-Status", "5")
+				return nil
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			otw, exporter := newTestOpenTelemetryWrapper()
+			otw.trailers = []string{"grpc-status", "grpc-message"}
+
+			req := httptest.NewRequest(http.MethodPost, "https://example.com/", nil)
+			if err := otw.ServeHTTP(httptest.NewRecorder(), req, tt.handler); err != nil {
+				t.Fatalf("ServeHTTP() error = %v", err)
+			}
+
+			if got := spanAttribute(t, exporter, "http.response.trailer.grpc-status"); got != "5" {
+				t.Errorf("http.response.trailer.grpc-status = %q, expected 5", got)
+			}
+			if got := spanAttribute(t, exporter, "http.response.trailer.grpc-message"); got != "" {
+				t.Errorf("http.response.trailer.grpc-message = %q, expected no attribute for an unset trailer", got)
+			}
+		})
+	}
+}
+
+func TestOpenTelemetryWrapper_ServeHTTP_server(t *testing.T) {
+	tests := []struct {
+		name       string
+		serverName string
+	}{
+		{name: "named server", serverName: "srv0"},
+		{name: "no server"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			otw, exporter := newTestOpenTelemetryWrapper()
+			otw.serverName = tt.serverName
+
+			req := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+			err := otw.ServeHTTP(httptest.NewRecorder(), req, caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error {
+				return nil
+			}))
+			if err != nil {
+				t.Fatalf("ServeHTTP() error = %v", err)
+			}
+
+			if got := spanAttribute(t, exporter, "caddy.server"); got != tt.serverName {
+				t.Errorf("caddy.server = %q, expected %q", got, tt.serverName)
+			}
+		})
+	}
+}
+
+func TestOpenTelemetryWrapper_ServeHTTP_clientIP(t *testing.T) {
+	tests := []struct {
+		name            string
+		captureClientIP bool
+		expected        string
+	}{
+		{name: "captured", captureClientIP: true, expected: "203.0.113.9"},
+		{name: "not captured"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			otw, exporter := newTestOpenTelemetryWrapper()
+			otw.captureClientIP = tt.captureClientIP
+
+			req := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+			req.RemoteAddr = "203.0.113.9:4321"
+			// the headers of proxies are not trusted
+			req.Header.Set("X-Forwarded-For", "198.51.100.1")
+
+			err := otw.ServeHTTP(httptest.NewRecorder(), req, caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error {
+				return nil
+			}))
+			if err != nil {
+				t.Fatalf("ServeHTTP() error = %v", err)
+			}
+
+			if got := spanAttribute(t, exporter, "net.peer.ip"); got != tt.expected {
+				t.Errorf("net.peer.ip = %q, expected %q", got, tt.expected)
+			}
+			if got := spanAttribute(t, exporter, "client.address"); got != tt.expected {
+				t.Errorf("client.address = %q, expected %q", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestOpenTelemetryWrapper_ServeHTTP_excludePaths(t *testing.T) {
+	tests := []struct {
+		name     string
+		path     string
+		expected int
+	}{
+		{name: "excluded path", path: "/healthz", expected: 0},
+		{name: "excluded prefix", path: "/internal/metrics", expected: 0},
+		{name: "path with an excluded path as prefix", path: "/healthz/deep", expected: 1},
+		{name: "other path", path: "/api", expected: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			otw, exporter := newTestOpenTelemetryWrapper()
+			otw.excludedPaths = map[string]struct{}{"/healthz": {}}
+			otw.excludedPathPrefixes = []string{"/internal/"}
+
+			req := httptest.NewRequest(http.MethodGet, "https://example.com"+tt.path, nil)
+
+			called := false
+			err := otw.ServeHTTP(httptest.NewRecorder(), req, caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error {
+				called = true
+				return nil
+			}))
+			if err != nil {
+				t.Fatalf("ServeHTTP() error = %v", err)
+			}
+			if !called {
+				t.Errorf("expected the next handler to be called")
+			}
+
+			if got := len(exporter.GetSpans()); got != tt.expected {
+				t.Errorf("got %d spans, expected %d", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestOpenTelemetryWrapper_ServeHTTP_existingSpan(t *testing.T) {
+	existing := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID: trace.TraceID{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f, 0x10},
+		SpanID:  trace.SpanID{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08},
+		// the default sampler, parent based, only samples the children of sampled spans
+		TraceFlags: trace.FlagsSampled,
+	})
+
+	tests := []struct {
+		name          string
+		policy        string
+		expectedSpans int
+		expectedChild bool
+	}{
+		{name: "default", expectedSpans: 1, expectedChild: true},
+		{name: "child", policy: existingSpanChild, expectedSpans: 1, expectedChild: true},
+		{name: "replace", policy: existingSpanReplace, expectedSpans: 1},
+		{name: "skip", policy: existingSpanSkip},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			otw, exporter := newTestOpenTelemetryWrapper()
+			otw.existingSpan = tt.policy
+
+			req := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+			req = req.WithContext(trace.ContextWithSpanContext(req.Context(), existing))
+
+			called := false
+			err := otw.ServeHTTP(httptest.NewRecorder(), req, caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error {
+				called = true
+				return nil
+			}))
+			if err != nil {
+				t.Fatalf("ServeHTTP() error = %v", err)
+			}
+			if !called {
+				t.Errorf("expected the next handler to be called")
+			}
+
+			spans := exporter.GetSpans()
+			if len(spans) != tt.expectedSpans {
+				t.Fatalf("got %d spans, expected %d", len(spans), tt.expectedSpans)
+			}
+			if tt.expectedSpans == 0 {
+				return
+			}
+
+			span := spans[0]
+			if child := span.Parent.SpanID() == existing.SpanID(); child != tt.expectedChild {
+				t.Errorf("span is a child of the existing span: %v, expected %v", child, tt.expectedChild)
+			}
+			if sameTrace := span.SpanContext.TraceID() == existing.TraceID(); sameTrace != tt.expectedChild {
+				t.Errorf("span is in the trace of the existing span: %v, expected %v", sameTrace, tt.expectedChild)
+			}
+		})
+	}
+}
+
+func TestOpenTelemetryWrapper_ServeHTTP_cookieCount(t *testing.T) {
+	tests := []struct {
+		name     string
+		cookies  []*http.Cookie
+		expected string
+	}{
+		{name: "no cookie", expected: "0"},
+		{
+			name: "several cookies",
+			cookies: []*http.Cookie{
+				{Name: "session", Value: "secret-session"},
+				{Name: "theme", Value: "dark"},
+				{Name: "lang", Value: "fr-CA"},
+			},
+			expected: "3",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			otw, exporter := newTestOpenTelemetryWrapper()
+
+			req := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+			for _, cookie := range tt.cookies {
+				req.AddCookie(cookie)
+			}
+
+			err := otw.ServeHTTP(httptest.NewRecorder(), req, caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error {
+				return nil
+			}))
+			if err != nil {
+				t.Fatalf("ServeHTTP() error = %v", err)
+			}
+
+			if got := spanAttribute(t, exporter, "http.request.cookie_count"); got != tt.expected {
+				t.Errorf("http.request.cookie_count = %q, expected %q", got, tt.expected)
+			}
+			for _, attr := range exporter.GetSpans()[0].Attributes {
+				for _, cookie := range tt.cookies {
+					if strings.Contains(string(attr.Key), cookie.Name) || strings.Contains(attr.Value.Emit(), cookie.Value) {
+						t.Errorf("attribute %s=%s records the cookie %s", attr.Key, attr.Value.Emit(), cookie.Name)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestCookieCount(t *testing.T) {
+	tests := []struct {
+		name     string
+		cookies  []string
+		expected int
+	}{
+		{name: "no header", expected: 0},
+		{name: "empty header", cookies: []string{""}, expected: 0},
+		{name: "one cookie", cookies: []string{"session=secret"}, expected: 1},
+		{name: "several cookies", cookies: []string{"session=secret; theme=dark;lang=fr-CA"}, expected: 3},
+		{name: "empty pairs", cookies: []string{"; session=secret; ;", " "}, expected: 1},
+		{name: "several headers", cookies: []string{"session=secret", "theme=dark; lang=fr-CA"}, expected: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			for _, cookie := range tt.cookies {
+				header.Add("Cookie", cookie)
+			}
+
+			if got := cookieCount(header); got != tt.expected {
+				t.Errorf("cookieCount() = %d, expected %d", got, tt.expected)
+			}
+			if allocs := testing.AllocsPerRun(10, func() { cookieCount(header) }); allocs != 0 {
+				t.Errorf("cookieCount() allocates %v times, expected none", allocs)
+			}
+		})
+	}
+}
+
+func TestOpenTelemetryWrapper_newOpenTelemetryWrapper_reloadSpanProcessor(t *testing.T) {
+	cfg := tracerConfig{
+		serviceName:   "reload-span-processor",
+		spanProcessor: spanProcessorBatch,
+		exporter:      tracerExporterConfig{insecure: true},
+	}
+	old, err := newOpenTelemetryWrapper(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("newOpenTelemetryWrapper() error = %v", err)
+	}
+
+	// caddy provisions the new configuration before cleaning up the old one
+	cfg.spanProcessor = spanProcessorSimple
+	reloaded, err := newOpenTelemetryWrapper(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("newOpenTelemetryWrapper() error = %v", err)
+	}
+	defer reloaded.cleanup(zap.NewNop())
+
+	if reloaded.tracerProviderKey == old.tracerProviderKey {
+		t.Fatalf("reloaded handler reuses the tracer provider built with the old span processor")
+	}
+	if err := old.cleanup(zap.NewNop()); err != nil {
+		t.Fatalf("cleanup() error = %v", err)
+	}
+
+	defaultTracerProviderCache.mu.Lock()
+	_, oldCached := defaultTracerProviderCache.tracerProviders[old.tracerProviderKey]
+	references := defaultTracerProviderCache.tracerProvidersCounter[reloaded.tracerProviderKey]
+	defaultTracerProviderCache.mu.Unlock()
+	if oldCached {
+		t.Errorf("tracer provider of the old configuration leaked in the cache")
+	}
+	if references != 1 {
+		t.Errorf("references of the reloaded tracer provider = %d, expected 1", references)
+	}
+}
+
+func TestOpenTelemetryWrapper_newOpenTelemetryWrapper_stdoutFile(t *testing.T) {
+	file, err := ioutil.TempFile("", "caddy-otel-*.json")
+	if err != nil {
+		t.Fatalf("TempFile() error = %v", err)
+	}
+	file.Close()
+	defer os.Remove(file.Name())
+
+	otw, err := newOpenTelemetryWrapper(context.Background(), tracerConfig{
+		serviceName: "stdout-file",
+		exporter:    tracerExporterConfig{protocol: protocolStdout, stdoutFile: file.Name()},
+	})
+	if err != nil {
+		t.Fatalf("newOpenTelemetryWrapper() error = %v", err)
+	}
+
+	_, span := otw.tracer.Start(context.Background(), "stdout-file-span")
+	span.End()
+	// the spans are flushed when the provider is shut down
+	if err := otw.cleanup(zap.NewNop()); err != nil {
+		t.Fatalf("cleanup() error = %v", err)
+	}
+
+	printed, err := ioutil.ReadFile(file.Name())
+	if err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+	if !strings.Contains(string(printed), "stdout-file-span") {
+		t.Errorf("expected the span to be printed to the file, got %q", printed)
+	}
+}
+
+func TestOpenTelemetryWrapper_newOpenTelemetryWrapper_spanLimits(t *testing.T) {
+	cfg := tracerConfig{
+		serviceName:             "span-limits",
+		spanAttributeCountLimit: 2,
+		exporter:                tracerExporterConfig{protocol: protocolStdout, stdoutFile: os.DevNull},
+	}
+	otw, err := newOpenTelemetryWrapper(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("newOpenTelemetryWrapper() error = %v", err)
+	}
+	defer otw.cleanup(nil)
+
+	_, span := otw.tracer.Start(context.Background(), "test")
+	defer span.End()
+	span.SetAttributes(attribute.String("a", "1"), attribute.String("b", "2"), attribute.String("c", "3"))
+	if got := len(span.(sdktrace.ReadOnlySpan).Attributes()); got != 2 {
+		t.Errorf("span attributes = %d, expected 2", got)
+	}
+
+	// the limits are set on the provider, which must not be shared with other limits
+	cfg.spanAttributeCountLimit = 0
+	cfg.spanAttributeValueLengthLimit = 16
+	other, err := newOpenTelemetryWrapper(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("newOpenTelemetryWrapper() error = %v", err)
+	}
+	defer other.cleanup(nil)
+	if other.tracerProviderKey == otw.tracerProviderKey {
+		t.Errorf("expected distinct tracer providers for distinct span limits")
+	}
+}
+
+func TestOpenTelemetryWrapper_newOpenTelemetryWrapper_failedInitialization(t *testing.T) {
+	cfg := tracerConfig{
+		serviceName: "failed-initialization",
+		exporter:    tracerExporterConfig{protocol: protocolStdout},
+	}
+	running, err := newOpenTelemetryWrapper(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("newOpenTelemetryWrapper() error = %v", err)
+	}
+	defer running.cleanup(nil)
+
+	// the metrics are not supported over stdout, the initialization fails once the provider is obtained
+	cfg.metrics = true
+	failed, err := newOpenTelemetryWrapper(context.Background(), cfg)
+	if err == nil {
+		t.Fatalf("newOpenTelemetryWrapper() expected an error")
+	}
+	// caddy cleans up the modules whose provisioning failed
+	if err := failed.cleanup(zap.NewNop()); err != nil {
+		t.Fatalf("cleanup() error = %v", err)
+	}
+
+	defaultTracerProviderCache.mu.Lock()
+	references := defaultTracerProviderCache.tracerProvidersCounter[running.tracerProviderKey]
+	defaultTracerProviderCache.mu.Unlock()
+	if references != 1 {
+		t.Errorf("references of the running tracer provider = %d, expected 1", references)
+	}
+}
+
+func TestOpenTelemetryWrapper_newOpenTelemetryWrapper_dedicatedProvider(t *testing.T) {
+	cfg := tracerConfig{
+		serviceName:       "dedicated-provider",
+		dedicatedProvider: true,
+		exporter:          tracerExporterConfig{protocol: protocolStdout, stdoutFile: os.DevNull},
+	}
+	providers := defaultTracerProviderCache.len()
+
+	first, err := newOpenTelemetryWrapper(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("newOpenTelemetryWrapper() error = %v", err)
+	}
+	second, err := newOpenTelemetryWrapper(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("newOpenTelemetryWrapper() error = %v", err)
+	}
+
+	// the handlers of identical settings do not share their providers, which are not cached
+	if first.dedicatedProvider == nil || first.dedicatedProvider == second.dedicatedProvider {
+		t.Errorf("expected a dedicated tracer provider for each handler")
+	}
+	if n := defaultTracerProviderCache.len(); n != providers {
+		t.Errorf("cached tracer providers = %d, expected %d", n, providers)
+	}
+
+	if err := first.cleanup(nil); err != nil {
+		t.Fatalf("cleanup() error = %v", err)
+	}
+	// the provider of the other handler is still running
+	_, span := second.tracer.Start(context.Background(), "test")
+	span.End()
+	if !span.SpanContext().IsValid() {
+		t.Errorf("expected the provider of the other handler to still record spans")
+	}
+	if err := second.cleanup(nil); err != nil {
+		t.Fatalf("cleanup() error = %v", err)
+	}
+}
+
+func TestOpenTelemetryWrapper_newOpenTelemetryWrapper_serviceNameFromEnv(t *testing.T) {
+	os.Setenv("OTEL_SERVICE_NAME", "env-service")
+	defer os.Unsetenv("OTEL_SERVICE_NAME")
+	// OTEL_SERVICE_NAME prevails over the service.name of the resource attributes
+	os.Setenv("OTEL_RESOURCE_ATTRIBUTES", "service.name=attributes-service")
+	defer os.Unsetenv("OTEL_RESOURCE_ATTRIBUTES")
+
+	otw, err := newOpenTelemetryWrapper(context.Background(), tracerConfig{
+		exporter: tracerExporterConfig{protocol: protocolStdout, stdoutFile: os.DevNull},
+	})
+	if err != nil {
+		t.Fatalf("newOpenTelemetryWrapper() error = %v", err)
+	}
+	defer otw.cleanup(nil)
+
+	_, span := otw.tracer.Start(context.Background(), "test")
+	defer span.End()
+	readOnlySpan, ok := span.(sdktrace.ReadOnlySpan)
+	if !ok {
+		t.Fatalf("expected a recording span")
+	}
+
+	var got string
+	for _, attr := range readOnlySpan.Resource().Attributes() {
+		if attr.Key == semconv.ServiceNameKey {
+			got = attr.Value.AsString()
+		}
+	}
+	if got != "env-service" {
+		t.Errorf("service.name = %q, expected %q", got, "env-service")
+	}
+}
+
+func TestOpenTelemetryWrapper_ServeHTTP_bodySizes(t *testing.T) {
+	tests := []struct {
+		name             string
+		capture          bool
+		body             string
+		expectedRequest  string
+		expectedResponse string
+	}{
+		{name: "captured", capture: true, body: `{"name":"caddy"}`, expectedRequest: "16", expectedResponse: "5"},
+		{name: "not captured", body: `{"name":"caddy"}`},
+		{name: "no content length", capture: true, expectedResponse: "5"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			otw, exporter := newTestOpenTelemetryWrapper()
+			otw.captureBodySizes = tt.capture
+
+			req := httptest.NewRequest(http.MethodPost, "https://example.com/", strings.NewReader(tt.body))
+			if tt.body != "" {
+				req.Header.Set("Content-Length", strconv.Itoa(len(tt.body)))
+			}
+			err := otw.ServeHTTP(httptest.NewRecorder(), req, caddyhttp.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) error {
+				_, err := w.Write([]byte("hello"))
+				return err
+			}))
+			if err != nil {
+				t.Fatalf("ServeHTTP() error = %v", err)
+			}
+
+			if got := spanAttribute(t, exporter, "http.request_content_length"); got != tt.expectedRequest {
+				t.Errorf("http.request_content_length = %q, expected %q", got, tt.expectedRequest)
+			}
+			if got := spanAttribute(t, exporter, "http.response_content_length"); got != tt.expectedResponse {
+				t.Errorf("http.response_content_length = %q, expected %q", got, tt.expectedResponse)
+			}
+		})
+	}
+}
@@ -0,0 +1,277 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package opentelemetry
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.uber.org/zap"
+)
+
+// defaultShutdownTimeout bounds the flush and the shutdown of a tracer
+// provider on cleanup, unless configured otherwise.
+const defaultShutdownTimeout = 5 * time.Second
+
+// defaultTracerProviderCache is shared by all the handlers of the module, so
+// that handlers with identical configuration reuse a single tracer provider.
+var defaultTracerProviderCache = newTracerProviderCache()
+
+// tracerProviderKey identifies a tracer provider by the configuration
+// it was built with.
+type tracerProviderKey struct {
+	serviceName    string
+	serviceVersion string
+	endpoint       string
+	urlPath        string
+	protocol       string
+	certificate    string
+	insecure       bool
+	timeout        time.Duration
+	compression    string
+
+	clientCertificate string
+	clientKey         string
+	tlsSkipVerify     bool
+	serverName        string
+	failoverEndpoints string
+	// failoverRetryInterval is the configured one, zero for the default one.
+	failoverRetryInterval time.Duration
+	// retry is the description of the retry config, empty if the default one is used.
+	retry string
+	// stdoutFile is the file of the stdout exporter, so that the providers printing to different files are not shared.
+	stdoutFile string
+
+	// sampler is the description of the configured sampler, empty if the default one is used.
+	sampler string
+
+	hostRedaction string
+	// hostRedactionKeyHash is the hash of the key of the host hashes.
+	hostRedactionKeyHash string
+
+	truncationStrategy string
+	truncationLength   int
+
+	spanAttributeValueLengthLimit int
+	spanAttributeCountLimit       int
+
+	// resourceAttributes is the description of the custom resource attributes.
+	resourceAttributes string
+
+	// headersHash is the hash of the exporter headers, which may contain secrets.
+	headersHash string
+
+	simpleSpanProcessor bool
+	minSpanDuration     time.Duration
+
+	// traceIDPrefix is the hex encoded prefix of the trace IDs, empty if they are entirely random.
+	traceIDPrefix string
+	// idGenerator is the name of the ID generator, empty for the default one.
+	idGenerator string
+
+	// heartbeatInterval is the interval of the heartbeat of the provider, zero for none.
+	heartbeatInterval time.Duration
+}
+
+// tracerProviderCache keeps track of the tracer providers and of the
+// number of handlers using each of them.
+type tracerProviderCache struct {
+	mu sync.Mutex
+
+	tracerProviders        map[tracerProviderKey]*sdktrace.TracerProvider
+	tracerProvidersCounter map[tracerProviderKey]int
+	// tracerProvidersQueue holds the queue of the spans to export of each tracer provider, if tracked.
+	tracerProvidersQueue map[tracerProviderKey]*spanQueue
+	// tracerProvidersHeartbeat holds the heartbeat of each tracer provider, if any.
+	tracerProvidersHeartbeat map[tracerProviderKey]*heartbeat
+}
+
+func newTracerProviderCache() *tracerProviderCache {
+	return &tracerProviderCache{
+		tracerProviders:          make(map[tracerProviderKey]*sdktrace.TracerProvider),
+		tracerProvidersCounter:   make(map[tracerProviderKey]int),
+		tracerProvidersQueue:     make(map[tracerProviderKey]*spanQueue),
+		tracerProvidersHeartbeat: make(map[tracerProviderKey]*heartbeat),
+	}
+}
+
+// getTracerProvider creates or returns the cached tracer provider for the key
+// and increments the number of its users. The queue, if not nil, must track
+// the spans of the provider built with opts; it is used to drain the provider.
+//
+// cached is true if the provider was already in the cache, in which case opts
+// are not used: the caller must release the resources they hold, e.g. the
+// connections of the exporters.
+//
+// The heartbeat of the provider, if the key has an interval, is started with
+// the provider, so that the handlers sharing it emit a single heartbeat.
+func (t *tracerProviderCache) getTracerProvider(key tracerProviderKey, queue *spanQueue, opts ...sdktrace.TracerProviderOption) (tp *sdktrace.TracerProvider, cached bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.tracerProvidersCounter[key]++
+
+	if tp, ok := t.tracerProviders[key]; ok {
+		return tp, true
+	}
+
+	tp = sdktrace.NewTracerProvider(opts...)
+	t.tracerProviders[key] = tp
+	if queue != nil {
+		t.tracerProvidersQueue[key] = queue
+	}
+	if key.heartbeatInterval > 0 {
+		t.tracerProvidersHeartbeat[key] = startHeartbeat(tp.Tracer("github.com/caddyserver/caddy/v2/modules/caddyhttp/opentelemetry"), key.heartbeatInterval)
+	}
+
+	return tp, false
+}
+
+// cleanupTracerProvider decrements the number of users of the tracer provider
+// for the key, and flushes and shuts it down once it is no longer used.
+//
+// A provider still used, e.g. by the handlers of the new configuration on a
+// reload, is flushed anyway, so that the spans of the handler cleaned up are
+// exported promptly.
+//
+// The errors of the flushes are logged with logger, if not nil.
+//
+// If drainTimeout is positive and the spans of the provider are tracked, the
+// provider is flushed until all its spans are exported or the timeout expires.
+// The provider is removed from the cache first, so that draining it does not
+// block the other users of the cache.
+//
+// The flush and the shutdown, after the drain if any, are bounded by
+// shutdownTimeout, defaultShutdownTimeout if zero, so that an unreachable
+// collector does not block the stop of Caddy.
+func (t *tracerProviderCache) cleanupTracerProvider(key tracerProviderKey, drainTimeout, shutdownTimeout time.Duration, logger *zap.Logger) error {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	if shutdownTimeout <= 0 {
+		shutdownTimeout = defaultShutdownTimeout
+	}
+
+	tp, queue, hb, unused := t.release(key)
+	if tp == nil {
+		return nil
+	}
+	if !unused {
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := tp.ForceFlush(ctx); err != nil {
+			logger.Error("forcing flush", zap.Error(err))
+		}
+		return nil
+	}
+
+	// stopped out of the lock of the cache, its last span may be exported synchronously
+	hb.stop()
+
+	return shutdownTracerProvider(tp, queue, drainTimeout, shutdownTimeout, logger)
+}
+
+// shutdownTracerProvider drains, if drainTimeout is positive and its spans
+// are tracked by queue, or else flushes tp, and shuts it down. The flush and
+// the shutdown are bounded by shutdownTimeout, which must be positive.
+func shutdownTracerProvider(tp *sdktrace.TracerProvider, queue *spanQueue, drainTimeout, shutdownTimeout time.Duration, logger *zap.Logger) error {
+	drained := queue != nil && drainTimeout > 0
+	if drained {
+		drainTracerProvider(tp, queue, drainTimeout, logger)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	if !drained {
+		// tracerProvider.ForceFlush SHOULD complete or abort within some timeout https://github.com/open-telemetry/opentelemetry-specification/blob/main/specification/trace/sdk.md#forceflush
+		err := tp.ForceFlush(ctx)
+		if err != nil {
+			logger.Error("forcing flush", zap.Error(err))
+		}
+	}
+
+	err := tp.Shutdown(ctx)
+	if err != nil {
+		return fmt.Errorf("shutting down tracer provider: %w", err)
+	}
+
+	return nil
+}
+
+// release decrements the number of users of the tracer provider for the key
+// and returns it, nil if not cached. Once it is no longer used, unused is
+// true and the provider is removed from the cache, to be shut down, and
+// returned with its queue, if tracked, and its heartbeat, if any, to be
+// stopped.
+func (t *tracerProviderCache) release(key tracerProviderKey) (tp *sdktrace.TracerProvider, queue *spanQueue, hb *heartbeat, unused bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	tp = t.tracerProviders[key]
+
+	if t.tracerProvidersCounter[key] > 0 {
+		t.tracerProvidersCounter[key]--
+	}
+	if t.tracerProvidersCounter[key] > 0 {
+		return tp, nil, nil, false
+	}
+
+	queue = t.tracerProvidersQueue[key]
+	hb = t.tracerProvidersHeartbeat[key]
+
+	delete(t.tracerProviders, key)
+	delete(t.tracerProvidersCounter, key)
+	delete(t.tracerProvidersQueue, key)
+	delete(t.tracerProvidersHeartbeat, key)
+
+	return tp, queue, hb, true
+}
+
+// len returns the number of tracer providers in the cache.
+func (t *tracerProviderCache) len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return len(t.tracerProviders)
+}
+
+// hasServiceName returns true if a tracer provider of the service name is cached.
+func (t *tracerProviderCache) hasServiceName(serviceName string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for key := range t.tracerProviders {
+		if key.serviceName == serviceName {
+			return true
+		}
+	}
+	return false
+}
+
+// references returns the number of users of the tracer providers, by service name.
+func (t *tracerProviderCache) references() map[string]int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	references := make(map[string]int, len(t.tracerProvidersCounter))
+	for key, counter := range t.tracerProvidersCounter {
+		references[key.serviceName] += counter
+	}
+	return references
+}
@@ -0,0 +1,161 @@
+package opentelemetry
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.uber.org/zap"
+)
+
+func TestTracerProviderCache_getTracerProvider(t *testing.T) {
+	cache := newTracerProviderCache()
+	key := tracerProviderKey{serviceName: "test"}
+
+	tp1, _ := cache.getTracerProvider(key, nil)
+	tp2, _ := cache.getTracerProvider(key, nil)
+
+	if tp1 != tp2 {
+		t.Errorf("expected the same tracer provider for the same key")
+	}
+	if cache.tracerProvidersCounter[key] != 2 {
+		t.Errorf("counter = %d, expected 2", cache.tracerProvidersCounter[key])
+	}
+
+	tp3, _ := cache.getTracerProvider(tracerProviderKey{serviceName: "other"}, nil)
+	if tp3 == tp1 {
+		t.Errorf("expected a different tracer provider for a different key")
+	}
+}
+
+func TestTracerProviderCache_cleanupTracerProvider(t *testing.T) {
+	cache := newTracerProviderCache()
+	key := tracerProviderKey{serviceName: "test"}
+
+	// the SDK fails to shut down a provider without span processors
+	exporter := tracetest.NewInMemoryExporter()
+	cache.getTracerProvider(key, nil, sdktrace.WithSyncer(exporter))
+	cache.getTracerProvider(key, nil, sdktrace.WithSyncer(exporter))
+
+	if err := cache.cleanupTracerProvider(key, 0, 0, nil); err != nil {
+		t.Fatalf("cleanupTracerProvider() error = %v", err)
+	}
+	if _, ok := cache.tracerProviders[key]; !ok {
+		t.Errorf("tracer provider should be kept while it is still used")
+	}
+
+	if err := cache.cleanupTracerProvider(key, 0, 0, nil); err != nil {
+		t.Fatalf("cleanupTracerProvider() error = %v", err)
+	}
+	if _, ok := cache.tracerProviders[key]; ok {
+		t.Errorf("tracer provider should be removed once unused")
+	}
+	if _, ok := cache.tracerProvidersCounter[key]; ok {
+		t.Errorf("tracer provider counter should be removed once unused")
+	}
+}
+
+// flushCountingProcessor counts the flushes of its spans.
+type flushCountingProcessor struct {
+	flushes int32
+}
+
+func (p *flushCountingProcessor) OnStart(context.Context, sdktrace.ReadWriteSpan) {}
+func (p *flushCountingProcessor) OnEnd(sdktrace.ReadOnlySpan)                     {}
+func (p *flushCountingProcessor) Shutdown(context.Context) error                  { return nil }
+func (p *flushCountingProcessor) ForceFlush(context.Context) error {
+	atomic.AddInt32(&p.flushes, 1)
+	return nil
+}
+
+func TestTracerProviderCache_cleanupTracerProvider_flushStillUsed(t *testing.T) {
+	cache := newTracerProviderCache()
+	key := tracerProviderKey{serviceName: "test"}
+	// the batch span processor of the SDK only flushes the spans it has
+	// already dequeued, the flush itself is what is expected
+	processor := &flushCountingProcessor{}
+
+	// the old and the new handlers of a reload share the provider
+	cache.getTracerProvider(key, nil, sdktrace.WithSpanProcessor(processor))
+	cache.getTracerProvider(key, nil, sdktrace.WithSpanProcessor(processor))
+	defer cache.cleanupTracerProvider(key, 0, 0, zap.NewNop())
+
+	if err := cache.cleanupTracerProvider(key, 0, 0, zap.NewNop()); err != nil {
+		t.Fatalf("cleanupTracerProvider() error = %v", err)
+	}
+	if got := atomic.LoadInt32(&processor.flushes); got != 1 {
+		t.Errorf("got %d flushes after the cleanup of a still used provider, expected 1", got)
+	}
+	if _, ok := cache.tracerProviders[key]; !ok {
+		t.Errorf("tracer provider should be kept while it is still used")
+	}
+}
+
+// failingFlushProcessor fails to flush its spans.
+type failingFlushProcessor struct{}
+
+func (failingFlushProcessor) OnStart(context.Context, sdktrace.ReadWriteSpan) {}
+func (failingFlushProcessor) OnEnd(sdktrace.ReadOnlySpan)                     {}
+func (failingFlushProcessor) Shutdown(context.Context) error                  { return nil }
+func (failingFlushProcessor) ForceFlush(context.Context) error                { return errors.New("flush failed") }
+
+func TestTracerProviderCache_cleanupTracerProvider_nilLogger(t *testing.T) {
+	cache := newTracerProviderCache()
+	key := tracerProviderKey{serviceName: "test"}
+
+	cache.getTracerProvider(key, nil, sdktrace.WithSpanProcessor(failingFlushProcessor{}))
+	cache.getTracerProvider(key, nil, sdktrace.WithSpanProcessor(failingFlushProcessor{}))
+
+	// the flush of the still used provider, then of the unused one, fail
+	for i := 0; i < 2; i++ {
+		if err := cache.cleanupTracerProvider(key, 0, 0, nil); err != nil {
+			t.Fatalf("cleanupTracerProvider() error = %v", err)
+		}
+	}
+}
+
+// hangingExporter blocks, like an exporter to an unreachable collector,
+// until release is closed.
+type hangingExporter struct {
+	release chan struct{}
+}
+
+func (e hangingExporter) ExportSpans(context.Context, []sdktrace.ReadOnlySpan) error {
+	<-e.release
+	return nil
+}
+
+func (e hangingExporter) Shutdown(context.Context) error {
+	<-e.release
+	return nil
+}
+
+func TestTracerProviderCache_cleanupTracerProvider_shutdownTimeout(t *testing.T) {
+	cache := newTracerProviderCache()
+	key := tracerProviderKey{serviceName: "test"}
+	exporter := hangingExporter{release: make(chan struct{})}
+	defer close(exporter.release)
+
+	tp, _ := cache.getTracerProvider(key, nil, sdktrace.WithBatcher(exporter))
+	_, span := tp.Tracer("test").Start(context.Background(), "span")
+	span.End()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cache.cleanupTracerProvider(key, 0, 100*time.Millisecond, zap.NewNop())
+	}()
+
+	select {
+	case <-done:
+		// the timeout is reported as an error of the shutdown, what matters is that it returned
+	case <-time.After(2 * time.Second):
+		t.Fatalf("cleanupTracerProvider() did not return within the shutdown timeout")
+	}
+	if cache.len() != 0 {
+		t.Errorf("tracer provider should be removed once unused")
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package opentelemetry
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+)
+
+const (
+	truncationRaw   = "raw"
+	truncationSmart = "smart"
+)
+
+// urlAttributeKeys are the attributes truncated at URL boundaries by the "smart" strategy.
+var urlAttributeKeys = map[attribute.Key]struct{}{
+	semconv.HTTPTargetKey: {},
+	semconv.HTTPURLKey:    {},
+}
+
+// validateTruncationStrategy returns an error if strategy is not a supported truncation strategy.
+func validateTruncationStrategy(strategy string) error {
+	switch strategy {
+	case "", truncationRaw, truncationSmart:
+		return nil
+	default:
+		return fmt.Errorf("unsupported truncation strategy %q", strategy)
+	}
+}
+
+// truncateAttributes returns a copy of attrs with the string values longer
+// than limit truncated. With the "smart" strategy, URL attributes are cut at
+// the last path or query boundary that fits, so that they stay meaningful;
+// all other values, and URLs without such a boundary, are cut at limit.
+func truncateAttributes(attrs []attribute.KeyValue, strategy string, limit int) []attribute.KeyValue {
+	result := make([]attribute.KeyValue, len(attrs))
+	for i, attr := range attrs {
+		result[i] = attr
+		if attr.Value.Type() != attribute.STRING {
+			continue
+		}
+		v := attr.Value.AsString()
+		if len(v) <= limit {
+			continue
+		}
+		if _, ok := urlAttributeKeys[attr.Key]; ok && strategy == truncationSmart {
+			result[i] = attr.Key.String(truncateURL(v, limit))
+		} else {
+			result[i] = attr.Key.String(truncateString(v, limit))
+		}
+	}
+	return result
+}
+
+// truncateURL cuts u before the last '/', '?' or '&' found within the first limit bytes.
+func truncateURL(u string, limit int) string {
+	if i := strings.LastIndexAny(u[:limit+1], "/?&"); i > 0 {
+		return u[:i]
+	}
+	return truncateString(u, limit)
+}
+
+// truncateString cuts s to at most limit bytes without splitting a UTF-8 sequence.
+func truncateString(s string, limit int) string {
+	for limit > 0 && !utf8.RuneStart(s[limit]) {
+		limit--
+	}
+	return s[:limit]
+}
@@ -0,0 +1,36 @@
+package opentelemetry
+
+import (
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+)
+
+func TestTruncateAttributes(t *testing.T) {
+	target := "/api/v1/users/12345/orders?status=open"
+
+	tests := []struct {
+		name     string
+		strategy string
+		attr     attribute.KeyValue
+		limit    int
+		expected string
+	}{
+		{name: "raw url", strategy: truncationRaw, attr: semconv.HTTPTargetKey.String(target), limit: 16, expected: "/api/v1/users/12"},
+		{name: "smart url at path boundary", strategy: truncationSmart, attr: semconv.HTTPTargetKey.String(target), limit: 16, expected: "/api/v1/users"},
+		{name: "smart url at query boundary", strategy: truncationSmart, attr: semconv.HTTPTargetKey.String(target), limit: 30, expected: "/api/v1/users/12345/orders"},
+		{name: "smart url exactly at boundary", strategy: truncationSmart, attr: semconv.HTTPTargetKey.String(target), limit: 13, expected: "/api/v1/users"},
+		{name: "smart non url", strategy: truncationSmart, attr: semconv.HTTPUserAgentKey.String("agent/1.0 (details)"), limit: 8, expected: "agent/1."},
+		{name: "short value", strategy: truncationSmart, attr: semconv.HTTPTargetKey.String("/a"), limit: 8, expected: "/a"},
+		{name: "utf-8", strategy: truncationRaw, attr: attribute.String("name", "héllo"), limit: 2, expected: "h"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := truncateAttributes([]attribute.KeyValue{tt.attr}, tt.strategy, tt.limit)
+			if got[0].Value.AsString() != tt.expected {
+				t.Errorf("truncateAttributes() = %q, expected %q", got[0].Value.AsString(), tt.expected)
+			}
+		})
+	}
+}